@@ -0,0 +1,264 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	cryptdisk "github.com/multiverse-os/portalgun/vm/fs/cryptdisk"
+)
+
+//
+// An offline tool for managing encrypted disk images.
+//
+//   portal-crypt -passphrase-file=pw -size=10G create disk.img
+//   portal-crypt -passphrase-file=pw -new-passphrase-file=pw2 add-key disk.img
+//   portal-crypt -passphrase-file=pw -slot=0 remove-key disk.img
+//   portal-crypt -passphrase-file=pw -new-passphrase-file=pw2 rekey disk.img
+//   portal-crypt info disk.img
+//
+// Images must not be in use by a running VM.
+//
+
+var NoCommand = errors.New("Usage: portal-crypt [options] <create|add-key|remove-key|rekey|info> <image>")
+var NoPassphrase = errors.New("No passphrase file given?")
+var BadSize = errors.New("Invalid size?")
+
+var passphraseFile = flag.String("passphrase-file", "", "file holding the passphrase")
+var newPassphraseFile = flag.String("new-passphrase-file", "", "file holding the new passphrase")
+var size = flag.String("size", "", "image size (e.g. 512M, 10G)")
+var slot = flag.Int("slot", -1, "key slot to remove")
+var iterations = flag.Int("iterations", cryptdisk.DefaultIterations, "PBKDF2 iterations")
+
+func die(err error) {
+	log.Fatal(err)
+}
+
+func readPassphrase(path string) ([]byte, error) {
+	if path == "" {
+		return nil, NoPassphrase
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Allow a trailing newline.
+	return []byte(strings.TrimRight(string(data), "\r\n")), nil
+}
+
+func parseSize(value string) (int64, error) {
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(value, "K"):
+		multiplier = 1024
+	case strings.HasSuffix(value, "M"):
+		multiplier = 1024 * 1024
+	case strings.HasSuffix(value, "G"):
+		multiplier = 1024 * 1024 * 1024
+	case strings.HasSuffix(value, "T"):
+		multiplier = 1024 * 1024 * 1024 * 1024
+	}
+	if multiplier != 1 {
+		value = value[:len(value)-1]
+	}
+
+	var result int64
+	_, err := fmt.Sscanf(value, "%d", &result)
+	if err != nil || result <= 0 {
+		return 0, BadSize
+	}
+	return result * multiplier, nil
+}
+
+func create(path string) error {
+	passphrase, err := readPassphrase(*passphraseFile)
+	if err != nil {
+		return err
+	}
+	length, err := parseSize(*size)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	err = file.Truncate(cryptdisk.PayloadOffset + length)
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+	_, err = cryptdisk.Create(file, length, passphrase, *iterations)
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+
+	return file.Sync()
+}
+
+func unlock(path string) (*os.File, *cryptdisk.Disk, error) {
+	passphrase, err := readPassphrase(*passphraseFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	disk, err := cryptdisk.Unlock(file, passphrase)
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	return file, disk, nil
+}
+
+func addKey(path string) error {
+	passphrase, err := readPassphrase(*newPassphraseFile)
+	if err != nil {
+		return err
+	}
+	file, disk, err := unlock(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	index, err := disk.AddKey(passphrase, *iterations)
+	if err != nil {
+		return err
+	}
+	log.Printf("Added key slot %d.", index)
+	return file.Sync()
+}
+
+func removeKey(path string) error {
+	file, disk, err := unlock(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	err = disk.RemoveKey(*slot)
+	if err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+//
+// Re-encrypt the whole image under a new master key.
+// This writes a new image alongside the old one, and
+// renames it over the original once it's complete.
+// Only the new passphrase is valid afterwards.
+//
+func rekey(path string) error {
+	passphrase, err := readPassphrase(*newPassphraseFile)
+	if err != nil {
+		return err
+	}
+	file, disk, err := unlock(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	length, _ := disk.Size()
+	temp_path := path + ".rekey"
+	temp, err := os.OpenFile(temp_path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer temp.Close()
+
+	cleanup := func(err error) error {
+		os.Remove(temp_path)
+		return err
+	}
+
+	err = temp.Truncate(cryptdisk.PayloadOffset + length)
+	if err != nil {
+		return cleanup(err)
+	}
+	target, err := cryptdisk.Create(temp, length, passphrase, *iterations)
+	if err != nil {
+		return cleanup(err)
+	}
+
+	buffer := make([]byte, 1024*1024)
+	for offset := int64(0); offset < length; offset += int64(len(buffer)) {
+		n, err := disk.ReadAt(buffer, offset)
+		if err != nil && err != io.EOF {
+			return cleanup(err)
+		}
+		_, err = target.WriteAt(buffer[:n], offset)
+		if err != nil {
+			return cleanup(err)
+		}
+	}
+
+	err = temp.Sync()
+	if err != nil {
+		return cleanup(err)
+	}
+	return os.Rename(temp_path, path)
+}
+
+func info(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	header, err := cryptdisk.ReadHeader(file)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("cipher: %s\n", header.CipherName())
+	fmt.Printf("size:   %d\n", header.Size)
+	for _, index := range header.ActiveSlots() {
+		fmt.Printf("slot %d: %d iterations\n", index, header.Slots[index].Iterations)
+	}
+	return nil
+}
+
+func main() {
+	flag.Parse()
+	if flag.NArg() != 2 {
+		die(NoCommand)
+	}
+
+	var err error
+	path := flag.Arg(1)
+	switch flag.Arg(0) {
+	case "create":
+		err = create(path)
+	case "add-key":
+		err = addKey(path)
+	case "remove-key":
+		err = removeKey(path)
+	case "rekey":
+		err = rekey(path)
+	case "info":
+		err = info(path)
+	default:
+		err = NoCommand
+	}
+	if err != nil {
+		die(err)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	vswitch "github.com/multiverse-os/portalgun/vm/net/vswitch"
+)
+
+//
+// A private L2 network for a group of VMs.
+//
+//   portal-switch /tmp/cluster.sock
+//
+// Each VM connects a virtio-net device to the socket
+// (see VirtioNetSwitch). The switch lives until it is
+// killed, and removes its socket on the way out.
+//
+
+var NoSocket = errors.New("Usage: portal-switch [options] <socket>")
+
+var debug = flag.Bool("debug", false, "log ports and learned addresses")
+
+func die(err error) {
+	log.Fatal(err)
+}
+
+func main() {
+	flag.Parse()
+	if flag.NArg() != 1 {
+		die(NoSocket)
+	}
+	path := flag.Arg(0)
+
+	listener, err := vswitch.Listen(path)
+	if err != nil {
+		die(err)
+	}
+
+	// Clean up on exit.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		listener.Close()
+	}()
+
+	sw := vswitch.New()
+	sw.Debug = *debug
+	sw.Serve(listener)
+}
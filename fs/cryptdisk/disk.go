@@ -0,0 +1,265 @@
+package cryptdisk
+
+import (
+	"crypto/aes"
+	"crypto/rand"
+	"io"
+	"sync"
+	"syscall"
+
+	"golang.org/x/crypto/xts"
+)
+
+//
+// Storage --
+//
+// The encrypted image (normally a file).
+//
+type Storage interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+//
+// Disk --
+//
+// An unlocked image. Reads and writes are in plaintext
+// and at payload offsets; the header is not visible.
+// Each 512-byte sector is encrypted with AES-256-XTS,
+// using the sector number as the tweak.
+//
+type Disk struct {
+	storage Storage
+	header  *Header
+	key     []byte
+	cipher  *xts.Cipher
+
+	// Serializes writes. A partial sector is read,
+	// modified and written back, and any other write
+	// to the same sector in between would be lost.
+	rmw_lock sync.Mutex
+}
+
+//
+// Write a fresh header (with a random master key).
+// The caller is responsible for sizing the storage
+// to PayloadOffset + size bytes.
+//
+func Create(
+	storage Storage,
+	size int64,
+	passphrase []byte,
+	iterations int) (*Disk, error) {
+
+	if size%SectorSize != 0 {
+		return nil, UnalignedSize
+	}
+
+	key := make([]byte, KeyBytes)
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, err
+	}
+
+	header := newHeader(size)
+	err = header.seal(0, key, passphrase, iterations)
+	if err != nil {
+		return nil, err
+	}
+	err = header.Write(storage)
+	if err != nil {
+		return nil, err
+	}
+
+	return newDisk(storage, header, key)
+}
+
+//
+// Unlock an existing image with a passphrase.
+//
+func Unlock(storage Storage, passphrase []byte) (*Disk, error) {
+	header, err := ReadHeader(storage)
+	if err != nil {
+		return nil, err
+	}
+
+	key, _, err := header.open(passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	return newDisk(storage, header, key)
+}
+
+//
+// Unlock an existing image with the raw master key.
+// (This is used to hand off an unlocked disk).
+//
+func UnlockWithKey(storage Storage, key []byte) (*Disk, error) {
+	header, err := ReadHeader(storage)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != KeyBytes {
+		return nil, BadPassphrase
+	}
+
+	return newDisk(storage, header, key)
+}
+
+func newDisk(storage Storage, header *Header, key []byte) (*Disk, error) {
+	cipher, err := xts.NewCipher(aes.NewCipher, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Disk{
+		storage: storage,
+		header:  header,
+		key:     key,
+		cipher:  cipher,
+	}, nil
+}
+
+func (disk *Disk) Header() *Header {
+	return disk.header
+}
+
+//
+// The raw master key.
+// Handle with care.
+//
+func (disk *Disk) Key() []byte {
+	return disk.key
+}
+
+func (disk *Disk) Size() (int64, error) {
+	return int64(disk.header.Size), nil
+}
+
+//
+// Read & decrypt whole sectors.
+//
+func (disk *Disk) readSectors(data []byte, sector int64) error {
+	_, err := disk.storage.ReadAt(data, PayloadOffset+sector*SectorSize)
+	if err == io.EOF {
+		// A short image; the tail reads as zero ciphertext.
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(data); i += SectorSize {
+		disk.cipher.Decrypt(
+			data[i:i+SectorSize],
+			data[i:i+SectorSize],
+			uint64(sector)+uint64(i/SectorSize))
+	}
+	return nil
+}
+
+//
+// Encrypt & write whole sectors.
+// Note that this encrypts the data in place.
+//
+func (disk *Disk) writeSectors(data []byte, sector int64) error {
+	for i := 0; i < len(data); i += SectorSize {
+		disk.cipher.Encrypt(
+			data[i:i+SectorSize],
+			data[i:i+SectorSize],
+			uint64(sector)+uint64(i/SectorSize))
+	}
+	_, err := disk.storage.WriteAt(data, PayloadOffset+sector*SectorSize)
+	return err
+}
+
+func (disk *Disk) ReadAt(data []byte, offset int64) (int, error) {
+
+	size := int64(disk.header.Size)
+	if offset >= size {
+		return 0, io.EOF
+	}
+	short := false
+	if offset+int64(len(data)) > size {
+		data = data[:size-offset]
+		short = true
+	}
+
+	// Work on the covering sectors.
+	first := offset / SectorSize
+	last := (offset + int64(len(data)) + SectorSize - 1) / SectorSize
+	plain := make([]byte, (last-first)*SectorSize)
+	err := disk.readSectors(plain, first)
+	if err != nil {
+		return 0, err
+	}
+	copy(data, plain[offset-first*SectorSize:])
+
+	if short {
+		return len(data), io.EOF
+	}
+	return len(data), nil
+}
+
+func (disk *Disk) WriteAt(data []byte, offset int64) (int, error) {
+
+	if offset+int64(len(data)) > int64(disk.header.Size) {
+		return 0, syscall.ENOSPC
+	}
+
+	first := offset / SectorSize
+	last := (offset + int64(len(data)) + SectorSize - 1) / SectorSize
+	plain := make([]byte, (last-first)*SectorSize)
+
+	disk.rmw_lock.Lock()
+	defer disk.rmw_lock.Unlock()
+
+	if offset%SectorSize != 0 || len(data)%SectorSize != 0 {
+		// Partial sectors need a read-modify-write.
+		err := disk.readSectors(plain, first)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	copy(plain[offset-first*SectorSize:], data)
+	err := disk.writeSectors(plain, first)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(data), nil
+}
+
+//
+// Add a passphrase, returning the slot used.
+//
+func (disk *Disk) AddKey(passphrase []byte, iterations int) (int, error) {
+	index := disk.header.freeSlot()
+	if index < 0 {
+		return -1, NoFreeSlots
+	}
+
+	err := disk.header.seal(index, disk.key, passphrase, iterations)
+	if err != nil {
+		return -1, err
+	}
+
+	return index, disk.header.Write(disk.storage)
+}
+
+//
+// Remove a passphrase slot.
+// We refuse to remove the last one.
+//
+func (disk *Disk) RemoveKey(index int) error {
+	if index < 0 || index >= MaxSlots || disk.header.Slots[index].Active == 0 {
+		return InvalidSlot
+	}
+	if len(disk.header.ActiveSlots()) == 1 {
+		return LastSlot
+	}
+
+	disk.header.Slots[index] = Slot{}
+	return disk.header.Write(disk.storage)
+}
@@ -0,0 +1,111 @@
+package cryptdisk
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newImage(t *testing.T, size int64) *os.File {
+	file, err := os.Create(filepath.Join(t.TempDir(), "disk.img"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = file.Truncate(PayloadOffset + size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestReadWrite(t *testing.T) {
+	file := newImage(t, 64*1024)
+	defer file.Close()
+
+	disk, err := Create(file, 64*1024, []byte("secret"), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := bytes.Repeat([]byte("plaintext!"), 400)
+	_, err = disk.WriteAt(data, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing readable on disk.
+	raw := make([]byte, 64*1024)
+	file.ReadAt(raw, PayloadOffset)
+	if bytes.Contains(raw, []byte("plaintext!")) {
+		t.Fatal("plaintext on disk")
+	}
+
+	// Reopen and read back.
+	reopened, err := Unlock(file, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := make([]byte, len(data))
+	_, err = reopened.ReadAt(check, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(check, data) {
+		t.Error("read mismatch")
+	}
+
+	// The same data in different sectors encrypts differently.
+	block := bytes.Repeat([]byte{0xaa}, SectorSize)
+	disk.WriteAt(block, 0)
+	disk.WriteAt(block, SectorSize*8)
+	first := make([]byte, SectorSize)
+	second := make([]byte, SectorSize)
+	file.ReadAt(first, PayloadOffset)
+	file.ReadAt(second, PayloadOffset+SectorSize*8)
+	if bytes.Equal(first, second) {
+		t.Error("sector tweak not applied")
+	}
+}
+
+func TestKeySlots(t *testing.T) {
+	file := newImage(t, 4096)
+	defer file.Close()
+
+	disk, err := Create(file, 4096, []byte("one"), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	disk.WriteAt([]byte("hello"), 0)
+
+	_, err = Unlock(file, []byte("two"))
+	if err != BadPassphrase {
+		t.Fatalf("expected bad passphrase, got %v", err)
+	}
+
+	slot, err := disk.AddKey([]byte("two"), 1000)
+	if err != nil || slot != 1 {
+		t.Fatalf("add key: %d %v", slot, err)
+	}
+	other, err := Unlock(file, []byte("two"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := make([]byte, 5)
+	other.ReadAt(check, 0)
+	if string(check) != "hello" {
+		t.Error("wrong key recovered")
+	}
+
+	err = disk.RemoveKey(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Unlock(file, []byte("one"))
+	if err != BadPassphrase {
+		t.Error("removed key still works")
+	}
+	if disk.RemoveKey(1) != LastSlot {
+		t.Error("removed the last slot")
+	}
+}
@@ -0,0 +1,17 @@
+package cryptdisk
+
+import (
+	"errors"
+)
+
+// Global errors.
+var (
+	InvalidHeader      = errors.New("invalid encrypted image header?")
+	UnsupportedVersion = errors.New("unsupported encrypted image version")
+	UnsupportedCipher  = errors.New("unsupported cipher")
+	UnalignedSize      = errors.New("size is not a multiple of the sector size")
+	BadPassphrase      = errors.New("no key slot matches passphrase")
+	NoFreeSlots        = errors.New("no free key slots")
+	InvalidSlot        = errors.New("invalid key slot")
+	LastSlot           = errors.New("refusing to remove the last key slot")
+)
@@ -0,0 +1,201 @@
+package cryptdisk
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+//
+// On-disk format.
+//
+// The image starts with a small plaintext header, followed
+// by the encrypted payload at PayloadOffset. The header is:
+//
+//   magic       [8]byte  "NOVMCRYP"
+//   version     uint32
+//   cipher      [32]byte (NUL-padded name)
+//   key bytes   uint32
+//   size        uint64   (payload size in bytes)
+//   slots       [MaxSlots]Slot
+//
+// Each key slot holds a copy of the master key, wrapped
+// with AES-GCM under a key derived from a passphrase with
+// PBKDF2-SHA256. The GCM tag lets us tell a bad passphrase
+// apart from a good one without storing a key digest.
+//
+// Everything is big-endian.
+//
+
+const (
+	Magic         = "NOVMCRYP"
+	Version       = 1
+	CipherXTS     = "aes-xts-plain64"
+	KeyBytes      = 64
+	SectorSize    = 512
+	PayloadOffset = 4096
+	MaxSlots      = 8
+
+	DefaultIterations = 100000
+)
+
+type Slot struct {
+	Active     uint32
+	Iterations uint32
+	Salt       [32]byte
+	Nonce      [12]byte
+	Wrapped    [KeyBytes + 16]byte
+}
+
+type Header struct {
+	Magic    [8]byte
+	Version  uint32
+	Cipher   [32]byte
+	KeyBytes uint32
+	Size     uint64
+	Slots    [MaxSlots]Slot
+}
+
+func (header *Header) CipherName() string {
+	return string(bytes.TrimRight(header.Cipher[:], "\x00"))
+}
+
+func ReadHeader(storage io.ReaderAt) (*Header, error) {
+	data := make([]byte, PayloadOffset)
+	_, err := storage.ReadAt(data, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	header := new(Header)
+	err = binary.Read(bytes.NewReader(data), binary.BigEndian, header)
+	if err != nil {
+		return nil, InvalidHeader
+	}
+	if string(header.Magic[:]) != Magic {
+		return nil, InvalidHeader
+	}
+	if header.Version != Version {
+		return nil, UnsupportedVersion
+	}
+	if header.CipherName() != CipherXTS || header.KeyBytes != KeyBytes {
+		return nil, UnsupportedCipher
+	}
+
+	return header, nil
+}
+
+func (header *Header) Write(storage io.WriterAt) error {
+	buffer := bytes.NewBuffer(nil)
+	err := binary.Write(buffer, binary.BigEndian, header)
+	if err != nil {
+		return err
+	}
+
+	// Pad out to the payload.
+	data := make([]byte, PayloadOffset)
+	copy(data, buffer.Bytes())
+	_, err = storage.WriteAt(data, 0)
+	return err
+}
+
+func newHeader(size int64) *Header {
+	header := &Header{
+		Version:  Version,
+		KeyBytes: KeyBytes,
+		Size:     uint64(size),
+	}
+	copy(header.Magic[:], Magic)
+	copy(header.Cipher[:], CipherXTS)
+	return header
+}
+
+func slotCipher(slot *Slot, passphrase []byte) (cipher.AEAD, error) {
+	kek := pbkdf2.Key(
+		passphrase,
+		slot.Salt[:],
+		int(slot.Iterations),
+		32,
+		sha256.New)
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+//
+// Wrap the master key into the given slot.
+//
+func (header *Header) seal(index int, key []byte, passphrase []byte, iterations int) error {
+
+	if iterations <= 0 {
+		iterations = DefaultIterations
+	}
+
+	slot := &header.Slots[index]
+	slot.Iterations = uint32(iterations)
+	_, err := rand.Read(slot.Salt[:])
+	if err != nil {
+		return err
+	}
+	_, err = rand.Read(slot.Nonce[:])
+	if err != nil {
+		return err
+	}
+
+	aead, err := slotCipher(slot, passphrase)
+	if err != nil {
+		return err
+	}
+	copy(slot.Wrapped[:], aead.Seal(nil, slot.Nonce[:], key, header.Magic[:]))
+	slot.Active = 1
+	return nil
+}
+
+//
+// Find the master key using the passphrase.
+// Returns the key and the slot it was found in.
+//
+func (header *Header) open(passphrase []byte) ([]byte, int, error) {
+	for index := 0; index < MaxSlots; index += 1 {
+		slot := &header.Slots[index]
+		if slot.Active == 0 {
+			continue
+		}
+		aead, err := slotCipher(slot, passphrase)
+		if err != nil {
+			return nil, -1, err
+		}
+		key, err := aead.Open(nil, slot.Nonce[:], slot.Wrapped[:], header.Magic[:])
+		if err == nil {
+			return key, index, nil
+		}
+	}
+	return nil, -1, BadPassphrase
+}
+
+func (header *Header) freeSlot() int {
+	for index := 0; index < MaxSlots; index += 1 {
+		if header.Slots[index].Active == 0 {
+			return index
+		}
+	}
+	return -1
+}
+
+func (header *Header) ActiveSlots() []int {
+	active := make([]int, 0, MaxSlots)
+	for index := 0; index < MaxSlots; index += 1 {
+		if header.Slots[index].Active != 0 {
+			active = append(active, index)
+		}
+	}
+	return active
+}
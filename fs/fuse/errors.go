@@ -0,0 +1,39 @@
+package fuse
+
+import (
+	"errors"
+	"os"
+	"syscall"
+
+	plan9 "github.com/multiverse-os/portalgun/vm/fs/plan9"
+)
+
+// Global errors.
+var (
+	ShortRequest  = errors.New("short fuse request?")
+	ShortReply    = errors.New("no room for fuse reply?")
+	BadCacheMode  = errors.New("unknown fuse cache mode?")
+	UnknownNode   = syscall.ESTALE
+	UnknownHandle = syscall.EBADF
+)
+
+// Returned by operations the kernel doesn't expect a reply to.
+var noReply = errors.New("no reply")
+
+//
+// Errors travel as negative errno values on the wire.
+// The overlay returns a mix of errnos and 9P errors.
+//
+func toErrno(err error) int32 {
+	switch err := err.(type) {
+	case syscall.Errno:
+		return -int32(err)
+	case *plan9.Error:
+		return -int32(err.Errornum)
+	case *os.PathError:
+		return toErrno(err.Err)
+	case *os.LinkError:
+		return toErrno(err.Err)
+	}
+	return -int32(syscall.EIO)
+}
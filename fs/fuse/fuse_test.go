@@ -0,0 +1,368 @@
+package fuse
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	plan9 "github.com/multiverse-os/portalgun/vm/fs/plan9"
+)
+
+//
+// A request & reply in plain memory.
+//
+type memBuffer struct {
+	data     []byte
+	readable int
+}
+
+func (buf *memBuffer) Length() int   { return len(buf.data) }
+func (buf *memBuffer) Readable() int { return buf.readable }
+
+func (buf *memBuffer) CopyOut(offset int, data []byte) int {
+	return copy(data, buf.data[offset:])
+}
+
+func (buf *memBuffer) CopyIn(offset int, data []byte) int {
+	return copy(buf.data[offset:], data)
+}
+
+func (buf *memBuffer) PRead(fd int, fd_offset int64, buf_offset int, length int) (int, error) {
+	return syscall.Pread(fd, buf.data[buf_offset:buf_offset+length], fd_offset)
+}
+
+func (buf *memBuffer) PWrite(fd int, fd_offset int64, buf_offset int, length int) (int, error) {
+	return syscall.Pwrite(fd, buf.data[buf_offset:buf_offset+length], fd_offset)
+}
+
+type testServer struct {
+	*Server
+	t      *testing.T
+	upper  string
+	unique uint64
+}
+
+func newTestServer(t *testing.T, lower string) *testServer {
+	fs := new(plan9.Fs)
+	fs.Init()
+	upper := t.TempDir()
+	fs.Write["/"] = upper
+	if lower != "" {
+		fs.Read["/"] = []string{lower}
+	}
+	if err := fs.Attach(); err != nil {
+		t.Fatal(err)
+	}
+	server := new(Server)
+	if err := server.Attach(fs, CacheAuto); err != nil {
+		t.Fatal(err)
+	}
+	return &testServer{Server: server, t: t, upper: upper}
+}
+
+//
+// Send a request, returning the reply body (or errno).
+//
+func (server *testServer) call(
+	opcode uint32,
+	nodeid uint64,
+	args []byte,
+	reply int) ([]byte, syscall.Errno) {
+
+	server.unique += 1
+	request := make([]byte, InHeaderSize+len(args))
+	binary.LittleEndian.PutUint32(request[0:], uint32(len(request)))
+	binary.LittleEndian.PutUint32(request[4:], opcode)
+	binary.LittleEndian.PutUint64(request[8:], server.unique)
+	binary.LittleEndian.PutUint64(request[16:], nodeid)
+	copy(request[InHeaderSize:], args)
+
+	buf := &memBuffer{
+		data:     append(request, make([]byte, OutHeaderSize+reply)...),
+		readable: len(request),
+	}
+	length := server.Handle(buf)
+	if length == 0 {
+		return nil, 0
+	}
+	out := buf.data[buf.readable : buf.readable+length]
+	if int(binary.LittleEndian.Uint32(out[0:])) != length {
+		server.t.Fatalf("op %d: bad reply length", opcode)
+	}
+	if binary.LittleEndian.Uint64(out[8:]) != server.unique {
+		server.t.Fatalf("op %d: bad reply unique", opcode)
+	}
+	errno := int32(binary.LittleEndian.Uint32(out[4:]))
+	return out[OutHeaderSize:], syscall.Errno(-errno)
+}
+
+func (server *testServer) mustCall(
+	opcode uint32,
+	nodeid uint64,
+	args []byte,
+	reply int) []byte {
+
+	out, errno := server.call(opcode, nodeid, args, reply)
+	if errno != 0 {
+		server.t.Fatalf("op %d: %s", opcode, errno.Error())
+	}
+	return out
+}
+
+func name(names ...string) []byte {
+	data := make([]byte, 0)
+	for _, name := range names {
+		data = append(append(data, name...), 0)
+	}
+	return data
+}
+
+func (server *testServer) lookup(parent uint64, child string) (uint64, syscall.Errno) {
+	out, errno := server.call(OpLookup, parent, name(child), EntryOutSize)
+	if errno != 0 {
+		return 0, errno
+	}
+	return binary.LittleEndian.Uint64(out[0:]), 0
+}
+
+func (server *testServer) create(parent uint64, child string, mode uint32) (uint64, uint64) {
+	args := make([]byte, CreateInSize)
+	binary.LittleEndian.PutUint32(args[0:], syscall.O_RDWR|syscall.O_CREAT)
+	binary.LittleEndian.PutUint32(args[4:], mode)
+	out := server.mustCall(OpCreate, parent, append(args, name(child)...), EntryOutSize+OpenOutSize)
+	return binary.LittleEndian.Uint64(out[0:]), binary.LittleEndian.Uint64(out[EntryOutSize:])
+}
+
+func (server *testServer) write(node uint64, fh uint64, offset uint64, data []byte) {
+	args := make([]byte, WriteInSize)
+	binary.LittleEndian.PutUint64(args[0:], fh)
+	binary.LittleEndian.PutUint64(args[8:], offset)
+	binary.LittleEndian.PutUint32(args[16:], uint32(len(data)))
+	out := server.mustCall(OpWrite, node, append(args, data...), WriteOutSize)
+	if int(binary.LittleEndian.Uint32(out)) != len(data) {
+		server.t.Fatalf("short write")
+	}
+}
+
+func (server *testServer) read(node uint64, fh uint64, offset uint64, size int) []byte {
+	args := make([]byte, ReadInSize)
+	binary.LittleEndian.PutUint64(args[0:], fh)
+	binary.LittleEndian.PutUint64(args[8:], offset)
+	binary.LittleEndian.PutUint32(args[16:], uint32(size))
+	return server.mustCall(OpRead, node, args, size)
+}
+
+func (server *testServer) open(node uint64, flags uint32) uint64 {
+	args := make([]byte, OpenInSize)
+	binary.LittleEndian.PutUint32(args[0:], flags)
+	out := server.mustCall(OpOpen, node, args, OpenOutSize)
+	return binary.LittleEndian.Uint64(out[0:])
+}
+
+func (server *testServer) size(node uint64) uint64 {
+	out := server.mustCall(OpGetattr, node, make([]byte, 16), AttrOutSize)
+	return binary.LittleEndian.Uint64(out[16+8:])
+}
+
+func TestInit(t *testing.T) {
+	server := newTestServer(t, "")
+
+	args := make([]byte, InitInSize)
+	binary.LittleEndian.PutUint32(args[0:], 7)
+	binary.LittleEndian.PutUint32(args[4:], 38)
+	binary.LittleEndian.PutUint32(args[12:], InitDoReaddirplus|InitAsyncRead|(1<<31))
+	out := server.mustCall(OpInit, 0, args, InitOutSize)
+	if binary.LittleEndian.Uint32(out[0:]) != KernelVersion ||
+		binary.LittleEndian.Uint32(out[4:]) != KernelMinorVersion {
+		t.Fatalf("bad version")
+	}
+	if binary.LittleEndian.Uint32(out[12:]) != InitDoReaddirplus|InitAsyncRead {
+		t.Fatalf("bad flags: %x", binary.LittleEndian.Uint32(out[12:]))
+	}
+	if binary.LittleEndian.Uint32(out[20:]) != MaxWrite {
+		t.Fatalf("bad max write")
+	}
+
+	// Unknown requests.
+	_, errno := server.call(1000, RootId, nil, 0)
+	if errno != syscall.ENOSYS {
+		t.Fatalf("expected ENOSYS, got %v", errno)
+	}
+}
+
+func TestCreateWriteRead(t *testing.T) {
+	server := newTestServer(t, "")
+
+	node, fh := server.create(RootId, "file", 0640)
+	server.write(node, fh, 0, []byte("hello world"))
+	server.write(node, fh, 6, []byte("there"))
+	if data := server.read(node, fh, 0, 64); string(data) != "hello there" {
+		t.Fatalf("read %q", data)
+	}
+	if server.size(node) != 11 {
+		t.Fatalf("bad size")
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(server.upper, "file"))
+	if err != nil || string(data) != "hello there" {
+		t.Fatalf("host file %q (%v)", data, err)
+	}
+	info, _ := os.Stat(filepath.Join(server.upper, "file"))
+	if info.Mode().Perm() != 0640 {
+		t.Fatalf("bad mode %o", info.Mode().Perm())
+	}
+
+	// Looking it up gives the same node.
+	other, errno := server.lookup(RootId, "file")
+	if errno != 0 || other != node {
+		t.Fatalf("lookup %d (%v)", other, errno)
+	}
+	if _, errno := server.lookup(RootId, "missing"); errno != syscall.ENOENT {
+		t.Fatalf("expected ENOENT, got %v", errno)
+	}
+}
+
+func TestSetattr(t *testing.T) {
+	server := newTestServer(t, "")
+	node, fh := server.create(RootId, "file", 0600)
+	server.write(node, fh, 0, make([]byte, 4096))
+
+	args := make([]byte, SetattrInSize)
+	binary.LittleEndian.PutUint32(args[0:], FattrSize|FattrMode|FattrMtime)
+	binary.LittleEndian.PutUint64(args[16:], 100)
+	binary.LittleEndian.PutUint64(args[40:], 1000000)
+	binary.LittleEndian.PutUint32(args[68:], 0755)
+	server.mustCall(OpSetattr, node, args, AttrOutSize)
+
+	info, err := os.Stat(filepath.Join(server.upper, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 100 || info.Mode().Perm() != 0755 || info.ModTime().Unix() != 1000000 {
+		t.Fatalf("bad attributes: %d %o %d", info.Size(), info.Mode().Perm(), info.ModTime().Unix())
+	}
+}
+
+func TestReaddirplus(t *testing.T) {
+	server := newTestServer(t, "")
+	for _, child := range []string{"a", "b", "c"} {
+		server.create(RootId, child, 0644)
+	}
+	args := make([]byte, MkdirInSize)
+	binary.LittleEndian.PutUint32(args[0:], 0755)
+	server.mustCall(OpMkdir, RootId, append(args, name("d")...), EntryOutSize)
+
+	out := server.mustCall(OpOpendir, RootId, make([]byte, OpenInSize), OpenOutSize)
+	fh := binary.LittleEndian.Uint64(out[0:])
+
+	// Read a single entry at a time.
+	seen := make(map[string]uint64)
+	offset := uint64(0)
+	for {
+		args := make([]byte, ReadInSize)
+		binary.LittleEndian.PutUint64(args[0:], fh)
+		binary.LittleEndian.PutUint64(args[8:], offset)
+		binary.LittleEndian.PutUint32(args[16:], EntryOutSize+DirentSize+8)
+		out := server.mustCall(OpReaddirplus, RootId, args, 512)
+		if len(out) == 0 {
+			break
+		}
+		nodeid := binary.LittleEndian.Uint64(out[0:])
+		dirent := out[EntryOutSize:]
+		offset = binary.LittleEndian.Uint64(dirent[8:])
+		namelen := binary.LittleEndian.Uint32(dirent[16:])
+		kind := binary.LittleEndian.Uint32(dirent[20:])
+		child := string(dirent[DirentSize : DirentSize+namelen])
+		if (child == "d") != (kind == syscall.S_IFDIR>>12) {
+			t.Fatalf("bad type for %s", child)
+		}
+		seen[child] = nodeid
+	}
+	if len(seen) != 4 {
+		t.Fatalf("saw %v", seen)
+	}
+
+	// The entries count as lookups.
+	node, _ := server.lookup(RootId, "a")
+	if node != seen["a"] || server.Nodes[node].Lookups != 3 {
+		t.Fatalf("bad lookup count")
+	}
+	server.call(OpForget, node, []byte{3, 0, 0, 0, 0, 0, 0, 0}, 0)
+	if _, ok := server.Nodes[node]; ok {
+		t.Fatalf("node not forgotten")
+	}
+	server.mustCall(OpReleasedir, RootId, make([]byte, ReleaseInSize), 0)
+}
+
+func TestRenameUnlink(t *testing.T) {
+	server := newTestServer(t, "")
+	a, fh := server.create(RootId, "a", 0644)
+	server.write(a, fh, 0, []byte("aaa"))
+	b, fh := server.create(RootId, "b", 0644)
+	server.write(b, fh, 0, []byte("bbb"))
+
+	args := make([]byte, RenameInSize)
+	binary.LittleEndian.PutUint64(args[0:], RootId)
+	server.mustCall(OpRename, RootId, append(args, name("a", "b")...), 0)
+
+	data, err := ioutil.ReadFile(filepath.Join(server.upper, "b"))
+	if err != nil || string(data) != "aaa" {
+		t.Fatalf("host file %q (%v)", data, err)
+	}
+	if _, errno := server.lookup(RootId, "a"); errno != syscall.ENOENT {
+		t.Fatalf("expected ENOENT, got %v", errno)
+	}
+
+	// The renamed node follows, the replaced one is gone.
+	if server.Nodes[a].Path != "/b" {
+		t.Fatalf("node not moved")
+	}
+	if _, errno := server.call(OpGetattr, b, make([]byte, 16), AttrOutSize); errno != syscall.ESTALE {
+		t.Fatalf("expected ESTALE, got %v", errno)
+	}
+
+	server.mustCall(OpUnlink, RootId, name("b"), 0)
+	if _, errno := server.lookup(RootId, "b"); errno != syscall.ENOENT {
+		t.Fatalf("expected ENOENT, got %v", errno)
+	}
+
+	// And it can be created again.
+	server.create(RootId, "b", 0644)
+}
+
+func TestCopyUp(t *testing.T) {
+	lower := t.TempDir()
+	ioutil.WriteFile(filepath.Join(lower, "file"), []byte("lower data"), 0644)
+	server := newTestServer(t, lower)
+
+	node, errno := server.lookup(RootId, "file")
+	if errno != 0 {
+		t.Fatalf("lookup: %v", errno)
+	}
+	fh := server.open(node, syscall.O_RDWR)
+	if data := server.read(node, fh, 0, 64); string(data) != "lower data" {
+		t.Fatalf("read %q", data)
+	}
+	server.write(node, fh, 0, []byte("upper"))
+	if data := server.read(node, fh, 0, 64); string(data) != "upper data" {
+		t.Fatalf("read %q", data)
+	}
+
+	data, _ := ioutil.ReadFile(filepath.Join(lower, "file"))
+	if string(data) != "lower data" {
+		t.Fatalf("lower modified: %q", data)
+	}
+	data, _ = ioutil.ReadFile(filepath.Join(server.upper, "file"))
+	if string(data) != "upper data" {
+		t.Fatalf("upper %q", data)
+	}
+
+	// Opening with O_TRUNC empties it.
+	server.open(node, syscall.O_WRONLY|syscall.O_TRUNC)
+	if server.size(node) != 0 {
+		t.Fatalf("not truncated")
+	}
+}
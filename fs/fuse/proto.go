@@ -0,0 +1,239 @@
+package fuse
+
+import (
+	"encoding/binary"
+)
+
+//
+// Protocol constants.
+//
+// See include/uapi/linux/fuse.h in the kernel. We speak
+// 7.31 (the first with virtio-fs), and nothing older than
+// that is possible over virtio anyways.
+//
+
+// Versions.
+const (
+	KernelVersion      = 7
+	KernelMinorVersion = 31
+)
+
+// The root node.
+const RootId = 1
+
+// Opcodes.
+const (
+	OpLookup      = 1
+	OpForget      = 2
+	OpGetattr     = 3
+	OpSetattr     = 4
+	OpReadlink    = 5
+	OpMkdir       = 9
+	OpUnlink      = 10
+	OpRmdir       = 11
+	OpRename      = 12
+	OpOpen        = 14
+	OpRead        = 15
+	OpWrite       = 16
+	OpStatfs      = 17
+	OpRelease     = 18
+	OpFsync       = 20
+	OpFlush       = 25
+	OpInit        = 26
+	OpOpendir     = 27
+	OpReaddir     = 28
+	OpReleasedir  = 29
+	OpFsyncdir    = 30
+	OpCreate      = 35
+	OpInterrupt   = 36
+	OpDestroy     = 38
+	OpBatchForget = 42
+	OpReaddirplus = 44
+	OpRename2     = 45
+)
+
+// Init flags.
+const (
+	InitAsyncRead      = 1 << 0
+	InitAtomicOTrunc   = 1 << 3
+	InitBigWrites      = 1 << 5
+	InitAutoInvalData  = 1 << 12
+	InitDoReaddirplus  = 1 << 13
+	InitParallelDirops = 1 << 18
+	InitMaxPages       = 1 << 22
+)
+
+// Setattr valid bits.
+const (
+	FattrMode     = 1 << 0
+	FattrUid      = 1 << 1
+	FattrGid      = 1 << 2
+	FattrSize     = 1 << 3
+	FattrAtime    = 1 << 4
+	FattrMtime    = 1 << 5
+	FattrFh       = 1 << 6
+	FattrAtimeNow = 1 << 7
+	FattrMtimeNow = 1 << 8
+)
+
+// Open reply flags.
+const (
+	FopenDirectIo  = 1 << 0
+	FopenKeepCache = 1 << 1
+	FopenCacheDir  = 1 << 3
+)
+
+// Fsync flags.
+const (
+	FsyncFdatasync = 1 << 0
+)
+
+// Rename flags.
+const (
+	RenameNoreplace = 1 << 0
+	RenameExchange  = 1 << 1
+)
+
+// Limits.
+const (
+	MaxWrite = 1024 * 1024
+	MaxPages = MaxWrite / 4096
+)
+
+// Structure sizes.
+const (
+	InHeaderSize  = 40
+	OutHeaderSize = 16
+	AttrSize      = 88
+	EntryOutSize  = 40 + AttrSize
+	AttrOutSize   = 16 + AttrSize
+	OpenOutSize   = 16
+	WriteOutSize  = 8
+	InitOutSize   = 64
+	StatfsOutSize = 80
+	DirentSize    = 24
+	ReadInSize    = 40
+	WriteInSize   = 40
+	SetattrInSize = 88
+	CreateInSize  = 16
+	ForgetOneSize = 16
+	RenameInSize  = 8
+	Rename2InSize = 16
+	MkdirInSize   = 8
+	InitInSize    = 16
+	FsyncInSize   = 16
+	OpenInSize    = 8
+	ReleaseInSize = 24
+	ForgetInSize  = 8
+)
+
+//
+// Enough for any request we handle (two names
+// at most), not including the data for writes.
+//
+const MaxRequestArgs = 4096
+
+//
+// InHeader --
+//
+// The header on every request.
+//
+type InHeader struct {
+	Len    uint32
+	Opcode uint32
+	Unique uint64
+	Nodeid uint64
+	Uid    uint32
+	Gid    uint32
+	Pid    uint32
+}
+
+func (header *InHeader) decode(data []byte) {
+	header.Len = binary.LittleEndian.Uint32(data[0:])
+	header.Opcode = binary.LittleEndian.Uint32(data[4:])
+	header.Unique = binary.LittleEndian.Uint64(data[8:])
+	header.Nodeid = binary.LittleEndian.Uint64(data[16:])
+	header.Uid = binary.LittleEndian.Uint32(data[24:])
+	header.Gid = binary.LittleEndian.Uint32(data[28:])
+	header.Pid = binary.LittleEndian.Uint32(data[32:])
+}
+
+//
+// Attr --
+//
+// The attributes of a node, as the kernel sees them.
+//
+type Attr struct {
+	Ino       uint64
+	Size      uint64
+	Blocks    uint64
+	Atime     uint64
+	Mtime     uint64
+	Ctime     uint64
+	Atimensec uint32
+	Mtimensec uint32
+	Ctimensec uint32
+	Mode      uint32
+	Nlink     uint32
+	Uid       uint32
+	Gid       uint32
+	Rdev      uint32
+	Blksize   uint32
+}
+
+func (attr *Attr) encode(data []byte) {
+	binary.LittleEndian.PutUint64(data[0:], attr.Ino)
+	binary.LittleEndian.PutUint64(data[8:], attr.Size)
+	binary.LittleEndian.PutUint64(data[16:], attr.Blocks)
+	binary.LittleEndian.PutUint64(data[24:], attr.Atime)
+	binary.LittleEndian.PutUint64(data[32:], attr.Mtime)
+	binary.LittleEndian.PutUint64(data[40:], attr.Ctime)
+	binary.LittleEndian.PutUint32(data[48:], attr.Atimensec)
+	binary.LittleEndian.PutUint32(data[52:], attr.Mtimensec)
+	binary.LittleEndian.PutUint32(data[56:], attr.Ctimensec)
+	binary.LittleEndian.PutUint32(data[60:], attr.Mode)
+	binary.LittleEndian.PutUint32(data[64:], attr.Nlink)
+	binary.LittleEndian.PutUint32(data[68:], attr.Uid)
+	binary.LittleEndian.PutUint32(data[72:], attr.Gid)
+	binary.LittleEndian.PutUint32(data[76:], attr.Rdev)
+	binary.LittleEndian.PutUint32(data[80:], attr.Blksize)
+}
+
+//
+// Encode an entry_out (a node, and how long to cache it).
+//
+func encodeEntry(data []byte, nodeid uint64, timeout uint64, attr *Attr) {
+	binary.LittleEndian.PutUint64(data[0:], nodeid)
+	binary.LittleEndian.PutUint64(data[8:], 0)
+	binary.LittleEndian.PutUint64(data[16:], timeout)
+	binary.LittleEndian.PutUint64(data[24:], timeout)
+	attr.encode(data[40:])
+}
+
+//
+// Encode a dirent, returning the padded size.
+//
+func encodeDirent(data []byte, ino uint64, offset uint64, name string, kind uint32) int {
+	binary.LittleEndian.PutUint64(data[0:], ino)
+	binary.LittleEndian.PutUint64(data[8:], offset)
+	binary.LittleEndian.PutUint32(data[16:], uint32(len(name)))
+	binary.LittleEndian.PutUint32(data[20:], kind)
+	copy(data[DirentSize:], name)
+	return direntSize(name)
+}
+
+func direntSize(name string) int {
+	return (DirentSize + len(name) + 7) &^ 7
+}
+
+//
+// Names follow the fixed part of the request.
+//
+func cstring(data []byte) (string, []byte) {
+	for i, c := range data {
+		if c == 0 {
+			return string(data[:i]), data[i+1:]
+		}
+	}
+	return string(data), nil
+}
@@ -0,0 +1,1099 @@
+package fuse
+
+import (
+	"encoding/binary"
+	"log"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	plan9 "github.com/multiverse-os/portalgun/vm/fs/plan9"
+)
+
+//
+// CacheMode --
+//
+// How long the guest may cache what it sees.
+//
+// none:   Nothing is cached, all I/O goes to us.
+// auto:   Attributes and names are cached briefly,
+//         and data is revalidated on open.
+// always: Everything is cached indefinitely. This is
+//         only safe if nothing else touches the files.
+//
+type CacheMode string
+
+const (
+	CacheNone   CacheMode = "none"
+	CacheAuto   CacheMode = "auto"
+	CacheAlways CacheMode = "always"
+)
+
+//
+// Buffer --
+//
+// A single request & reply. The request (which the
+// server reads) is first, followed by the space for
+// the reply. Data is moved directly to and from fds.
+//
+type Buffer interface {
+	Length() int
+	Readable() int
+
+	CopyOut(offset int, data []byte) int
+	CopyIn(offset int, data []byte) int
+
+	PRead(fd int, fd_offset int64, buf_offset int, length int) (int, error)
+	PWrite(fd int, fd_offset int64, buf_offset int, length int) (int, error)
+}
+
+//
+// Node --
+//
+// Something the guest has looked up. The guest
+// refers to it by Id until it forgets it.
+//
+type Node struct {
+	Id      uint64 `json:"id"`
+	Path    string `json:"path"`
+	Lookups uint64 `json:"lookups"`
+
+	// Has this been unlinked (or replaced)?
+	// If so, the path may now refer to something else.
+	Detached bool `json:"detached,omitempty"`
+
+	// Our reference to the underlying file.
+	// This is nil if the file has been replaced.
+	file *plan9.File
+}
+
+//
+// Handle --
+//
+// An open file or directory.
+//
+type Handle struct {
+	Id   uint64 `json:"id"`
+	Node uint64 `json:"node"`
+
+	// Directory entries (from the first read).
+	// This is not serialized, and will be
+	// regenerated if reads continue after restore.
+	entries []*plan9.Dir
+
+	lock sync.Mutex
+}
+
+//
+// Server --
+//
+// Serves the overlay in a plan9.Fs over FUSE.
+//
+type Server struct {
+	// Our nodes and open handles.
+	Nodes   map[uint64]*Node   `json:"nodes"`
+	Handles map[uint64]*Handle `json:"handles"`
+
+	// The last id handed out (for either).
+	Nextid uint64 `json:"nextid"`
+
+	// The negotiated minor version.
+	Minor uint32 `json:"minor"`
+
+	// Debug requests?
+	Debug bool `json:"-"`
+
+	fs    *plan9.Fs
+	cache CacheMode
+
+	// Attached nodes, by path.
+	paths map[string]*Node
+
+	lock sync.Mutex
+}
+
+type request struct {
+	InHeader
+
+	// The rest of the request.
+	args []byte
+
+	buf Buffer
+
+	// Where the reply goes, and how much fits.
+	out     int
+	out_len int
+
+	// Data placed directly after the reply header.
+	data int
+}
+
+func (server *Server) debug(format string, v ...interface{}) {
+	if server.Debug {
+		log.Printf("fuse: "+format, v...)
+	}
+}
+
+//
+// Attach to the given overlay.
+//
+// This is also called after restore, where the nodes
+// the guest knows about are looked up again.
+//
+func (server *Server) Attach(fs *plan9.Fs, cache CacheMode) error {
+	switch cache {
+	case "":
+		cache = CacheAuto
+	case CacheNone, CacheAuto, CacheAlways:
+	default:
+		return BadCacheMode
+	}
+
+	server.fs = fs
+	server.cache = cache
+	server.paths = make(map[string]*Node)
+	if server.Nodes == nil {
+		server.Nodes = make(map[uint64]*Node)
+	}
+	if server.Handles == nil {
+		server.Handles = make(map[uint64]*Handle)
+	}
+	if server.Nextid < RootId {
+		server.Nextid = RootId
+	}
+
+	// The root is always there.
+	if _, ok := server.Nodes[RootId]; !ok {
+		server.Nodes[RootId] = &Node{Id: RootId, Path: "/", Lookups: 1}
+	}
+
+	for _, node := range server.Nodes {
+		if node.file != nil {
+			continue
+		}
+		file, err := fs.Lookup(node.Path)
+		if err != nil {
+			return err
+		}
+		node.file = file
+		if !node.Detached {
+			server.paths[node.Path] = node
+		}
+	}
+
+	return nil
+}
+
+func (server *Server) timeout() uint64 {
+	switch server.cache {
+	case CacheNone:
+		return 0
+	case CacheAlways:
+		return uint64(24 * time.Hour / time.Second)
+	}
+	return 1
+}
+
+func (server *Server) openFlags(dir bool) uint32 {
+	switch server.cache {
+	case CacheNone:
+		if dir {
+			return 0
+		}
+		return FopenDirectIo
+	case CacheAlways:
+		if dir {
+			return FopenKeepCache | FopenCacheDir
+		}
+		return FopenKeepCache
+	}
+	return 0
+}
+
+func (server *Server) node(id uint64) (*Node, error) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	node, ok := server.Nodes[id]
+	if !ok || node.file == nil {
+		return nil, UnknownNode
+	}
+	return node, nil
+}
+
+func (server *Server) handle(id uint64) (*Handle, error) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	handle, ok := server.Handles[id]
+	if !ok {
+		return nil, UnknownHandle
+	}
+	return handle, nil
+}
+
+//
+// Record a lookup of the given path.
+// This consumes the reference to the file.
+//
+func (server *Server) addNode(path string, file *plan9.File) *Node {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	node, ok := server.paths[path]
+	if ok && node.file == file {
+		node.Lookups += 1
+		file.DecRef(server.fs, path)
+		return node
+	}
+
+	server.Nextid += 1
+	node = &Node{Id: server.Nextid, Path: path, Lookups: 1, file: file}
+	server.Nodes[node.Id] = node
+	server.paths[path] = node
+	return node
+}
+
+func (server *Server) forget(id uint64, lookups uint64) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	node, ok := server.Nodes[id]
+	if !ok || id == RootId {
+		return
+	}
+	if lookups < node.Lookups {
+		node.Lookups -= lookups
+		return
+	}
+
+	delete(server.Nodes, id)
+	if server.paths[node.Path] == node {
+		delete(server.paths, node.Path)
+	}
+	if node.file != nil {
+		node.file.DecRef(server.fs, node.Path)
+	}
+}
+
+//
+// Drop the node at path (it's been unlinked).
+// The guest may still use it until it's forgotten.
+//
+func (server *Server) detach(path string) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	node, ok := server.paths[path]
+	if ok {
+		node.Detached = true
+		delete(server.paths, path)
+	}
+}
+
+//
+// Update nodes after a rename.
+//
+// The overlay has already moved the file itself.
+// Anything below it is looked up again at its new
+// path, since the old objects refer to the old one.
+//
+func (server *Server) moved(orig_path string, new_path string, file *plan9.File) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	// Whatever was there has been replaced. The guest
+	// may still refer to it, but it's gone for good.
+	replaced, ok := server.paths[new_path]
+	if ok && replaced.file != file {
+		replaced.file.DecRef(server.fs, "")
+		replaced.file = nil
+		replaced.Detached = true
+		delete(server.paths, new_path)
+	}
+
+	for _, node := range server.Nodes {
+		if node.Detached {
+			continue
+		}
+		if node.Path == orig_path {
+			delete(server.paths, orig_path)
+			node.Path = new_path
+			server.paths[new_path] = node
+			continue
+		}
+		if !strings.HasPrefix(node.Path, orig_path+"/") {
+			continue
+		}
+		child_path := path.Join(new_path, node.Path[len(orig_path):])
+		child, err := server.fs.Lookup(child_path)
+		if err != nil {
+			continue
+		}
+		delete(server.paths, node.Path)
+		node.file.DecRef(server.fs, node.Path)
+		node.Path = child_path
+		node.file = child
+		server.paths[child_path] = node
+	}
+}
+
+func (server *Server) attr(node *Node) (*Attr, error) {
+	var stat syscall.Stat_t
+	err := node.file.Stat(&stat)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Attr{
+		Ino:       node.file.Qid.Path,
+		Size:      uint64(stat.Size),
+		Blocks:    uint64(stat.Blocks),
+		Atime:     uint64(stat.Atim.Sec),
+		Mtime:     uint64(stat.Mtim.Sec),
+		Ctime:     uint64(stat.Ctim.Sec),
+		Atimensec: uint32(stat.Atim.Nsec),
+		Mtimensec: uint32(stat.Mtim.Nsec),
+		Ctimensec: uint32(stat.Ctim.Nsec),
+		Mode:      stat.Mode,
+		Nlink:     uint32(stat.Nlink),
+		Uid:       stat.Uid,
+		Gid:       stat.Gid,
+		Rdev:      uint32(stat.Rdev),
+		Blksize:   uint32(stat.Blksize),
+	}, nil
+}
+
+func (server *Server) entry(node *Node) ([]byte, error) {
+	attr, err := server.attr(node)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, EntryOutSize)
+	encodeEntry(out, node.Id, server.timeout(), attr)
+	return out, nil
+}
+
+//
+// Look up a child (with a reference).
+//
+func (server *Server) child(parent *Node, name string) (string, *plan9.File, error) {
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return "", nil, syscall.EINVAL
+	}
+	child_path := path.Join(parent.Path, name)
+	file, err := server.fs.Lookup(child_path)
+	return child_path, file, err
+}
+
+func isDir(file *plan9.File) bool {
+	return file.Qid.Type&plan9.QTDIR != 0
+}
+
+//
+// Handle --
+//
+// Serve a single request, returning the length of
+// the reply (which is zero if there isn't one).
+//
+func (server *Server) Handle(buf Buffer) int {
+	readable := buf.Readable()
+	if readable < InHeaderSize {
+		server.debug("short request (%d bytes)", readable)
+		return 0
+	}
+
+	header := make([]byte, InHeaderSize)
+	buf.CopyOut(0, header)
+	req := &request{buf: buf, out: readable, out_len: buf.Length() - readable}
+	req.InHeader.decode(header)
+
+	// Pull in the arguments.
+	// (The data for writes is left in place).
+	args := readable - InHeaderSize
+	if req.Opcode == OpWrite && args > WriteInSize {
+		args = WriteInSize
+	}
+	if args > MaxRequestArgs {
+		args = MaxRequestArgs
+	}
+	req.args = make([]byte, args)
+	buf.CopyOut(InHeaderSize, req.args)
+
+	reply, err := server.dispatch(req)
+	if err == noReply {
+		return 0
+	}
+
+	if req.out_len < OutHeaderSize+len(reply)+req.data {
+		server.debug("op %d: %s", req.Opcode, ShortReply.Error())
+		return 0
+	}
+
+	out := make([]byte, OutHeaderSize+len(reply))
+	if err != nil {
+		server.debug("op %d (node %d): %s", req.Opcode, req.Nodeid, err.Error())
+		binary.LittleEndian.PutUint32(out[4:], uint32(toErrno(err)))
+		out = out[:OutHeaderSize]
+		req.data = 0
+	} else {
+		server.debug("op %d (node %d): %d bytes", req.Opcode, req.Nodeid, len(reply)+req.data)
+		copy(out[OutHeaderSize:], reply)
+	}
+	binary.LittleEndian.PutUint32(out[0:], uint32(len(out)+req.data))
+	binary.LittleEndian.PutUint64(out[8:], req.Unique)
+	buf.CopyIn(req.out, out)
+
+	return len(out) + req.data
+}
+
+func (server *Server) dispatch(req *request) ([]byte, error) {
+	switch req.Opcode {
+	case OpInit:
+		return server.init(req)
+	case OpDestroy, OpFlush:
+		return nil, nil
+	case OpForget:
+		return server.forgetOne(req)
+	case OpBatchForget:
+		return server.batchForget(req)
+	case OpInterrupt:
+		// Requests are never blocked on anything
+		// the guest could interrupt. Just ignore it.
+		return nil, noReply
+	case OpStatfs:
+		return server.statfs(req)
+	}
+
+	// Everything else is against a node.
+	node, err := server.node(req.Nodeid)
+	if err != nil {
+		return nil, err
+	}
+
+	switch req.Opcode {
+	case OpLookup:
+		return server.lookup(req, node)
+	case OpGetattr:
+		return server.getattr(req, node)
+	case OpSetattr:
+		return server.setattr(req, node)
+	case OpReadlink:
+		target, err := node.file.Readlink()
+		return []byte(target), err
+	case OpMkdir:
+		return server.mkdir(req, node)
+	case OpUnlink:
+		return nil, server.unlink(req, node, false)
+	case OpRmdir:
+		return nil, server.unlink(req, node, true)
+	case OpRename:
+		return nil, server.rename(req, node, false)
+	case OpRename2:
+		return nil, server.rename(req, node, true)
+	case OpOpen:
+		return server.open(req, node, false)
+	case OpOpendir:
+		return server.open(req, node, true)
+	case OpCreate:
+		return server.create(req, node)
+	case OpRead:
+		return nil, server.read(req, node)
+	case OpWrite:
+		return server.write(req, node)
+	case OpReaddir:
+		return server.readdir(req, node, false)
+	case OpReaddirplus:
+		return server.readdir(req, node, true)
+	case OpRelease, OpReleasedir:
+		return server.release(req)
+	case OpFsync, OpFsyncdir:
+		return nil, server.fsync(req, node)
+	}
+
+	return nil, syscall.ENOSYS
+}
+
+func (server *Server) init(req *request) ([]byte, error) {
+	if len(req.args) < InitInSize {
+		return nil, ShortRequest
+	}
+	major := binary.LittleEndian.Uint32(req.args[0:])
+	minor := binary.LittleEndian.Uint32(req.args[4:])
+	readahead := binary.LittleEndian.Uint32(req.args[8:])
+	flags := binary.LittleEndian.Uint32(req.args[12:])
+	if major < KernelVersion {
+		return nil, syscall.EPROTO
+	}
+	if major > KernelVersion || minor > KernelMinorVersion {
+		minor = KernelMinorVersion
+	}
+
+	server.lock.Lock()
+	server.Minor = minor
+	server.lock.Unlock()
+
+	flags &= InitAsyncRead | InitAtomicOTrunc | InitBigWrites |
+		InitAutoInvalData | InitDoReaddirplus |
+		InitParallelDirops | InitMaxPages
+	server.debug("init %d.%d (flags %x)", major, minor, flags)
+
+	out := make([]byte, InitOutSize)
+	binary.LittleEndian.PutUint32(out[0:], KernelVersion)
+	binary.LittleEndian.PutUint32(out[4:], minor)
+	binary.LittleEndian.PutUint32(out[8:], readahead)
+	binary.LittleEndian.PutUint32(out[12:], flags)
+	binary.LittleEndian.PutUint16(out[16:], 64) // max_background
+	binary.LittleEndian.PutUint16(out[18:], 48) // congestion_threshold
+	binary.LittleEndian.PutUint32(out[20:], MaxWrite)
+	binary.LittleEndian.PutUint32(out[24:], 1) // time_gran
+	binary.LittleEndian.PutUint16(out[28:], MaxPages)
+	return out, nil
+}
+
+func (server *Server) forgetOne(req *request) ([]byte, error) {
+	if len(req.args) >= ForgetInSize {
+		server.forget(req.Nodeid, binary.LittleEndian.Uint64(req.args))
+	}
+	return nil, noReply
+}
+
+func (server *Server) batchForget(req *request) ([]byte, error) {
+	if len(req.args) < 8 {
+		return nil, noReply
+	}
+	count := int(binary.LittleEndian.Uint32(req.args))
+	for i := 0; i < count && 8+(i+1)*ForgetOneSize <= len(req.args); i += 1 {
+		one := req.args[8+i*ForgetOneSize:]
+		server.forget(
+			binary.LittleEndian.Uint64(one[0:]),
+			binary.LittleEndian.Uint64(one[8:]))
+	}
+	return nil, noReply
+}
+
+func (server *Server) statfs(req *request) ([]byte, error) {
+	var stat syscall.Statfs_t
+	err := server.fs.Statfs(&stat)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, StatfsOutSize)
+	binary.LittleEndian.PutUint64(out[0:], stat.Blocks)
+	binary.LittleEndian.PutUint64(out[8:], stat.Bfree)
+	binary.LittleEndian.PutUint64(out[16:], stat.Bavail)
+	binary.LittleEndian.PutUint64(out[24:], stat.Files)
+	binary.LittleEndian.PutUint64(out[32:], stat.Ffree)
+	binary.LittleEndian.PutUint32(out[40:], uint32(stat.Bsize))
+	binary.LittleEndian.PutUint32(out[44:], uint32(stat.Namelen))
+	binary.LittleEndian.PutUint32(out[48:], uint32(stat.Frsize))
+	return out, nil
+}
+
+func (server *Server) lookup(req *request, parent *Node) ([]byte, error) {
+	name, _ := cstring(req.args)
+	child_path, file, err := server.child(parent, name)
+	if err != nil {
+		return nil, err
+	}
+	if !file.Exists() {
+		file.DecRef(server.fs, child_path)
+		return nil, syscall.ENOENT
+	}
+	node := server.addNode(child_path, file)
+	out, err := server.entry(node)
+	if err != nil {
+		server.forget(node.Id, 1)
+	}
+	return out, err
+}
+
+func (server *Server) getattr(req *request, node *Node) ([]byte, error) {
+	attr, err := server.attr(node)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, AttrOutSize)
+	binary.LittleEndian.PutUint64(out[0:], server.timeout())
+	attr.encode(out[16:])
+	return out, nil
+}
+
+func (server *Server) setattr(req *request, node *Node) ([]byte, error) {
+	if len(req.args) < SetattrInSize {
+		return nil, ShortRequest
+	}
+	valid := binary.LittleEndian.Uint32(req.args[0:])
+	size := binary.LittleEndian.Uint64(req.args[16:])
+	atime := binary.LittleEndian.Uint64(req.args[32:])
+	mtime := binary.LittleEndian.Uint64(req.args[40:])
+	atimensec := binary.LittleEndian.Uint32(req.args[56:])
+	mtimensec := binary.LittleEndian.Uint32(req.args[60:])
+	mode := binary.LittleEndian.Uint32(req.args[68:])
+	uid := binary.LittleEndian.Uint32(req.args[76:])
+	gid := binary.LittleEndian.Uint32(req.args[80:])
+
+	changes := uint32(FattrMode | FattrUid | FattrGid | FattrSize |
+		FattrAtime | FattrMtime | FattrAtimeNow | FattrMtimeNow)
+	if valid&changes != 0 {
+		// Everything is done in the write layer.
+		write_path, err := node.file.CopyUp(server.fs, node.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		if valid&FattrMode != 0 {
+			err = syscall.Chmod(write_path, mode&07777)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if valid&(FattrUid|FattrGid) != 0 {
+			new_uid, new_gid := -1, -1
+			if valid&FattrUid != 0 {
+				new_uid = int(uid)
+			}
+			if valid&FattrGid != 0 {
+				new_gid = int(gid)
+			}
+			err = syscall.Lchown(write_path, new_uid, new_gid)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if valid&FattrSize != 0 {
+			err = node.file.Truncate(server.fs, size)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if valid&(FattrAtime|FattrMtime|FattrAtimeNow|FattrMtimeNow) != 0 {
+			var stat syscall.Stat_t
+			err = syscall.Lstat(write_path, &stat)
+			if err != nil {
+				return nil, err
+			}
+			now := syscall.NsecToTimespec(time.Now().UnixNano())
+			times := []syscall.Timespec{stat.Atim, stat.Mtim}
+			switch {
+			case valid&FattrAtimeNow != 0:
+				times[0] = now
+			case valid&FattrAtime != 0:
+				times[0] = syscall.Timespec{Sec: int64(atime), Nsec: int64(atimensec)}
+			}
+			switch {
+			case valid&FattrMtimeNow != 0:
+				times[1] = now
+			case valid&FattrMtime != 0:
+				times[1] = syscall.Timespec{Sec: int64(mtime), Nsec: int64(mtimensec)}
+			}
+			err = syscall.UtimesNano(write_path, times)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return server.getattr(req, node)
+}
+
+func (server *Server) mkdir(req *request, parent *Node) ([]byte, error) {
+	if len(req.args) < MkdirInSize {
+		return nil, ShortRequest
+	}
+	mode := binary.LittleEndian.Uint32(req.args[0:])
+	name, _ := cstring(req.args[MkdirInSize:])
+	child_path, file, err := server.child(parent, name)
+	if err != nil {
+		return nil, err
+	}
+	err = file.Create(server.fs, child_path, syscall.S_IFDIR|(mode&07777))
+	if err != nil {
+		file.DecRef(server.fs, child_path)
+		return nil, err
+	}
+	node := server.addNode(child_path, file)
+	return server.entry(node)
+}
+
+func (server *Server) unlink(req *request, parent *Node, dir bool) error {
+	name, _ := cstring(req.args)
+	child_path, file, err := server.child(parent, name)
+	if err != nil {
+		return err
+	}
+	defer file.DecRef(server.fs, child_path)
+
+	if !file.Exists() {
+		return syscall.ENOENT
+	}
+	if dir && !isDir(file) {
+		return syscall.ENOTDIR
+	}
+	if !dir && isDir(file) {
+		return syscall.EISDIR
+	}
+	if dir {
+		children, err := file.Children(server.fs, child_path)
+		if err != nil {
+			return err
+		}
+		if len(children) > 0 {
+			return syscall.ENOTEMPTY
+		}
+	}
+
+	err = file.Remove(server.fs, child_path)
+	if err != nil {
+		return err
+	}
+	server.detach(child_path)
+	return nil
+}
+
+func (server *Server) rename(req *request, parent *Node, extended bool) error {
+	size := RenameInSize
+	if extended {
+		size = Rename2InSize
+	}
+	if len(req.args) < size {
+		return ShortRequest
+	}
+	newdir := binary.LittleEndian.Uint64(req.args[0:])
+	flags := uint32(0)
+	if extended {
+		flags = binary.LittleEndian.Uint32(req.args[8:])
+	}
+	if flags&RenameExchange != 0 {
+		return syscall.EINVAL
+	}
+	orig_name, rest := cstring(req.args[size:])
+	new_name, _ := cstring(rest)
+
+	new_parent, err := server.node(newdir)
+	if err != nil {
+		return err
+	}
+	orig_path, file, err := server.child(parent, orig_name)
+	if err != nil {
+		return err
+	}
+	defer file.DecRef(server.fs, orig_path)
+	if !file.Exists() {
+		return syscall.ENOENT
+	}
+	new_path, other, err := server.child(new_parent, new_name)
+	if err != nil {
+		return err
+	}
+	if new_path == orig_path {
+		other.DecRef(server.fs, new_path)
+		return nil
+	}
+
+	// Replace whatever is there.
+	// (The overlay won't rename over it).
+	if other.Exists() {
+		if flags&RenameNoreplace != 0 {
+			other.DecRef(server.fs, new_path)
+			return syscall.EEXIST
+		}
+		if isDir(other) != isDir(file) {
+			other.DecRef(server.fs, new_path)
+			if isDir(file) {
+				return syscall.ENOTDIR
+			}
+			return syscall.EISDIR
+		}
+		if isDir(other) {
+			children, err := other.Children(server.fs, new_path)
+			if err == nil && len(children) > 0 {
+				err = syscall.ENOTEMPTY
+			}
+			if err != nil {
+				other.DecRef(server.fs, new_path)
+				return err
+			}
+		}
+		err = other.Remove(server.fs, new_path)
+		if err != nil {
+			other.DecRef(server.fs, new_path)
+			return err
+		}
+	}
+	other.DecRef(server.fs, new_path)
+
+	// Directories can only be moved if there's nothing
+	// beneath them in a read layer. (The guest will fall
+	// back to copying, as it would for any other device).
+	if isDir(file) {
+		if !file.WriteOnly() {
+			return syscall.EXDEV
+		}
+	} else {
+		_, err = file.CopyUp(server.fs, orig_path)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = file.Rename(server.fs, orig_path, new_path)
+	if err != nil {
+		return err
+	}
+	server.moved(orig_path, new_path, file)
+	return nil
+}
+
+func (server *Server) newHandle(node *Node) *Handle {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	server.Nextid += 1
+	handle := &Handle{Id: server.Nextid, Node: node.Id}
+	server.Handles[handle.Id] = handle
+	return handle
+}
+
+func (server *Server) openReply(handle *Handle, dir bool) []byte {
+	out := make([]byte, OpenOutSize)
+	binary.LittleEndian.PutUint64(out[0:], handle.Id)
+	binary.LittleEndian.PutUint32(out[8:], server.openFlags(dir))
+	return out
+}
+
+//
+// Truncate on open (we ask for O_TRUNC to be passed).
+//
+func (server *Server) truncate(node *Node) error {
+	return node.file.Truncate(server.fs, 0)
+}
+
+func (server *Server) open(req *request, node *Node, dir bool) ([]byte, error) {
+	if len(req.args) < OpenInSize {
+		return nil, ShortRequest
+	}
+	flags := binary.LittleEndian.Uint32(req.args[0:])
+	if !node.file.Exists() {
+		return nil, syscall.ENOENT
+	}
+	if dir != isDir(node.file) {
+		if dir {
+			return nil, syscall.ENOTDIR
+		}
+		return nil, syscall.EISDIR
+	}
+	if !dir && flags&syscall.O_TRUNC != 0 && flags&syscall.O_ACCMODE != syscall.O_RDONLY {
+		err := server.truncate(node)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return server.openReply(server.newHandle(node), dir), nil
+}
+
+func (server *Server) create(req *request, parent *Node) ([]byte, error) {
+	if len(req.args) < CreateInSize {
+		return nil, ShortRequest
+	}
+	flags := binary.LittleEndian.Uint32(req.args[0:])
+	mode := binary.LittleEndian.Uint32(req.args[4:])
+	name, _ := cstring(req.args[CreateInSize:])
+	child_path, file, err := server.child(parent, name)
+	if err != nil {
+		return nil, err
+	}
+
+	created := true
+	err = file.Create(server.fs, child_path, syscall.S_IFREG|(mode&07777))
+	if err == plan9.Eexist && flags&syscall.O_EXCL == 0 && !isDir(file) {
+		created = false
+		err = nil
+	}
+	if err != nil {
+		file.DecRef(server.fs, child_path)
+		return nil, err
+	}
+	node := server.addNode(child_path, file)
+
+	if created {
+		// New files are created private.
+		var write_path string
+		write_path, err = file.CopyUp(server.fs, child_path)
+		if err == nil {
+			err = syscall.Chmod(write_path, mode&07777)
+		}
+	} else if flags&syscall.O_TRUNC != 0 {
+		err = server.truncate(node)
+	}
+	if err != nil {
+		server.forget(node.Id, 1)
+		return nil, err
+	}
+
+	entry, err := server.entry(node)
+	if err != nil {
+		server.forget(node.Id, 1)
+		return nil, err
+	}
+	return append(entry, server.openReply(server.newHandle(node), false)...), nil
+}
+
+func (server *Server) read(req *request, node *Node) error {
+	if len(req.args) < ReadInSize {
+		return ShortRequest
+	}
+	offset := binary.LittleEndian.Uint64(req.args[8:])
+	size := int(binary.LittleEndian.Uint32(req.args[16:]))
+	if size > req.out_len-OutHeaderSize {
+		size = req.out_len - OutHeaderSize
+	}
+	if size <= 0 {
+		return nil
+	}
+
+	fd, err := node.file.LockReadAt(server.fs, offset, uint64(size))
+	if err != nil {
+		return err
+	}
+	defer node.file.Unlock()
+
+	length, err := req.buf.PRead(fd, int64(offset), req.out+OutHeaderSize, size)
+	if err != nil {
+		return err
+	}
+	req.data = length
+	return nil
+}
+
+func (server *Server) write(req *request, node *Node) ([]byte, error) {
+	if len(req.args) < WriteInSize {
+		return nil, ShortRequest
+	}
+	offset := binary.LittleEndian.Uint64(req.args[8:])
+	size := int(binary.LittleEndian.Uint32(req.args[16:]))
+	if InHeaderSize+WriteInSize+size > req.buf.Readable() {
+		return nil, ShortRequest
+	}
+
+	length := 0
+	if size > 0 {
+		var err error
+		length, err = node.file.WriteAt(server.fs, offset, uint64(size), func(fd int) (int, error) {
+			return req.buf.PWrite(fd, int64(offset), InHeaderSize+WriteInSize, size)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	out := make([]byte, WriteOutSize)
+	binary.LittleEndian.PutUint32(out[0:], uint32(length))
+	return out, nil
+}
+
+func (server *Server) readdir(req *request, node *Node, plus bool) ([]byte, error) {
+	if len(req.args) < ReadInSize {
+		return nil, ShortRequest
+	}
+	handle, err := server.handle(binary.LittleEndian.Uint64(req.args[0:]))
+	if err != nil {
+		return nil, err
+	}
+	offset := binary.LittleEndian.Uint64(req.args[8:])
+	size := int(binary.LittleEndian.Uint32(req.args[16:]))
+	if size > req.out_len-OutHeaderSize {
+		size = req.out_len - OutHeaderSize
+	}
+
+	handle.lock.Lock()
+	defer handle.lock.Unlock()
+
+	// We take a snapshot on the first read,
+	// and offsets are simply indices into it.
+	if offset == 0 || handle.entries == nil {
+		handle.entries, err = node.file.Children(server.fs, node.Path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	out := make([]byte, 0, size)
+	for index := int(offset); index < len(handle.entries); index += 1 {
+		dir := handle.entries[index]
+		entry_size := direntSize(dir.Name)
+		if plus {
+			entry_size += EntryOutSize
+		}
+		if len(out)+entry_size > size {
+			break
+		}
+		entry := make([]byte, entry_size)
+
+		ino := dir.Qid.Path
+		kind := uint32(syscall.S_IFREG >> 12)
+		if dir.Qid.Type&plan9.QTDIR != 0 {
+			kind = syscall.S_IFDIR >> 12
+		} else if dir.Qid.Type&plan9.QTSYMLINK != 0 {
+			kind = syscall.S_IFLNK >> 12
+		}
+
+		if plus {
+			// This counts as a lookup.
+			child_path, file, err := server.child(node, dir.Name)
+			if err != nil {
+				continue
+			}
+			if !file.Exists() {
+				file.DecRef(server.fs, child_path)
+				continue
+			}
+			child := server.addNode(child_path, file)
+			attr, err := server.attr(child)
+			if err != nil {
+				server.forget(child.Id, 1)
+				continue
+			}
+			encodeEntry(entry, child.Id, server.timeout(), attr)
+			ino = attr.Ino
+			kind = (attr.Mode & syscall.S_IFMT) >> 12
+			encodeDirent(entry[EntryOutSize:], ino, uint64(index+1), dir.Name, kind)
+		} else {
+			encodeDirent(entry, ino, uint64(index+1), dir.Name, kind)
+		}
+
+		out = append(out, entry...)
+	}
+
+	return out, nil
+}
+
+func (server *Server) release(req *request) ([]byte, error) {
+	if len(req.args) < ReleaseInSize {
+		return nil, ShortRequest
+	}
+	id := binary.LittleEndian.Uint64(req.args[0:])
+	server.lock.Lock()
+	delete(server.Handles, id)
+	server.lock.Unlock()
+	return nil, nil
+}
+
+func (server *Server) fsync(req *request, node *Node) error {
+	if len(req.args) < FsyncInSize {
+		return ShortRequest
+	}
+	flags := binary.LittleEndian.Uint32(req.args[8:])
+
+	fd, err := node.file.LockRead(server.fs)
+	if err != nil {
+		return err
+	}
+	defer node.file.Unlock()
+
+	if flags&FsyncFdatasync != 0 {
+		return syscall.Fdatasync(fd)
+	}
+	return syscall.Fsync(fd)
+}
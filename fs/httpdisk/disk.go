@@ -0,0 +1,401 @@
+package httpdisk
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+//
+// Cache --
+//
+// Where fetched chunks are kept. This is normally a sparse
+// local file, the same size as the remote image.
+//
+type Cache interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+//
+// Options --
+//
+type Options struct {
+	// The size of each fetch (default 1MB).
+	ChunkSize int64
+
+	// How many chunks to read ahead on sequential access.
+	Prefetch int
+
+	// Chunks already present in the cache (from a previous
+	// run), along with the ETag they were fetched under.
+	// If the remote ETag has changed, these are discarded.
+	Cached []byte
+	ETag   string
+
+	// The HTTP client to use (default http.DefaultClient).
+	Client *http.Client
+}
+
+const DefaultChunkSize = 1024 * 1024
+
+//
+// A single in-flight fetch.
+//
+type fetch struct {
+	done chan struct{}
+	err  error
+}
+
+//
+// Disk --
+//
+// A read-only disk backed by an HTTP server which supports
+// range requests. Data is fetched in fixed-size chunks on
+// demand, and kept in the local cache.
+//
+type Disk struct {
+	url    string
+	client *http.Client
+	cache  Cache
+
+	size     int64
+	chunk    int64
+	prefetch int
+	etag     string
+	modified string
+
+	// Chunks present in the cache.
+	present []byte
+
+	// Fetches in progress.
+	inflight map[int64]*fetch
+
+	// The last chunk read (for detecting sequential access).
+	last int64
+
+	// Bounds concurrent prefetches.
+	prefetching chan bool
+
+	lock sync.Mutex
+}
+
+func Open(url string, cache Cache, options Options) (*Disk, error) {
+
+	disk := &Disk{
+		url:      url,
+		client:   options.Client,
+		cache:    cache,
+		chunk:    options.ChunkSize,
+		prefetch: options.Prefetch,
+		inflight: make(map[int64]*fetch),
+		last:     -1,
+	}
+	if disk.client == nil {
+		disk.client = http.DefaultClient
+	}
+	if disk.chunk == 0 {
+		disk.chunk = DefaultChunkSize
+	}
+	if disk.chunk < 512 {
+		return nil, InvalidChunkSize
+	}
+	if disk.prefetch > 0 {
+		disk.prefetching = make(chan bool, disk.prefetch)
+	}
+
+	// Probe for the size & range support.
+	err := disk.probe()
+	if err != nil {
+		return nil, err
+	}
+
+	chunks := (disk.size + disk.chunk - 1) / disk.chunk
+	disk.present = make([]byte, (chunks+7)/8)
+
+	// Can we reuse what's in the cache?
+	if options.Cached != nil &&
+		len(options.Cached) == len(disk.present) &&
+		options.ETag != "" &&
+		options.ETag == disk.etag {
+		copy(disk.present, options.Cached)
+	}
+
+	return disk, nil
+}
+
+func (disk *Disk) get(start int64, end int64) (*http.Response, error) {
+	request, err := http.NewRequest("GET", disk.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+
+	// If the image changes, we get the whole thing back
+	// (rather than a 206) and fail. Only a strong ETag will
+	// do for this, so a weak one falls back to the date.
+	if disk.etag != "" && !strings.HasPrefix(disk.etag, "W/") {
+		request.Header.Set("If-Range", disk.etag)
+	} else if disk.modified != "" {
+		request.Header.Set("If-Range", disk.modified)
+	}
+
+	response, err := disk.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusPartialContent {
+		response.Body.Close()
+		if response.StatusCode == http.StatusOK {
+			return nil, RangeNotSupported
+		}
+		return nil, &StatusError{response.StatusCode}
+	}
+
+	// Failing that, we can still see the change
+	// if the server sends the ETag with the 206.
+	etag := response.Header.Get("ETag")
+	if disk.etag != "" && etag != "" && etag != disk.etag {
+		response.Body.Close()
+		return nil, RangeNotSupported
+	}
+
+	return response, nil
+}
+
+func (disk *Disk) probe() error {
+	response, err := disk.get(0, 0)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	start, _, total, err := parseContentRange(response.Header.Get("Content-Range"))
+	if err != nil {
+		return err
+	}
+	if start != 0 || total <= 0 {
+		return InvalidContentRange
+	}
+
+	disk.size = total
+	disk.etag = response.Header.Get("ETag")
+	disk.modified = response.Header.Get("Last-Modified")
+	return nil
+}
+
+//
+// Parse "bytes start-end/total".
+//
+func parseContentRange(value string) (int64, int64, int64, error) {
+	if !strings.HasPrefix(value, "bytes ") {
+		return 0, 0, 0, InvalidContentRange
+	}
+	value = value[len("bytes "):]
+
+	slash := strings.IndexByte(value, '/')
+	dash := strings.IndexByte(value, '-')
+	if slash < 0 || dash < 0 || dash > slash {
+		return 0, 0, 0, InvalidContentRange
+	}
+
+	start, err := strconv.ParseInt(value[:dash], 10, 64)
+	if err != nil {
+		return 0, 0, 0, InvalidContentRange
+	}
+	end, err := strconv.ParseInt(value[dash+1:slash], 10, 64)
+	if err != nil {
+		return 0, 0, 0, InvalidContentRange
+	}
+	total, err := strconv.ParseInt(value[slash+1:], 10, 64)
+	if err != nil {
+		// An unknown total ("*") is no good to us.
+		return 0, 0, 0, InvalidContentRange
+	}
+
+	return start, end, total, nil
+}
+
+func (disk *Disk) isPresent(chunk int64) bool {
+	return disk.present[chunk/8]&(1<<uint(chunk%8)) != 0
+}
+
+//
+// Make sure the given chunk is in the cache.
+//
+func (disk *Disk) ensure(chunk int64) error {
+
+	disk.lock.Lock()
+	if disk.isPresent(chunk) {
+		disk.lock.Unlock()
+		return nil
+	}
+	if pending, ok := disk.inflight[chunk]; ok {
+		// Someone else is fetching it.
+		disk.lock.Unlock()
+		<-pending.done
+		return pending.err
+	}
+	pending := &fetch{done: make(chan struct{})}
+	disk.inflight[chunk] = pending
+	disk.lock.Unlock()
+
+	pending.err = disk.fetch(chunk)
+
+	disk.lock.Lock()
+	if pending.err == nil {
+		disk.present[chunk/8] |= 1 << uint(chunk%8)
+	}
+	delete(disk.inflight, chunk)
+	disk.lock.Unlock()
+
+	close(pending.done)
+	return pending.err
+}
+
+func (disk *Disk) fetch(chunk int64) error {
+
+	start := chunk * disk.chunk
+	end := start + disk.chunk - 1
+	if end >= disk.size {
+		end = disk.size - 1
+	}
+
+	response, err := disk.get(start, end)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	got_start, got_end, _, err := parseContentRange(response.Header.Get("Content-Range"))
+	if err != nil {
+		return err
+	}
+	if got_start != start || got_end != end {
+		return InvalidContentRange
+	}
+
+	data := make([]byte, end-start+1)
+	_, err = io.ReadFull(response.Body, data)
+	if err != nil {
+		return err
+	}
+
+	_, err = disk.cache.WriteAt(data, start)
+	return err
+}
+
+//
+// Read ahead after sequential access.
+//
+func (disk *Disk) readahead(chunk int64) {
+
+	if disk.prefetch == 0 {
+		return
+	}
+
+	disk.lock.Lock()
+	sequential := disk.last >= 0 && (chunk == disk.last || chunk == disk.last+1)
+	disk.last = chunk
+	disk.lock.Unlock()
+
+	if !sequential {
+		return
+	}
+
+	for next := chunk + 1; next <= chunk+int64(disk.prefetch); next += 1 {
+		if next*disk.chunk >= disk.size {
+			break
+		}
+
+		disk.lock.Lock()
+		_, busy := disk.inflight[next]
+		skip := busy || disk.isPresent(next)
+		disk.lock.Unlock()
+		if skip {
+			continue
+		}
+
+		select {
+		case disk.prefetching <- true:
+			go func(next int64) {
+				// Errors here are ignored; the
+				// chunk will be fetched on demand.
+				disk.ensure(next)
+				<-disk.prefetching
+			}(next)
+		default:
+			// Enough already in flight.
+			return
+		}
+	}
+}
+
+func (disk *Disk) ReadAt(data []byte, offset int64) (int, error) {
+
+	if offset >= disk.size {
+		return 0, io.EOF
+	}
+	short := false
+	if offset+int64(len(data)) > disk.size {
+		data = data[:disk.size-offset]
+		short = true
+	}
+
+	done := 0
+	for done < len(data) {
+		pos := offset + int64(done)
+		chunk := pos / disk.chunk
+
+		length := int(disk.chunk - pos%disk.chunk)
+		if length > len(data)-done {
+			length = len(data) - done
+		}
+
+		err := disk.ensure(chunk)
+		if err != nil {
+			return done, err
+		}
+		disk.readahead(chunk)
+
+		n, err := disk.cache.ReadAt(data[done:done+length], pos)
+		done += n
+		if err != nil {
+			return done, err
+		}
+	}
+
+	if short {
+		return done, io.EOF
+	}
+	return done, nil
+}
+
+func (disk *Disk) WriteAt(data []byte, offset int64) (int, error) {
+	return 0, syscall.EROFS
+}
+
+func (disk *Disk) Size() (int64, error) {
+	return disk.size, nil
+}
+
+func (disk *Disk) ETag() string {
+	return disk.etag
+}
+
+//
+// A snapshot of chunks present in the cache.
+// Pass this back in Options to reuse the cache.
+//
+func (disk *Disk) Cached() []byte {
+	disk.lock.Lock()
+	defer disk.lock.Unlock()
+
+	cached := make([]byte, len(disk.present))
+	copy(cached, disk.present)
+	return cached
+}
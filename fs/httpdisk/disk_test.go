@@ -0,0 +1,253 @@
+package httpdisk
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+type artifact struct {
+	data     []byte
+	etag     string
+	modified time.Time
+	requests int32
+}
+
+func (image *artifact) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt32(&image.requests, 1)
+	w.Header().Set("ETag", image.etag)
+	http.ServeContent(w, r, "disk.img", image.modified, bytes.NewReader(image.data))
+}
+
+func newArtifact(size int) *artifact {
+	data := make([]byte, size)
+	for i := 0; i < size; i += 1 {
+		data[i] = byte(i*7) ^ byte(i>>12)
+	}
+	return &artifact{data: data, etag: `"v1"`}
+}
+
+func newCache(t *testing.T) *os.File {
+	cache, err := os.Create(filepath.Join(t.TempDir(), "cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cache
+}
+
+func TestRead(t *testing.T) {
+	image := newArtifact(5*4096 + 100)
+	server := httptest.NewServer(image)
+	defer server.Close()
+
+	cache := newCache(t)
+	defer cache.Close()
+
+	disk, err := Open(server.URL, cache, Options{ChunkSize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	size, _ := disk.Size()
+	if size != int64(len(image.data)) {
+		t.Fatalf("size is %d", size)
+	}
+
+	// Span two chunks.
+	data := make([]byte, 5000)
+	_, err = disk.ReadAt(data, 3000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, image.data[3000:8000]) {
+		t.Error("read mismatch")
+	}
+
+	// Cached now.
+	before := atomic.LoadInt32(&image.requests)
+	_, err = disk.ReadAt(data, 3000)
+	if err != nil || atomic.LoadInt32(&image.requests) != before {
+		t.Errorf("expected a cache hit (%v)", err)
+	}
+
+	// The short tail.
+	tail := make([]byte, 200)
+	n, _ := disk.ReadAt(tail, int64(len(image.data)-100))
+	if n != 100 || !bytes.Equal(tail[:n], image.data[len(image.data)-100:]) {
+		t.Error("tail mismatch")
+	}
+
+	_, err = disk.WriteAt(data, 0)
+	if err != syscall.EROFS {
+		t.Errorf("expected EROFS, got %v", err)
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	image := newArtifact(16 * 4096)
+	server := httptest.NewServer(image)
+	defer server.Close()
+
+	cache := newCache(t)
+	defer cache.Close()
+
+	disk, err := Open(server.URL, cache, Options{ChunkSize: 4096, Prefetch: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, 4096)
+	disk.ReadAt(data, 0)
+	disk.ReadAt(data, 4096)
+
+	// Chunks 2-5 should arrive without being asked for.
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		cached := disk.Cached()
+		if cached[0]&0x3c == 0x3c {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("prefetch did not happen: %x", disk.Cached())
+}
+
+func TestConcurrentFetch(t *testing.T) {
+	image := newArtifact(4 * 4096)
+	server := httptest.NewServer(image)
+	defer server.Close()
+
+	cache := newCache(t)
+	defer cache.Close()
+
+	disk, err := Open(server.URL, cache, Options{ChunkSize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := atomic.LoadInt32(&image.requests)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i += 1 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data := make([]byte, 512)
+			disk.ReadAt(data, 8192)
+			if !bytes.Equal(data, image.data[8192:8192+512]) {
+				t.Error("read mismatch")
+			}
+		}()
+	}
+	wg.Wait()
+
+	if fetched := atomic.LoadInt32(&image.requests) - before; fetched != 1 {
+		t.Errorf("expected one fetch, got %d", fetched)
+	}
+}
+
+func TestCacheReuse(t *testing.T) {
+	image := newArtifact(4 * 4096)
+	server := httptest.NewServer(image)
+	defer server.Close()
+
+	cache := newCache(t)
+	defer cache.Close()
+
+	disk, err := Open(server.URL, cache, Options{ChunkSize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 4096)
+	disk.ReadAt(data, 0)
+
+	// Reopen with the saved state.
+	reopened, err := Open(server.URL, cache, Options{
+		ChunkSize: 4096,
+		Cached:    disk.Cached(),
+		ETag:      disk.ETag(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := atomic.LoadInt32(&image.requests)
+	reopened.ReadAt(data, 0)
+	if atomic.LoadInt32(&image.requests) != before {
+		t.Error("cache was not reused")
+	}
+
+	// The image changes: the cache must be dropped,
+	// and in-flight readers must notice.
+	image.etag = `"v2"`
+	changed, err := Open(server.URL, cache, Options{
+		ChunkSize: 4096,
+		Cached:    disk.Cached(),
+		ETag:      disk.ETag(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed.Cached()[0] != 0 {
+		t.Error("stale cache was reused")
+	}
+	_, err = disk.ReadAt(data, 4096)
+	if err != RangeNotSupported {
+		t.Errorf("expected change to be detected, got %v", err)
+	}
+}
+
+func TestWeakETag(t *testing.T) {
+	image := newArtifact(4 * 4096)
+	image.etag = `W/"v1"`
+	image.modified = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	server := httptest.NewServer(image)
+	defer server.Close()
+
+	cache := newCache(t)
+	defer cache.Close()
+
+	// The server won't range on a weak ETag,
+	// so the date is used instead.
+	disk, err := Open(server.URL, cache, Options{ChunkSize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 4096)
+	_, err = disk.ReadAt(data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, image.data[:4096]) {
+		t.Error("read mismatch")
+	}
+
+	image.etag = `W/"v2"`
+	image.modified = image.modified.Add(time.Hour)
+	_, err = disk.ReadAt(data, 4096)
+	if err != RangeNotSupported {
+		t.Errorf("expected change to be detected, got %v", err)
+	}
+
+	// Without a date, there's no If-Range at all,
+	// but the change is still seen in the reply.
+	image.etag = `W/"v1"`
+	image.modified = time.Time{}
+	disk, err = Open(server.URL, cache, Options{ChunkSize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = disk.ReadAt(data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	image.etag = `W/"v2"`
+	_, err = disk.ReadAt(data, 4096)
+	if err != RangeNotSupported {
+		t.Errorf("expected change to be detected, got %v", err)
+	}
+}
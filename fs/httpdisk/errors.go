@@ -0,0 +1,24 @@
+package httpdisk
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Global errors.
+var (
+	InvalidChunkSize    = errors.New("invalid chunk size?")
+	InvalidContentRange = errors.New("invalid content range?")
+	RangeNotSupported   = errors.New("server does not support ranges (or image changed)")
+)
+
+//
+// An unexpected HTTP status.
+//
+type StatusError struct {
+	Code int
+}
+
+func (err *StatusError) Error() string {
+	return fmt.Sprintf("unexpected http status %d", err.Code)
+}
@@ -0,0 +1,564 @@
+package nbd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+)
+
+//
+// A pending request.
+//
+type call struct {
+	// For reads, where the data goes.
+	data   []byte
+	offset uint64
+
+	// The first error seen.
+	err error
+
+	// Signalled on completion.
+	done chan error
+}
+
+//
+// Client --
+//
+// A client for a single export. Requests may be issued
+// concurrently from any number of goroutines; replies
+// are matched up by handle in a separate goroutine.
+//
+type Client struct {
+	conn   net.Conn
+	reader *bufio.Reader
+
+	// The export.
+	size  int64
+	flags uint16
+
+	// Did the server agree to structured replies?
+	structured bool
+
+	// Serializes requests on the wire.
+	write_lock sync.Mutex
+
+	// In-flight requests.
+	calls  map[uint64]*call
+	handle uint64
+	err    error
+	lock   sync.Mutex
+}
+
+//
+// Connect to the given export.
+// The network is either "unix" or "tcp".
+//
+func Dial(network string, address string, export string) (*Client, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := NewClient(conn, export)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return client, nil
+}
+
+//
+// Negotiate the given export on an existing connection.
+//
+func NewClient(conn net.Conn, export string) (*Client, error) {
+
+	client := &Client{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		calls:  make(map[uint64]*call),
+	}
+
+	err := client.handshake(export)
+	if err != nil {
+		return nil, err
+	}
+
+	go client.receive()
+	return client, nil
+}
+
+func (client *Client) handshake(export string) error {
+
+	var magic uint64
+	err := get(client.reader, &magic)
+	if err != nil {
+		return err
+	}
+	if magic != NBDMagic {
+		return BadMagic
+	}
+
+	err = get(client.reader, &magic)
+	if err != nil {
+		return err
+	}
+	if magic == OldStyleMagic {
+		return OldStyleServer
+	}
+	if magic != IHaveOptMagic {
+		return BadMagic
+	}
+
+	var server_flags uint16
+	err = get(client.reader, &server_flags)
+	if err != nil {
+		return err
+	}
+	if server_flags&FlagFixedNewstyle == 0 {
+		return NotFixedNewstyle
+	}
+
+	client_flags := uint32(ClientFlagFixedNewstyle)
+	no_zeroes := server_flags&FlagNoZeroes != 0
+	if no_zeroes {
+		client_flags |= ClientFlagNoZeroes
+	}
+	err = put(client.conn, client_flags)
+	if err != nil {
+		return err
+	}
+
+	// Ask for structured replies.
+	// This is optional, so failure is fine.
+	err = sendOption(client.conn, OptStructuredReply, nil)
+	if err != nil {
+		return err
+	}
+	reply, _, err := client.readOptionReply(OptStructuredReply)
+	if err != nil {
+		return err
+	}
+	client.structured = reply.Type == RepAck
+
+	// Select our export.
+	err = client.optGo(export)
+	if optErr, ok := err.(*OptionError); ok && optErr.Reply == RepErrUnsup {
+		// An older server, fall back.
+		return client.optExportName(export, no_zeroes)
+	}
+	return err
+}
+
+func (client *Client) readOptionReply(option uint32) (*optionReply, []byte, error) {
+	reply, data, err := readOptionReply(client.reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	if reply.Option != option {
+		return nil, nil, BadMagic
+	}
+	return reply, data, nil
+}
+
+func (client *Client) optGo(export string) error {
+
+	// Name, then no specific info requests.
+	// The server always sends InfoExport for Go.
+	data := make([]byte, 4+len(export)+2)
+	binary.BigEndian.PutUint32(data[0:], uint32(len(export)))
+	copy(data[4:], export)
+	binary.BigEndian.PutUint16(data[4+len(export):], 0)
+
+	err := sendOption(client.conn, OptGo, data)
+	if err != nil {
+		return err
+	}
+
+	have_export := false
+	for {
+		reply, data, err := client.readOptionReply(OptGo)
+		if err != nil {
+			return err
+		}
+
+		switch reply.Type {
+		case RepInfo:
+			if len(data) >= 12 && binary.BigEndian.Uint16(data) == InfoExport {
+				client.size = int64(binary.BigEndian.Uint64(data[2:]))
+				client.flags = binary.BigEndian.Uint16(data[10:])
+				have_export = true
+			}
+			continue
+
+		case RepAck:
+			if !have_export {
+				return ShortReply
+			}
+			return nil
+
+		default:
+			if reply.Type&RepFlagError != 0 {
+				return &OptionError{OptGo, reply.Type, string(data)}
+			}
+			// Unknown reply types are ignored.
+			continue
+		}
+	}
+}
+
+func (client *Client) optExportName(export string, no_zeroes bool) error {
+
+	err := sendOption(client.conn, OptExportName, []byte(export))
+	if err != nil {
+		return err
+	}
+
+	var size uint64
+	err = get(client.reader, &size)
+	if err != nil {
+		return err
+	}
+	err = get(client.reader, &client.flags)
+	if err != nil {
+		return err
+	}
+	if !no_zeroes {
+		_, err = io.ReadFull(client.reader, make([]byte, 124))
+		if err != nil {
+			return err
+		}
+	}
+
+	client.size = int64(size)
+	return nil
+}
+
+func (client *Client) fail(err error) {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	if client.err == nil {
+		client.err = err
+	}
+	for handle, call := range client.calls {
+		delete(client.calls, handle)
+		call.done <- client.err
+	}
+}
+
+func (client *Client) lookup(handle uint64) *call {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	return client.calls[handle]
+}
+
+func (client *Client) complete(handle uint64, err error) {
+	client.lock.Lock()
+	call, ok := client.calls[handle]
+	delete(client.calls, handle)
+	client.lock.Unlock()
+
+	if ok {
+		if call.err == nil {
+			call.err = err
+		}
+		call.done <- call.err
+	}
+}
+
+func (client *Client) receive() {
+	for {
+		err := client.receiveOne()
+		if err != nil {
+			client.fail(err)
+			client.conn.Close()
+			return
+		}
+	}
+}
+
+func (client *Client) receiveOne() error {
+
+	var magic uint32
+	err := get(client.reader, &magic)
+	if err != nil {
+		return err
+	}
+
+	switch magic {
+	case SimpleReplyMagic:
+		var reply struct {
+			Error  uint32
+			Handle uint64
+		}
+		err = get(client.reader, &reply)
+		if err != nil {
+			return err
+		}
+		call := client.lookup(reply.Handle)
+		if call == nil {
+			return UnknownHandle
+		}
+		if reply.Error == 0 && call.data != nil {
+			// Reads are followed by the full payload.
+			_, err = io.ReadFull(client.reader, call.data)
+			if err != nil {
+				return err
+			}
+		}
+		client.complete(reply.Handle, toErrno(reply.Error))
+		return nil
+
+	case StructuredReplyMagic:
+		reply := new(structuredReply)
+		err = get(client.reader, reply)
+		if err != nil {
+			return err
+		}
+		call := client.lookup(reply.Handle)
+		if call == nil {
+			return UnknownHandle
+		}
+		err = client.receiveChunk(call, reply)
+		if err != nil {
+			return err
+		}
+		if reply.Flags&ReplyFlagDone != 0 {
+			client.complete(reply.Handle, nil)
+		}
+		return nil
+	}
+
+	return BadMagic
+}
+
+func (client *Client) receiveChunk(call *call, reply *structuredReply) error {
+
+	switch reply.Type {
+	case ReplyTypeNone:
+		return nil
+
+	case ReplyTypeOffsetData:
+		var offset uint64
+		if reply.Length < 8 {
+			return ShortReply
+		}
+		err := get(client.reader, &offset)
+		if err != nil {
+			return err
+		}
+		length := uint64(reply.Length - 8)
+		if call.data == nil ||
+			offset < call.offset ||
+			offset+length > call.offset+uint64(len(call.data)) {
+			return ShortReply
+		}
+		start := offset - call.offset
+		_, err = io.ReadFull(client.reader, call.data[start:start+length])
+		return err
+
+	case ReplyTypeOffsetHole:
+		var hole struct {
+			Offset uint64
+			Length uint32
+		}
+		if reply.Length != 12 {
+			return ShortReply
+		}
+		err := get(client.reader, &hole)
+		if err != nil {
+			return err
+		}
+		if call.data == nil ||
+			hole.Offset < call.offset ||
+			hole.Offset+uint64(hole.Length) > call.offset+uint64(len(call.data)) {
+			return ShortReply
+		}
+		start := hole.Offset - call.offset
+		for i := start; i < start+uint64(hole.Length); i += 1 {
+			call.data[i] = 0
+		}
+		return nil
+	}
+
+	// Read the remaining payload.
+	payload := make([]byte, reply.Length)
+	_, err := io.ReadFull(client.reader, payload)
+	if err != nil {
+		return err
+	}
+
+	if reply.Type&(1<<15) != 0 {
+		// An error chunk.
+		if len(payload) < 6 {
+			return ShortReply
+		}
+		if call.err == nil {
+			call.err = toErrno(binary.BigEndian.Uint32(payload))
+			if call.err == nil {
+				call.err = syscall.EIO
+			}
+		}
+	}
+
+	// Other chunk types are ignored.
+	return nil
+}
+
+func (client *Client) do(
+	cmd uint16,
+	flags uint16,
+	offset uint64,
+	length uint32,
+	read []byte,
+	write []byte) error {
+
+	call := &call{
+		data:   read,
+		offset: offset,
+		done:   make(chan error, 1),
+	}
+
+	client.lock.Lock()
+	if client.err != nil {
+		err := client.err
+		client.lock.Unlock()
+		return err
+	}
+	client.handle += 1
+	handle := client.handle
+	client.calls[handle] = call
+	client.lock.Unlock()
+
+	client.write_lock.Lock()
+	err := put(client.conn, &requestHeader{
+		Magic:  RequestMagic,
+		Flags:  flags,
+		Type:   cmd,
+		Handle: handle,
+		Offset: offset,
+		Length: length,
+	})
+	if err == nil && write != nil {
+		_, err = client.conn.Write(write)
+	}
+	client.write_lock.Unlock()
+
+	if err != nil {
+		client.fail(err)
+		client.conn.Close()
+	}
+
+	return <-call.done
+}
+
+func (client *Client) ReadAt(data []byte, offset int64) (int, error) {
+
+	done := 0
+
+	for done < len(data) {
+		chunk := data[done:]
+		if len(chunk) > MaxRequest {
+			chunk = chunk[:MaxRequest]
+		}
+		err := client.do(
+			CmdRead,
+			0,
+			uint64(offset)+uint64(done),
+			uint32(len(chunk)),
+			chunk,
+			nil)
+		if err != nil {
+			return done, err
+		}
+		done += len(chunk)
+	}
+
+	return done, nil
+}
+
+func (client *Client) WriteAt(data []byte, offset int64) (int, error) {
+
+	if client.flags&TransReadOnly != 0 {
+		return 0, syscall.EROFS
+	}
+
+	done := 0
+
+	for done < len(data) {
+		chunk := data[done:]
+		if len(chunk) > MaxRequest {
+			chunk = chunk[:MaxRequest]
+		}
+		err := client.do(
+			CmdWrite,
+			0,
+			uint64(offset)+uint64(done),
+			uint32(len(chunk)),
+			nil,
+			chunk)
+		if err != nil {
+			return done, err
+		}
+		done += len(chunk)
+	}
+
+	return done, nil
+}
+
+func (client *Client) Flush() error {
+	if client.flags&TransSendFlush == 0 {
+		// Nothing is cached.
+		return nil
+	}
+	return client.do(CmdFlush, 0, 0, 0, nil, nil)
+}
+
+func (client *Client) Trim(offset int64, length int64) error {
+	if client.flags&TransSendTrim == 0 {
+		return syscall.ENOTSUP
+	}
+	for length > 0 {
+		chunk := length
+		if chunk > MaxRequest {
+			chunk = MaxRequest
+		}
+		err := client.do(CmdTrim, 0, uint64(offset), uint32(chunk), nil, nil)
+		if err != nil {
+			return err
+		}
+		offset += chunk
+		length -= chunk
+	}
+	return nil
+}
+
+func (client *Client) Size() (int64, error) {
+	return client.size, nil
+}
+
+func (client *Client) ReadOnly() bool {
+	return client.flags&TransReadOnly != 0
+}
+
+func (client *Client) CanTrim() bool {
+	return client.flags&TransSendTrim != 0
+}
+
+func (client *Client) Structured() bool {
+	return client.structured
+}
+
+func (client *Client) Close() error {
+	client.write_lock.Lock()
+	put(client.conn, &requestHeader{Magic: RequestMagic, Type: CmdDisc})
+	client.write_lock.Unlock()
+
+	client.fail(ClientClosed)
+	return client.conn.Close()
+}
@@ -0,0 +1,70 @@
+package nbd
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+// Global errors.
+var (
+	BadMagic         = errors.New("bad nbd magic?")
+	OldStyleServer   = errors.New("oldstyle nbd servers are not supported")
+	NotFixedNewstyle = errors.New("server does not support fixed newstyle")
+	UnknownHandle    = errors.New("reply for unknown handle?")
+	ShortReply       = errors.New("short nbd reply?")
+	OptionTooLarge   = errors.New("nbd option too large?")
+	RequestTooLarge  = errors.New("nbd request too large?")
+	ClientClosed     = errors.New("nbd client closed")
+)
+
+//
+// An error returned by the server during negotiation.
+//
+type OptionError struct {
+	Option  uint32
+	Reply   uint32
+	Message string
+}
+
+func (err *OptionError) Error() string {
+	if err.Message != "" {
+		return fmt.Sprintf("nbd option %d failed (%x): %s",
+			err.Option, err.Reply, err.Message)
+	}
+	return fmt.Sprintf("nbd option %d failed (%x)", err.Option, err.Reply)
+}
+
+//
+// Errors travel as errno values on the wire.
+// We map them directly onto syscall errnos.
+//
+func toErrno(code uint32) error {
+	if code == 0 {
+		return nil
+	}
+	return syscall.Errno(code)
+}
+
+func fromError(err error) uint32 {
+	if err == nil {
+		return 0
+	}
+	if errno, ok := err.(syscall.Errno); ok {
+		switch errno {
+		case syscall.EPERM, syscall.EROFS:
+			return EPERM
+		case syscall.ENOMEM:
+			return ENOMEM
+		case syscall.EINVAL:
+			return EINVAL
+		case syscall.ENOSPC:
+			return ENOSPC
+		case syscall.EOVERFLOW:
+			return EOVERFLOW
+		case syscall.ENOTSUP:
+			return ENOTSUP
+		}
+	}
+	return EIO
+}
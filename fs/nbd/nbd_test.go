@@ -0,0 +1,276 @@
+package nbd
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+//
+// A simple in-memory disk.
+//
+type memDisk struct {
+	data    []byte
+	flushes int
+	trims   int
+	lock    sync.Mutex
+}
+
+func (disk *memDisk) ReadAt(data []byte, offset int64) (int, error) {
+	disk.lock.Lock()
+	defer disk.lock.Unlock()
+	if offset >= int64(len(disk.data)) {
+		return 0, io.EOF
+	}
+	n := copy(data, disk.data[offset:])
+	if n < len(data) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (disk *memDisk) WriteAt(data []byte, offset int64) (int, error) {
+	disk.lock.Lock()
+	defer disk.lock.Unlock()
+	if offset+int64(len(data)) > int64(len(disk.data)) {
+		return 0, syscall.ENOSPC
+	}
+	return copy(disk.data[offset:], data), nil
+}
+
+func (disk *memDisk) Size() (int64, error) {
+	return int64(len(disk.data)), nil
+}
+
+func (disk *memDisk) Flush() error {
+	disk.lock.Lock()
+	defer disk.lock.Unlock()
+	disk.flushes += 1
+	return nil
+}
+
+type trimDisk struct {
+	*memDisk
+}
+
+func (disk trimDisk) Trim(offset int64, length int64) error {
+	disk.lock.Lock()
+	defer disk.lock.Unlock()
+	disk.trims += 1
+	for i := offset; i < offset+length; i += 1 {
+		disk.data[i] = 0
+	}
+	return nil
+}
+
+func serve(t *testing.T, exports ...*Export) (*Server, string) {
+	path := filepath.Join(t.TempDir(), "nbd.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(exports...)
+	go server.Serve(listener)
+	return server, path
+}
+
+func pattern(length int, seed byte) []byte {
+	data := make([]byte, length)
+	for i := 0; i < length; i += 1 {
+		data[i] = byte(i) ^ seed
+	}
+	return data
+}
+
+func TestReadWrite(t *testing.T) {
+	disk := &memDisk{data: pattern(1<<20, 0)}
+	server, path := serve(t, &Export{Name: "disk", Backend: disk})
+	defer server.Close()
+
+	client, err := Dial("unix", path, "disk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if !client.Structured() {
+		t.Error("expected structured replies")
+	}
+	size, _ := client.Size()
+	if size != 1<<20 {
+		t.Fatalf("size is %d", size)
+	}
+
+	data := make([]byte, 8192)
+	_, err = client.ReadAt(data, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, disk.data[4096:4096+8192]) {
+		t.Error("read mismatch")
+	}
+
+	update := pattern(12345, 0x5a)
+	_, err = client.WriteAt(update, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(disk.data[1000:1000+len(update)], update) {
+		t.Error("write mismatch")
+	}
+
+	err = client.Flush()
+	if err != nil || disk.flushes != 1 {
+		t.Errorf("flush: %v (%d)", err, disk.flushes)
+	}
+
+	// Trim isn't supported by this backend.
+	if client.CanTrim() || client.Trim(0, 512) != syscall.ENOTSUP {
+		t.Error("trim should be unsupported")
+	}
+
+	// Out of bounds.
+	_, err = client.ReadAt(data, 1<<20-512)
+	if err != syscall.EINVAL {
+		t.Errorf("expected EINVAL, got %v", err)
+	}
+
+	// Also where the end wraps around.
+	_, err = client.ReadAt(data[:1024], -512)
+	if err != syscall.EINVAL {
+		t.Errorf("expected EINVAL, got %v", err)
+	}
+	_, err = client.WriteAt(data[:1024], -512)
+	if err != syscall.ENOSPC {
+		t.Errorf("expected ENOSPC, got %v", err)
+	}
+
+	// The connection is still usable.
+	_, err = client.ReadAt(data[:512], 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConcurrent(t *testing.T) {
+	disk := &memDisk{data: pattern(1<<20, 0)}
+	server, path := serve(t, &Export{Name: "disk", Backend: disk})
+	defer server.Close()
+
+	client, err := Dial("unix", path, "disk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i += 1 {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			offset := int64(i * 65536)
+			data := pattern(65536, byte(i))
+			_, err := client.WriteAt(data, offset)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			check := make([]byte, 65536)
+			_, err = client.ReadAt(check, offset)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if !bytes.Equal(check, data) {
+				t.Errorf("mismatch at %d", offset)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestTrimAndReadOnly(t *testing.T) {
+	disk := &memDisk{data: pattern(65536, 0)}
+	server, path := serve(t,
+		&Export{Name: "rw", Backend: trimDisk{disk}},
+		&Export{Name: "ro", Backend: disk, ReadOnly: true})
+	defer server.Close()
+
+	rw, err := Dial("unix", path, "rw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rw.Close()
+	if !rw.CanTrim() {
+		t.Fatal("trim not advertised")
+	}
+	err = rw.Trim(4096, 4096)
+	if err != nil || disk.trims != 1 {
+		t.Fatalf("trim: %v", err)
+	}
+	if !bytes.Equal(disk.data[4096:8192], make([]byte, 4096)) {
+		t.Error("trim did not zero")
+	}
+
+	ro, err := Dial("unix", path, "ro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro.Close()
+	if !ro.ReadOnly() {
+		t.Error("export not read-only")
+	}
+	_, err = ro.WriteAt([]byte{1}, 0)
+	if err != syscall.EROFS {
+		t.Errorf("expected EROFS, got %v", err)
+	}
+
+	_, err = Dial("unix", path, "missing")
+	if optErr, ok := err.(*OptionError); !ok || optErr.Reply != RepErrUnknown {
+		t.Errorf("expected unknown export, got %v", err)
+	}
+}
+
+func TestSimpleReplies(t *testing.T) {
+	disk := &memDisk{data: pattern(65536, 0)}
+	server, path := serve(t, &Export{Name: "disk", Backend: disk})
+	defer server.Close()
+
+	// Negotiate by hand, without structured replies,
+	// using the legacy export name option.
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &Client{conn: conn, calls: make(map[uint64]*call)}
+	client.reader = bufio.NewReader(conn)
+	var header struct {
+		Magic  uint64
+		Option uint64
+		Flags  uint16
+	}
+	if get(client.reader, &header) != nil || header.Magic != NBDMagic {
+		t.Fatal("bad greeting")
+	}
+	put(conn, uint32(ClientFlagFixedNewstyle|ClientFlagNoZeroes))
+	err = client.optExportName("disk", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.receive()
+	defer client.Close()
+
+	data := make([]byte, 4096)
+	_, err = client.ReadAt(data, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, disk.data[512:512+4096]) {
+		t.Error("read mismatch")
+	}
+}
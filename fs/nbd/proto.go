@@ -0,0 +1,139 @@
+package nbd
+
+//
+// Protocol constants.
+//
+// See the NBD protocol specification (doc/proto.md in the
+// upstream nbd repository). We implement only the fixed
+// newstyle handshake; oldstyle servers are rejected.
+//
+
+// Handshake magic.
+const (
+	NBDMagic      = 0x4e42444d41474943 // "NBDMAGIC"
+	IHaveOptMagic = 0x49484156454f5054 // "IHAVEOPT"
+	OldStyleMagic = 0x0000420281861253
+	OptReplyMagic = 0x0003e889045565a9
+)
+
+// Handshake flags (server).
+const (
+	FlagFixedNewstyle = 1 << 0
+	FlagNoZeroes      = 1 << 1
+)
+
+// Client flags.
+const (
+	ClientFlagFixedNewstyle = 1 << 0
+	ClientFlagNoZeroes      = 1 << 1
+)
+
+// Options.
+const (
+	OptExportName      = 1
+	OptAbort           = 2
+	OptList            = 3
+	OptStartTLS        = 5
+	OptInfo            = 6
+	OptGo              = 7
+	OptStructuredReply = 8
+)
+
+// Option replies.
+const (
+	RepAck    = 1
+	RepServer = 2
+	RepInfo   = 3
+
+	RepFlagError    = 1 << 31
+	RepErrUnsup     = RepFlagError | 1
+	RepErrPolicy    = RepFlagError | 2
+	RepErrInvalid   = RepFlagError | 3
+	RepErrPlatform  = RepFlagError | 4
+	RepErrTLSReqd   = RepFlagError | 5
+	RepErrUnknown   = RepFlagError | 6
+	RepErrShutdown  = RepFlagError | 7
+	RepErrBlockSize = RepFlagError | 8
+)
+
+// Info types.
+const (
+	InfoExport      = 0
+	InfoName        = 1
+	InfoDescription = 2
+	InfoBlockSize   = 3
+)
+
+// Transmission flags.
+const (
+	TransHasFlags        = 1 << 0
+	TransReadOnly        = 1 << 1
+	TransSendFlush       = 1 << 2
+	TransSendFua         = 1 << 3
+	TransRotational      = 1 << 4
+	TransSendTrim        = 1 << 5
+	TransSendWriteZeroes = 1 << 6
+	TransCanMultiConn    = 1 << 8
+)
+
+// Transmission magic.
+const (
+	RequestMagic         = 0x25609513
+	SimpleReplyMagic     = 0x67446698
+	StructuredReplyMagic = 0x668e33ef
+)
+
+// Commands.
+const (
+	CmdRead        = 0
+	CmdWrite       = 1
+	CmdDisc        = 2
+	CmdFlush       = 3
+	CmdTrim        = 4
+	CmdWriteZeroes = 6
+)
+
+// Command flags.
+const (
+	CmdFlagFua    = 1 << 0
+	CmdFlagNoHole = 1 << 1
+	CmdFlagDf     = 1 << 2
+)
+
+// Structured reply flags.
+const (
+	ReplyFlagDone = 1 << 0
+)
+
+// Structured reply types.
+const (
+	ReplyTypeNone        = 0
+	ReplyTypeOffsetData  = 1
+	ReplyTypeOffsetHole  = 2
+	ReplyTypeBlockStatus = 5
+	ReplyTypeError       = 1<<15 | 1
+	ReplyTypeErrorOffset = 1<<15 | 2
+)
+
+// Error values (these are errnos on the wire).
+const (
+	EPERM     = 1
+	EIO       = 5
+	ENOMEM    = 12
+	EINVAL    = 22
+	ENOSPC    = 28
+	EOVERFLOW = 75
+	ENOTSUP   = 95
+	ESHUTDOWN = 108
+)
+
+//
+// Limits.
+//
+const (
+	// The largest request we will issue or accept.
+	MaxRequest = 32 * 1024 * 1024
+
+	// The largest option payload we will accept.
+	MaxOption = 64 * 1024
+)
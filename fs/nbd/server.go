@@ -0,0 +1,538 @@
+package nbd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"syscall"
+)
+
+//
+// Backend --
+//
+// Anything that looks like a disk can be exported.
+//
+type Backend interface {
+	io.ReaderAt
+	io.WriterAt
+	Size() (int64, error)
+	Flush() error
+}
+
+//
+// Backends may optionally support discard.
+//
+type Trimmer interface {
+	Trim(offset int64, length int64) error
+}
+
+//
+// Export --
+//
+// A single named export.
+//
+type Export struct {
+	Name     string
+	Backend  Backend
+	ReadOnly bool
+}
+
+//
+// Server --
+//
+// Serves any number of exports to any number of clients.
+// Requests on a single connection are handled in order.
+//
+type Server struct {
+	exports map[string]*Export
+
+	// Open listeners & connections.
+	// These are closed on Close().
+	listeners map[net.Listener]bool
+	conns     map[net.Conn]bool
+	closed    bool
+
+	lock sync.Mutex
+
+	// Debug requests?
+	Debug bool
+}
+
+func NewServer(exports ...*Export) *Server {
+	server := &Server{
+		exports:   make(map[string]*Export),
+		listeners: make(map[net.Listener]bool),
+		conns:     make(map[net.Conn]bool),
+	}
+	for _, export := range exports {
+		server.exports[export.Name] = export
+	}
+	return server
+}
+
+func (server *Server) debug(format string, v ...interface{}) {
+	if server.Debug {
+		log.Printf("nbd: "+format, v...)
+	}
+}
+
+func (server *Server) lookup(name string) *Export {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	return server.exports[name]
+}
+
+//
+// Accept connections until the listener is closed.
+//
+func (server *Server) Serve(listener net.Listener) error {
+
+	server.lock.Lock()
+	if server.closed {
+		server.lock.Unlock()
+		listener.Close()
+		return ClientClosed
+	}
+	server.listeners[listener] = true
+	server.lock.Unlock()
+
+	defer func() {
+		server.lock.Lock()
+		delete(server.listeners, listener)
+		server.lock.Unlock()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go server.ServeConn(conn)
+	}
+}
+
+//
+// Serve a single client connection.
+//
+func (server *Server) ServeConn(conn net.Conn) error {
+
+	server.lock.Lock()
+	if server.closed {
+		server.lock.Unlock()
+		conn.Close()
+		return ClientClosed
+	}
+	server.conns[conn] = true
+	server.lock.Unlock()
+
+	defer func() {
+		server.lock.Lock()
+		delete(server.conns, conn)
+		server.lock.Unlock()
+		conn.Close()
+	}()
+
+	session := &session{
+		server: server,
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+	}
+
+	export, err := session.negotiate()
+	if err != nil || export == nil {
+		server.debug("negotiation failed: %v", err)
+		return err
+	}
+
+	return session.transmit(export)
+}
+
+//
+// Stop all listeners and drop all clients.
+//
+func (server *Server) Close() error {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	server.closed = true
+	for listener, _ := range server.listeners {
+		listener.Close()
+	}
+	for conn, _ := range server.conns {
+		conn.Close()
+	}
+	return nil
+}
+
+//
+// Per-connection state.
+//
+type session struct {
+	server *Server
+	conn   net.Conn
+	reader *bufio.Reader
+
+	no_zeroes  bool
+	structured bool
+}
+
+func (session *session) flags(export *Export) uint16 {
+	flags := uint16(TransHasFlags | TransSendFlush | TransSendFua)
+	if export.ReadOnly {
+		flags |= TransReadOnly
+	} else {
+		flags |= TransSendWriteZeroes
+		if _, ok := export.Backend.(Trimmer); ok {
+			flags |= TransSendTrim
+		}
+	}
+	return flags
+}
+
+func (session *session) negotiate() (*Export, error) {
+
+	err := put(session.conn, &struct {
+		Magic  uint64
+		Option uint64
+		Flags  uint16
+	}{NBDMagic, IHaveOptMagic, FlagFixedNewstyle | FlagNoZeroes})
+	if err != nil {
+		return nil, err
+	}
+
+	var client_flags uint32
+	err = get(session.reader, &client_flags)
+	if err != nil {
+		return nil, err
+	}
+	if client_flags&ClientFlagFixedNewstyle == 0 {
+		return nil, NotFixedNewstyle
+	}
+	if client_flags&^(ClientFlagFixedNewstyle|ClientFlagNoZeroes) != 0 {
+		// Unknown flags, per the spec we must disconnect.
+		return nil, BadMagic
+	}
+	session.no_zeroes = client_flags&ClientFlagNoZeroes != 0
+
+	for {
+		header := new(optionHeader)
+		err = get(session.reader, header)
+		if err != nil {
+			return nil, err
+		}
+		if header.Magic != IHaveOptMagic {
+			return nil, BadMagic
+		}
+		if header.Length > MaxOption {
+			return nil, OptionTooLarge
+		}
+		data := make([]byte, header.Length)
+		_, err = io.ReadFull(session.reader, data)
+		if err != nil {
+			return nil, err
+		}
+
+		session.server.debug("option %d (%d bytes)", header.Option, header.Length)
+
+		switch header.Option {
+		case OptExportName:
+			export := session.server.lookup(string(data))
+			if export == nil {
+				// No way to report errors here.
+				return nil, nil
+			}
+			size, err := export.Backend.Size()
+			if err != nil {
+				return nil, err
+			}
+			err = put(session.conn, &struct {
+				Size  uint64
+				Flags uint16
+			}{uint64(size), session.flags(export)})
+			if err != nil {
+				return nil, err
+			}
+			if !session.no_zeroes {
+				_, err = session.conn.Write(make([]byte, 124))
+				if err != nil {
+					return nil, err
+				}
+			}
+			return export, nil
+
+		case OptInfo:
+			fallthrough
+		case OptGo:
+			export, err := session.info(header.Option, data)
+			if err != nil {
+				return nil, err
+			}
+			if export != nil && header.Option == OptGo {
+				return export, nil
+			}
+
+		case OptStructuredReply:
+			if len(data) != 0 {
+				err = sendOptionReply(session.conn, header.Option, RepErrInvalid, nil)
+			} else {
+				session.structured = true
+				err = sendOptionReply(session.conn, header.Option, RepAck, nil)
+			}
+			if err != nil {
+				return nil, err
+			}
+
+		case OptList:
+			err = session.list(data)
+			if err != nil {
+				return nil, err
+			}
+
+		case OptAbort:
+			sendOptionReply(session.conn, header.Option, RepAck, nil)
+			return nil, nil
+
+		default:
+			err = sendOptionReply(session.conn, header.Option, RepErrUnsup, nil)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+func (session *session) info(option uint32, data []byte) (*Export, error) {
+
+	// Parse the request.
+	if len(data) < 6 {
+		return nil, sendOptionReply(session.conn, option, RepErrInvalid, nil)
+	}
+	name_len := binary.BigEndian.Uint32(data)
+	if uint64(len(data)) < 4+uint64(name_len)+2 {
+		return nil, sendOptionReply(session.conn, option, RepErrInvalid, nil)
+	}
+	name := string(data[4 : 4+name_len])
+	requests := int(binary.BigEndian.Uint16(data[4+name_len:]))
+	if len(data) != 4+int(name_len)+2+2*requests {
+		return nil, sendOptionReply(session.conn, option, RepErrInvalid, nil)
+	}
+
+	export := session.server.lookup(name)
+	if export == nil {
+		return nil, sendOptionReply(
+			session.conn,
+			option,
+			RepErrUnknown,
+			[]byte("unknown export"))
+	}
+	size, err := export.Backend.Size()
+	if err != nil {
+		return nil, sendOptionReply(session.conn, option, RepErrPlatform, nil)
+	}
+
+	// We always send the export info.
+	// Any other requested info is optional.
+	info := make([]byte, 12)
+	binary.BigEndian.PutUint16(info[0:], InfoExport)
+	binary.BigEndian.PutUint64(info[2:], uint64(size))
+	binary.BigEndian.PutUint16(info[10:], session.flags(export))
+	err = sendOptionReply(session.conn, option, RepInfo, info)
+	if err != nil {
+		return nil, err
+	}
+
+	return export, sendOptionReply(session.conn, option, RepAck, nil)
+}
+
+func (session *session) list(data []byte) error {
+	if len(data) != 0 {
+		return sendOptionReply(session.conn, OptList, RepErrInvalid, nil)
+	}
+
+	session.server.lock.Lock()
+	names := make([]string, 0, len(session.server.exports))
+	for name, _ := range session.server.exports {
+		names = append(names, name)
+	}
+	session.server.lock.Unlock()
+
+	for _, name := range names {
+		reply := make([]byte, 4+len(name))
+		binary.BigEndian.PutUint32(reply, uint32(len(name)))
+		copy(reply[4:], name)
+		err := sendOptionReply(session.conn, OptList, RepServer, reply)
+		if err != nil {
+			return err
+		}
+	}
+
+	return sendOptionReply(session.conn, OptList, RepAck, nil)
+}
+
+func (session *session) reply(handle uint64, err error) error {
+	return put(session.conn, &simpleReply{SimpleReplyMagic, fromError(err), handle})
+}
+
+func (session *session) replyRead(handle uint64, offset uint64, data []byte, err error) error {
+
+	if !session.structured {
+		if err != nil {
+			return session.reply(handle, err)
+		}
+		reply := make([]byte, 16+len(data))
+		binary.BigEndian.PutUint32(reply[0:], SimpleReplyMagic)
+		binary.BigEndian.PutUint64(reply[8:], handle)
+		copy(reply[16:], data)
+		_, err = session.conn.Write(reply)
+		return err
+	}
+
+	if err != nil {
+		// Error chunk: errno, no message.
+		reply := make([]byte, 4+2+2+8+4+6)
+		binary.BigEndian.PutUint32(reply[0:], StructuredReplyMagic)
+		binary.BigEndian.PutUint16(reply[4:], ReplyFlagDone)
+		binary.BigEndian.PutUint16(reply[6:], ReplyTypeError)
+		binary.BigEndian.PutUint64(reply[8:], handle)
+		binary.BigEndian.PutUint32(reply[16:], 6)
+		binary.BigEndian.PutUint32(reply[20:], fromError(err))
+		_, err = session.conn.Write(reply)
+		return err
+	}
+
+	// A single data chunk.
+	reply := make([]byte, 4+2+2+8+4+8+len(data))
+	binary.BigEndian.PutUint32(reply[0:], StructuredReplyMagic)
+	binary.BigEndian.PutUint16(reply[4:], ReplyFlagDone)
+	binary.BigEndian.PutUint16(reply[6:], ReplyTypeOffsetData)
+	binary.BigEndian.PutUint64(reply[8:], handle)
+	binary.BigEndian.PutUint32(reply[16:], uint32(8+len(data)))
+	binary.BigEndian.PutUint64(reply[20:], offset)
+	copy(reply[28:], data)
+	_, err = session.conn.Write(reply)
+	return err
+}
+
+func (session *session) transmit(export *Export) error {
+
+	for {
+		request := new(requestHeader)
+		err := get(session.reader, request)
+		if err != nil {
+			return err
+		}
+		if request.Magic != RequestMagic {
+			return BadMagic
+		}
+
+		session.server.debug(
+			"cmd %d [%x,%x]",
+			request.Type,
+			request.Offset,
+			request.Offset+uint64(request.Length))
+
+		// Check bounds up front.
+		// (Careful, the end may wrap).
+		size, err := export.Backend.Size()
+		if err != nil {
+			return err
+		}
+		in_bounds := (request.Offset <= uint64(size) &&
+			uint64(request.Length) <= uint64(size)-request.Offset)
+
+		switch request.Type {
+		case CmdRead:
+			if request.Length > MaxRequest || !in_bounds {
+				err = session.replyRead(request.Handle, request.Offset, nil, syscall.EINVAL)
+				break
+			}
+			data := make([]byte, request.Length)
+			_, read_err := export.Backend.ReadAt(data, int64(request.Offset))
+			if read_err == io.EOF {
+				read_err = nil
+			}
+			err = session.replyRead(request.Handle, request.Offset, data, read_err)
+
+		case CmdWrite:
+			if request.Length > MaxRequest {
+				// We can't skip the payload safely.
+				return RequestTooLarge
+			}
+			data := make([]byte, request.Length)
+			_, err = io.ReadFull(session.reader, data)
+			if err != nil {
+				return err
+			}
+			if export.ReadOnly {
+				err = session.reply(request.Handle, syscall.EPERM)
+				break
+			}
+			if !in_bounds {
+				err = session.reply(request.Handle, syscall.ENOSPC)
+				break
+			}
+			_, write_err := export.Backend.WriteAt(data, int64(request.Offset))
+			if write_err == nil && request.Flags&CmdFlagFua != 0 {
+				write_err = export.Backend.Flush()
+			}
+			err = session.reply(request.Handle, write_err)
+
+		case CmdWriteZeroes:
+			if export.ReadOnly {
+				err = session.reply(request.Handle, syscall.EPERM)
+				break
+			}
+			if !in_bounds {
+				err = session.reply(request.Handle, syscall.ENOSPC)
+				break
+			}
+			zeroes := make([]byte, 64*1024)
+			var write_err error
+			for done := uint64(0); done < uint64(request.Length) && write_err == nil; {
+				chunk := uint64(request.Length) - done
+				if chunk > uint64(len(zeroes)) {
+					chunk = uint64(len(zeroes))
+				}
+				_, write_err = export.Backend.WriteAt(
+					zeroes[:chunk],
+					int64(request.Offset+done))
+				done += chunk
+			}
+			if write_err == nil && request.Flags&CmdFlagFua != 0 {
+				write_err = export.Backend.Flush()
+			}
+			err = session.reply(request.Handle, write_err)
+
+		case CmdFlush:
+			err = session.reply(request.Handle, export.Backend.Flush())
+
+		case CmdTrim:
+			trimmer, ok := export.Backend.(Trimmer)
+			if export.ReadOnly || !ok {
+				err = session.reply(request.Handle, syscall.EINVAL)
+				break
+			}
+			if !in_bounds {
+				err = session.reply(request.Handle, syscall.ENOSPC)
+				break
+			}
+			err = session.reply(
+				request.Handle,
+				trimmer.Trim(int64(request.Offset), int64(request.Length)))
+
+		case CmdDisc:
+			return nil
+
+		default:
+			err = session.reply(request.Handle, syscall.EINVAL)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
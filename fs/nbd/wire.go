@@ -0,0 +1,89 @@
+package nbd
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+//
+// Fixed-size wire headers.
+// Everything in NBD is big-endian.
+//
+
+type optionHeader struct {
+	Magic  uint64
+	Option uint32
+	Length uint32
+}
+
+type optionReply struct {
+	Magic  uint64
+	Option uint32
+	Type   uint32
+	Length uint32
+}
+
+type requestHeader struct {
+	Magic  uint32
+	Flags  uint16
+	Type   uint16
+	Handle uint64
+	Offset uint64
+	Length uint32
+}
+
+type simpleReply struct {
+	Magic  uint32
+	Error  uint32
+	Handle uint64
+}
+
+type structuredReply struct {
+	Flags  uint16
+	Type   uint16
+	Handle uint64
+	Length uint32
+}
+
+func get(reader io.Reader, data interface{}) error {
+	return binary.Read(reader, binary.BigEndian, data)
+}
+
+func put(writer io.Writer, data interface{}) error {
+	return binary.Write(writer, binary.BigEndian, data)
+}
+
+func sendOption(writer io.Writer, option uint32, data []byte) error {
+	err := put(writer, &optionHeader{IHaveOptMagic, option, uint32(len(data))})
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(data)
+	return err
+}
+
+func sendOptionReply(writer io.Writer, option uint32, reply uint32, data []byte) error {
+	err := put(writer, &optionReply{OptReplyMagic, option, reply, uint32(len(data))})
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(data)
+	return err
+}
+
+func readOptionReply(reader io.Reader) (*optionReply, []byte, error) {
+	reply := new(optionReply)
+	err := get(reader, reply)
+	if err != nil {
+		return nil, nil, err
+	}
+	if reply.Magic != OptReplyMagic {
+		return nil, nil, BadMagic
+	}
+	if reply.Length > MaxOption {
+		return nil, nil, OptionTooLarge
+	}
+	data := make([]byte, reply.Length)
+	_, err = io.ReadFull(reader, data)
+	return reply, data, err
+}
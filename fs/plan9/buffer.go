@@ -94,3 +94,105 @@ func pstat(buf Buffer, d *Dir, dotu bool) int {
 	}
 	return sz
 }
+
+func gattr(buf Buffer, attr *Attr) {
+	attr.Mode = buf.Read32()
+	attr.Uid = buf.Read32()
+	attr.Gid = buf.Read32()
+	attr.Nlink = buf.Read64()
+	attr.Rdev = buf.Read64()
+	attr.Size = buf.Read64()
+	attr.Blksize = buf.Read64()
+	attr.Blocks = buf.Read64()
+	attr.Atime = buf.Read64()
+	attr.Atimensec = buf.Read64()
+	attr.Mtime = buf.Read64()
+	attr.Mtimensec = buf.Read64()
+	attr.Ctime = buf.Read64()
+	attr.Ctimensec = buf.Read64()
+	attr.Btime = buf.Read64()
+	attr.Btimensec = buf.Read64()
+	attr.Gen = buf.Read64()
+	attr.Dataversion = buf.Read64()
+}
+
+func pattr(buf Buffer, attr *Attr) {
+	buf.Write32(attr.Mode)
+	buf.Write32(attr.Uid)
+	buf.Write32(attr.Gid)
+	buf.Write64(attr.Nlink)
+	buf.Write64(attr.Rdev)
+	buf.Write64(attr.Size)
+	buf.Write64(attr.Blksize)
+	buf.Write64(attr.Blocks)
+	buf.Write64(attr.Atime)
+	buf.Write64(attr.Atimensec)
+	buf.Write64(attr.Mtime)
+	buf.Write64(attr.Mtimensec)
+	buf.Write64(attr.Ctime)
+	buf.Write64(attr.Ctimensec)
+	buf.Write64(attr.Btime)
+	buf.Write64(attr.Btimensec)
+	buf.Write64(attr.Gen)
+	buf.Write64(attr.Dataversion)
+}
+
+func gstatfs(buf Buffer, st *Statfs) {
+	st.Type = buf.Read32()
+	st.Bsize = buf.Read32()
+	st.Blocks = buf.Read64()
+	st.Bfree = buf.Read64()
+	st.Bavail = buf.Read64()
+	st.Files = buf.Read64()
+	st.Ffree = buf.Read64()
+	st.Fsid = buf.Read64()
+	st.Namelen = buf.Read32()
+}
+
+func pstatfs(buf Buffer, st *Statfs) {
+	buf.Write32(st.Type)
+	buf.Write32(st.Bsize)
+	buf.Write64(st.Blocks)
+	buf.Write64(st.Bfree)
+	buf.Write64(st.Bavail)
+	buf.Write64(st.Files)
+	buf.Write64(st.Ffree)
+	buf.Write64(st.Fsid)
+	buf.Write32(st.Namelen)
+}
+
+// Tlock has flags, and Tgetlock & Rgetlock do not.
+func glock(buf Buffer, lock *Lock, flags bool) {
+	lock.Type = buf.Read8()
+	if flags {
+		lock.Flags = buf.Read32()
+	}
+	lock.Start = buf.Read64()
+	lock.Length = buf.Read64()
+	lock.Procid = buf.Read32()
+	lock.Clientid = buf.ReadString()
+}
+
+func plock(buf Buffer, lock *Lock) {
+	buf.Write8(lock.Type)
+	buf.Write64(lock.Start)
+	buf.Write64(lock.Length)
+	buf.Write32(lock.Procid)
+	buf.WriteString(lock.Clientid)
+}
+
+func locksz(lock *Lock) int {
+	return 1 + 8 + 8 + 4 + 2 + len(lock.Clientid)
+}
+
+func direntsz(d *Dir) int {
+	return 13 + 8 + 1 + 2 + len(d.Name) // qid[13] offset[8] type[1] name[s]
+}
+
+func pdirent(buf Buffer, d *Dir, offset uint64) int {
+	pqid(buf, &d.Qid)
+	buf.Write64(offset)
+	buf.Write8(uint8(d.rawmode >> 12)) // DT_* from the mode.
+	buf.WriteString(d.Name)
+	return direntsz(d)
+}
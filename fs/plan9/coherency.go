@@ -0,0 +1,444 @@
+package plan9
+
+import (
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+//
+// Coherency --
+//
+// How we notice changes made to the layers on the host
+// (i.e. not through us). When a file is found to have
+// changed, it is resolved against the layers again and
+// its qid version is bumped, so the guest knows to drop
+// whatever it has cached.
+//
+// none:    Nothing is noticed. Files we have already
+//          looked up stay as they were resolved.
+// timeout: Files are checked again on lookup (or stat)
+//          once it's been longer than the timeout.
+// strict:  The layers are watched with inotify, and any
+//          files affected are checked immediately.
+//
+type Coherency string
+
+const (
+	CoherencyNone    Coherency = "none"
+	CoherencyTimeout Coherency = "timeout"
+	CoherencyStrict  Coherency = "strict"
+)
+
+//
+// The default timeout (in milliseconds).
+//
+const DefaultCoherencyTimeout = 1000
+
+//
+// What a file resolved to (when last checked).
+//
+type fileStamp struct {
+	read_path     string
+	read_exists   bool
+	write_path    string
+	write_exists  bool
+	write_deleted bool
+
+	dev   uint64
+	ino   uint64
+	mode  uint32
+	size  int64
+	mtime syscall.Timespec
+	ctime syscall.Timespec
+}
+
+func (file *File) currentStamp() fileStamp {
+	stamp := fileStamp{
+		read_path:     file.read_path,
+		read_exists:   file.read_exists,
+		write_path:    file.write_path,
+		write_exists:  file.write_exists,
+		write_deleted: file.write_deleted,
+	}
+
+	// As per dir().
+	stat_path := file.read_path
+	if file.write_exists {
+		stat_path = file.write_path
+	}
+	var stat syscall.Stat_t
+	if syscall.Lstat(stat_path, &stat) == nil {
+		stamp.dev = stat.Dev
+		stamp.ino = stat.Ino
+		stamp.mode = stat.Mode
+		stamp.size = stat.Size
+		stamp.mtime = stat.Mtim
+		stamp.ctime = stat.Ctim
+	}
+
+	return stamp
+}
+
+//
+// Is this still the same underlying file?
+// (It may have been modified, but not replaced).
+//
+func (stamp fileStamp) sameFile(other fileStamp) bool {
+	return (stamp.read_path == other.read_path &&
+		stamp.read_exists == other.read_exists &&
+		stamp.write_path == other.write_path &&
+		stamp.write_exists == other.write_exists &&
+		stamp.write_deleted == other.write_deleted &&
+		stamp.dev == other.dev &&
+		stamp.ino == other.ino)
+}
+
+//
+// Note a change we've made to the write file, so
+// that it isn't taken for a change on the host.
+// (The RWMutex must be held, at least shared).
+//
+func (file *File) ownChange() {
+	file.stamp_lock.Lock()
+	defer file.stamp_lock.Unlock()
+
+	stamp := file.currentStamp()
+	if stamp.sameFile(file.stamp) {
+		file.stamp = stamp
+	}
+}
+
+//
+// Resolve the file against the layers again.
+// Returns true if anything has changed.
+// (The RWMutex must be held exclusively).
+//
+func (file *File) revalidate(fs *Fs, file_path string) bool {
+	file.findPaths(fs, file_path)
+	if file.exists() {
+		file.fillType(file_path)
+	}
+	file.checked = time.Now()
+
+	stamp := file.currentStamp()
+	if stamp == file.stamp {
+		return false
+	}
+	if !stamp.sameFile(file.stamp) {
+		// Any descriptors refer to the old file.
+		// (They're reopened on next use, and the
+		// LRU entry is refreshed at the same time).
+		file.closeFds()
+	}
+	file.stamp = stamp
+	file.Qid.Version += 1
+	return true
+}
+
+//
+// Check the file if it has been a while.
+//
+// This does nothing unless we're in timeout mode. If
+// the file is busy, we leave it for the next time
+// (the caller may already be holding it locked).
+//
+func (fs *Fs) check(file *File, file_path string) {
+	if fs.Coherency != CoherencyTimeout {
+		return
+	}
+	if !file.RWMutex.TryLock() {
+		return
+	}
+	defer file.RWMutex.Unlock()
+
+	timeout := time.Duration(fs.CoherencyTimeout) * time.Millisecond
+	if time.Since(file.checked) >= timeout {
+		file.revalidate(fs, file_path)
+	}
+}
+
+//
+// Check the given file now (if we have it).
+// (The layerLock must be held).
+//
+func (fs *Fs) invalidate(file_path string) {
+	fs.filesLock.RLock()
+	file, ok := fs.files[file_path]
+	if ok {
+		atomic.AddInt32(&file.refs, 1)
+	}
+	fs.filesLock.RUnlock()
+	if !ok {
+		return
+	}
+
+	file.RWMutex.Lock()
+	file.revalidate(fs, file_path)
+	file.RWMutex.Unlock()
+	file.DecRef(fs, file_path)
+}
+
+//
+// Check the given file, which has been changed in
+// place. This is nearly always our own write, so we
+// compare against the stamp first -- without holding
+// up any other writes to the file.
+// (The layerLock must be held).
+//
+func (fs *Fs) invalidateModified(file_path string) {
+	fs.filesLock.RLock()
+	file, ok := fs.files[file_path]
+	if ok {
+		atomic.AddInt32(&file.refs, 1)
+	}
+	fs.filesLock.RUnlock()
+	if !ok {
+		return
+	}
+
+	file.RWMutex.RLock()
+	file.stamp_lock.Lock()
+	same := file.currentStamp() == file.stamp
+	file.stamp_lock.Unlock()
+	file.RWMutex.RUnlock()
+
+	if !same {
+		fs.invalidate(file_path)
+	}
+	file.DecRef(fs, file_path)
+}
+
+//
+// Check every file we have.
+//
+func (fs *Fs) invalidateAll() {
+	fs.filesLock.RLock()
+	paths := make([]string, 0, len(fs.files))
+	for file_path, _ := range fs.files {
+		paths = append(paths, file_path)
+	}
+	fs.filesLock.RUnlock()
+
+	for _, file_path := range paths {
+		fs.invalidate(file_path)
+	}
+}
+
+//
+// Layer watches --
+//
+// In strict mode, every directory in every layer is
+// watched. Each watch maps back to the directory in the
+// overlay, so an event names the file to be checked.
+// Events are collected a read at a time, so that a burst
+// of writes to the same file only checks it once.
+//
+// The write layers are watched too, where changes to the
+// contents (and to the attributes, which includes the
+// write map) are nearly always our own. Each of those
+// updates the file's stamp (see ownChange()), so only a
+// change on the host will fail to match it.
+//
+const watchMask = (syscall.IN_CREATE |
+	syscall.IN_DELETE |
+	syscall.IN_MODIFY |
+	syscall.IN_ATTRIB |
+	syscall.IN_MOVED_FROM |
+	syscall.IN_MOVED_TO |
+	syscall.IN_DELETE_SELF |
+	syscall.IN_MOVE_SELF |
+	syscall.IN_ONLYDIR |
+	syscall.IN_DONT_FOLLOW)
+
+//
+// A change in place (not to which file it is).
+//
+const modifyMask = syscall.IN_MODIFY | syscall.IN_ATTRIB
+
+type watch struct {
+	// The directory on the host.
+	host_path string
+
+	// Where it appears in the overlay.
+	overlay_paths []string
+}
+
+type watcher struct {
+	fd      int
+	file    *os.File
+	watches map[int32]*watch
+}
+
+func (fs *Fs) startWatcher() error {
+	fd, err := syscall.InotifyInit1(syscall.IN_NONBLOCK | syscall.IN_CLOEXEC)
+	if err != nil {
+		return err
+	}
+
+	w := &watcher{
+		fd: fd,
+		// Non-blocking, so reads go through the poller
+		// (and are interrupted when the file is closed).
+		file:    os.NewFile(uintptr(fd), "inotify"),
+		watches: make(map[int32]*watch),
+	}
+
+	for prefix, backing_paths := range fs.Read {
+		for _, backing_path := range backing_paths {
+			w.addTree(backing_path, prefix)
+		}
+	}
+	for prefix, backing_path := range fs.Write {
+		w.addTree(backing_path, prefix)
+	}
+
+	fs.watcher = w
+	go fs.watch(w)
+	return nil
+}
+
+func (fs *Fs) stopWatcher() {
+	if fs.watcher != nil {
+		fs.watcher.file.Close()
+		fs.watcher = nil
+	}
+}
+
+//
+// Watch every directory beneath host_root.
+// Returns everything found (as in the overlay).
+//
+func (w *watcher) addTree(host_root string, overlay_root string) []string {
+	found := make([]string, 0, 0)
+
+	filepath.Walk(host_root, func(
+		host_path string,
+		info os.FileInfo,
+		err error) error {
+
+		if err != nil {
+			return nil
+		}
+		overlay_path := path.Join(overlay_root, host_path[len(host_root):])
+		found = append(found, overlay_path)
+		if !info.IsDir() {
+			return nil
+		}
+
+		wd, err := syscall.InotifyAddWatch(w.fd, host_path, watchMask)
+		if err != nil {
+			// Most likely we're out of watches.
+			// Changes here simply won't be seen.
+			log.Printf("unable to watch %s: %s", host_path, err.Error())
+			return filepath.SkipDir
+		}
+
+		existing, ok := w.watches[int32(wd)]
+		if !ok {
+			existing = &watch{host_path: host_path}
+			w.watches[int32(wd)] = existing
+		}
+		for _, other_path := range existing.overlay_paths {
+			if other_path == overlay_path {
+				return nil
+			}
+		}
+		existing.overlay_paths = append(existing.overlay_paths, overlay_path)
+		return nil
+	})
+
+	return found
+}
+
+func (fs *Fs) watch(w *watcher) {
+	buf := make([]byte, 64*1024)
+
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			// We've been stopped.
+			return
+		}
+
+		changed := make(map[string]bool)
+		modified := make(map[string]bool)
+		overflow := false
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			name_start := offset + syscall.SizeofInotifyEvent
+			name := strings.TrimRight(
+				string(buf[name_start:name_start+int(event.Len)]),
+				"\x00")
+			offset = name_start + int(event.Len)
+
+			if event.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				// We've lost track.
+				overflow = true
+				continue
+			}
+			existing, ok := w.watches[event.Wd]
+			if !ok {
+				continue
+			}
+			if event.Mask&syscall.IN_IGNORED != 0 {
+				// The directory is gone.
+				delete(w.watches, event.Wd)
+				continue
+			}
+			for _, overlay_path := range existing.overlay_paths {
+				if name == "" {
+					// The directory itself.
+					changed[overlay_path] = true
+					continue
+				}
+
+				file_path := path.Join(overlay_path, name)
+				if event.Mask&^(modifyMask|syscall.IN_ISDIR) == 0 {
+					modified[file_path] = true
+					continue
+				}
+				changed[file_path] = true
+				if event.Mask&(syscall.IN_CREATE|
+					syscall.IN_DELETE|
+					syscall.IN_MOVED_FROM|
+					syscall.IN_MOVED_TO) != 0 {
+					changed[overlay_path] = true
+				}
+				if event.Mask&syscall.IN_ISDIR != 0 &&
+					event.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+					// Anything already in there was
+					// created before we were watching.
+					found := w.addTree(
+						path.Join(existing.host_path, name),
+						file_path)
+					for _, found_path := range found {
+						changed[found_path] = true
+					}
+				}
+			}
+		}
+
+		fs.layerLock.RLock()
+		if overflow {
+			fs.invalidateAll()
+		} else {
+			for file_path, _ := range changed {
+				fs.invalidate(file_path)
+			}
+			for file_path, _ := range modified {
+				if !changed[file_path] {
+					fs.invalidateModified(file_path)
+				}
+			}
+		}
+		fs.layerLock.RUnlock()
+	}
+}
@@ -0,0 +1,198 @@
+package plan9
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newCoherentFs(t *testing.T, coherency Coherency) (*Fs, string, string) {
+	lower := t.TempDir()
+	upper := t.TempDir()
+	err := ioutil.WriteFile(filepath.Join(lower, "file"), []byte("lower"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs := new(Fs)
+	fs.Init()
+	fs.Write["/"] = upper
+	fs.Read["/"] = []string{lower}
+	fs.Coherency = coherency
+	fs.CoherencyTimeout = 1
+	if err := fs.Attach(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(fs.stopWatcher)
+	return fs, upper, lower
+}
+
+func version(file *File) uint32 {
+	file.RLock()
+	defer file.RUnlock()
+	return file.Qid.Version
+}
+
+//
+// Wait for the file to change (as the guest would see it).
+//
+func waitVersion(t *testing.T, fs *Fs, file_path string, previous uint32) *File {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		time.Sleep(2 * time.Millisecond)
+		file, err := fs.Lookup(file_path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version(file) != previous {
+			return file
+		}
+		file.DecRef(fs, file_path)
+		if time.Now().After(deadline) {
+			t.Fatalf("%s: change not noticed", file_path)
+		}
+	}
+}
+
+func testCoherency(t *testing.T, coherency Coherency) {
+	fs, upper, lower := newCoherentFs(t, coherency)
+	file, err := fs.Lookup("/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(readAll(t, fs, file, 4096), []byte("lower")) {
+		t.Fatalf("wrong contents")
+	}
+
+	// Changed in place.
+	previous := version(file)
+	err = ioutil.WriteFile(filepath.Join(lower, "file"), []byte("changed"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file = waitVersion(t, fs, "/file", previous)
+	if !bytes.Equal(readAll(t, fs, file, 4096), []byte("changed")) {
+		t.Fatalf("wrong contents after change")
+	}
+
+	// Replaced in the write layer.
+	previous = version(file)
+	err = ioutil.WriteFile(filepath.Join(upper, "file.tmp"), []byte("upper"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Rename(filepath.Join(upper, "file.tmp"), filepath.Join(upper, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	file = waitVersion(t, fs, "/file", previous)
+	if !bytes.Equal(readAll(t, fs, file, 4096), []byte("upper")) {
+		t.Fatalf("wrong contents after replace")
+	}
+
+	// Created in a new directory.
+	missing, err := fs.Lookup("/dir/new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if missing.Exists() {
+		t.Fatalf("file exists already?")
+	}
+	previous = version(missing)
+	if err := os.Mkdir(filepath.Join(lower, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(lower, "dir", "new"), []byte("new"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	missing = waitVersion(t, fs, "/dir/new", previous)
+	if !missing.Exists() {
+		t.Fatalf("new file not found")
+	}
+}
+
+func TestCoherencyTimeout(t *testing.T) {
+	testCoherency(t, CoherencyTimeout)
+}
+
+func TestCoherencyStrict(t *testing.T) {
+	testCoherency(t, CoherencyStrict)
+}
+
+func TestCoherencyOwnWrites(t *testing.T) {
+	fs, _, _ := newCoherentFs(t, CoherencyStrict)
+	file, err := fs.Lookup("/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The copy up creates the file in the write
+	// layer, which may be noticed (once).
+	writeAt(t, fs, file, 0, []byte("L"))
+	time.Sleep(20 * time.Millisecond)
+
+	// But writing to it (and its write map) isn't.
+	previous := version(file)
+	for i := 0; i < 10; i += 1 {
+		writeAt(t, fs, file, i, []byte("w"))
+	}
+	time.Sleep(10 * time.Millisecond)
+	if version(file) != previous {
+		t.Fatalf("version changed by our own writes")
+	}
+}
+
+func TestCoherencyHostWrites(t *testing.T) {
+	fs, upper, _ := newCoherentFs(t, CoherencyStrict)
+	file, err := fs.Lookup("/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeAt(t, fs, file, 0, []byte("lower"))
+	time.Sleep(20 * time.Millisecond)
+
+	// Edited in place in the write layer.
+	previous := version(file)
+	host, err := os.OpenFile(filepath.Join(upper, "file"), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = host.WriteAt([]byte("upper"), 0)
+	host.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file = waitVersion(t, fs, "/file", previous)
+	if !bytes.Equal(readAll(t, fs, file, 4096), []byte("upper")) {
+		t.Fatalf("wrong contents after change")
+	}
+}
+
+func TestCoherencyNone(t *testing.T) {
+	fs, _, lower := newCoherentFs(t, CoherencyNone)
+	file, err := fs.Lookup("/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(lower, "file"), []byte("changed"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if version(file) != 0 {
+		t.Fatalf("version changed?")
+	}
+}
+
+func TestCoherencyBadMode(t *testing.T) {
+	fs := new(Fs)
+	fs.Init()
+	fs.Coherency = "sometimes"
+	if err := fs.Attach(); err != BadCoherency {
+		t.Fatalf("expected BadCoherency, got %v", err)
+	}
+}
@@ -0,0 +1,794 @@
+package plan9
+
+import (
+	"math"
+	"path"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	platform "github.com/multiverse-os/portalgun/vm/kvm"
+)
+
+//
+// 9P2000.L --
+//
+// These are the operations for the Linux dialect. They
+// are built on the same overlay as the 9P2000 operations,
+// so that everything new is created in the write layer,
+// and anything modified is copied up first.
+//
+
+// The largest extended attribute we'll hold.
+const XattrMax = 65536
+
+func lopenMode(flags uint32) uint8 {
+	var mode uint8
+	switch flags & LOACCMODE {
+	case LOWRONLY:
+		mode = OWRITE
+	case LORDWR:
+		mode = ORDWR
+	default:
+		mode = OREAD
+	}
+	if flags&LOTRUNC != 0 {
+		mode |= OTRUNC
+	}
+	return mode
+}
+
+func mkdev(major uint32, minor uint32) int {
+	// As per the glibc encoding.
+	return int((uint64(major&0xfffff000) << 32) |
+		(uint64(major&0x00000fff) << 8) |
+		(uint64(minor&0xffffff00) << 12) |
+		(uint64(minor & 0x000000ff)))
+}
+
+func isDir(file *File) bool {
+	return file.Qid.Type&QTDIR != 0
+}
+
+func (fs *Fs) statfs(fid *Fid) (*Statfs, error) {
+	var st syscall.Statfs_t
+	err := fs.Statfs(&st)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Statfs{
+		Type:    uint32(st.Type),
+		Bsize:   uint32(st.Bsize),
+		Blocks:  st.Blocks,
+		Bfree:   st.Bfree,
+		Bavail:  st.Bavail,
+		Files:   st.Files,
+		Ffree:   st.Ffree,
+		Fsid:    uint64(uint32(st.Fsid.X__val[0])) | uint64(uint32(st.Fsid.X__val[1]))<<32,
+		Namelen: uint32(st.Namelen),
+	}, nil
+}
+
+func (fs *Fs) lopen(fid *Fid, flags uint32) (*Qid, uint32, error) {
+	mode := lopenMode(flags)
+	if isDir(fid.file) && mode&3 != OREAD {
+		return nil, 0, Eisdir
+	}
+
+	qid, iounit, err := fs.open(fid, mode)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if mode&OTRUNC != 0 && mode&3 != OREAD {
+		err = fid.file.truncate(fs, 0)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	return qid, iounit, nil
+}
+
+func (fs *Fs) lopenPost(fid *Fid, flags uint32) { fs.openPost(fid, lopenMode(flags)) }
+
+//
+// Set the mode and owner of a new file. The owner
+// is best effort, since we may not be privileged
+// enough to give files away.
+//
+func (fs *Fs) setup(file *File, file_path string, mode uint32, uid uint32, gid uint32) error {
+	write_path, err := file.CopyUp(fs, file_path)
+	if err != nil {
+		return err
+	}
+
+	if mode&syscall.S_IFMT != syscall.S_IFLNK {
+		err = syscall.Chmod(write_path, mode&07777)
+		if err != nil {
+			return err
+		}
+	}
+
+	new_uid := -1
+	new_gid := -1
+	if uid != NOUID {
+		new_uid = int(uid)
+	}
+	if gid != NOUID {
+		new_gid = int(gid)
+	}
+	syscall.Lchown(write_path, new_uid, new_gid)
+
+	return nil
+}
+
+func (fs *Fs) lcreate(
+	fid *Fid,
+	name string,
+	flags uint32,
+	mode uint32,
+	gid uint32) (*File, *Qid, uint32, error) {
+
+	// Already opened?
+	if fid.Opened {
+		return nil, nil, 0, Eopen
+	}
+	// Trying to create not in a directory?
+	if !isDir(fid.file) {
+		return nil, nil, 0, Enotdir
+	}
+
+	new_path := path.Join(fid.Path, name)
+	new_file, err := fs.lookup(new_path)
+	if err != nil {
+		if new_file != nil {
+			new_file.DecRef(fs, new_path)
+		}
+		return nil, nil, 0, err
+	}
+
+	err = new_file.create(fs, new_path, syscall.S_IFREG|(mode&07777))
+	if err == Eexist && flags&LOEXCL == 0 {
+		// Just open what's there.
+		if isDir(new_file) {
+			err = Eisdir
+		} else if flags&LOTRUNC != 0 {
+			err = new_file.truncate(fs, 0)
+		} else {
+			err = nil
+		}
+	} else if err == nil {
+		err = fs.setup(new_file, new_path, mode, fid.Uid, gid)
+	}
+	if err != nil {
+		new_file.DecRef(fs, new_path)
+		return nil, nil, 0, err
+	}
+
+	// Give back a reference to our file.
+	return new_file, &new_file.Qid, platform.PageSize, nil
+}
+
+//
+// Make a new node in the directory, using the given
+// function to create it. This returns the new file
+// with a reference held.
+//
+func (fs *Fs) mknode(
+	dir *Fid,
+	name string,
+	make_fn func(write_path string) error) (*File, string, error) {
+
+	if !isDir(dir.file) {
+		return nil, "", Enotdir
+	}
+
+	new_path := path.Join(dir.Path, name)
+	new_file, err := fs.lookup(new_path)
+	if err != nil {
+		if new_file != nil {
+			new_file.DecRef(fs, new_path)
+		}
+		return nil, "", err
+	}
+
+	err = new_file.createWith(fs, new_path, make_fn)
+	if err != nil {
+		new_file.DecRef(fs, new_path)
+		return nil, "", err
+	}
+
+	return new_file, new_path, nil
+}
+
+func (fs *Fs) symlink(dir *Fid, name string, target string, gid uint32) (*Qid, error) {
+	new_file, new_path, err := fs.mknode(dir, name, func(write_path string) error {
+		return syscall.Symlink(target, write_path)
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer new_file.DecRef(fs, new_path)
+
+	err = fs.setup(new_file, new_path, syscall.S_IFLNK, dir.Uid, gid)
+	qid := new_file.Qid
+	return &qid, err
+}
+
+func (fs *Fs) mknod(
+	dir *Fid,
+	name string,
+	mode uint32,
+	major uint32,
+	minor uint32,
+	gid uint32) (*Qid, error) {
+
+	new_file, new_path, err := fs.mknode(dir, name, func(write_path string) error {
+		return syscall.Mknod(write_path, mode, mkdev(major, minor))
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer new_file.DecRef(fs, new_path)
+
+	err = fs.setup(new_file, new_path, mode, dir.Uid, gid)
+	qid := new_file.Qid
+	return &qid, err
+}
+
+func (fs *Fs) mkdir(dir *Fid, name string, mode uint32, gid uint32) (*Qid, error) {
+	if !isDir(dir.file) {
+		return nil, Enotdir
+	}
+
+	new_path := path.Join(dir.Path, name)
+	new_file, err := fs.lookup(new_path)
+	if err != nil {
+		if new_file != nil {
+			new_file.DecRef(fs, new_path)
+		}
+		return nil, err
+	}
+	defer new_file.DecRef(fs, new_path)
+
+	err = new_file.create(fs, new_path, syscall.S_IFDIR|(mode&07777))
+	if err != nil {
+		return nil, err
+	}
+
+	err = fs.setup(new_file, new_path, mode, dir.Uid, gid)
+	qid := new_file.Qid
+	return &qid, err
+}
+
+func (fs *Fs) link(dir *Fid, fid *Fid, name string) error {
+	// No links to directories.
+	if isDir(fid.file) {
+		return Eperm
+	}
+
+	// The link is made in the write layer.
+	// (And both names need all of the data).
+	orig_path, err := fid.file.CopyUpAll(fs, fid.Path)
+	if err != nil {
+		return err
+	}
+
+	new_file, new_path, err := fs.mknode(dir, name, func(write_path string) error {
+		return syscall.Link(orig_path, write_path)
+	})
+	if err != nil {
+		return err
+	}
+	new_file.DecRef(fs, new_path)
+	return nil
+}
+
+func (fs *Fs) readlink(fid *Fid) (string, error) {
+	return fid.file.Readlink()
+}
+
+func (fs *Fs) unlinkat(dir *Fid, name string, flags uint32) error {
+	file_path := path.Join(dir.Path, name)
+	file, err := fs.lookup(file_path)
+	if err != nil {
+		if file != nil {
+			file.DecRef(fs, file_path)
+		}
+		return err
+	}
+	defer file.DecRef(fs, file_path)
+
+	if !file.Exists() {
+		return Enoent
+	}
+
+	if flags&AT_REMOVEDIR != 0 {
+		if !isDir(file) {
+			return Enotdir
+		}
+		children, err := file.children(fs, file_path)
+		if err != nil {
+			return err
+		}
+		if len(children) > 0 {
+			return Enotempty
+		}
+	} else if isDir(file) {
+		return Eisdir
+	}
+
+	return file.remove(fs, file_path)
+}
+
+//
+// Rename a file, replacing whatever is at the new path.
+// (The overlay itself won't rename over existing files).
+//
+func (fs *Fs) move(file *File, orig_path string, new_path string) error {
+
+	if new_path == orig_path {
+		return nil
+	}
+	if strings.HasPrefix(new_path, orig_path+"/") {
+		return Einval
+	}
+	if !file.Exists() {
+		return Enoent
+	}
+
+	other, err := fs.lookup(new_path)
+	if err != nil {
+		if other != nil {
+			other.DecRef(fs, new_path)
+		}
+		return err
+	}
+	defer other.DecRef(fs, new_path)
+	if other.Exists() {
+		switch {
+		case isDir(other) && !isDir(file):
+			return Eisdir
+		case !isDir(other) && isDir(file):
+			return Enotdir
+		case isDir(other):
+			children, err := other.children(fs, new_path)
+			if err != nil {
+				return err
+			}
+			if len(children) > 0 {
+				return Enotempty
+			}
+		}
+	}
+
+	// Directories can only be moved if there's nothing
+	// beneath them in a read layer. (The client will fall
+	// back to copying, as it would for any other device).
+	if isDir(file) {
+		if !file.WriteOnly() {
+			return Exdev
+		}
+	} else {
+		_, err = file.CopyUp(fs, orig_path)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Only now that we know the move can
+	// go ahead is the target replaced.
+	if other.Exists() {
+		err = other.remove(fs, new_path)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = file.rename(fs, orig_path, new_path)
+	if err != nil {
+		return err
+	}
+
+	fs.moveFids(orig_path, new_path)
+	return nil
+}
+
+//
+// Move the fids beneath a renamed directory.
+// (The rename takes care of the directory's own fids).
+//
+func (fs *Fs) moveFids(orig_path string, new_path string) {
+
+	fs.fidLock.RLock()
+	moved := make([]*Fid, 0)
+	for _, fid := range fs.Pool {
+		if strings.HasPrefix(fid.Path, orig_path+"/") {
+			atomic.AddInt32(&fid.refs, 1)
+			moved = append(moved, fid)
+		}
+	}
+	fs.fidLock.RUnlock()
+
+	for _, fid := range moved {
+		child_path := new_path + fid.Path[len(orig_path):]
+		child, err := fs.lookup(child_path)
+		if err == nil {
+			fid.file.DecRef(fs, fid.Path)
+			fid.Path = child_path
+			fid.file = child
+		} else if child != nil {
+			child.DecRef(fs, child_path)
+		}
+		fid.DecRef(fs)
+	}
+}
+
+func (fs *Fs) renameTo(fid *Fid, dir *Fid, name string) error {
+	return fs.move(fid.file, fid.Path, path.Join(dir.Path, name))
+}
+
+func (fs *Fs) renameat(
+	orig_dir *Fid,
+	orig_name string,
+	new_dir *Fid,
+	new_name string) error {
+
+	orig_path := path.Join(orig_dir.Path, orig_name)
+	file, err := fs.lookup(orig_path)
+	if err != nil {
+		if file != nil {
+			file.DecRef(fs, orig_path)
+		}
+		return err
+	}
+	defer file.DecRef(fs, orig_path)
+
+	return fs.move(file, orig_path, path.Join(new_dir.Path, new_name))
+}
+
+func (fs *Fs) getattr(fid *Fid, mask uint64) (uint64, *Attr, error) {
+	fs.check(fid.file, fid.Path)
+
+	var stat syscall.Stat_t
+	err := fid.file.Stat(&stat)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	// We always give back the basic set,
+	// regardless of what was asked for.
+	attr := &Attr{
+		Mode:      stat.Mode,
+		Uid:       stat.Uid,
+		Gid:       stat.Gid,
+		Nlink:     uint64(stat.Nlink),
+		Rdev:      uint64(stat.Rdev),
+		Size:      uint64(stat.Size),
+		Blksize:   uint64(stat.Blksize),
+		Blocks:    uint64(stat.Blocks),
+		Atime:     uint64(stat.Atim.Sec),
+		Atimensec: uint64(stat.Atim.Nsec),
+		Mtime:     uint64(stat.Mtim.Sec),
+		Mtimensec: uint64(stat.Mtim.Nsec),
+		Ctime:     uint64(stat.Ctim.Sec),
+		Ctimensec: uint64(stat.Ctim.Nsec),
+	}
+	return GETATTR_BASIC, attr, nil
+}
+
+func (fs *Fs) setattr(fid *Fid, valid uint32, attr *Attr) error {
+
+	// Nothing to do for just the ctime.
+	changes := uint32(SETATTR_MODE | SETATTR_UID | SETATTR_GID |
+		SETATTR_SIZE | SETATTR_ATIME | SETATTR_MTIME)
+	if valid&changes == 0 {
+		return nil
+	}
+
+	// Everything is done in the write layer.
+	write_path, err := fid.file.CopyUp(fs, fid.Path)
+	if err != nil {
+		return err
+	}
+
+	if valid&SETATTR_MODE != 0 {
+		err = syscall.Chmod(write_path, attr.Mode&07777)
+		if err != nil {
+			return err
+		}
+	}
+
+	if valid&(SETATTR_UID|SETATTR_GID) != 0 {
+		new_uid := -1
+		new_gid := -1
+		if valid&SETATTR_UID != 0 {
+			new_uid = int(attr.Uid)
+		}
+		if valid&SETATTR_GID != 0 {
+			new_gid = int(attr.Gid)
+		}
+		err = syscall.Lchown(write_path, new_uid, new_gid)
+		if err != nil {
+			return err
+		}
+	}
+
+	if valid&SETATTR_SIZE != 0 {
+		err = fid.file.truncate(fs, attr.Size)
+		if err != nil {
+			return err
+		}
+	}
+
+	if valid&(SETATTR_ATIME|SETATTR_MTIME) != 0 {
+		var stat syscall.Stat_t
+		err = syscall.Lstat(write_path, &stat)
+		if err != nil {
+			return err
+		}
+
+		// The times are now, unless they're given.
+		now := syscall.NsecToTimespec(time.Now().UnixNano())
+		times := []syscall.Timespec{stat.Atim, stat.Mtim}
+		if valid&SETATTR_ATIME != 0 {
+			times[0] = now
+			if valid&SETATTR_ATIMESET != 0 {
+				times[0] = syscall.Timespec{
+					Sec:  int64(attr.Atime),
+					Nsec: int64(attr.Atimensec),
+				}
+			}
+		}
+		if valid&SETATTR_MTIME != 0 {
+			times[1] = now
+			if valid&SETATTR_MTIMESET != 0 {
+				times[1] = syscall.Timespec{
+					Sec:  int64(attr.Mtime),
+					Nsec: int64(attr.Mtimensec),
+				}
+			}
+		}
+		err = syscall.UtimesNano(write_path, times)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//
+// Extended attributes --
+//
+// Walking to an xattr gives a new fid, which is read to
+// get the value (or the list of names, if no name is
+// given). Creating one turns the fid into one that is
+// written with the value, which is set on clunk.
+//
+
+func (fs *Fs) xattrwalk(fid *Fid, newfid uint32, name string) (uint64, error) {
+	data, err := fid.file.getxattr(name)
+	if err != nil {
+		return 0, err
+	}
+
+	fid.file.IncRef(fs)
+	nfid, err := fs.NewFid(newfid, fid.Path, fid.file)
+	if err != nil {
+		fid.file.DecRef(fs, fid.Path)
+		return 0, err
+	}
+	nfid.Uid = fid.Uid
+	nfid.Xattr = true
+	nfid.Xattrname = name
+	nfid.Xattrdata = data
+
+	return uint64(len(data)), nil
+}
+
+func (fs *Fs) xattrcreate(fid *Fid, name string, size uint64, flags uint32) error {
+	if size > XattrMax {
+		return Erange
+	}
+
+	fid.Xattr = true
+	fid.Xattrcreate = true
+	fid.Xattrname = name
+	fid.Xattrdata = make([]byte, size)
+	fid.Xattrflags = flags
+	return nil
+}
+
+func (fs *Fs) readXattr(fid *Fid, offset uint64, count uint32) []byte {
+	if offset >= uint64(len(fid.Xattrdata)) {
+		return []byte{}
+	}
+	end := offset + uint64(count)
+	if end > uint64(len(fid.Xattrdata)) {
+		end = uint64(len(fid.Xattrdata))
+	}
+	return fid.Xattrdata[offset:end]
+}
+
+func (fs *Fs) writeXattr(fid *Fid, offset uint64, data []byte) error {
+	if !fid.Xattrcreate {
+		return Ebaduse
+	}
+	if offset+uint64(len(data)) > uint64(len(fid.Xattrdata)) {
+		return Erange
+	}
+	copy(fid.Xattrdata[offset:], data)
+	return nil
+}
+
+func (fs *Fs) readDirL(fid *Fid, offset uint64) ([]*Dir, error) {
+	if !isDir(fid.file) {
+		return nil, Enotdir
+	}
+
+	// Entries are at their index (plus one, since
+	// zero is the start). A read from the start takes
+	// a new snapshot of the directory.
+	if offset == 0 || fid.Direntries == nil {
+		children, err := fid.file.children(fs, fid.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		// Include ourselves and our parent.
+		self, err := fid.file.dir(".", true)
+		if err != nil {
+			return nil, err
+		}
+		parent := *self
+		parent.Name = ".."
+		parent_path := path.Dir(fid.Path)
+		parent_file, err := fs.lookup(parent_path)
+		if err == nil {
+			parent_dir, err := parent_file.dir("..", true)
+			if err == nil {
+				parent = *parent_dir
+			}
+		}
+		if parent_file != nil {
+			parent_file.DecRef(fs, parent_path)
+		}
+
+		fid.Direntries = append([]*Dir{self, &parent}, children...)
+	}
+
+	if offset >= uint64(len(fid.Direntries)) {
+		return []*Dir{}, nil
+	}
+	return fid.Direntries[offset:], nil
+}
+
+func (fs *Fs) fsync(fid *Fid, datasync bool) error {
+	err := fid.file.lockRead(fs)
+	if err != nil {
+		return err
+	}
+	defer fid.file.unlock()
+
+	if datasync {
+		return syscall.Fdatasync(fid.file.read_fd)
+	}
+	return syscall.Fsync(fid.file.read_fd)
+}
+
+//
+// Locks --
+//
+// Byte-range locks are kept here, per file, rather than
+// taken on the host (where they would all be ours). The
+// guest kernel checks its own processes' locks before it
+// asks us, so these only ever matter between clients
+// (e.g. two mounts of the same layers). An owner is a
+// client & process, and a lock never conflicts with its
+// own owner's. A lock that would block is refused with
+// LOCK_BLOCKED, and it's up to the client to try again.
+//
+
+func lockEnd(lock *Lock) uint64 {
+	if lock.Length == 0 || lock.Start+lock.Length < lock.Start {
+		return math.MaxUint64
+	}
+	return lock.Start + lock.Length
+}
+
+func sameOwner(lock *Lock, other *Lock) bool {
+	return lock.Procid == other.Procid && lock.Clientid == other.Clientid
+}
+
+//
+// The first lock held by someone else that conflicts.
+// (The locks_lock must be held).
+//
+func (file *File) lockConflict(lock *Lock) *Lock {
+	for i := range file.locks {
+		other := &file.locks[i]
+		if sameOwner(lock, other) ||
+			(lock.Type == LOCK_RDLCK && other.Type == LOCK_RDLCK) {
+			continue
+		}
+		if other.Start < lockEnd(lock) && lock.Start < lockEnd(other) {
+			return other
+		}
+	}
+	return nil
+}
+
+func (fs *Fs) lock(fid *Fid, lock *Lock) (uint8, error) {
+	switch lock.Type {
+	case LOCK_RDLCK, LOCK_WRLCK, LOCK_UNLCK:
+	default:
+		return LOCK_ERROR, Einval
+	}
+
+	file := fid.file
+	file.locks_lock.Lock()
+	defer file.locks_lock.Unlock()
+
+	if lock.Type != LOCK_UNLCK && file.lockConflict(lock) != nil {
+		return LOCK_BLOCKED, nil
+	}
+
+	// Take the range out of the owner's locks (splitting
+	// any that straddle it), then add the new lock.
+	end := lockEnd(lock)
+	locks := make([]Lock, 0, len(file.locks)+2)
+	for _, other := range file.locks {
+		other_end := lockEnd(&other)
+		if !sameOwner(lock, &other) || other_end <= lock.Start || end <= other.Start {
+			locks = append(locks, other)
+			continue
+		}
+		if other.Start < lock.Start {
+			before := other
+			before.Length = lock.Start - other.Start
+			locks = append(locks, before)
+		}
+		if end < other_end {
+			after := other
+			after.Start = end
+			if other.Length != 0 {
+				after.Length = other_end - end
+			}
+			locks = append(locks, after)
+		}
+	}
+	if lock.Type != LOCK_UNLCK {
+		held := *lock
+		held.Flags = 0
+		locks = append(locks, held)
+	}
+	file.locks = locks
+
+	return LOCK_SUCCESS, nil
+}
+
+func (fs *Fs) getlock(fid *Fid, lock *Lock) (*Lock, error) {
+	switch lock.Type {
+	case LOCK_RDLCK, LOCK_WRLCK:
+	case LOCK_UNLCK:
+		return lock, nil
+	default:
+		return nil, Einval
+	}
+
+	file := fid.file
+	file.locks_lock.Lock()
+	defer file.locks_lock.Unlock()
+
+	result := *lock
+	if other := file.lockConflict(lock); other != nil {
+		result = *other
+	} else {
+		result.Type = LOCK_UNLCK
+	}
+	return &result, nil
+}
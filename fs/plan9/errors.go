@@ -9,6 +9,7 @@ var (
 	BufferInsufficient = errors.New("insufficient buffer?")
 	InvalidMessage     = errors.New("invalid 9pfs message?")
 	XattrError         = errors.New("unable to fetch xattr?")
+	BadCoherency       = errors.New("unknown coherency mode?")
 
 	// Internal errors.
 	Eunknownfid error = &Error{"unknown fid", EINVAL}
@@ -25,5 +26,9 @@ var (
 	Enotimpl    error = &Error{"not implemented", EINVAL}
 	Eexist      error = &Error{"file already exists", EEXIST}
 	Enoent      error = &Error{"file not found", ENOENT}
-	Enotempty   error = &Error{"directory not empty", EPERM}
+	Enotempty   error = &Error{"directory not empty", ENOTEMPTY}
+	Eisdir      error = &Error{"is a directory", EISDIR}
+	Exdev       error = &Error{"cross-device link", EXDEV}
+	Einval      error = &Error{"invalid argument", EINVAL}
+	Erange      error = &Error{"result too large", ERANGE}
 )
@@ -20,6 +20,15 @@ type Fid struct {
 	Diroffset uint64 `json:"diroffset"`
 	// If directory, list of children (reset by read(offset=0).
 	Direntries []*Dir `json:"direntries"`
+	// The user (as attached), for new files.
+	Uid uint32 `json:"uid"`
+	// If an xattr, the name and value. The value is
+	// set on clunk if it's being created (9P2000.L).
+	Xattr       bool   `json:"xattr"`
+	Xattrname   string `json:"xattrname"`
+	Xattrdata   []byte `json:"xattrdata"`
+	Xattrflags  uint32 `json:"xattrflags"`
+	Xattrcreate bool   `json:"xattrcreate"`
 	// The associated file.
 	//
 	// This is looked up from the filesystem map
@@ -36,34 +36,47 @@ type File struct {
 	// The associated file fds.
 	read_fd  int
 	write_fd int
+	// Our path in the overlay.
+	overlay_path string
+	// What we resolved to, and when.
+	// (For noticing changes on the host).
+	stamp   fileStamp
+	checked time.Time
+	// Held to update the stamp without
+	// holding the RWMutex exclusively.
+	stamp_lock sync.Mutex
 
 	// The write map --
 	//
-	// This is future work.
-	//
-	// This will track sparse holes in the write_fd,
-	// and ensures that it is populated as necessary.
-	// Each entry represents a sparse hole. If a read
-	// comes in and corresponds to a hole, we will send
-	// the read to the read_fd. If a read comes in and
-	// partially overlaps with a hole, then we need to
-	// copy data from the read_fd to the write_fd first,
+	// This tracks sparse holes in the write_fd, and
+	// ensures that it is populated as necessary. Each
+	// entry represents a sparse hole. If a read comes
+	// in and corresponds to a hole, we send the read to
+	// the read file (the lower_fd). If a read comes in
+	// and partially overlaps with a hole, then we copy
+	// data from the read file to the write_fd first,
 	// then return the write_fd. When a write comes in,
 	// we always send the write to the write_fd and
 	// update the write_map appropriately to remove any
-	// holes that might be there.
+	// holes that might be there. (See writemap.go).
 	//
 	// NOTE: The write files are actually *sparse*
 	// copies on top of the read files. It's very
 	// important that tar -S is used to compress and
 	// uncompress bundles to have this maintained.
 	//
-	// type Hole struct {
-	//  start  uint64
-	//  length uint64
-	// }
-	//
-	// write_map []Hole
+	write_map []Hole
+	lower_fd  int
+
+	// Lock protecting the above.
+	// (This is taken with the RWMutex read-locked,
+	// so that both readers and writers may populate).
+	map_lock sync.Mutex
+
+	// Byte-range locks held by clients.
+	// (See dotl.go; these are only in memory).
+	locks      []Lock
+	locks_lock sync.Mutex
 
 	// Our RWMutex (protects r=>w transition).
 	sync.RWMutex
@@ -118,6 +131,8 @@ var P9ModeToMode = map[uint32]uint32{
 
 func (file *File) findPaths(fs *Fs, filepath string) {
 
+	file.overlay_path = filepath
+
 	// Figure out our write path first.
 	write_prefix := ""
 	write_backing_path := "."
@@ -156,38 +171,55 @@ func (file *File) findPaths(fs *Fs, filepath string) {
 			(!file.read_exists ||
 				len(prefix) > len(read_prefix)) {
 
-			for _, backing_path := range backing_paths {
+			// The layers are listed from the bottom up.
+			// The topmost layer with this file wins, and if
+			// it's deleted there that hides the layers below.
+			for i := len(backing_paths) - 1; i >= 0; i -= 1 {
+				backing_path := backing_paths[i]
 
 				// Does this file exist?
 				test_path := path.Join(backing_path, filepath[len(prefix):])
 				err := syscall.Lstat(test_path, &stat)
-				if err == nil {
-					// Check if it's deleted.
-					// NOTE: If we can't read the extended
-					// attributes on this file, we can assume
-					// that it is not deleted.
-					deleted, _ := readdelattr(test_path)
-					if !deleted {
-						read_prefix = prefix
-						read_backing_path = backing_path
-						file.read_exists = true
-						if !file.write_deleted && !file.write_exists {
-							file.mode = stat.Mode
-						}
+				if err != nil {
+					continue
+				}
+
+				// Check if it's deleted.
+				// NOTE: If we can't read the extended
+				// attributes on this file, we can assume
+				// that it is not deleted.
+				deleted, _ := readdelattr(test_path)
+				if !deleted {
+					read_prefix = prefix
+					read_backing_path = backing_path
+					file.read_exists = true
+					if !file.write_deleted && !file.write_exists {
+						file.mode = stat.Mode
 					}
 				}
+				break
 			}
 		}
 	}
 	file.read_path = path.Join(
 		read_backing_path,
 		filepath[len(read_prefix):])
+
+	// Pick up any holes in the write file.
+	// (These only make sense over a read file).
+	file.map_lock.Lock()
+	file.write_map = nil
+	if file.write_exists && !file.write_deleted && file.read_exists &&
+		file.mode&syscall.S_IFMT == syscall.S_IFREG {
+		file.write_map = loadWriteMap(file.write_path)
+	}
+	file.map_lock.Unlock()
 }
 
 func (fs *Fs) lookup(path string) (*File, error) {
 
 	// Normalize path.
-	if len(path) > 0 && path[len(path)-1] == '/' {
+	if len(path) > 1 && path[len(path)-1] == '/' {
 		path = path[:len(path)-1]
 	}
 
@@ -196,6 +228,7 @@ func (fs *Fs) lookup(path string) (*File, error) {
 	if ok {
 		atomic.AddInt32(&file.refs, 1)
 		fs.filesLock.RUnlock()
+		fs.check(file, path)
 		return file, nil
 	}
 	fs.filesLock.RUnlock()
@@ -381,6 +414,11 @@ func (file *File) unlink() error {
 	file.write_exists = false
 	file.write_deleted = false
 
+	// Nothing left to copy up.
+	file.map_lock.Lock()
+	file.write_map = nil
+	file.map_lock.Unlock()
+
 	return nil
 }
 
@@ -424,6 +462,26 @@ func (file *File) remove(
 	file.write_exists = true
 	file.write_deleted = true
 
+	// Any open descriptors refer to what was removed.
+	// (If the file is created again, it's a new one).
+	if file.read_fd != -1 {
+		syscall.Close(file.read_fd)
+	}
+	if file.write_fd != -1 &&
+		file.write_fd != file.read_fd {
+		syscall.Close(file.write_fd)
+	}
+	file.read_fd = -1
+	file.write_fd = -1
+
+	// (The map was cleared by unlink above).
+	file.map_lock.Lock()
+	if file.lower_fd != -1 {
+		syscall.Close(file.lower_fd)
+	}
+	file.lower_fd = -1
+	file.map_lock.Unlock()
+
 	return nil
 }
 
@@ -539,24 +597,75 @@ func (file *File) create(
 	return nil
 }
 
+//
+// Create something other than a regular file or directory
+// (i.e. a symlink, device or hard link) in the write layer,
+// using the given function to make it at the write path.
+//
+func (file *File) createWith(
+	fs *Fs,
+	path string,
+	make_fn func(write_path string) error) error {
+
+	file.RWMutex.Lock()
+	defer file.RWMutex.Unlock()
+
+	if file.exists() {
+		return Eexist
+	}
+
+	if file.write_exists && file.write_deleted {
+		// Is it just marked deleted?
+		err := file.unlink()
+		if err != nil {
+			return err
+		}
+	}
+
+	// Make sure the parent exists.
+	err := file.makeTree(fs, path)
+	if err != nil {
+		return err
+	}
+
+	err = make_fn(file.write_path)
+	if err != nil {
+		return err
+	}
+
+	var stat syscall.Stat_t
+	err = syscall.Lstat(file.write_path, &stat)
+	if err != nil {
+		return err
+	}
+
+	// We now exist.
+	file.mode = stat.Mode
+	file.write_exists = true
+	return file.fillType(file.write_path)
+}
+
 func (file *File) rename(
 	fs *Fs,
 	orig_path string,
 	new_path string) error {
 
 	fs.filesLock.Lock()
-	defer fs.filesLock.Unlock()
 
 	other_file, ok := fs.files[new_path]
 	if ok && other_file.exists() {
+		fs.filesLock.Unlock()
 		return Eexist
 	}
 
-	// Drop the original reference.
-	// (We've not replaced it atomically).
+	// Hold a reference to the original until we're
+	// done swapping fids. This is dropped after the
+	// lock is released, since it may be the last one.
 	if other_file != nil {
+		atomic.AddInt32(&other_file.refs, 1)
 		defer other_file.DecRef(fs, "")
 	}
+	defer fs.filesLock.Unlock()
 
 	if file.write_exists && file.write_deleted {
 		// Is it just marked deleted?
@@ -566,11 +675,36 @@ func (file *File) rename(
 		}
 	}
 
+	// Any holes are relative to our current read
+	// file, so they need to be filled before we go.
+	// (As do any in the files beneath a directory).
+	err := file.fillHoles()
+	if err != nil {
+		return err
+	}
+	if file.write_exists && file.mode&syscall.S_IFMT == syscall.S_IFDIR {
+		err = fs.fillTree(orig_path, file.write_path)
+		if err != nil {
+			return err
+		}
+	}
+
 	// Try the rename.
 	orig_read_path := file.read_path
+	orig_read_exists := file.read_exists
 	orig_write_path := file.write_path
 	file.findPaths(fs, new_path)
-	err := syscall.Rename(orig_write_path, file.write_path)
+	if file.write_deleted {
+		// Clear the record of whatever was here.
+		err := file.unlink()
+		if err != nil {
+			file.read_path = orig_read_path
+			file.write_path = orig_write_path
+			file.overlay_path = orig_path
+			return err
+		}
+	}
+	err = syscall.Rename(orig_write_path, file.write_path)
 	if err != nil {
 		if err == syscall.EXDEV {
 			// TODO: The file cannot be renamed across file system.
@@ -581,6 +715,7 @@ func (file *File) rename(
 
 		file.read_path = orig_read_path
 		file.write_path = orig_write_path
+		file.overlay_path = orig_path
 		return err
 	}
 
@@ -615,6 +750,12 @@ func (file *File) rename(
 	// This is done at the very end, since there's
 	// really nothing we can do at this point. We
 	// even explicitly ignore the result. Ugh.
+	// (If it was in a read layer, we need something
+	// to record on, as per remove() above).
+	if orig_read_exists {
+		mode := (syscall.S_IFDIR | syscall.S_IRUSR | syscall.S_IWUSR | syscall.S_IXUSR)
+		syscall.Mkdir(orig_write_path, uint32(mode))
+	}
 	setdelattr(orig_write_path)
 
 	return nil
@@ -643,11 +784,6 @@ func (file *File) lockWrite(fs *Fs) error {
 
 	// Make sure the file exists.
 	if !file.write_exists || file.write_deleted {
-		// NOTE: It would be really great to handle
-		// all these writes as simply overlays and keep
-		// a map of all the sparse holes in the file.
-		// See above with the write_map, for now I'll
-		// leave this for future work.
 		if file.write_deleted {
 			// Remove the file.
 			file.unlink()
@@ -659,22 +795,25 @@ func (file *File) lockWrite(fs *Fs) error {
 		} else if !file.read_exists {
 			// This is a fresh file.
 			// It doesn't exist in any read layer.
+			err := file.makeTree(fs, file.overlay_path)
+			if err != nil {
+				file.RWMutex.Unlock()
+				return err
+			}
 			mode |= syscall.O_CREAT | syscall.O_RDWR
 			perm |= syscall.S_IRUSR | syscall.S_IWUSR | syscall.S_IXUSR
 			file.write_exists = true
 
 		} else {
 			// Not deleted && read_exists.
-			// We grab a memory map and write out
-			// a copy of the new file. This could
-			// be made much more efficient (per above).
-			data, err := ioutil.ReadFile(file.read_path)
+			// We make a sparse copy of the file,
+			// which is populated as it's used.
+			err := file.makeTree(fs, file.overlay_path)
 			if err != nil {
 				file.RWMutex.Unlock()
 				return err
 			}
-			perm |= syscall.S_IRUSR | syscall.S_IWUSR | syscall.S_IXUSR
-			err = ioutil.WriteFile(file.write_path, data, os.FileMode(perm))
+			err = file.copyUp()
 			if err != nil {
 				file.RWMutex.Unlock()
 				return err
@@ -703,6 +842,60 @@ func (file *File) lockWrite(fs *Fs) error {
 	return file.lockWrite(fs)
 }
 
+//
+// Make a sparse copy of the read file.
+// (The RWMutex must be held exclusively).
+//
+func (file *File) copyUp() error {
+
+	var stat syscall.Stat_t
+	err := syscall.Lstat(file.read_path, &stat)
+	if err != nil {
+		return err
+	}
+	if stat.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		// Nothing to be sparse about.
+		data, err := ioutil.ReadFile(file.read_path)
+		if err != nil {
+			return err
+		}
+		perm := syscall.S_IRUSR | syscall.S_IWUSR | syscall.S_IXUSR
+		return ioutil.WriteFile(file.write_path, data, os.FileMode(perm))
+	}
+
+	fd, err := syscall.Open(
+		file.write_path,
+		syscall.O_RDWR|syscall.O_CREAT|syscall.O_TRUNC|syscall.O_CLOEXEC,
+		syscall.S_IRUSR|syscall.S_IWUSR)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	// Keep the same attributes. (We still need
+	// to be able to write, and the owner is only
+	// best effort, as per the rest of the layer).
+	err = syscall.Fchmod(fd, (stat.Mode&07777)|syscall.S_IRUSR|syscall.S_IWUSR)
+	if err != nil {
+		return err
+	}
+	syscall.Fchown(fd, int(stat.Uid), int(stat.Gid))
+
+	err = syscall.Ftruncate(fd, stat.Size)
+	if err != nil {
+		return err
+	}
+
+	// It's all one big hole.
+	file.map_lock.Lock()
+	defer file.map_lock.Unlock()
+	file.write_map = nil
+	if stat.Size > 0 {
+		file.write_map = []Hole{Hole{0, uint64(stat.Size)}}
+	}
+	return file.saveWriteMap()
+}
+
 func (file *File) lockRead(fs *Fs) error {
 
 	file.RWMutex.RLock()
@@ -728,8 +921,13 @@ func (file *File) lockRead(fs *Fs) error {
 	}
 
 	// Okay, no write available.
-	// Let's open our read path.
-	new_fd, err := syscall.Open(file.read_path, syscall.O_RDONLY, 0)
+	// Let's open whichever is on top. (Any holes
+	// in the write file are handled by readFd()).
+	open_path := file.read_path
+	if file.write_exists && !file.write_deleted {
+		open_path = file.write_path
+	}
+	new_fd, err := syscall.Open(open_path, syscall.O_RDONLY|syscall.O_CLOEXEC, 0)
 	if err != nil {
 		file.RWMutex.Unlock()
 		return err
@@ -746,7 +944,14 @@ func (file *File) lockRead(fs *Fs) error {
 func (file *File) flush() {
 	file.RWMutex.Lock()
 	defer file.RWMutex.Unlock()
+	file.closeFds()
+}
 
+//
+// Close all our descriptors.
+// (The RWMutex must be held exclusively).
+//
+func (file *File) closeFds() {
 	// Close the file if still opened.
 	if file.read_fd != -1 {
 		syscall.Close(file.read_fd)
@@ -759,6 +964,13 @@ func (file *File) flush() {
 		syscall.Close(file.write_fd)
 	}
 
+	file.map_lock.Lock()
+	if file.lower_fd != -1 {
+		syscall.Close(file.lower_fd)
+	}
+	file.lower_fd = -1
+	file.map_lock.Unlock()
+
 	file.read_fd = -1
 	file.write_fd = -1
 }
@@ -808,6 +1020,7 @@ func (file *File) dir(
 	dir.Uidnum = stat.Uid
 	dir.Gidnum = stat.Gid
 	dir.Muidnum = stat.Uid
+	dir.rawmode = stat.Mode
 
 	for mask, type_bit := range ModeToP9Type {
 		if stat.Mode&mask == mask {
@@ -926,7 +1139,8 @@ func (file *File) DecRef(fs *Fs, path string) {
 		}
 
 		// Remove this file.
-		if path != "" {
+		// (Unless it's been replaced by a rename).
+		if path != "" && fs.files[path] == file {
 			delete(fs.files, path)
 		}
 		fs.filesLock.Unlock()
@@ -961,9 +1175,12 @@ func (fs *Fs) NewFile(path string) (*File, error) {
 	// Reset our FDs.
 	file.read_fd = -1
 	file.write_fd = -1
+	file.lower_fd = -1
 
 	file.Qid.Version = 0
 	file.Qid.Path = atomic.AddUint64(&fs.Fileid, 1)
+	file.stamp = file.currentStamp()
+	file.checked = time.Now()
 
 	if file.exists() {
 		return file, file.fillType(path)
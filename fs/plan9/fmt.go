@@ -187,6 +187,131 @@ func (fc *Fcall) String() string {
 		ret = fmt.Sprintf(
 			"Rwstat tag %d",
 			fc.Tag)
+	case Rlerror:
+		ret = fmt.Sprintf(
+			"Rlerror tag %d ecode %d",
+			fc.Tag, fc.Errornum)
+	case Tstatfs:
+		ret = fmt.Sprintf(
+			"Tstatfs tag %d fid %x",
+			fc.Tag, fc.Fid)
+	case Rstatfs:
+		ret = fmt.Sprintf(
+			"Rstatfs tag %d type %x bsize %d blocks %d bfree %d files %d ffree %d",
+			fc.Tag, fc.Statfs.Type, fc.Statfs.Bsize, fc.Statfs.Blocks,
+			fc.Statfs.Bfree, fc.Statfs.Files, fc.Statfs.Ffree)
+	case Tlopen:
+		ret = fmt.Sprintf(
+			"Tlopen tag %d fid %x flags %x",
+			fc.Tag, fc.Fid, fc.Flags)
+	case Rlopen:
+		ret = fmt.Sprintf(
+			"Rlopen tag %d qid %v iounit %d",
+			fc.Tag, &fc.Qid, fc.Iounit)
+	case Tlcreate:
+		ret = fmt.Sprintf(
+			"Tlcreate tag %d fid %x name '%s' flags %x mode %o gid %d",
+			fc.Tag, fc.Fid, fc.Name, fc.Flags, fc.Perm, fc.Egid)
+	case Rlcreate:
+		ret = fmt.Sprintf(
+			"Rlcreate tag %d qid %v iounit %d",
+			fc.Tag, &fc.Qid, fc.Iounit)
+	case Tsymlink:
+		ret = fmt.Sprintf(
+			"Tsymlink tag %d fid %x name '%s' target '%s' gid %d",
+			fc.Tag, fc.Fid, fc.Name, fc.Target, fc.Egid)
+	case Tmknod:
+		ret = fmt.Sprintf(
+			"Tmknod tag %d fid %x name '%s' mode %o major %d minor %d gid %d",
+			fc.Tag, fc.Fid, fc.Name, fc.Perm, fc.Major, fc.Minor, fc.Egid)
+	case Rsymlink, Rmknod, Rmkdir:
+		ret = fmt.Sprintf(
+			"R%d tag %d qid %v",
+			fc.Type, fc.Tag, &fc.Qid)
+	case Trename:
+		ret = fmt.Sprintf(
+			"Trename tag %d fid %x dfid %x name '%s'",
+			fc.Tag, fc.Fid, fc.Dfid, fc.Name)
+	case Treadlink:
+		ret = fmt.Sprintf(
+			"Treadlink tag %d fid %x",
+			fc.Tag, fc.Fid)
+	case Rreadlink:
+		ret = fmt.Sprintf(
+			"Rreadlink tag %d target '%s'",
+			fc.Tag, fc.Target)
+	case Tgetattr:
+		ret = fmt.Sprintf(
+			"Tgetattr tag %d fid %x mask %x",
+			fc.Tag, fc.Fid, fc.Mask)
+	case Rgetattr:
+		ret = fmt.Sprintf(
+			"Rgetattr tag %d valid %x qid %v mode %o uid %d gid %d size %d",
+			fc.Tag, fc.Mask, &fc.Qid, fc.Attr.Mode,
+			fc.Attr.Uid, fc.Attr.Gid, fc.Attr.Size)
+	case Tsetattr:
+		ret = fmt.Sprintf(
+			"Tsetattr tag %d fid %x valid %x mode %o uid %d gid %d size %d",
+			fc.Tag, fc.Fid, fc.Valid, fc.Attr.Mode,
+			fc.Attr.Uid, fc.Attr.Gid, fc.Attr.Size)
+	case Txattrwalk:
+		ret = fmt.Sprintf(
+			"Txattrwalk tag %d fid %x newfid %x name '%s'",
+			fc.Tag, fc.Fid, fc.Newfid, fc.Name)
+	case Rxattrwalk:
+		ret = fmt.Sprintf(
+			"Rxattrwalk tag %d size %d",
+			fc.Tag, fc.Xattrsize)
+	case Txattrcreate:
+		ret = fmt.Sprintf(
+			"Txattrcreate tag %d fid %x name '%s' size %d flags %x",
+			fc.Tag, fc.Fid, fc.Name, fc.Xattrsize, fc.Flags)
+	case Treaddir:
+		ret = fmt.Sprintf(
+			"Treaddir tag %d fid %x offset %d count %d",
+			fc.Tag, fc.Fid, fc.Offset, fc.Count)
+	case Rreaddir:
+		ret = fmt.Sprintf(
+			"Rreaddir tag %d count %d",
+			fc.Tag, fc.Count)
+	case Tfsync:
+		ret = fmt.Sprintf(
+			"Tfsync tag %d fid %x datasync %d",
+			fc.Tag, fc.Fid, fc.Datasync)
+	case Tlock, Tgetlock:
+		ret = fmt.Sprintf(
+			"T%d tag %d fid %x type %d flags %x start %d length %d proc %d client '%s'",
+			fc.Type, fc.Tag, fc.Fid, fc.Lock.Type, fc.Lock.Flags,
+			fc.Lock.Start, fc.Lock.Length, fc.Lock.Procid, fc.Lock.Clientid)
+	case Rlock:
+		ret = fmt.Sprintf(
+			"Rlock tag %d status %d",
+			fc.Tag, fc.Status)
+	case Rgetlock:
+		ret = fmt.Sprintf(
+			"Rgetlock tag %d type %d start %d length %d proc %d client '%s'",
+			fc.Tag, fc.Lock.Type, fc.Lock.Start, fc.Lock.Length,
+			fc.Lock.Procid, fc.Lock.Clientid)
+	case Tlink:
+		ret = fmt.Sprintf(
+			"Tlink tag %d dfid %x fid %x name '%s'",
+			fc.Tag, fc.Dfid, fc.Fid, fc.Name)
+	case Tmkdir:
+		ret = fmt.Sprintf(
+			"Tmkdir tag %d fid %x name '%s' mode %o gid %d",
+			fc.Tag, fc.Fid, fc.Name, fc.Perm, fc.Egid)
+	case Trenameat:
+		ret = fmt.Sprintf(
+			"Trenameat tag %d fid %x name '%s' dfid %x newname '%s'",
+			fc.Tag, fc.Fid, fc.Name, fc.Dfid, fc.Newname)
+	case Tunlinkat:
+		ret = fmt.Sprintf(
+			"Tunlinkat tag %d fid %x name '%s' flags %x",
+			fc.Tag, fc.Fid, fc.Name, fc.Flags)
+	case Rrename, Rsetattr, Rxattrcreate, Rfsync, Rlink, Rrenameat, Runlinkat:
+		ret = fmt.Sprintf(
+			"R%d tag %d",
+			fc.Type, fc.Tag)
 	default:
 		ret = fmt.Sprintf(
 			"invalid call: %d",
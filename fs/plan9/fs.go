@@ -17,6 +17,7 @@ package plan9
 import (
 	"encoding/json"
 	"log"
+	"os"
 	"sync"
 	"syscall"
 )
@@ -40,6 +41,9 @@ type Fs struct {
 	// are we speaking 9P2000.u?
 	Dotu bool `json:"dotu"`
 
+	// are we speaking 9P2000.L?
+	Dotl bool `json:"dotl"`
+
 	// open FiDs.
 	Pool Fidpool `json:"pool"`
 
@@ -50,6 +54,10 @@ type Fs struct {
 	fidLock sync.RWMutex
 	fidCond *sync.Cond
 
+	// Held (shared) for every request, and held
+	// exclusively while the layers are changed.
+	layerLock sync.RWMutex
+
 	// Our open files.
 	// This is not serialized.
 	files map[string]*File
@@ -72,20 +80,46 @@ type Fs struct {
 
 	// Our file descriptor limits.
 	Fdlimit uint `json:"fdlimit"`
+
+	// How we notice changes on the host.
+	Coherency Coherency `json:"coherency"`
+
+	// How long files are trusted (in ms).
+	// This applies to the timeout mode only.
+	CoherencyTimeout uint `json:"coherency-timeout"`
+
+	// Our layer watches (strict mode).
+	watcher *watcher
 }
 
 func (fs *Fs) error(buf Buffer, tag uint16, err error) error {
 
 	// Was there an error?
 	// If so, encode it properly.
-	int_err, ok := err.(*Error)
-	if ok {
+	errstr := err.Error()
+	errornum := uint32(syscall.EIO)
+	switch int_err := err.(type) {
+	case *Error:
 		// We have a specific error code.
-		return PackRerror(buf, tag, int_err.Err, int_err.Errornum, fs.Dotu)
+		errstr = int_err.Err
+		errornum = int_err.Errornum
+	case syscall.Errno:
+		errornum = uint32(int_err)
+	case *os.PathError:
+		if errno, ok := int_err.Err.(syscall.Errno); ok {
+			errornum = uint32(errno)
+		}
+	case *os.LinkError:
+		if errno, ok := int_err.Err.(syscall.Errno); ok {
+			errornum = uint32(errno)
+		}
 	}
 
-	// This is a generic error.
-	return PackRerror(buf, tag, err.Error(), uint32(syscall.EIO), fs.Dotu)
+	// 9P2000.L has only the code.
+	if fs.Dotl {
+		return PackRlerror(buf, tag, errornum)
+	}
+	return PackRerror(buf, tag, errstr, errornum, fs.Dotu)
 }
 
 func (fs *Fs) wait(tag uint16) {
@@ -107,9 +141,14 @@ func (fs *Fs) Handle(req Buffer, resp Buffer, debug bool) error {
 
 	var fid *Fid
 	var afid *Fid
+	var dfid *Fid
+
+	// Keep the layers as they are.
+	fs.layerLock.RLock()
+	defer fs.layerLock.RUnlock()
 
 	// Unpack our message.
-	fcall, err := Unpack(req, fs.Dotu)
+	fcall, err := Unpack(req, fs.Dotu || fs.Dotl)
 	if err != nil {
 		log.Printf("9pfs serialization error?")
 		err = fs.error(resp, NOTAG, err)
@@ -157,18 +196,27 @@ func (fs *Fs) Handle(req Buffer, resp Buffer, debug bool) error {
 		}
 		defer afid.DecRef(fs)
 	}
+	if fcall.Dfid != NOFID {
+		dfid = fs.GetFid(fcall.Dfid)
+		if dfid == nil {
+			err = fs.error(resp, fcall.Tag, Eunknownfid)
+			goto done
+		}
+		defer dfid.DecRef(fs)
+	}
 
 	switch fcall.Type {
 	case Tversion:
 		var msize uint32
 		var dotu bool
+		var dotl bool
 		var version string
-		msize, dotu, version, err = fs.version(fcall.Msize, fcall.Version)
+		msize, dotu, dotl, version, err = fs.version(fcall.Msize, fcall.Version)
 		if err == nil {
 			err = PackRversion(resp, fcall.Tag, msize, version)
 		}
 		if err == nil {
-			fs.versionPost(msize, dotu)
+			fs.versionPost(msize, dotu, dotl)
 		}
 
 	case Tauth:
@@ -228,6 +276,16 @@ func (fs *Fs) Handle(req Buffer, resp Buffer, debug bool) error {
 		if fid == nil {
 			err = Eunknownfid
 
+		} else if fid.Xattr {
+
+			// Reading an xattr value (or list).
+			data := fs.readXattr(fid, fcall.Offset, fcall.Count)
+			err = PackRread(resp, fcall.Tag, uint32(len(data)))
+			if err == nil {
+				resp.WriteBytes(data)
+				err = checkBuffer(resp)
+			}
+
 		} else if fid.file.Qid.Type&QTDIR != 0 {
 
 			var children []*Dir
@@ -300,6 +358,15 @@ func (fs *Fs) Handle(req Buffer, resp Buffer, debug bool) error {
 		if fid == nil {
 			err = Eunknownfid
 
+		} else if fid.Xattr {
+
+			// Writing an xattr value.
+			data := req.ReadBytes(int(fcall.Count))
+			err = fs.writeXattr(fid, fcall.Offset, data)
+			if err == nil {
+				err = PackRwrite(resp, fcall.Tag, uint32(len(data)))
+			}
+
 		} else if fid.file.Qid.Type&QTDIR != 0 {
 			err = Ebaduse
 
@@ -307,23 +374,24 @@ func (fs *Fs) Handle(req Buffer, resp Buffer, debug bool) error {
 
 			var fd int
 			var length int
+			var filling bool
 
-			fd, err = fs.writeFile(fid, int64(fcall.Offset), int(fcall.Count))
+			fd, filling, err = fs.writeFile(fid, int64(fcall.Offset), int(fcall.Count))
 			if err == nil {
 				err = PackRwrite(resp, fcall.Tag, 0)
-			}
-			if err == nil {
-				// Perform the actual write.
-				length, err = req.WriteToFd(fd, int64(fcall.Offset), int(fcall.Count))
+				if err == nil {
+					// Perform the actual write.
+					length, err = req.WriteToFd(fd, int64(fcall.Offset), int(fcall.Count))
+				}
 				if err == nil {
 					// Repack with the appropriate count.
 					err = PackRwrite(resp, fcall.Tag, uint32(length))
 				}
-			}
-			if err == nil {
-				fs.writeFilePost(fid, uint32(length))
-			} else {
-				fs.writeFileFail(fid, uint32(length))
+				if err == nil {
+					fs.writeFilePost(fid, fcall.Offset, uint32(length), filling)
+				} else {
+					fs.writeFileFail(fid, fcall.Offset, uint32(length), filling)
+				}
 			}
 		}
 
@@ -332,9 +400,8 @@ func (fs *Fs) Handle(req Buffer, resp Buffer, debug bool) error {
 		if err == nil {
 			err = PackRclunk(resp, fcall.Tag)
 		}
-		if err == nil {
-			fs.clunkPost(fid)
-		}
+		// The fid is gone, regardless.
+		fs.clunkPost(fid)
 
 	case Tremove:
 		err = fs.remove(fid)
@@ -364,6 +431,167 @@ func (fs *Fs) Handle(req Buffer, resp Buffer, debug bool) error {
 			fs.wstatFail(fid, dir, &fcall.Dir)
 		}
 
+	case Tstatfs:
+		var st *Statfs
+		st, err = fs.statfs(fid)
+		if err == nil {
+			err = PackRstatfs(resp, fcall.Tag, st)
+		}
+
+	case Tlopen:
+		var qid *Qid
+		var iounit uint32
+		qid, iounit, err = fs.lopen(fid, fcall.Flags)
+		if err == nil {
+			err = PackRlopen(resp, fcall.Tag, qid, iounit)
+		}
+		if err == nil {
+			fs.lopenPost(fid, fcall.Flags)
+		}
+
+	case Tlcreate:
+		var file *File
+		var qid *Qid
+		var iounit uint32
+		file, qid, iounit, err = fs.lcreate(fid, fcall.Name, fcall.Flags, fcall.Perm, fcall.Egid)
+		if err == nil {
+			err = PackRlcreate(resp, fcall.Tag, qid, iounit)
+		}
+		if err == nil {
+			fs.createPost(fid, file, fcall.Name, lopenMode(fcall.Flags))
+		} else {
+			fs.createFail(fid, file, fcall.Name, lopenMode(fcall.Flags))
+		}
+
+	case Tsymlink:
+		var qid *Qid
+		qid, err = fs.symlink(fid, fcall.Name, fcall.Target, fcall.Egid)
+		if err == nil {
+			err = PackRsymlink(resp, fcall.Tag, qid)
+		}
+
+	case Tmknod:
+		var qid *Qid
+		qid, err = fs.mknod(fid, fcall.Name, fcall.Perm, fcall.Major, fcall.Minor, fcall.Egid)
+		if err == nil {
+			err = PackRmknod(resp, fcall.Tag, qid)
+		}
+
+	case Tmkdir:
+		var qid *Qid
+		qid, err = fs.mkdir(fid, fcall.Name, fcall.Perm, fcall.Egid)
+		if err == nil {
+			err = PackRmkdir(resp, fcall.Tag, qid)
+		}
+
+	case Trename:
+		err = fs.renameTo(fid, dfid, fcall.Name)
+		if err == nil {
+			err = PackRrename(resp, fcall.Tag)
+		}
+
+	case Trenameat:
+		err = fs.renameat(fid, fcall.Name, dfid, fcall.Newname)
+		if err == nil {
+			err = PackRrenameat(resp, fcall.Tag)
+		}
+
+	case Tunlinkat:
+		err = fs.unlinkat(fid, fcall.Name, fcall.Flags)
+		if err == nil {
+			err = PackRunlinkat(resp, fcall.Tag)
+		}
+
+	case Tlink:
+		err = fs.link(dfid, fid, fcall.Name)
+		if err == nil {
+			err = PackRlink(resp, fcall.Tag)
+		}
+
+	case Treadlink:
+		var target string
+		target, err = fs.readlink(fid)
+		if err == nil {
+			err = PackRreadlink(resp, fcall.Tag, target)
+		}
+
+	case Tgetattr:
+		var valid uint64
+		var attr *Attr
+		valid, attr, err = fs.getattr(fid, fcall.Mask)
+		if err == nil {
+			err = PackRgetattr(resp, fcall.Tag, valid, &fid.file.Qid, attr)
+		}
+
+	case Tsetattr:
+		err = fs.setattr(fid, fcall.Valid, &fcall.Attr)
+		if err == nil {
+			err = PackRsetattr(resp, fcall.Tag)
+		}
+
+	case Txattrwalk:
+		var size uint64
+		size, err = fs.xattrwalk(fid, fcall.Newfid, fcall.Name)
+		if err == nil {
+			err = PackRxattrwalk(resp, fcall.Tag, size)
+		}
+
+	case Txattrcreate:
+		err = fs.xattrcreate(fid, fcall.Name, fcall.Xattrsize, fcall.Flags)
+		if err == nil {
+			err = PackRxattrcreate(resp, fcall.Tag)
+		}
+
+	case Treaddir:
+		var children []*Dir
+		var written int
+
+		children, err = fs.readDirL(fid, fcall.Offset)
+		if err == nil {
+			// Pack with no count.
+			err = PackRreaddir(resp, fcall.Tag, 0)
+		}
+		if err == nil {
+			// Pack as many entries as will fit.
+			for i, child := range children {
+				size := direntsz(child)
+				if written+size > int(fcall.Count) ||
+					resp.WriteLeft() < size {
+					break
+				}
+				if debug {
+					log.Printf(
+						"fid %x child[%d] -> %s",
+						fcall.Fid,
+						fcall.Offset+uint64(i),
+						child.Name)
+				}
+				written += pdirent(resp, child, fcall.Offset+uint64(i)+1)
+			}
+			// Repack with the appropriate count.
+			err = PackRreaddir(resp, fcall.Tag, uint32(written))
+		}
+
+	case Tfsync:
+		err = fs.fsync(fid, fcall.Datasync != 0)
+		if err == nil {
+			err = PackRfsync(resp, fcall.Tag)
+		}
+
+	case Tlock:
+		var status uint8
+		status, err = fs.lock(fid, &fcall.Lock)
+		if err == nil {
+			err = PackRlock(resp, fcall.Tag, status)
+		}
+
+	case Tgetlock:
+		var lock *Lock
+		lock, err = fs.getlock(fid, &fcall.Lock)
+		if err == nil {
+			err = PackRgetlock(resp, fcall.Tag, lock)
+		}
+
 	default:
 		err = InvalidMessage
 	}
@@ -377,7 +605,7 @@ func (fs *Fs) Handle(req Buffer, resp Buffer, debug bool) error {
 done:
 	if debug {
 		resp.ReadRewind()
-		rcall, err := Unpack(resp, fs.Dotu)
+		rcall, err := Unpack(resp, fs.Dotu || fs.Dotl)
 		if err != nil {
 			log.Printf("9pfs response error? req: Fcall -> %s", fcall.String())
 			return err
@@ -449,6 +677,22 @@ func (fs *Fs) Attach() error {
 		fs.Fdlimit = uint(rlim.Cur) / 2
 	}
 
+	switch fs.Coherency {
+	case "":
+		fs.Coherency = CoherencyNone
+	case CoherencyNone, CoherencyTimeout:
+	case CoherencyStrict:
+		err = fs.startWatcher()
+		if err != nil {
+			return err
+		}
+	default:
+		return BadCoherency
+	}
+	if fs.CoherencyTimeout == 0 {
+		fs.CoherencyTimeout = DefaultCoherencyTimeout
+	}
+
 	return nil
 }
 
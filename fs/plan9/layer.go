@@ -0,0 +1,375 @@
+package plan9
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+//
+// Write layer changes --
+//
+// Everything the guest does lands in the write layer,
+// so that is a complete record of what has changed
+// relative to the read layers beneath it. A deletion
+// is recorded as a marked directory (see xattr.go),
+// which we report (and export) as a whiteout.
+//
+
+const (
+	ChangeAdded    = "added"
+	ChangeModified = "modified"
+	ChangeDeleted  = "deleted"
+)
+
+//
+// Whiteouts in exported archives use the
+// usual convention (i.e. as docker & OCI).
+//
+const WhiteoutPrefix = ".wh."
+
+type Change struct {
+	// The path (as the guest sees it).
+	Path string `json:"path"`
+
+	// What happened.
+	Kind string `json:"kind"`
+}
+
+func (fs *Fs) writePrefixes() []string {
+	prefixes := make([]string, 0, len(fs.Write))
+	for prefix, _ := range fs.Write {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	return prefixes
+}
+
+//
+// Walk every entry in the write layer.
+//
+// The kind is empty for directories which are only
+// there to hold changes beneath them. Deleted entries
+// are not descended into (they're just markers).
+//
+func (fs *Fs) walkWrite(
+	walk_fn func(
+		guest_path string,
+		file *File,
+		info os.FileInfo,
+		kind string) error) error {
+
+	for _, prefix := range fs.writePrefixes() {
+		backing_path := fs.Write[prefix]
+
+		err := filepath.Walk(backing_path, func(
+			write_path string,
+			info os.FileInfo,
+			err error) error {
+
+			if err != nil {
+				return err
+			}
+			if write_path == backing_path {
+				return nil
+			}
+			guest_path := path.Join(prefix, write_path[len(backing_path):])
+
+			// Find out what's in the layers.
+			file := new(File)
+			file.read_fd = -1
+			file.write_fd = -1
+			file.lower_fd = -1
+			file.findPaths(fs, guest_path)
+			defer file.flush()
+			if file.write_path != path.Clean(write_path) {
+				// This is under another write mapping.
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+
+			if file.write_deleted {
+				// Was there anything to delete?
+				if file.read_exists {
+					err = walk_fn(guest_path, file, info, ChangeDeleted)
+				}
+				if err == nil && info.IsDir() {
+					err = filepath.SkipDir
+				}
+				return err
+			}
+
+			kind := ChangeAdded
+			if file.read_exists {
+				kind = ChangeModified
+				if info.IsDir() && sameAttrs(write_path, file.read_path) {
+					kind = ""
+				}
+			}
+			return walk_fn(guest_path, file, info, kind)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func sameAttrs(path1 string, path2 string) bool {
+	var stat1 syscall.Stat_t
+	var stat2 syscall.Stat_t
+	if syscall.Lstat(path1, &stat1) != nil ||
+		syscall.Lstat(path2, &stat2) != nil {
+		return false
+	}
+	return (stat1.Mode == stat2.Mode &&
+		stat1.Uid == stat2.Uid &&
+		stat1.Gid == stat2.Gid)
+}
+
+//
+// List everything changed in the write layer.
+//
+func (fs *Fs) Diff() ([]Change, error) {
+	fs.layerLock.RLock()
+	defer fs.layerLock.RUnlock()
+
+	changes := make([]Change, 0, 0)
+
+	err := fs.walkWrite(func(
+		guest_path string,
+		file *File,
+		info os.FileInfo,
+		kind string) error {
+
+		if kind != "" {
+			changes = append(changes, Change{guest_path, kind})
+		}
+		return nil
+	})
+
+	return changes, err
+}
+
+//
+// Write the write layer out as a tar archive.
+//
+// This includes all the directories leading to
+// changes, so that their attributes are preserved.
+// Deletions are written as (empty) whiteout files.
+//
+func (fs *Fs) Export(output io.Writer) error {
+	fs.layerLock.RLock()
+	defer fs.layerLock.RUnlock()
+
+	archive := tar.NewWriter(output)
+
+	err := fs.walkWrite(func(
+		guest_path string,
+		file *File,
+		info os.FileInfo,
+		kind string) error {
+
+		name := strings.TrimPrefix(guest_path, "/")
+
+		if kind == ChangeDeleted {
+			return archive.WriteHeader(&tar.Header{
+				Name:     path.Join(path.Dir(name), WhiteoutPrefix+path.Base(name)),
+				Typeflag: tar.TypeReg,
+				Mode:     0600,
+				ModTime:  info.ModTime(),
+			})
+		}
+
+		var link string
+		var err error
+		if info.Mode()&os.ModeSymlink != 0 {
+			link, err = os.Readlink(file.write_path)
+			if err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = name
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		err = archive.WriteHeader(header)
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+
+		data, err := os.Open(file.write_path)
+		if err != nil {
+			return err
+		}
+		defer data.Close()
+		var contents io.Reader = data
+
+		if len(file.write_map) > 0 {
+			// Fill in the holes.
+			lower, err := os.Open(file.read_path)
+			if err != nil {
+				return err
+			}
+			defer lower.Close()
+			contents = mergeHoles(data, lower, file.write_map, header.Size)
+		}
+
+		_, err = io.CopyN(archive, contents, header.Size)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return archive.Close()
+}
+
+//
+// Re-resolve all our files against the layers.
+// This is necessary after the layers have been
+// changed underneath us (by Reset or Commit).
+//
+func (fs *Fs) refresh() {
+
+	// The layers may have moved.
+	if fs.watcher != nil {
+		fs.stopWatcher()
+		fs.startWatcher()
+	}
+
+	// Grab the current files.
+	// (We don't hold the lock while we work on
+	// them, since a file lock is taken first
+	// elsewhere, e.g. in makeTree()).
+	fs.filesLock.RLock()
+	files := make(map[string]*File, len(fs.files))
+	for file_path, file := range fs.files {
+		files[file_path] = file
+	}
+	fs.filesLock.RUnlock()
+
+	for file_path, file := range files {
+		// Any descriptors refer to the old layers.
+		file.flush()
+
+		file.RWMutex.Lock()
+		file.findPaths(fs, file_path)
+		if file.exists() {
+			file.fillType(file_path)
+		}
+		file.RWMutex.Unlock()
+	}
+}
+
+//
+// Drop everything in the write layer.
+//
+// Requests are held off until this is done, but the
+// guest will see its changes vanish, so this should
+// only be done when the guest is paused (and has
+// nothing cached) or not using the files.
+//
+func (fs *Fs) Reset() error {
+	fs.layerLock.Lock()
+	defer fs.layerLock.Unlock()
+	defer fs.refresh()
+
+	for _, prefix := range fs.writePrefixes() {
+		backing_path := fs.Write[prefix]
+
+		entries, err := ioutil.ReadDir(backing_path)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			err = os.RemoveAll(path.Join(backing_path, entry.Name()))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+//
+// Move the write layer to target, and add it as the
+// top read layer. Each write mapping is moved beneath
+// target according to its prefix (so with the usual
+// single mapping for "/", target is the new layer).
+//
+// The guest's view of the files doesn't change, and
+// requests are held off until this is done.
+//
+// The target must be on the same filesystem as the
+// write layer, since the layer is simply renamed.
+//
+func (fs *Fs) Commit(target string) error {
+	fs.layerLock.Lock()
+	defer fs.layerLock.Unlock()
+	defer fs.refresh()
+
+	// The new layer mustn't depend on the ones
+	// beneath it, so we fill in any sparse copies.
+	err := fs.walkWrite(func(
+		guest_path string,
+		file *File,
+		info os.FileInfo,
+		kind string) error {
+
+		return file.fillHoles()
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, prefix := range fs.writePrefixes() {
+		backing_path := fs.Write[prefix]
+		layer_path := path.Join(target, prefix)
+
+		_, err := os.Lstat(layer_path)
+		if err == nil {
+			return Eexist
+		}
+
+		info, err := os.Stat(backing_path)
+		if err != nil {
+			return err
+		}
+		err = os.MkdirAll(path.Dir(layer_path), 0755)
+		if err != nil {
+			return err
+		}
+
+		// Swap in a fresh write layer.
+		err = os.Rename(backing_path, layer_path)
+		if link_err, ok := err.(*os.LinkError); ok && link_err.Err == syscall.EXDEV {
+			return Exdev
+		} else if err != nil {
+			return err
+		}
+		err = os.Mkdir(backing_path, info.Mode().Perm())
+		if err != nil {
+			return err
+		}
+
+		// Layers are listed bottom to top.
+		fs.Read[prefix] = append(fs.Read[prefix], layer_path)
+	}
+
+	return nil
+}
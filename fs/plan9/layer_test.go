@@ -0,0 +1,206 @@
+package plan9
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"testing"
+)
+
+//
+// A lower layer with a few files, and some changes
+// on top: one modified, one added, one deleted.
+//
+func makeChanges(t *testing.T) (*Fs, string, string) {
+	lower := t.TempDir()
+	upper := t.TempDir()
+	for _, name := range []string{"keep", "edit", "gone"} {
+		err := ioutil.WriteFile(filepath.Join(lower, name), []byte(name), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	fs := newTestFs(t, upper, lower)
+
+	edit, err := fs.Lookup("/edit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeAt(t, fs, edit, 4, []byte("ed"))
+
+	added, err := fs.Lookup("/new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := added.Create(fs, "/new", syscall.S_IFREG|0644); err != nil {
+		t.Fatal(err)
+	}
+	writeAt(t, fs, added, 0, []byte("new"))
+
+	gone, err := fs.Lookup("/gone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gone.Remove(fs, "/gone"); err != nil {
+		t.Fatal(err)
+	}
+
+	return fs, upper, lower
+}
+
+func checkContents(t *testing.T, fs *Fs, file_path string, expected string) {
+	file, err := fs.Lookup(file_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.DecRef(fs, file_path)
+	if expected == "" {
+		if file.Exists() {
+			t.Fatalf("%s: still exists", file_path)
+		}
+		return
+	}
+	if !file.Exists() {
+		t.Fatalf("%s: missing", file_path)
+	}
+	data := readAll(t, fs, file, 4096)
+	if string(data) != expected {
+		t.Fatalf("%s: got %q, expected %q", file_path, data, expected)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	fs, _, _ := makeChanges(t)
+
+	changes, err := fs.Diff()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(changes, func(i int, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	expected := []Change{
+		{"/edit", ChangeModified},
+		{"/gone", ChangeDeleted},
+		{"/new", ChangeAdded},
+	}
+	if len(changes) != len(expected) {
+		t.Fatalf("got %v, expected %v", changes, expected)
+	}
+	for i, change := range changes {
+		if change != expected[i] {
+			t.Fatalf("got %v, expected %v", changes, expected)
+		}
+	}
+}
+
+func TestExport(t *testing.T) {
+	fs, _, _ := makeChanges(t)
+
+	var output bytes.Buffer
+	if err := fs.Export(&output); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := make(map[string]string)
+	archive := tar.NewReader(&output)
+	for {
+		header, err := archive.Next()
+		if err != nil {
+			break
+		}
+		data, err := ioutil.ReadAll(archive)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			t.Fatalf("%s: unexpected type %c", header.Name, header.Typeflag)
+		}
+		entries[header.Name] = string(data)
+	}
+
+	// The modified file is complete (not just
+	// the blocks that were copied up), and the
+	// deletion is a whiteout.
+	expected := map[string]string{
+		"edit":                  "edited",
+		"new":                   "new",
+		WhiteoutPrefix + "gone": "",
+	}
+	if len(entries) != len(expected) {
+		t.Fatalf("got %v, expected %v", entries, expected)
+	}
+	for name, data := range expected {
+		if entries[name] != data {
+			t.Fatalf("%s: got %q, expected %q", name, entries[name], data)
+		}
+	}
+}
+
+func TestReset(t *testing.T) {
+	fs, upper, _ := makeChanges(t)
+
+	if err := fs.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ioutil.ReadDir(upper)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("write layer not empty")
+	}
+
+	// Files already looked up see the read layer.
+	checkContents(t, fs, "/edit", "edit")
+	checkContents(t, fs, "/gone", "gone")
+	checkContents(t, fs, "/new", "")
+}
+
+func TestCommit(t *testing.T) {
+	fs, upper, lower := makeChanges(t)
+	target := filepath.Join(t.TempDir(), "layer")
+
+	if err := fs.Commit(target); err != nil {
+		t.Fatal(err)
+	}
+	if len(fs.Read["/"]) != 2 || fs.Read["/"][1] != target {
+		t.Fatalf("layer not added: %v", fs.Read["/"])
+	}
+	entries, err := ioutil.ReadDir(upper)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("write layer not empty")
+	}
+
+	// Nothing appears to have changed, and
+	// the deletion hides the layer below.
+	changes, err := fs.Diff()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 0 {
+		t.Fatalf("changes left behind: %v", changes)
+	}
+	checkContents(t, fs, "/keep", "keep")
+	checkContents(t, fs, "/edit", "edited")
+	checkContents(t, fs, "/new", "new")
+	checkContents(t, fs, "/gone", "")
+
+	// The same again from scratch.
+	fs = newTestFs(t, upper, lower)
+	fs.Read["/"] = append(fs.Read["/"], target)
+	fs.refresh()
+	checkContents(t, fs, "/edit", "edited")
+	checkContents(t, fs, "/gone", "")
+
+	// A second commit can't reuse the target.
+	if err := fs.Commit(target); err != Eexist {
+		t.Fatalf("expected Eexist, got %v", err)
+	}
+}
@@ -10,24 +10,29 @@ import (
 
 func (fs *Fs) version(
 	msize uint32,
-	version string) (uint32, bool, string, error) {
+	version string) (uint32, bool, bool, string, error) {
 
 	// Cap the msize.
 	if msize < IOHDRSZ {
-		return 0, false, "", &Error{"msize too small", EINVAL}
+		return 0, false, false, "", &Error{"msize too small", EINVAL}
 	}
 
-	// We speak basic P9 or P9.u.
-	// TODO: Well we should defintiely be speaking fucking 9p2000.l
+	// We speak basic P9, P9.u or P9.L.
+	dotl := version == "9P2000.L"
 	dotu := version == "9P2000.u" && fs.Dotu
 	ver := "9P2000"
-	if dotu {
+	if dotl {
+		ver = "9P2000.L"
+	} else if dotu {
 		ver = "9P2000.u"
 	}
-	return msize, dotu, ver, nil
+	return msize, dotu, dotl, ver, nil
 }
 
-func (fs *Fs) versionPost(msize uint32, dotu bool) { fs.Dotu = dotu }
+func (fs *Fs) versionPost(msize uint32, dotu bool, dotl bool) {
+	fs.Dotu = dotu
+	fs.Dotl = dotl
+}
 
 func (fs *Fs) auth(afid uint32, uname string, aname string, unamenum uint32) (*Qid, error) {
 
@@ -53,6 +58,7 @@ func (fs *Fs) attach(fid uint32, afid *Fid, uname string, aname string, unamenum
 		}
 		return nil, err
 	}
+	newfid.Uid = unamenum
 
 	return &fs.root.Qid, nil
 }
@@ -114,6 +120,7 @@ func (fs *Fs) walk(fid *Fid, newfid uint32, names []string) ([]Qid, error) {
 			}
 			return nil, err
 		}
+		nfid.Uid = fid.Uid
 	}
 
 	return qids, nil
@@ -197,6 +204,7 @@ func (fs *Fs) createPost(fid *Fid, new_file *File, name string, mode uint8) {
 	// Swap out the files.
 	fid.file.DecRef(fs, fid.Path)
 	fid.file = new_file
+	fid.Path = path.Join(fid.Path, name)
 
 	fid.Omode = mode
 	fid.Opened = true
@@ -243,7 +251,10 @@ func (fs *Fs) readFile(fid *Fid, offset int64, length int) (int, error) {
 
 	// Lock the file for reading.
 	err := fid.file.lockRead(fs)
-	return fid.file.read_fd, err
+	if err != nil {
+		return -1, err
+	}
+	return fid.file.readFd(uint64(offset), uint64(length))
 }
 
 func (fs *Fs) readDirPost(fid *Fid, count uint32, entries int) {
@@ -258,16 +269,39 @@ func (fs *Fs) readDirPost(fid *Fid, count uint32, entries int) {
 	}
 }
 
-func (fs *Fs) writeFile(fid *Fid, offset int64, count int) (int, error) {
+func (fs *Fs) writeFile(fid *Fid, offset int64, count int) (int, bool, error) {
 	err := fid.file.lockWrite(fs)
-	return fid.file.write_fd, err
+	if err != nil {
+		return -1, false, err
+	}
+	fd, filling, err := fid.file.writeFd(uint64(offset), uint64(count))
+	if err != nil {
+		fid.file.unlock()
+	}
+	return fd, filling, err
 }
 
-func (fs *Fs) readFilePost(fid *Fid, count uint32)  { fid.file.unlock() }
-func (fs *Fs) readFileFail(fid *Fid, count uint32)  { fid.file.unlock() }
-func (fs *Fs) writeFilePost(fid *Fid, count uint32) { fid.file.unlock() }
-func (fs *Fs) writeFileFail(fid *Fid, count uint32) { fid.file.unlock() }
-func (fs *Fs) clunk(fid *Fid) error                 { return nil }
+func (fs *Fs) readFilePost(fid *Fid, count uint32) { fid.file.unlock() }
+func (fs *Fs) readFileFail(fid *Fid, count uint32) { fid.file.unlock() }
+
+func (fs *Fs) writeFilePost(fid *Fid, offset uint64, count uint32, filling bool) {
+	fid.file.wrote(offset, uint64(count), filling)
+	fid.file.unlock()
+}
+
+func (fs *Fs) writeFileFail(fid *Fid, offset uint64, count uint32, filling bool) {
+	// Whatever was written is not kept.
+	fid.file.wrote(offset, 0, filling)
+	fid.file.unlock()
+}
+
+func (fs *Fs) clunk(fid *Fid) error {
+	// Set any xattr being created.
+	if fid.Xattrcreate {
+		return fid.file.setxattr(fs, fid.Path, fid.Xattrname, fid.Xattrdata, int(fid.Xattrflags))
+	}
+	return nil
+}
 
 func (fs *Fs) clunkPost(fid *Fid) {
 	// Drop the fid reference.
@@ -294,6 +328,8 @@ func (fs *Fs) removePost(fid *Fid) error {
 }
 
 func (fs *Fs) stat(fid *Fid) (*Dir, error) {
+	fs.check(fid.file, fid.Path)
+
 	// Get underlying file information.
 	return fid.file.dir(path.Base(fid.Path), true)
 }
@@ -358,7 +394,7 @@ func (fs *Fs) wstatPost(fid *Fid, cur *Dir, next *Dir) error {
 	// Truncate the file.
 	if next.Length != math.MaxUint64 &&
 		next.Length != cur.Length {
-		err := syscall.Ftruncate(fid.file.write_fd, int64(next.Length))
+		err := fid.file.resize(next.Length)
 		if err != nil {
 			return err
 		}
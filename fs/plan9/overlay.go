@@ -0,0 +1,218 @@
+package plan9
+
+import (
+	"os"
+	"syscall"
+)
+
+//
+// Overlay access --
+//
+// The read/write layering above is not specific to 9P.
+// These expose it to other file servers (i.e. virtio-fs),
+// so that they see exactly the same view of the files,
+// with the same copy-up and deletion semantics.
+//
+// Files are returned with a reference held, which must
+// be dropped with DecRef() (using the same path).
+//
+
+func (fs *Fs) Lookup(path string) (*File, error) {
+	file, err := fs.lookup(path)
+	if err != nil && file != nil {
+		file.DecRef(fs, path)
+		file = nil
+	}
+	return file, err
+}
+
+func (file *File) Exists() bool {
+	file.RWMutex.RLock()
+	defer file.RWMutex.RUnlock()
+	return file.exists()
+}
+
+//
+// Is the file only in the write layer? If not,
+// there's something from a read layer below it.
+//
+func (file *File) WriteOnly() bool {
+	file.RWMutex.RLock()
+	defer file.RWMutex.RUnlock()
+	return file.write_exists && !file.write_deleted && !file.read_exists
+}
+
+//
+// The current attributes of the file.
+// This is from whichever layer is on top.
+//
+func (file *File) Stat(stat *syscall.Stat_t) error {
+	file.RWMutex.RLock()
+	defer file.RWMutex.RUnlock()
+	if !file.exists() {
+		return Enoent
+	}
+	if file.write_exists {
+		return syscall.Lstat(file.write_path, stat)
+	}
+	return syscall.Lstat(file.read_path, stat)
+}
+
+func (file *File) Readlink() (string, error) {
+	file.RWMutex.RLock()
+	defer file.RWMutex.RUnlock()
+	if file.write_exists {
+		return os.Readlink(file.write_path)
+	}
+	return os.Readlink(file.read_path)
+}
+
+//
+// Lock the file and return an fd for reading or
+// writing. (Writing copies the file up first).
+//
+// The caller must call Unlock() when finished.
+//
+// NOTE: Since the copy in the write layer may be
+// sparse, data must only be accessed via the fds
+// from LockReadAt() and WriteAt(), which are good
+// only for the given range. The fds here are only
+// for things like fsync().
+//
+func (file *File) LockRead(fs *Fs) (int, error) {
+	err := file.lockRead(fs)
+	return file.read_fd, err
+}
+
+func (file *File) LockWrite(fs *Fs) (int, error) {
+	err := file.lockWrite(fs)
+	return file.write_fd, err
+}
+
+func (file *File) LockReadAt(fs *Fs, offset uint64, length uint64) (int, error) {
+	err := file.lockRead(fs)
+	if err != nil {
+		return -1, err
+	}
+	fd, err := file.readFd(offset, length)
+	if err != nil {
+		file.unlock()
+	}
+	return fd, err
+}
+
+//
+// Write the given range via write(), which returns
+// how much it actually wrote. (Writes can't be left
+// open like reads, since only what was written may
+// be taken out of the write map).
+//
+func (file *File) WriteAt(
+	fs *Fs,
+	offset uint64,
+	length uint64,
+	write func(fd int) (int, error)) (int, error) {
+
+	err := file.lockWrite(fs)
+	if err != nil {
+		return 0, err
+	}
+	defer file.unlock()
+
+	fd, filling, err := file.writeFd(offset, length)
+	if err != nil {
+		return 0, err
+	}
+	written, err := write(fd)
+	if err != nil || written < 0 {
+		written = 0
+	}
+	if map_err := file.wrote(offset, uint64(written), filling); err == nil {
+		err = map_err
+	}
+	return written, err
+}
+
+func (file *File) Unlock() {
+	file.unlock()
+}
+
+//
+// Ensure the file is in the write layer, and return
+// its path there. Directories are created rather than
+// copied, since their children are merged anyways.
+//
+// The copy may be sparse, so the path is good for
+// changing attributes but not for data. (Use Truncate()
+// to change the size, and CopyUpAll() for everything).
+//
+func (file *File) CopyUp(fs *Fs, path string) (string, error) {
+	file.RWMutex.RLock()
+	is_dir := file.Qid.Type&QTDIR != 0
+	copied := file.write_exists && !file.write_deleted
+	file.RWMutex.RUnlock()
+
+	if !copied {
+		if is_dir {
+			err := file.create(fs, path, file.mode)
+			if err != nil && err != Eexist {
+				return "", err
+			}
+		} else {
+			err := file.lockWrite(fs)
+			if err != nil {
+				return "", err
+			}
+			file.unlock()
+		}
+	}
+
+	file.RWMutex.RLock()
+	defer file.RWMutex.RUnlock()
+	return file.write_path, nil
+}
+
+//
+// Ensure the write layer has a complete copy.
+//
+func (file *File) CopyUpAll(fs *Fs, path string) (string, error) {
+	write_path, err := file.CopyUp(fs, path)
+	if err != nil {
+		return "", err
+	}
+	return write_path, file.fillHoles()
+}
+
+func (file *File) Truncate(fs *Fs, size uint64) error {
+	return file.truncate(fs, size)
+}
+
+//
+// Create the file with the given mode (including type).
+// This returns Eexist if the file was already present.
+//
+func (file *File) Create(fs *Fs, path string, mode uint32) error {
+	return file.create(fs, path, mode)
+}
+
+func (file *File) Remove(fs *Fs, path string) error {
+	return file.remove(fs, path)
+}
+
+func (file *File) Rename(fs *Fs, orig_path string, new_path string) error {
+	return file.rename(fs, orig_path, new_path)
+}
+
+//
+// All the visible children (merged across layers).
+//
+func (file *File) Children(fs *Fs, path string) ([]*Dir, error) {
+	return file.children(fs, path)
+}
+
+//
+// Stats for the write layer (where new data goes).
+//
+func (fs *Fs) Statfs(stat *syscall.Statfs_t) error {
+	return syscall.Statfs(fs.root.write_path, stat)
+}
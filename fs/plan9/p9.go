@@ -33,6 +33,50 @@ const (
 	Tlast
 )
 
+// 9P2000.L message types
+const (
+	Tlerror      = 6
+	Rlerror      = 7
+	Tstatfs      = 8
+	Rstatfs      = 9
+	Tlopen       = 12
+	Rlopen       = 13
+	Tlcreate     = 14
+	Rlcreate     = 15
+	Tsymlink     = 16
+	Rsymlink     = 17
+	Tmknod       = 18
+	Rmknod       = 19
+	Trename      = 20
+	Rrename      = 21
+	Treadlink    = 22
+	Rreadlink    = 23
+	Tgetattr     = 24
+	Rgetattr     = 25
+	Tsetattr     = 26
+	Rsetattr     = 27
+	Txattrwalk   = 30
+	Rxattrwalk   = 31
+	Txattrcreate = 32
+	Rxattrcreate = 33
+	Treaddir     = 40
+	Rreaddir     = 41
+	Tfsync       = 50
+	Rfsync       = 51
+	Tlock        = 52
+	Rlock        = 53
+	Tgetlock     = 54
+	Rgetlock     = 55
+	Tlink        = 70
+	Rlink        = 71
+	Tmkdir       = 72
+	Rmkdir       = 73
+	Trenameat    = 74
+	Rrenameat    = 75
+	Tunlinkat    = 76
+	Runlinkat    = 77
+)
+
 const (
 	MSIZE   = 8192 + IOHDRSZ // default message size (8192+IOHdrSz)
 	IOHDRSZ = 24             // the non-data size of the Twrite messages
@@ -83,6 +127,69 @@ const (
 	DMEXEC      = 0x1        // mode bit for execute permission
 )
 
+// Flags for Tlopen and Tlcreate (as per Linux)
+const (
+	LOACCMODE   = 0x3
+	LORDONLY    = 0x0
+	LOWRONLY    = 0x1
+	LORDWR      = 0x2
+	LOCREAT     = 0x40
+	LOEXCL      = 0x80
+	LOTRUNC     = 0x200
+	LOAPPEND    = 0x400
+	LODIRECTORY = 0x10000
+)
+
+// Bits in the request mask for Tgetattr
+const (
+	GETATTR_MODE        = 0x1
+	GETATTR_NLINK       = 0x2
+	GETATTR_UID         = 0x4
+	GETATTR_GID         = 0x8
+	GETATTR_RDEV        = 0x10
+	GETATTR_ATIME       = 0x20
+	GETATTR_MTIME       = 0x40
+	GETATTR_CTIME       = 0x80
+	GETATTR_INO         = 0x100
+	GETATTR_SIZE        = 0x200
+	GETATTR_BLOCKS      = 0x400
+	GETATTR_BTIME       = 0x800
+	GETATTR_GEN         = 0x1000
+	GETATTR_DATAVERSION = 0x2000
+	GETATTR_BASIC       = 0x7ff // everything up to blocks
+	GETATTR_ALL         = 0x3fff
+)
+
+// Bits in the valid mask for Tsetattr
+const (
+	SETATTR_MODE     = 0x1
+	SETATTR_UID      = 0x2
+	SETATTR_GID      = 0x4
+	SETATTR_SIZE     = 0x8
+	SETATTR_ATIME    = 0x10
+	SETATTR_MTIME    = 0x20
+	SETATTR_CTIME    = 0x40
+	SETATTR_ATIMESET = 0x80 // use the given atime (not now)
+	SETATTR_MTIMESET = 0x100
+)
+
+// Lock types and status for Tlock and Tgetlock
+const (
+	LOCK_RDLCK = 0
+	LOCK_WRLCK = 1
+	LOCK_UNLCK = 2
+
+	LOCK_SUCCESS = 0
+	LOCK_BLOCKED = 1
+	LOCK_ERROR   = 2
+	LOCK_GRACE   = 3
+)
+
+// Flags for Tunlinkat
+const (
+	AT_REMOVEDIR = 0x200
+)
+
 const (
 	NOTAG uint16 = 0xFFFF     // no tag specified
 	NOFID uint32 = 0xFFFFFFFF // no fid specified
@@ -91,12 +198,16 @@ const (
 
 // Error values
 const (
-	EPERM   = 1
-	ENOENT  = 2
-	EIO     = 5
-	EEXIST  = 17
-	ENOTDIR = 20
-	EINVAL  = 22
+	EPERM     = 1
+	ENOENT    = 2
+	EIO       = 5
+	EEXIST    = 17
+	ENOTDIR   = 20
+	EXDEV     = 18
+	EISDIR    = 21
+	EINVAL    = 22
+	ERANGE    = 34
+	ENOTEMPTY = 39
 )
 
 // Error represents a 9P2000 (and 9P2000.u) error.
@@ -131,6 +242,55 @@ type Dir struct {
 	Uidnum  uint32 // owner ID
 	Gidnum  uint32 // group ID
 	Muidnum uint32 // ID of the last user that modified the file
+
+	// The host mode (for 9P2000.L directory entries).
+	// This is not on the wire for 9P2000 or 9P2000.u.
+	rawmode uint32
+}
+
+// Attr describes a file (9P2000.L).
+type Attr struct {
+	Mode        uint32 // protection and type (as per Linux)
+	Uid         uint32 // owner ID
+	Gid         uint32 // group ID
+	Nlink       uint64 // number of hard links
+	Rdev        uint64 // device ID (if special file)
+	Size        uint64 // file length in bytes
+	Blksize     uint64 // block size for I/O
+	Blocks      uint64 // number of 512 byte blocks
+	Atime       uint64 // last access time in seconds
+	Atimensec   uint64
+	Mtime       uint64 // last modified time in seconds
+	Mtimensec   uint64
+	Ctime       uint64 // last status change in seconds
+	Ctimensec   uint64
+	Btime       uint64 // creation time (reserved)
+	Btimensec   uint64
+	Gen         uint64 // inode generation (reserved)
+	Dataversion uint64 // data version (reserved)
+}
+
+// Statfs describes a file system (9P2000.L).
+type Statfs struct {
+	Type    uint32 // type of file system
+	Bsize   uint32 // optimal transfer block size
+	Blocks  uint64 // total data blocks in file system
+	Bfree   uint64 // free blocks in fs
+	Bavail  uint64 // free blocks avail to non-superuser
+	Files   uint64 // total file nodes in file system
+	Ffree   uint64 // free file nodes in fs
+	Fsid    uint64 // file system id
+	Namelen uint32 // maximum length of filenames
+}
+
+// Lock describes a POSIX lock (9P2000.L).
+type Lock struct {
+	Type     uint8  // lock type (LOCK_RDLCK, etc.)
+	Flags    uint32 // blocking or reclaim (used by Tlock)
+	Start    uint64 // starting offset for lock
+	Length   uint64 // number of bytes (0 means to the end)
+	Procid   uint32 // process ID of the lock owner
+	Clientid string // client identifier
 }
 
 // Fcall represents a 9P2000 message.
@@ -162,6 +322,66 @@ type Fcall struct {
 	Errornum uint32 // error code, 9P2000.u only (used by Rerror)
 	Ext      string // special file description, 9P2000.u only (used by Tcreate)
 	Unamenum uint32 // user ID, 9P2000.u only (used by Tauth, Tattach)
+
+	/* 9P2000.L extensions */
+	Dfid      uint32 // second (directory) fid (used by Trename, Tlink, Trenameat)
+	Newname   string // new file name (used by Trenameat)
+	Flags     uint32 // Linux flags (used by Tlopen, Tlcreate, Tunlinkat, Txattrcreate)
+	Egid      uint32 // group ID for new files (used by Tlcreate, Tsymlink, Tmknod, Tmkdir)
+	Major     uint32 // device major number (used by Tmknod)
+	Minor     uint32 // device minor number (used by Tmknod)
+	Target    string // link target (used by Tsymlink, Rreadlink)
+	Mask      uint64 // attributes requested or valid (used by Tgetattr, Rgetattr)
+	Valid     uint32 // attributes to change (used by Tsetattr)
+	Attr      Attr   // file attributes (used by Rgetattr, Tsetattr)
+	Statfs    Statfs // file system (used by Rstatfs)
+	Xattrsize uint64 // size of the xattr (used by Rxattrwalk, Txattrcreate)
+	Datasync  uint32 // only flush data (used by Tfsync)
+	Lock      Lock   // lock description (used by Tlock, Tgetlock, Rgetlock)
+	Status    uint8  // lock status (used by Rlock)
+}
+
+// minimum size of a 9P2000.L message for a type
+var minFclsize = map[uint8]uint32{
+	Rlerror:      4,   /* ecode[4] */
+	Tstatfs:      4,   /* fid[4] */
+	Rstatfs:      60,  /* type[4] bsize[4] blocks..fsid[8*6] namelen[4] */
+	Tlopen:       8,   /* fid[4] flags[4] */
+	Rlopen:       17,  /* qid[13] iounit[4] */
+	Tlcreate:     18,  /* fid[4] name[s] flags[4] mode[4] gid[4] */
+	Rlcreate:     17,  /* qid[13] iounit[4] */
+	Tsymlink:     12,  /* fid[4] name[s] symtgt[s] gid[4] */
+	Rsymlink:     13,  /* qid[13] */
+	Tmknod:       22,  /* dfid[4] name[s] mode[4] major[4] minor[4] gid[4] */
+	Rmknod:       13,  /* qid[13] */
+	Trename:      10,  /* fid[4] dfid[4] name[s] */
+	Rrename:      0,   /* */
+	Treadlink:    4,   /* fid[4] */
+	Rreadlink:    2,   /* target[s] */
+	Tgetattr:     12,  /* fid[4] request_mask[8] */
+	Rgetattr:     153, /* valid[8] qid[13] mode..gid[4*3] nlink..data_version[8*15] */
+	Tsetattr:     60,  /* fid[4] valid..gid[4*4] size..mtime_nsec[8*5] */
+	Rsetattr:     0,   /* */
+	Txattrwalk:   10,  /* fid[4] newfid[4] name[s] */
+	Rxattrwalk:   8,   /* size[8] */
+	Txattrcreate: 18,  /* fid[4] name[s] attr_size[8] flags[4] */
+	Rxattrcreate: 0,   /* */
+	Treaddir:     16,  /* fid[4] offset[8] count[4] */
+	Rreaddir:     4,   /* count[4] */
+	Tfsync:       4,   /* fid[4] (datasync[4]) */
+	Rfsync:       0,   /* */
+	Tlock:        31,  /* fid[4] type[1] flags[4] start[8] length[8] proc_id[4] client_id[s] */
+	Rlock:        1,   /* status[1] */
+	Tgetlock:     27,  /* fid[4] type[1] start[8] length[8] proc_id[4] client_id[s] */
+	Rgetlock:     23,  /* type[1] start[8] length[8] proc_id[4] client_id[s] */
+	Tlink:        10,  /* dfid[4] fid[4] name[s] */
+	Rlink:        0,   /* */
+	Tmkdir:       14,  /* dfid[4] name[s] mode[4] gid[4] */
+	Rmkdir:       13,  /* qid[13] */
+	Trenameat:    12,  /* olddirfid[4] oldname[s] newdirfid[4] newname[s] */
+	Rrenameat:    0,   /* */
+	Tunlinkat:    10,  /* dirfd[4] name[s] flags[4] */
+	Runlinkat:    0,   /* */
 }
 
 // minimum size of a 9P2000 message for a type
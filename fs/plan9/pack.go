@@ -183,3 +183,169 @@ func PackRstat(buf Buffer, tag uint16, d *Dir, dotu bool) error {
 }
 
 func PackRwstat(buf Buffer, tag uint16) error { return packCommon(buf, 0, Rwstat, tag) }
+
+//
+// 9P2000.L --
+//
+// Errors are only a number, and many of these are
+// shared in form with the 9P2000 replies above.
+//
+
+func PackRlerror(buf Buffer, tag uint16, errornum uint32) error {
+	err := packCommon(buf, 4, Rlerror, tag) // ecode[4]
+	if err != nil {
+		return err
+	}
+
+	buf.Write32(errornum)
+	return checkBuffer(buf)
+}
+
+func PackRstatfs(buf Buffer, tag uint16, st *Statfs) error {
+	size := 4 + 4 + 6*8 + 4 // type[4] bsize[4] blocks..fsid[8] namelen[4]
+	err := packCommon(buf, size, Rstatfs, tag)
+	if err != nil {
+		return err
+	}
+
+	pstatfs(buf, st)
+	return checkBuffer(buf)
+}
+
+func packQid(buf Buffer, id uint8, tag uint16, qid *Qid) error {
+	err := packCommon(buf, 13, id, tag) // qid[13]
+	if err != nil {
+		return err
+	}
+
+	pqid(buf, qid)
+	return checkBuffer(buf)
+}
+
+func PackRlopen(
+	buf Buffer,
+	tag uint16,
+	qid *Qid,
+	iounit uint32) error {
+
+	size := 13 + 4 // qid[13] iounit[4]
+	err := packCommon(buf, size, Rlopen, tag)
+	if err != nil {
+		return err
+	}
+
+	pqid(buf, qid)
+	buf.Write32(iounit)
+
+	return checkBuffer(buf)
+}
+
+func PackRlcreate(
+	buf Buffer,
+	tag uint16,
+	qid *Qid,
+	iounit uint32) error {
+
+	size := 13 + 4 // qid[13] iounit[4]
+	err := packCommon(buf, size, Rlcreate, tag)
+	if err != nil {
+		return err
+	}
+
+	pqid(buf, qid)
+	buf.Write32(iounit)
+
+	return checkBuffer(buf)
+}
+
+func PackRsymlink(buf Buffer, tag uint16, qid *Qid) error { return packQid(buf, Rsymlink, tag, qid) }
+func PackRmknod(buf Buffer, tag uint16, qid *Qid) error   { return packQid(buf, Rmknod, tag, qid) }
+func PackRmkdir(buf Buffer, tag uint16, qid *Qid) error   { return packQid(buf, Rmkdir, tag, qid) }
+func PackRrename(buf Buffer, tag uint16) error            { return packCommon(buf, 0, Rrename, tag) }
+
+func PackRreadlink(buf Buffer, tag uint16, target string) error {
+	size := 2 + len(target) // target[s]
+	err := packCommon(buf, size, Rreadlink, tag)
+	if err != nil {
+		return err
+	}
+
+	buf.WriteString(target)
+	return checkBuffer(buf)
+}
+
+func PackRgetattr(
+	buf Buffer,
+	tag uint16,
+	valid uint64,
+	qid *Qid,
+	attr *Attr) error {
+
+	size := 8 + 13 + 3*4 + 15*8 // valid[8] qid[13] mode..gid[4] nlink..data_version[8]
+	err := packCommon(buf, size, Rgetattr, tag)
+	if err != nil {
+		return err
+	}
+
+	buf.Write64(valid)
+	pqid(buf, qid)
+	pattr(buf, attr)
+
+	return checkBuffer(buf)
+}
+
+func PackRsetattr(buf Buffer, tag uint16) error { return packCommon(buf, 0, Rsetattr, tag) }
+
+func PackRxattrwalk(buf Buffer, tag uint16, size uint64) error {
+	err := packCommon(buf, 8, Rxattrwalk, tag) // size[8]
+	if err != nil {
+		return err
+	}
+
+	buf.Write64(size)
+	return checkBuffer(buf)
+}
+
+func PackRxattrcreate(buf Buffer, tag uint16) error { return packCommon(buf, 0, Rxattrcreate, tag) }
+
+func PackRreaddir(
+	buf Buffer,
+	tag uint16,
+	count uint32) error {
+
+	size := int(4 + count) // count[4] data[count]
+	err := packCommon(buf, size, Rreaddir, tag)
+	if err != nil {
+		return err
+	}
+
+	buf.Write32(count)
+
+	return checkBuffer(buf)
+}
+
+func PackRfsync(buf Buffer, tag uint16) error { return packCommon(buf, 0, Rfsync, tag) }
+
+func PackRlock(buf Buffer, tag uint16, status uint8) error {
+	err := packCommon(buf, 1, Rlock, tag) // status[1]
+	if err != nil {
+		return err
+	}
+
+	buf.Write8(status)
+	return checkBuffer(buf)
+}
+
+func PackRgetlock(buf Buffer, tag uint16, lock *Lock) error {
+	err := packCommon(buf, locksz(lock), Rgetlock, tag)
+	if err != nil {
+		return err
+	}
+
+	plock(buf, lock)
+	return checkBuffer(buf)
+}
+
+func PackRlink(buf Buffer, tag uint16) error     { return packCommon(buf, 0, Rlink, tag) }
+func PackRrenameat(buf Buffer, tag uint16) error { return packCommon(buf, 0, Rrenameat, tag) }
+func PackRunlinkat(buf Buffer, tag uint16) error { return packCommon(buf, 0, Runlinkat, tag) }
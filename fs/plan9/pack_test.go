@@ -0,0 +1,378 @@
+package plan9
+
+import (
+	"encoding/binary"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+//
+// A Buffer in memory, for the messages below.
+// Reads are of whatever has been written so far.
+//
+type memBuffer struct {
+	data         []byte
+	read_offset  int
+	write_offset int
+}
+
+func newMemBuffer(size int) *memBuffer {
+	return &memBuffer{data: make([]byte, size)}
+}
+
+func (buf *memBuffer) ReadLeft() int  { return buf.write_offset - buf.read_offset }
+func (buf *memBuffer) WriteLeft() int { return len(buf.data) - buf.write_offset }
+func (buf *memBuffer) ReadRewind()    { buf.read_offset = 0 }
+func (buf *memBuffer) WriteRewind()   { buf.write_offset = 0 }
+
+func (buf *memBuffer) read(size int) []byte {
+	if buf.ReadLeft() < size {
+		buf.read_offset += size
+		return make([]byte, size)
+	}
+	value := buf.data[buf.read_offset : buf.read_offset+size]
+	buf.read_offset += size
+	return value
+}
+
+func (buf *memBuffer) write(size int) []byte {
+	if buf.WriteLeft() < size {
+		buf.write_offset += size
+		return make([]byte, size)
+	}
+	value := buf.data[buf.write_offset : buf.write_offset+size]
+	buf.write_offset += size
+	return value
+}
+
+func (buf *memBuffer) Read8() uint8   { return buf.read(1)[0] }
+func (buf *memBuffer) Read16() uint16 { return binary.LittleEndian.Uint16(buf.read(2)) }
+func (buf *memBuffer) Read32() uint32 { return binary.LittleEndian.Uint32(buf.read(4)) }
+func (buf *memBuffer) Read64() uint64 { return binary.LittleEndian.Uint64(buf.read(8)) }
+
+func (buf *memBuffer) ReadBytes(length int) []byte {
+	return append([]byte(nil), buf.read(length)...)
+}
+
+func (buf *memBuffer) ReadString() string {
+	length := buf.Read16()
+	return string(buf.read(int(length)))
+}
+
+func (buf *memBuffer) Write8(value uint8)   { buf.write(1)[0] = value }
+func (buf *memBuffer) Write16(value uint16) { binary.LittleEndian.PutUint16(buf.write(2), value) }
+func (buf *memBuffer) Write32(value uint32) { binary.LittleEndian.PutUint32(buf.write(4), value) }
+func (buf *memBuffer) Write64(value uint64) { binary.LittleEndian.PutUint64(buf.write(8), value) }
+
+func (buf *memBuffer) WriteBytes(value []byte) { copy(buf.write(len(value)), value) }
+
+func (buf *memBuffer) WriteString(value string) {
+	buf.Write16(uint16(len(value)))
+	buf.WriteBytes([]byte(value))
+}
+
+func (buf *memBuffer) ReadFromFd(fd int, offset int64, length int) (int, error) {
+	return syscall.Pread(fd, buf.write(length), offset)
+}
+
+func (buf *memBuffer) WriteToFd(fd int, offset int64, length int) (int, error) {
+	return syscall.Pwrite(fd, buf.read(length), offset)
+}
+
+//
+// Unpack what's in the buffer, and check that it's the
+// whole message and that it has the expected fields.
+// (The header and unused fids are filled in here).
+//
+func checkUnpack(t *testing.T, buf *memBuffer, id uint8, tag uint16, expected Fcall) {
+	expected.Size = uint32(buf.write_offset)
+	expected.Type = id
+	expected.Tag = tag
+	for _, fid := range []*uint32{&expected.Fid, &expected.Afid, &expected.Newfid, &expected.Dfid} {
+		if *fid == 0 {
+			*fid = NOFID
+		}
+	}
+
+	buf.ReadRewind()
+	fc, err := Unpack(buf, true)
+	if err != nil {
+		t.Fatalf("%d: %v", id, err)
+	}
+	if buf.ReadLeft() != 0 {
+		t.Fatalf("%d: %d bytes left over", id, buf.ReadLeft())
+	}
+	if !reflect.DeepEqual(*fc, expected) {
+		t.Fatalf("%d: got %+v, expected %+v", id, *fc, expected)
+	}
+}
+
+func TestPackDotl(t *testing.T) {
+	qid := Qid{Type: QTDIR, Version: 3, Path: 0x123456789}
+	attr := Attr{
+		Mode: syscall.S_IFREG | 0644, Uid: 1000, Gid: 100,
+		Nlink: 1, Rdev: 2, Size: 4096, Blksize: 512, Blocks: 8,
+		Atime: 10, Atimensec: 11, Mtime: 12, Mtimensec: 13,
+		Ctime: 14, Ctimensec: 15, Btime: 16, Btimensec: 17,
+		Gen: 18, Dataversion: 19,
+	}
+	statfs := Statfs{
+		Type: 0x01021997, Bsize: 4096, Blocks: 100, Bfree: 50,
+		Bavail: 40, Files: 30, Ffree: 20, Fsid: 10, Namelen: 255,
+	}
+	lock := Lock{
+		Type: LOCK_WRLCK, Start: 100, Length: 50,
+		Procid: 42, Clientid: "guest",
+	}
+
+	cases := []struct {
+		id       uint8
+		pack     func(buf Buffer) error
+		expected Fcall
+	}{
+		{Rlerror, func(buf Buffer) error { return PackRlerror(buf, 1, ENOENT) }, Fcall{Errornum: ENOENT}},
+		{Rstatfs, func(buf Buffer) error { return PackRstatfs(buf, 1, &statfs) }, Fcall{Statfs: statfs}},
+		{Rlopen, func(buf Buffer) error { return PackRlopen(buf, 1, &qid, 8192) }, Fcall{Qid: qid, Iounit: 8192}},
+		{Rlcreate, func(buf Buffer) error { return PackRlcreate(buf, 1, &qid, 8192) }, Fcall{Qid: qid, Iounit: 8192}},
+		{Rsymlink, func(buf Buffer) error { return PackRsymlink(buf, 1, &qid) }, Fcall{Qid: qid}},
+		{Rmknod, func(buf Buffer) error { return PackRmknod(buf, 1, &qid) }, Fcall{Qid: qid}},
+		{Rmkdir, func(buf Buffer) error { return PackRmkdir(buf, 1, &qid) }, Fcall{Qid: qid}},
+		{Rrename, func(buf Buffer) error { return PackRrename(buf, 1) }, Fcall{}},
+		{Rreadlink, func(buf Buffer) error { return PackRreadlink(buf, 1, "../target") }, Fcall{Target: "../target"}},
+		{Rgetattr, func(buf Buffer) error { return PackRgetattr(buf, 1, GETATTR_BASIC, &qid, &attr) },
+			Fcall{Mask: GETATTR_BASIC, Qid: qid, Attr: attr}},
+		{Rsetattr, func(buf Buffer) error { return PackRsetattr(buf, 1) }, Fcall{}},
+		{Rxattrwalk, func(buf Buffer) error { return PackRxattrwalk(buf, 1, 77) }, Fcall{Xattrsize: 77}},
+		{Rxattrcreate, func(buf Buffer) error { return PackRxattrcreate(buf, 1) }, Fcall{}},
+		{Rreaddir, func(buf Buffer) error {
+			err := PackRreaddir(buf, 1, 5)
+			buf.WriteBytes([]byte("12345"))
+			return err
+		}, Fcall{Count: 5}},
+		{Rfsync, func(buf Buffer) error { return PackRfsync(buf, 1) }, Fcall{}},
+		{Rlock, func(buf Buffer) error { return PackRlock(buf, 1, LOCK_BLOCKED) }, Fcall{Status: LOCK_BLOCKED}},
+		{Rgetlock, func(buf Buffer) error { return PackRgetlock(buf, 1, &lock) }, Fcall{Lock: lock}},
+		{Rlink, func(buf Buffer) error { return PackRlink(buf, 1) }, Fcall{}},
+		{Rrenameat, func(buf Buffer) error { return PackRrenameat(buf, 1) }, Fcall{}},
+		{Runlinkat, func(buf Buffer) error { return PackRunlinkat(buf, 1) }, Fcall{}},
+	}
+
+	for _, c := range cases {
+		buf := newMemBuffer(1024)
+		if err := c.pack(buf); err != nil {
+			t.Fatalf("%d: %v", c.id, err)
+		}
+		checkUnpack(t, buf, c.id, 1, c.expected)
+	}
+
+	// Nothing is written past the end.
+	buf := newMemBuffer(16)
+	if err := PackRgetattr(buf, 1, GETATTR_BASIC, &qid, &attr); err != BufferInsufficient {
+		t.Fatalf("expected BufferInsufficient, got %v", err)
+	}
+}
+
+//
+// Build a request as the guest would.
+//
+func packRequest(id uint8, tag uint16, body func(buf Buffer)) *memBuffer {
+	scratch := newMemBuffer(1024)
+	body(scratch)
+
+	buf := newMemBuffer(1024)
+	buf.Write32(uint32(7 + scratch.write_offset))
+	buf.Write8(id)
+	buf.Write16(tag)
+	buf.WriteBytes(scratch.data[:scratch.write_offset])
+	return buf
+}
+
+func TestUnpackDotl(t *testing.T) {
+	lock := Lock{
+		Type: LOCK_RDLCK, Flags: 1, Start: 0, Length: 10,
+		Procid: 7, Clientid: "guest",
+	}
+	getlock := lock
+	getlock.Flags = 0
+
+	cases := []struct {
+		id       uint8
+		body     func(buf Buffer)
+		expected Fcall
+	}{
+		{Tstatfs, func(buf Buffer) { buf.Write32(1) }, Fcall{Fid: 1}},
+		{Tlopen, func(buf Buffer) {
+			buf.Write32(1)
+			buf.Write32(LORDWR)
+		}, Fcall{Fid: 1, Flags: LORDWR}},
+		{Tlcreate, func(buf Buffer) {
+			buf.Write32(1)
+			buf.WriteString("file")
+			buf.Write32(LOCREAT)
+			buf.Write32(0644)
+			buf.Write32(100)
+		}, Fcall{Fid: 1, Name: "file", Flags: LOCREAT, Perm: 0644, Egid: 100}},
+		{Tsymlink, func(buf Buffer) {
+			buf.Write32(1)
+			buf.WriteString("link")
+			buf.WriteString("target")
+			buf.Write32(100)
+		}, Fcall{Fid: 1, Name: "link", Target: "target", Egid: 100}},
+		{Tmknod, func(buf Buffer) {
+			buf.Write32(1)
+			buf.WriteString("dev")
+			buf.Write32(syscall.S_IFCHR | 0600)
+			buf.Write32(1)
+			buf.Write32(3)
+			buf.Write32(100)
+		}, Fcall{Fid: 1, Name: "dev", Perm: syscall.S_IFCHR | 0600, Major: 1, Minor: 3, Egid: 100}},
+		{Trename, func(buf Buffer) {
+			buf.Write32(1)
+			buf.Write32(2)
+			buf.WriteString("new")
+		}, Fcall{Fid: 1, Dfid: 2, Name: "new"}},
+		{Treadlink, func(buf Buffer) { buf.Write32(1) }, Fcall{Fid: 1}},
+		{Tgetattr, func(buf Buffer) {
+			buf.Write32(1)
+			buf.Write64(GETATTR_ALL)
+		}, Fcall{Fid: 1, Mask: GETATTR_ALL}},
+		{Tsetattr, func(buf Buffer) {
+			buf.Write32(1)
+			buf.Write32(SETATTR_MODE | SETATTR_SIZE)
+			buf.Write32(0600)
+			buf.Write32(1000)
+			buf.Write32(100)
+			buf.Write64(4096)
+			buf.Write64(1)
+			buf.Write64(2)
+			buf.Write64(3)
+			buf.Write64(4)
+		}, Fcall{Fid: 1, Valid: SETATTR_MODE | SETATTR_SIZE, Attr: Attr{
+			Mode: 0600, Uid: 1000, Gid: 100, Size: 4096,
+			Atime: 1, Atimensec: 2, Mtime: 3, Mtimensec: 4,
+		}}},
+		{Txattrwalk, func(buf Buffer) {
+			buf.Write32(1)
+			buf.Write32(2)
+			buf.WriteString("user.name")
+		}, Fcall{Fid: 1, Newfid: 2, Name: "user.name"}},
+		{Txattrcreate, func(buf Buffer) {
+			buf.Write32(1)
+			buf.WriteString("user.name")
+			buf.Write64(5)
+			buf.Write32(0)
+		}, Fcall{Fid: 1, Name: "user.name", Xattrsize: 5}},
+		{Treaddir, func(buf Buffer) {
+			buf.Write32(1)
+			buf.Write64(3)
+			buf.Write32(8192)
+		}, Fcall{Fid: 1, Offset: 3, Count: 8192}},
+		{Tfsync, func(buf Buffer) {
+			buf.Write32(1)
+			buf.Write32(1)
+		}, Fcall{Fid: 1, Datasync: 1}},
+		// (The older form, without datasync).
+		{Tfsync, func(buf Buffer) { buf.Write32(1) }, Fcall{Fid: 1}},
+		{Tlock, func(buf Buffer) {
+			buf.Write32(1)
+			buf.Write8(lock.Type)
+			buf.Write32(lock.Flags)
+			buf.Write64(lock.Start)
+			buf.Write64(lock.Length)
+			buf.Write32(lock.Procid)
+			buf.WriteString(lock.Clientid)
+		}, Fcall{Fid: 1, Lock: lock}},
+		{Tgetlock, func(buf Buffer) {
+			buf.Write32(1)
+			plock(buf, &getlock)
+		}, Fcall{Fid: 1, Lock: getlock}},
+		{Tlink, func(buf Buffer) {
+			buf.Write32(2)
+			buf.Write32(1)
+			buf.WriteString("link")
+		}, Fcall{Dfid: 2, Fid: 1, Name: "link"}},
+		{Tmkdir, func(buf Buffer) {
+			buf.Write32(1)
+			buf.WriteString("dir")
+			buf.Write32(0755)
+			buf.Write32(100)
+		}, Fcall{Fid: 1, Name: "dir", Perm: 0755, Egid: 100}},
+		{Trenameat, func(buf Buffer) {
+			buf.Write32(1)
+			buf.WriteString("old")
+			buf.Write32(2)
+			buf.WriteString("new")
+		}, Fcall{Fid: 1, Name: "old", Dfid: 2, Newname: "new"}},
+		{Tunlinkat, func(buf Buffer) {
+			buf.Write32(1)
+			buf.WriteString("dir")
+			buf.Write32(AT_REMOVEDIR)
+		}, Fcall{Fid: 1, Name: "dir", Flags: AT_REMOVEDIR}},
+	}
+
+	for _, c := range cases {
+		checkUnpack(t, packRequest(c.id, 2, c.body), c.id, 2, c.expected)
+	}
+
+	// Too short for the message type.
+	buf := packRequest(Tgetattr, 2, func(buf Buffer) { buf.Write32(1) })
+	if _, err := Unpack(buf, true); err != BufferInsufficient {
+		t.Fatalf("expected BufferInsufficient, got %v", err)
+	}
+}
+
+func TestLocks(t *testing.T) {
+	fs := new(Fs)
+	fid := &Fid{file: new(File)}
+	one := func(lock_type uint8, start uint64, length uint64) *Lock {
+		return &Lock{Type: lock_type, Start: start, Length: length, Procid: 1, Clientid: "one"}
+	}
+	two := func(lock_type uint8, start uint64, length uint64) *Lock {
+		return &Lock{Type: lock_type, Start: start, Length: length, Procid: 2, Clientid: "one"}
+	}
+	check := func(lock *Lock, expected uint8) {
+		status, err := fs.lock(fid, lock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != expected {
+			t.Fatalf("%+v: got %d, expected %d", *lock, status, expected)
+		}
+	}
+
+	// Readers share, writers don't.
+	check(one(LOCK_RDLCK, 0, 100), LOCK_SUCCESS)
+	check(two(LOCK_RDLCK, 50, 100), LOCK_SUCCESS)
+	check(two(LOCK_WRLCK, 50, 100), LOCK_BLOCKED)
+	check(two(LOCK_WRLCK, 100, 0), LOCK_SUCCESS)
+
+	// An owner can change its own lock.
+	check(one(LOCK_WRLCK, 0, 10), LOCK_SUCCESS)
+
+	// Unlocking the middle leaves both ends.
+	check(one(LOCK_UNLCK, 40, 20), LOCK_SUCCESS)
+	check(two(LOCK_WRLCK, 40, 20), LOCK_SUCCESS)
+	check(two(LOCK_WRLCK, 30, 20), LOCK_BLOCKED)
+	check(two(LOCK_WRLCK, 60, 40), LOCK_BLOCKED)
+
+	// Who holds what.
+	held, err := fs.getlock(fid, two(LOCK_RDLCK, 0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if held.Procid != 1 || held.Type != LOCK_WRLCK || held.Start != 0 || held.Length != 10 {
+		t.Fatalf("getlock: %+v", *held)
+	}
+	held, err = fs.getlock(fid, two(LOCK_WRLCK, 40, 20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if held.Type != LOCK_UNLCK {
+		t.Fatalf("getlock: %+v", *held)
+	}
+
+	if _, err := fs.lock(fid, one(42, 0, 0)); err != Einval {
+		t.Fatalf("expected Einval, got %v", err)
+	}
+}
@@ -7,6 +7,9 @@ import (
 // Creates a Fcall value from the on-the-wire representation. If
 // dotu is true, reads 9P2000.u messages. Returns the unpacked message,
 // error and how many bytes from the buffer were used by the message.
+//
+// The 9P2000.L messages have their own types, and are always read.
+// (9P2000.L uses the 9P2000.u forms of the messages it shares).
 func Unpack(
 	buf Buffer,
 	dotu bool) (*Fcall, error) {
@@ -21,6 +24,7 @@ func Unpack(
 	fc.Fid = NOFID
 	fc.Afid = NOFID
 	fc.Newfid = NOFID
+	fc.Dfid = NOFID
 
 	fc.Size = buf.Read32()
 	fc.Type = buf.Read8()
@@ -32,12 +36,18 @@ func Unpack(
 		return nil, BufferInsufficient
 	}
 
-	if fc.Type < Tversion || fc.Type >= Tlast {
+	if fc.Type >= Tlast {
 		return nil, InvalidMessage
 	}
 
 	var sz uint32
-	if dotu {
+	if fc.Type < Tversion {
+		var ok bool
+		sz, ok = minFclsize[fc.Type]
+		if !ok {
+			return nil, InvalidMessage
+		}
+	} else if dotu {
 		sz = minFcsize[fc.Type-Tversion]
 	} else {
 		sz = minFcusize[fc.Type-Tversion]
@@ -164,6 +174,144 @@ func Unpack(
 	case Rflush, Rclunk, Rremove, Rwstat:
 		break
 
+	case Rlerror:
+		fc.Errornum = buf.Read32()
+
+	case Tstatfs, Treadlink:
+		fc.Fid = buf.Read32()
+
+	case Rstatfs:
+		gstatfs(buf, &fc.Statfs)
+
+	case Tlopen:
+		fc.Fid = buf.Read32()
+		fc.Flags = buf.Read32()
+
+	case Rlopen, Rlcreate:
+		gqid(buf, &fc.Qid)
+		fc.Iounit = buf.Read32()
+
+	case Tlcreate:
+		fc.Fid = buf.Read32()
+		fc.Name = buf.ReadString()
+		fc.Flags = buf.Read32()
+		fc.Perm = buf.Read32()
+		fc.Egid = buf.Read32()
+
+	case Tsymlink:
+		fc.Fid = buf.Read32()
+		fc.Name = buf.ReadString()
+		fc.Target = buf.ReadString()
+		fc.Egid = buf.Read32()
+
+	case Rsymlink, Rmknod, Rmkdir:
+		gqid(buf, &fc.Qid)
+
+	case Tmknod:
+		fc.Fid = buf.Read32()
+		fc.Name = buf.ReadString()
+		fc.Perm = buf.Read32()
+		fc.Major = buf.Read32()
+		fc.Minor = buf.Read32()
+		fc.Egid = buf.Read32()
+
+	case Trename:
+		fc.Fid = buf.Read32()
+		fc.Dfid = buf.Read32()
+		fc.Name = buf.ReadString()
+
+	case Rreadlink:
+		fc.Target = buf.ReadString()
+
+	case Tgetattr:
+		fc.Fid = buf.Read32()
+		fc.Mask = buf.Read64()
+
+	case Rgetattr:
+		fc.Mask = buf.Read64()
+		gqid(buf, &fc.Qid)
+		gattr(buf, &fc.Attr)
+
+	case Tsetattr:
+		fc.Fid = buf.Read32()
+		fc.Valid = buf.Read32()
+		fc.Attr.Mode = buf.Read32()
+		fc.Attr.Uid = buf.Read32()
+		fc.Attr.Gid = buf.Read32()
+		fc.Attr.Size = buf.Read64()
+		fc.Attr.Atime = buf.Read64()
+		fc.Attr.Atimensec = buf.Read64()
+		fc.Attr.Mtime = buf.Read64()
+		fc.Attr.Mtimensec = buf.Read64()
+
+	case Txattrwalk:
+		fc.Fid = buf.Read32()
+		fc.Newfid = buf.Read32()
+		fc.Name = buf.ReadString()
+
+	case Rxattrwalk:
+		fc.Xattrsize = buf.Read64()
+
+	case Txattrcreate:
+		fc.Fid = buf.Read32()
+		fc.Name = buf.ReadString()
+		fc.Xattrsize = buf.Read64()
+		fc.Flags = buf.Read32()
+
+	case Treaddir:
+		fc.Fid = buf.Read32()
+		fc.Offset = buf.Read64()
+		fc.Count = buf.Read32()
+
+	case Rreaddir:
+		fc.Count = buf.Read32()
+		buf.ReadBytes(int(fc.Count))
+
+	case Tfsync:
+		fc.Fid = buf.Read32()
+		if buf.ReadLeft() > 0 {
+			fc.Datasync = buf.Read32()
+		}
+
+	case Tlock:
+		fc.Fid = buf.Read32()
+		glock(buf, &fc.Lock, true)
+
+	case Rlock:
+		fc.Status = buf.Read8()
+
+	case Tgetlock:
+		fc.Fid = buf.Read32()
+		glock(buf, &fc.Lock, false)
+
+	case Rgetlock:
+		glock(buf, &fc.Lock, false)
+
+	case Tlink:
+		fc.Dfid = buf.Read32()
+		fc.Fid = buf.Read32()
+		fc.Name = buf.ReadString()
+
+	case Tmkdir:
+		fc.Fid = buf.Read32()
+		fc.Name = buf.ReadString()
+		fc.Perm = buf.Read32()
+		fc.Egid = buf.Read32()
+
+	case Trenameat:
+		fc.Fid = buf.Read32()
+		fc.Name = buf.ReadString()
+		fc.Dfid = buf.Read32()
+		fc.Newname = buf.ReadString()
+
+	case Tunlinkat:
+		fc.Fid = buf.Read32()
+		fc.Name = buf.ReadString()
+		fc.Flags = buf.Read32()
+
+	case Rrename, Rsetattr, Rxattrcreate, Rfsync, Rlink, Rrenameat, Runlinkat:
+		break
+
 	default:
 		return nil, InvalidMessage
 	}
@@ -0,0 +1,448 @@
+package plan9
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"syscall"
+)
+
+//
+// Sparse copy-up --
+//
+// When a file from a read layer is first written, we
+// create it at full size in the write layer and record
+// the whole thing as a hole. Holes are populated from
+// the read file a block at a time, as they're needed:
+//
+//  * A read entirely within a hole goes to the read file.
+//  * A read partially overlapping a hole copies up the
+//    overlapping blocks, then goes to the write file.
+//  * A write copies up only the partial blocks at either
+//    end, since the rest is about to be overwritten.
+//
+// The map is kept in an extended attribute on the write
+// file, so that it survives a re-exec (or a restart). If
+// we can't store it there, the file is simply copied in
+// full (and there are no holes to track).
+//
+
+//
+// The granularity of the copy-up.
+//
+const WriteMapBlockSize = 64 * 1024
+
+//
+// Where the map is kept.
+// (This is hidden from clients).
+//
+const WriteMapAttr = "user.novm-holes"
+
+type Hole struct {
+	start  uint64
+	length uint64
+}
+
+func (hole Hole) end() uint64 {
+	return hole.start + hole.length
+}
+
+//
+// The blocks covering the given range.
+//
+func blocks(start uint64, end uint64) (uint64, uint64) {
+	start = start - (start % WriteMapBlockSize)
+	if end%WriteMapBlockSize != 0 {
+		end = end + WriteMapBlockSize - (end % WriteMapBlockSize)
+	}
+	return start, end
+}
+
+//
+// The parts of the holes within the given range.
+//
+func holesIn(holes []Hole, start uint64, end uint64) []Hole {
+	result := make([]Hole, 0, 0)
+	for _, hole := range holes {
+		hole_start := hole.start
+		hole_end := hole.end()
+		if hole_start < start {
+			hole_start = start
+		}
+		if hole_end > end {
+			hole_end = end
+		}
+		if hole_start < hole_end {
+			result = append(result, Hole{hole_start, hole_end - hole_start})
+		}
+	}
+	return result
+}
+
+//
+// The holes, less the given range.
+//
+func removeHoles(holes []Hole, start uint64, end uint64) []Hole {
+	result := make([]Hole, 0, len(holes)+1)
+	for _, hole := range holes {
+		if hole.start < start {
+			result = append(result, holesIn([]Hole{hole}, hole.start, start)...)
+		}
+		if hole.end() > end {
+			result = append(result, holesIn([]Hole{hole}, end, hole.end())...)
+		}
+	}
+	if len(result) == 0 {
+		return nil
+	}
+	return result
+}
+
+func loadWriteMap(write_path string) []Hole {
+	data, err := lgetxattr(write_path, WriteMapAttr)
+	if err != nil {
+		return nil
+	}
+
+	holes := make([]Hole, 0, len(data)/16)
+	for i := 0; i+16 <= len(data); i += 16 {
+		holes = append(holes, Hole{
+			binary.LittleEndian.Uint64(data[i:]),
+			binary.LittleEndian.Uint64(data[i+8:]),
+		})
+	}
+	if len(holes) == 0 {
+		return nil
+	}
+	return holes
+}
+
+//
+// Record the current write map.
+// (The map_lock must be held).
+//
+func (file *File) saveWriteMap() error {
+
+	if len(file.write_map) == 0 {
+		err := lremovexattr(file.write_path, WriteMapAttr)
+		if err == syscall.ENODATA || err == syscall.EOPNOTSUPP {
+			return nil
+		}
+		return err
+	}
+
+	data := make([]byte, 16*len(file.write_map))
+	for i, hole := range file.write_map {
+		binary.LittleEndian.PutUint64(data[16*i:], hole.start)
+		binary.LittleEndian.PutUint64(data[16*i+8:], hole.length)
+	}
+	err := lsetxattr(file.write_path, WriteMapAttr, data, 0)
+	if err == nil {
+		return nil
+	}
+
+	// We can't keep track of the holes.
+	// Copy up everything that's left.
+	err = file.copyIn(file.write_map)
+	if err != nil {
+		return err
+	}
+	file.write_map = nil
+	lremovexattr(file.write_path, WriteMapAttr)
+	return nil
+}
+
+func (file *File) lowerFd() (int, error) {
+	if file.lower_fd == -1 {
+		fd, err := syscall.Open(
+			file.read_path,
+			syscall.O_RDONLY|syscall.O_CLOEXEC,
+			0)
+		if err != nil {
+			return -1, err
+		}
+		file.lower_fd = fd
+	}
+	return file.lower_fd, nil
+}
+
+//
+// Copy the given holes up from the read file.
+// (The map_lock must be held).
+//
+func (file *File) copyIn(holes []Hole) error {
+
+	if len(holes) == 0 {
+		return nil
+	}
+
+	write_fd := file.write_fd
+	if write_fd == -1 {
+		// We may have only been opened for reading.
+		fd, err := syscall.Open(
+			file.write_path,
+			syscall.O_WRONLY|syscall.O_CLOEXEC,
+			0)
+		if err != nil {
+			return err
+		}
+		defer syscall.Close(fd)
+		write_fd = fd
+	}
+	lower_fd, err := file.lowerFd()
+	if err != nil {
+		return err
+	}
+
+	data := make([]byte, WriteMapBlockSize)
+	for _, hole := range holes {
+		offset := hole.start
+		for offset < hole.end() {
+			chunk := data
+			if hole.end()-offset < uint64(len(chunk)) {
+				chunk = chunk[:hole.end()-offset]
+			}
+			n, err := syscall.Pread(lower_fd, chunk, int64(offset))
+			if err != nil {
+				return err
+			}
+			if n == 0 {
+				// Beyond the end of the read file.
+				// (This is the same as the sparse hole).
+				break
+			}
+			written := 0
+			for written < n {
+				m, err := syscall.Pwrite(
+					write_fd,
+					chunk[written:n],
+					int64(offset)+int64(written))
+				if err != nil {
+					return err
+				}
+				written += m
+			}
+			offset += uint64(n)
+		}
+	}
+
+	return nil
+}
+
+//
+// Populate the given range (whole blocks).
+// (The map_lock must be held).
+//
+func (file *File) populate(start uint64, end uint64) error {
+	start, end = blocks(start, end)
+	holes := holesIn(file.write_map, start, end)
+	if len(holes) == 0 {
+		return nil
+	}
+	err := file.copyIn(holes)
+	if err != nil {
+		return err
+	}
+	file.write_map = removeHoles(file.write_map, start, end)
+	err = file.saveWriteMap()
+	file.ownChange()
+	return err
+}
+
+//
+// Copy up everything that's left.
+//
+func (file *File) fillHoles() error {
+	file.map_lock.Lock()
+	defer file.map_lock.Unlock()
+
+	if len(file.write_map) == 0 {
+		return nil
+	}
+	err := file.copyIn(file.write_map)
+	if err != nil {
+		return err
+	}
+	file.write_map = nil
+	err = file.saveWriteMap()
+	file.ownChange()
+	return err
+}
+
+//
+// Copy up everything that's left beneath a directory.
+//
+// The holes are relative to the read files at these
+// paths, which won't be found once the directory has
+// been renamed. Files we already have are filled as
+// they are (so their maps agree), and the rest from
+// the layers directly. (The filesLock must be held).
+//
+func (fs *Fs) fillTree(dir_path string, write_path string) error {
+	return filepath.Walk(write_path, func(
+		host_path string,
+		info os.FileInfo,
+		err error) error {
+
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if _, err := lgetxattr(host_path, WriteMapAttr); err != nil {
+			// No holes.
+			return nil
+		}
+
+		child_path := path.Join(dir_path, host_path[len(write_path):])
+		child, ok := fs.files[child_path]
+		if !ok {
+			child = &File{read_fd: -1, write_fd: -1, lower_fd: -1, index: -1}
+			child.findPaths(fs, child_path)
+			defer child.closeFds()
+		}
+		return child.fillHoles()
+	})
+}
+
+//
+// The descriptor to read the given range from.
+// (The file must be locked via lockRead).
+//
+func (file *File) readFd(offset uint64, length uint64) (int, error) {
+	file.map_lock.Lock()
+	defer file.map_lock.Unlock()
+
+	end := offset + length
+	holes := holesIn(file.write_map, offset, end)
+	if len(holes) == 0 {
+		return file.read_fd, nil
+	}
+	if len(holes) == 1 && holes[0].start == offset && holes[0].end() == end {
+		// It's all in the read file.
+		return file.lowerFd()
+	}
+
+	err := file.populate(offset, end)
+	return file.read_fd, err
+}
+
+//
+// The descriptor to write the given range to.
+// (The file must be locked via lockWrite).
+//
+// If the range touches any holes, this returns true
+// with the map_lock still held, and wrote() must be
+// called once the write is done. Until then readers
+// can't see the range half-written (or populate it
+// underneath us), and the holes being written stay
+// in the map, so a failed write (or a crash) leaves
+// the read file showing through rather than zeroes.
+//
+func (file *File) writeFd(offset uint64, length uint64) (int, bool, error) {
+	file.map_lock.Lock()
+
+	end := offset + length
+	start, block_end := blocks(offset, end)
+	if length == 0 || len(holesIn(file.write_map, start, block_end)) == 0 {
+		file.map_lock.Unlock()
+		return file.write_fd, false, nil
+	}
+
+	// Copy up whatever is left of the first
+	// and last blocks (the rest is overwritten).
+	holes := append(
+		holesIn(file.write_map, start, offset),
+		holesIn(file.write_map, end, block_end)...)
+	err := file.copyIn(holes)
+	if err == nil {
+		file.write_map = removeHoles(file.write_map, start, offset)
+		file.write_map = removeHoles(file.write_map, end, block_end)
+		err = file.saveWriteMap()
+	}
+	if err != nil {
+		file.map_lock.Unlock()
+		return -1, false, err
+	}
+
+	return file.write_fd, true, nil
+}
+
+//
+// Finish a write to the fd from writeFd(), given
+// how much was actually written.
+//
+func (file *File) wrote(offset uint64, written uint64, filling bool) error {
+	defer file.ownChange()
+	if !filling {
+		return nil
+	}
+	defer file.map_lock.Unlock()
+
+	file.write_map = removeHoles(file.write_map, offset, offset+written)
+	return file.saveWriteMap()
+}
+
+//
+// Change the size of the file.
+// (The file must be locked via lockWrite).
+//
+func (file *File) resize(size uint64) error {
+	file.map_lock.Lock()
+	defer file.map_lock.Unlock()
+
+	// Anything past the end is gone. (If the file
+	// grows again, it's zeroes -- not the read file).
+	if len(file.write_map) > 0 {
+		file.write_map = removeHoles(file.write_map, size, ^uint64(0))
+		err := file.saveWriteMap()
+		if err != nil {
+			return err
+		}
+	}
+
+	err := syscall.Ftruncate(file.write_fd, int64(size))
+	file.ownChange()
+	return err
+}
+
+func (file *File) truncate(fs *Fs, size uint64) error {
+	err := file.lockWrite(fs)
+	if err != nil {
+		return err
+	}
+	defer file.unlock()
+	return file.resize(size)
+}
+
+//
+// Read the complete contents of a write file,
+// taking the holes from the read file instead.
+//
+func mergeHoles(
+	write_file io.ReaderAt,
+	read_file io.ReaderAt,
+	holes []Hole,
+	size int64) io.Reader {
+
+	readers := make([]io.Reader, 0, 2*len(holes)+1)
+	offset := int64(0)
+	for _, hole := range holesIn(holes, 0, uint64(size)) {
+		if int64(hole.start) > offset {
+			readers = append(readers, io.NewSectionReader(
+				write_file, offset, int64(hole.start)-offset))
+		}
+		readers = append(readers, io.NewSectionReader(
+			read_file, int64(hole.start), int64(hole.length)))
+		offset = int64(hole.end())
+	}
+	if offset < size {
+		readers = append(readers, io.NewSectionReader(
+			write_file, offset, size-offset))
+	}
+
+	return io.MultiReader(readers...)
+}
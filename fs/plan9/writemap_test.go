@@ -0,0 +1,268 @@
+package plan9
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func newTestFs(tb testing.TB, upper string, lower string) *Fs {
+	fs := new(Fs)
+	fs.Init()
+	fs.Write["/"] = upper
+	fs.Read["/"] = []string{lower}
+	if err := fs.Attach(); err != nil {
+		tb.Fatal(err)
+	}
+	return fs
+}
+
+func makeLower(tb testing.TB, size int) (string, []byte) {
+	lower := tb.TempDir()
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	err := ioutil.WriteFile(filepath.Join(lower, "big"), data, 0644)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return lower, data
+}
+
+func writeAt(tb testing.TB, fs *Fs, file *File, offset int, data []byte) {
+	_, err := file.WriteAt(fs, uint64(offset), uint64(len(data)), func(fd int) (int, error) {
+		return syscall.Pwrite(fd, data, int64(offset))
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+}
+
+func readAll(tb testing.TB, fs *Fs, file *File, chunk int) []byte {
+	var stat syscall.Stat_t
+	if err := file.Stat(&stat); err != nil {
+		tb.Fatal(err)
+	}
+	result := make([]byte, 0, stat.Size)
+	for offset := 0; offset < int(stat.Size); offset += chunk {
+		data := make([]byte, chunk)
+		fd, err := file.LockReadAt(fs, uint64(offset), uint64(chunk))
+		if err != nil {
+			tb.Fatal(err)
+		}
+		n, err := syscall.Pread(fd, data, int64(offset))
+		file.Unlock()
+		if err != nil {
+			tb.Fatal(err)
+		}
+		result = append(result, data[:n]...)
+	}
+	return result
+}
+
+func TestWriteMap(t *testing.T) {
+	lower, expected := makeLower(t, 1<<20+123)
+	upper := t.TempDir()
+	fs := newTestFs(t, upper, lower)
+	file, err := fs.Lookup("/big")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Append, and scribble in the middle.
+	writeAt(t, fs, file, len(expected), []byte("tail"))
+	writeAt(t, fs, file, 100000, []byte("abc"))
+	expected = append(expected, "tail"...)
+	copy(expected[100000:], "abc")
+
+	// Only the touched blocks were copied.
+	var stat syscall.Stat_t
+	if err := syscall.Stat(filepath.Join(upper, "big"), &stat); err != nil {
+		t.Fatal(err)
+	}
+	if stat.Blocks*512 > 4*WriteMapBlockSize {
+		t.Fatalf("copy is not sparse (%d blocks)", stat.Blocks)
+	}
+	if !bytes.Equal(readAll(t, fs, file, WriteMapBlockSize), expected) {
+		t.Fatalf("contents differ")
+	}
+
+	// The map survives a restart.
+	fs = newTestFs(t, upper, lower)
+	file, err = fs.Lookup("/big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(file.write_map) != 2 {
+		t.Fatalf("write map was lost")
+	}
+
+	// Unaligned reads populate what they straddle.
+	if !bytes.Equal(readAll(t, fs, file, 7000), expected) {
+		t.Fatalf("contents differ after restart")
+	}
+
+	// Shrinking drops the holes past the end.
+	if err := file.Truncate(fs, 50000); err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Truncate(fs, 200000); err != nil {
+		t.Fatal(err)
+	}
+	expected = append(expected[:50000], make([]byte, 150000)...)
+	if !bytes.Equal(readAll(t, fs, file, 7000), expected) {
+		t.Fatalf("contents differ after truncate")
+	}
+
+	// A rename leaves the read file behind.
+	if err := file.Rename(fs, "/big", "/moved"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(upper, "moved"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, expected) {
+		t.Fatalf("holes not filled on rename")
+	}
+	if !bytes.Equal(readAll(t, fs, file, 7000), expected) {
+		t.Fatalf("contents differ after rename")
+	}
+}
+
+//
+// Only what was actually written leaves the holes.
+//
+func TestShortWrite(t *testing.T) {
+	lower, expected := makeLower(t, 8*WriteMapBlockSize)
+	upper := t.TempDir()
+	fs := newTestFs(t, upper, lower)
+	file, err := fs.Lookup("/big")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A failed write is not seen.
+	offset := 2 * WriteMapBlockSize
+	data := bytes.Repeat([]byte("x"), 2*WriteMapBlockSize)
+	_, err = file.WriteAt(fs, uint64(offset), uint64(len(data)), func(fd int) (int, error) {
+		syscall.Pwrite(fd, data, int64(offset))
+		return -1, syscall.EIO
+	})
+	if err != syscall.EIO {
+		t.Fatalf("expected EIO, got %v", err)
+	}
+	if !bytes.Equal(readAll(t, fs, file, 7000), expected) {
+		t.Fatalf("failed write was kept")
+	}
+
+	// A short write keeps only what it wrote.
+	offset = 5 * WriteMapBlockSize
+	written, err := file.WriteAt(fs, uint64(offset), uint64(len(data)), func(fd int) (int, error) {
+		return syscall.Pwrite(fd, data[:10], int64(offset))
+	})
+	if err != nil || written != 10 {
+		t.Fatalf("got %d, %v", written, err)
+	}
+	copy(expected[offset:], data[:10])
+	if !bytes.Equal(readAll(t, fs, file, 7000), expected) {
+		t.Fatalf("contents differ after short write")
+	}
+}
+
+//
+// Files beneath a renamed directory keep their
+// contents (the holes can't follow them there).
+//
+func TestRenameDirectory(t *testing.T) {
+	lower, expected := makeLower(t, 4*WriteMapBlockSize)
+	if err := os.Mkdir(filepath.Join(lower, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"held", "dropped"} {
+		err := os.Rename(filepath.Join(lower, "big"), filepath.Join(lower, "dir", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(filepath.Join(lower, "big"), expected, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	upper := t.TempDir()
+	fs := newTestFs(t, upper, lower)
+
+	// One file we still have, and one we don't.
+	held, err := fs.Lookup("/dir/held")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.DecRef(fs, "/dir/held")
+	writeAt(t, fs, held, 100, []byte("held"))
+	dropped, err := fs.Lookup("/dir/dropped")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeAt(t, fs, dropped, 100, []byte("dropped"))
+	dropped.DecRef(fs, "/dir/dropped")
+
+	dir, err := fs.Lookup("/dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dir.DecRef(fs, "/moved")
+	if err := dir.Rename(fs, "/dir", "/moved"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"held", "dropped"} {
+		contents := append([]byte(nil), expected...)
+		copy(contents[100:], name)
+		checkContents(t, fs, "/moved/"+name, string(contents))
+	}
+}
+
+//
+// The first append to a large file
+// (this was a complete copy before).
+//
+func BenchmarkAppendLargeFile(b *testing.B) {
+	lower, data := makeLower(b, 64<<20)
+	tail := make([]byte, 4096)
+
+	for i := 0; i < b.N; i += 1 {
+		b.StopTimer()
+		fs := newTestFs(b, b.TempDir(), lower)
+		file, err := fs.Lookup("/big")
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+
+		writeAt(b, fs, file, len(data), tail)
+	}
+}
+
+//
+// Reading back a large file that's been appended to
+// (mostly from the read file, with the tail copied).
+//
+func BenchmarkReadAppendedFile(b *testing.B) {
+	lower, data := makeLower(b, 64<<20)
+	fs := newTestFs(b, b.TempDir(), lower)
+	file, err := fs.Lookup("/big")
+	if err != nil {
+		b.Fatal(err)
+	}
+	writeAt(b, fs, file, len(data), make([]byte, 4096))
+
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i += 1 {
+		readAll(b, fs, file, WriteMapBlockSize)
+	}
+}
@@ -2,12 +2,14 @@ package plan9
 
 /*
 #include <errno.h>
+#include <stdlib.h>
 #include <sys/types.h>
 #include <sys/xattr.h>
 */
 import "C"
 
 import (
+	"bytes"
 	"path"
 	"syscall"
 	"unsafe"
@@ -67,3 +69,169 @@ func cleardelattr(filepath string) error {
 	}
 	return nil
 }
+
+//
+// User extended attributes --
+//
+// These are read from whichever layer is on top,
+// and are always set in the write layer. (Note that
+// copying up doesn't currently preserve them).
+//
+
+func lgetxattr(filepath string, name string) ([]byte, error) {
+	c_path := C.CString(filepath)
+	defer C.free(unsafe.Pointer(c_path))
+	c_name := C.CString(name)
+	defer C.free(unsafe.Pointer(c_name))
+
+	for {
+		size, err := C.lgetxattr(c_path, c_name, nil, 0)
+		if size < 0 {
+			return nil, err
+		}
+
+		// This may have changed in between.
+		data := make([]byte, int(size)+1)
+		size, err = C.lgetxattr(
+			c_path,
+			c_name,
+			unsafe.Pointer(&data[0]),
+			C.size_t(len(data)))
+		if size < 0 {
+			if err == syscall.ERANGE {
+				continue
+			}
+			return nil, err
+		}
+		return data[:size], nil
+	}
+}
+
+func llistxattr(filepath string) ([]byte, error) {
+	c_path := C.CString(filepath)
+	defer C.free(unsafe.Pointer(c_path))
+
+	for {
+		size, err := C.llistxattr(c_path, nil, 0)
+		if size < 0 {
+			return nil, err
+		}
+
+		data := make([]byte, int(size)+1)
+		size, err = C.llistxattr(
+			c_path,
+			(*C.char)(unsafe.Pointer(&data[0])),
+			C.size_t(len(data)))
+		if size < 0 {
+			if err == syscall.ERANGE {
+				continue
+			}
+			return nil, err
+		}
+		return data[:size], nil
+	}
+}
+
+func lsetxattr(filepath string, name string, data []byte, flags int) error {
+	c_path := C.CString(filepath)
+	defer C.free(unsafe.Pointer(c_path))
+	c_name := C.CString(name)
+	defer C.free(unsafe.Pointer(c_name))
+
+	// There may be no data at all.
+	value := make([]byte, len(data)+1)
+	copy(value, data)
+
+	e, err := C.lsetxattr(
+		c_path,
+		c_name,
+		unsafe.Pointer(&value[0]),
+		C.size_t(len(data)),
+		C.int(flags))
+	if e != 0 {
+		return err
+	}
+	return nil
+}
+
+func lremovexattr(filepath string, name string) error {
+	c_path := C.CString(filepath)
+	defer C.free(unsafe.Pointer(c_path))
+	c_name := C.CString(name)
+	defer C.free(unsafe.Pointer(c_name))
+
+	e, err := C.lremovexattr(c_path, c_name)
+	if e != 0 {
+		return err
+	}
+	return nil
+}
+
+//
+// Get the named attribute, or the
+// list of names if none is given.
+//
+func (file *File) getxattr(name string) ([]byte, error) {
+	file.RWMutex.RLock()
+	defer file.RWMutex.RUnlock()
+
+	if !file.exists() {
+		return nil, Enoent
+	}
+	stat_path := file.read_path
+	if file.write_exists {
+		stat_path = file.write_path
+	}
+
+	if name == "" {
+		names, err := llistxattr(stat_path)
+		if err != nil {
+			return nil, err
+		}
+		return hideWriteMap(names), nil
+	}
+	if name == WriteMapAttr {
+		return nil, syscall.ENODATA
+	}
+	return lgetxattr(stat_path, name)
+}
+
+//
+// Drop our write map from a list of names.
+// (The list is a series of NUL-terminated names).
+//
+func hideWriteMap(names []byte) []byte {
+	result := make([]byte, 0, len(names))
+	for _, name := range bytes.SplitAfter(names, []byte{0}) {
+		if string(name) != WriteMapAttr+"\x00" {
+			result = append(result, name...)
+		}
+	}
+	return result
+}
+
+//
+// Set the named attribute. An empty value
+// removes it (this is how clients remove them).
+//
+func (file *File) setxattr(
+	fs *Fs,
+	path string,
+	name string,
+	data []byte,
+	flags int) error {
+
+	if name == WriteMapAttr {
+		return Eperm
+	}
+
+	write_path, err := file.CopyUp(fs, path)
+	if err != nil {
+		return err
+	}
+
+	if len(data) == 0 {
+		return lremovexattr(write_path, name)
+	}
+	return lsetxattr(write_path, name, data, flags)
+}
@@ -0,0 +1,206 @@
+// +build linux
+
+package kvm
+
+import (
+	"errors"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// IOCTL calls.
+// (KVM_IRQFD and KVM_SET_GSI_ROUTING).
+const (
+	IoctlIrqFd         = 0x4020ae76
+	IoctlSetGsiRouting = 0x4008ae6a
+)
+
+// IOCTL flags.
+const (
+	IrqFdFlagDeassign = 0x1
+)
+
+// Routing entry types.
+const (
+	IrqRoutingIrqChip = 1
+	IrqRoutingMsi     = 2
+)
+
+// Interrupt controllers.
+const (
+	IrqChipPicMaster = 0
+	IrqChipPicSlave  = 1
+	IrqChipIoApic    = 2
+)
+
+// The GSIs below this are the IOAPIC pins.
+// (We hand out the ones above for MSI routes,
+// up to the most routes the kernel will take).
+const (
+	IoApicPins = 24
+	MaxGsi     = 4096
+)
+
+var NoFreeGsi = errors.New("No free GSIs?")
+
+type irqFd struct {
+	Fd         uint32
+	Gsi        uint32
+	Flags      uint32
+	ResampleFd uint32
+	pad        [16]uint8
+}
+
+type irqRoutingEntry struct {
+	Gsi   uint32
+	Type  uint32
+	Flags uint32
+	pad   uint32
+	// This is a union; irqchip (chip, pin)
+	// or msi (address lo, address hi, data).
+	Union [8]uint32
+}
+
+type msiRoute struct {
+	Address Pointer
+	Data    uint32
+}
+
+// MSI routes --
+//
+// An irqfd sends whatever GSI it's bound to, so an MSI
+// needs a route (its own GSI) before it can be sent this
+// way. Setting the routing replaces the whole table, so
+// we keep the MSI routes here and put the default routes
+// (for the PICs and the IOAPIC) back in every time.
+type msiRouting struct {
+	sync.Mutex
+	routes map[uint32]msiRoute
+}
+
+// (The routing lock must be held).
+func (vm *VirtualMachine) setRouting() error {
+	entries := make([]irqRoutingEntry, 0, 16+IoApicPins+len(vm.routing.routes))
+
+	// The defaults, as the kernel has them.
+	for pin := uint32(0); pin < IoApicPins; pin += 1 {
+		if pin < 16 {
+			chip := uint32(IrqChipPicMaster)
+			if pin >= 8 {
+				chip = IrqChipPicSlave
+			}
+			entries = append(entries, irqRoutingEntry{
+				Gsi:   pin,
+				Type:  IrqRoutingIrqChip,
+				Union: [8]uint32{chip, pin % 8},
+			})
+		}
+		entries = append(entries, irqRoutingEntry{
+			Gsi:   pin,
+			Type:  IrqRoutingIrqChip,
+			Union: [8]uint32{IrqChipIoApic, pin},
+		})
+	}
+
+	for gsi, route := range vm.routing.routes {
+		entries = append(entries, irqRoutingEntry{
+			Gsi:  gsi,
+			Type: IrqRoutingMsi,
+			Union: [8]uint32{
+				uint32(route.Address & 0xffffffff),
+				uint32(route.Address >> 32),
+				route.Data,
+			},
+		})
+	}
+
+	// This is a struct kvm_irq_routing, which is
+	// a count and flags followed by the entries.
+	buffer := make([]byte, 8+len(entries)*int(unsafe.Sizeof(irqRoutingEntry{})))
+	*(*uint32)(unsafe.Pointer(&buffer[0])) = uint32(len(entries))
+	for i, entry := range entries {
+		offset := 8 + i*int(unsafe.Sizeof(entry))
+		*(*irqRoutingEntry)(unsafe.Pointer(&buffer[offset])) = entry
+	}
+
+	_, _, e := syscall.Syscall(syscall.SYS_IOCTL, uintptr(vm.Fd), uintptr(IoctlSetGsiRouting), uintptr(unsafe.Pointer(&buffer[0])))
+	if e != 0 {
+		return e
+	}
+	return nil
+}
+
+// Add an MSI route, and return its GSI.
+func (vm *VirtualMachine) NewMsiRoute(addr Pointer, data uint32) (uint32, error) {
+	vm.routing.Lock()
+	defer vm.routing.Unlock()
+
+	if vm.routing.routes == nil {
+		vm.routing.routes = make(map[uint32]msiRoute)
+	}
+	gsi := uint32(IoApicPins)
+	for ; gsi < MaxGsi; gsi += 1 {
+		if _, ok := vm.routing.routes[gsi]; !ok {
+			break
+		}
+	}
+	if gsi == MaxGsi {
+		return 0, NoFreeGsi
+	}
+
+	vm.routing.routes[gsi] = msiRoute{addr, data}
+	err := vm.setRouting()
+	if err != nil {
+		delete(vm.routing.routes, gsi)
+		return 0, err
+	}
+	return gsi, nil
+}
+
+// Change where an MSI route goes.
+func (vm *VirtualMachine) SetMsiRoute(gsi uint32, addr Pointer, data uint32) error {
+	vm.routing.Lock()
+	defer vm.routing.Unlock()
+
+	old, ok := vm.routing.routes[gsi]
+	if ok && old.Address == addr && old.Data == data {
+		return nil
+	}
+	vm.routing.routes[gsi] = msiRoute{addr, data}
+	err := vm.setRouting()
+	if err != nil {
+		vm.routing.routes[gsi] = old
+	}
+	return err
+}
+
+func (vm *VirtualMachine) FreeMsiRoute(gsi uint32) error {
+	vm.routing.Lock()
+	defer vm.routing.Unlock()
+
+	delete(vm.routing.routes, gsi)
+	return vm.setRouting()
+}
+
+// Bind (or unbind) an eventfd to the given GSI.
+// Whenever it's signalled, the kernel sends the
+// interrupt without us having to see it.
+func (vm *VirtualMachine) SetIrqFd(fd int, gsi uint32, unbind bool) error {
+	irqfd := irqFd{
+		Fd:  uint32(fd),
+		Gsi: gsi,
+	}
+	if unbind {
+		irqfd.Flags |= IrqFdFlagDeassign
+	}
+
+	// Bind / unbind the eventfd.
+	_, _, e := syscall.Syscall(syscall.SYS_IOCTL, uintptr(vm.Fd), uintptr(IoctlIrqFd), uintptr(unsafe.Pointer(&irqfd)))
+	if e != 0 {
+		return e
+	}
+
+	// Success.
+	return nil
+}
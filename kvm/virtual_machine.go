@@ -16,6 +16,9 @@ type VirtualMachine struct {
 	MemoryRegion int
 	CPUID        []CPUID
 	MSRs         []uint32
+
+	// Our MSI routes (for irqfds).
+	routing msiRouting
 }
 
 func (self *KVM) NewVM() (*VirtualMachine, error) {
@@ -5,3 +5,4 @@ import (
 )
 
 var InvalidSetupHeader = errors.New("Setup header past page boundary?")
+var CmdlineTooLong = errors.New("Command line longer than a page?")
@@ -104,6 +104,43 @@ func (sysmap *LinuxSystemMap) Lookup(
 	return sysmap.symbols[symaddr], uint64(addr - symaddr)
 }
 
+//
+// VirtioMmio --
+//
+// Devices that can't be found by probing. The kernel
+// needs to be told their address, size and interrupt.
+//
+type VirtioMmio interface {
+	VirtioMmio() (kvm.Pointer, uint64, kvm.Irq, bool)
+}
+
+//
+// Add a virtio_mmio.device= entry for each of the model's
+// virtio-mmio devices, unless the cmdline already has one.
+//
+func VirtioMmioCmdline(model *Model, cmdline string) string {
+	for _, device := range model.Devices() {
+		mmio, ok := device.(VirtioMmio)
+		if !ok {
+			continue
+		}
+		addr, size, irq, ok := mmio.VirtioMmio()
+		if !ok {
+			continue
+		}
+		if strings.Contains(cmdline, fmt.Sprintf("@%#x:", addr)) {
+			continue
+		}
+		entry := fmt.Sprintf("virtio_mmio.device=%#x@%#x:%d", size, addr, irq)
+		log.Printf("loader: Adding %s.", entry)
+		if len(cmdline) > 0 {
+			cmdline += " "
+		}
+		cmdline += entry
+	}
+	return cmdline
+}
+
 func LoadLinux(vcpu *kvm.Vcpu, model *Model, boot_params, vmlinux, initrd, cmdline, system_map string) (SystemMap, *Convention, error) {
 	// Read the boot_params.
 	log.Print("loader: Reading kernel image...")
@@ -157,6 +194,11 @@ func LoadLinux(vcpu *kvm.Vcpu, model *Model, boot_params, vmlinux, initrd, cmdli
 	} else {
 		convention = &Linux32Convention
 	}
+	// Tell the kernel about any virtio-mmio devices.
+	cmdline = VirtioMmioCmdline(model, cmdline)
+	if len(cmdline) >= kvm.PageSize {
+		return nil, nil, CmdlineTooLong
+	}
 	// Load the cmdline.
 	// NOTE: Here we create a full page with
 	// trailing zeros. This is the expected form
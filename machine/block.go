@@ -0,0 +1,153 @@
+package machine
+
+import (
+	"io"
+	"syscall"
+
+	unix "golang.org/x/sys/unix"
+)
+
+//
+// BlockBackend --
+//
+// The storage behind a VirtioBlockDevice. The device
+// itself only deals with requests from the guest and
+// simply issues reads and writes against the backend
+// at byte offsets. Backends are free to implement
+// these however they like (a flat file, an overlay,
+// a remote disk, etc.).
+//
+type BlockBackend interface {
+	io.ReaderAt
+	io.WriterAt
+
+	// Ensure all writes are on stable storage.
+	Flush() error
+
+	// The size of the disk (in bytes).
+	Size() (int64, error)
+
+	// The preferred block size.
+	BlockSize() int
+
+	// Release any resources.
+	Close() error
+}
+
+//
+// Backends may optionally support discard.
+//
+type BlockTrimmer interface {
+	// Release the given range.
+	Trim(offset int64, length int64) error
+
+	// Is trim actually available?
+	CanTrim() bool
+}
+
+//
+// Backends may optionally be read-only.
+//
+type BlockReadOnly interface {
+	ReadOnly() bool
+}
+
+//
+// BlockFile --
+//
+// The simplest backend: a flat file (or host block device).
+//
+type BlockFile struct {
+	// The backing file.
+	fd int
+}
+
+func NewBlockFile(fd int) *BlockFile {
+	return &BlockFile{fd: fd}
+}
+
+func (file *BlockFile) ReadAt(data []byte, offset int64) (int, error) {
+
+	done := 0
+
+	for done < len(data) {
+		n, err := syscall.Pread(file.fd, data[done:], offset+int64(done))
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return done, err
+		}
+		if n == 0 {
+			return done, io.EOF
+		}
+		done += n
+	}
+
+	return done, nil
+}
+
+func (file *BlockFile) WriteAt(data []byte, offset int64) (int, error) {
+
+	done := 0
+
+	for done < len(data) {
+		n, err := syscall.Pwrite(file.fd, data[done:], offset+int64(done))
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return done, err
+		}
+		done += n
+	}
+
+	return done, nil
+}
+
+func (file *BlockFile) Flush() error {
+	return syscall.Fdatasync(file.fd)
+}
+
+func (file *BlockFile) Size() (int64, error) {
+	var stat syscall.Stat_t
+	err := syscall.Fstat(file.fd, &stat)
+	if err != nil {
+		return 0, err
+	}
+	if stat.Mode&syscall.S_IFMT == syscall.S_IFBLK {
+		// Block devices report no size via stat.
+		return syscall.Seek(file.fd, 0, 2)
+	}
+	return stat.Size, nil
+}
+
+func (file *BlockFile) BlockSize() int {
+	var stat syscall.Stat_t
+	err := syscall.Fstat(file.fd, &stat)
+	if err != nil || stat.Blksize <= 0 {
+		return 512
+	}
+	return int(stat.Blksize)
+}
+
+//
+// Discards punch holes (for regular files only).
+//
+func (file *BlockFile) Trim(offset int64, length int64) error {
+	return unix.Fallocate(
+		file.fd,
+		unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE,
+		offset,
+		length)
+}
+
+func (file *BlockFile) CanTrim() bool {
+	var stat syscall.Stat_t
+	err := syscall.Fstat(file.fd, &stat)
+	return err == nil && stat.Mode&syscall.S_IFMT == syscall.S_IFREG
+}
+
+func (file *BlockFile) Close() error {
+	return syscall.Close(file.fd)
+}
@@ -0,0 +1,247 @@
+package machine
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+//
+// BlockBackupStatus --
+//
+// The progress of a backup job.
+//
+type BlockBackupStatus struct {
+	// Where the backup is going.
+	Target string `json:"target"`
+
+	// Only regions changed since the last backup?
+	Incremental bool `json:"incremental"`
+
+	// Still going?
+	Running bool `json:"running"`
+
+	// Bytes to copy, and bytes copied.
+	Total int64 `json:"total"`
+	Done  int64 `json:"done"`
+
+	// Why it failed (if it did).
+	Error string `json:"error,omitempty"`
+}
+
+//
+// BlockBackup --
+//
+// A backup job. This copies the regions in a snapshot
+// of the dirty bitmap (or everything, for a full backup)
+// to a raw target image at the same offsets.
+//
+// The backup is a point-in-time copy: if the guest writes
+// to a region we haven't copied yet, we copy the old data
+// out first (copy-before-write).
+//
+// A full backup creates a new (sparse) target. An
+// incremental backup writes only the changed regions, so
+// pointing it at a copy of the previous backup rolls that
+// copy forward to the current state.
+//
+type BlockBackup struct {
+	BlockBackupStatus
+
+	// What we're copying from, and to.
+	backend BlockBackend
+	target  *os.File
+
+	// The tracking bitmap.
+	dirty *BlockDirty
+
+	// The regions covered, and those still to copy.
+	snapshot []byte
+	pending  []byte
+
+	// Disk size.
+	size int64
+
+	// Set on failure or cancel.
+	err error
+
+	lock sync.Mutex
+}
+
+func NewBlockBackup(
+	backend BlockBackend,
+	dirty *BlockDirty,
+	target string,
+	incremental bool) (*BlockBackup, error) {
+
+	size, err := backend.Size()
+	if err != nil {
+		return nil, err
+	}
+
+	// Full backups always start from scratch.
+	flags := os.O_RDWR | os.O_CREATE
+	if !incremental {
+		flags |= os.O_EXCL
+	}
+	file, err := os.OpenFile(target, flags, 0600)
+	if err != nil {
+		return nil, err
+	}
+	err = file.Truncate(size)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	job := &BlockBackup{
+		BlockBackupStatus: BlockBackupStatus{
+			Target:      target,
+			Incremental: incremental,
+			Running:     true,
+		},
+		backend: backend,
+		target:  file,
+		dirty:   dirty,
+		size:    size,
+	}
+
+	// Take our snapshot.
+	// From here on, writes will come through before().
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	err = dirty.start(job)
+	if err != nil {
+		file.Close()
+		if !incremental {
+			os.Remove(target)
+		}
+		return nil, err
+	}
+	job.pending = make([]byte, len(job.snapshot))
+	copy(job.pending, job.snapshot)
+
+	for index := int64(0); index < job.count(); index += 1 {
+		if job.isPending(index) {
+			_, length := job.extent(index)
+			job.Total += length
+		}
+	}
+
+	go job.run()
+	return job, nil
+}
+
+func (job *BlockBackup) count() int64 {
+	return (job.size + job.dirty.Granularity - 1) / job.dirty.Granularity
+}
+
+func (job *BlockBackup) isPending(index int64) bool {
+	return job.pending[index/8]&(1<<uint(index%8)) != 0
+}
+
+func (job *BlockBackup) extent(index int64) (int64, int64) {
+	offset := index * job.dirty.Granularity
+	length := job.dirty.Granularity
+	if offset+length > job.size {
+		length = job.size - offset
+	}
+	return offset, length
+}
+
+//
+// Copy out a single region.
+// The job lock must be held.
+//
+func (job *BlockBackup) copyExtent(index int64) error {
+	offset, length := job.extent(index)
+	data := make([]byte, length)
+	n, err := job.backend.ReadAt(data, offset)
+	if err != nil && !(err == io.EOF && int64(n) == length) {
+		return err
+	}
+
+	// Full backups start out sparse; no need to write
+	// zeroes. Incrementals may be overwriting old data.
+	if job.Incremental || !isZero(data) {
+		_, err = job.target.WriteAt(data, offset)
+		if err != nil {
+			return err
+		}
+	}
+
+	job.pending[index/8] &^= 1 << uint(index%8)
+	job.Done += length
+	return nil
+}
+
+//
+// Called before the guest writes a region.
+//
+func (job *BlockBackup) before(offset int64, length int64) {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+
+	if job.err != nil || length <= 0 {
+		return
+	}
+	first := offset / job.dirty.Granularity
+	last := (offset + length - 1) / job.dirty.Granularity
+	for index := first; index <= last && index < job.count(); index += 1 {
+		if job.isPending(index) {
+			err := job.copyExtent(index)
+			if err != nil {
+				// The job is no good, but the
+				// guest's write should proceed.
+				job.err = err
+				return
+			}
+		}
+	}
+}
+
+func (job *BlockBackup) run() {
+	var err error
+
+	for index := int64(0); index < job.count(); index += 1 {
+		job.lock.Lock()
+		err = job.err
+		if err == nil && job.isPending(index) {
+			err = job.copyExtent(index)
+		}
+		job.lock.Unlock()
+		if err != nil {
+			break
+		}
+	}
+
+	if err == nil {
+		err = job.target.Sync()
+	}
+	job.target.Close()
+	job.dirty.finish(job, err)
+
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	job.Running = false
+	if err != nil {
+		job.err = err
+		job.Error = err.Error()
+	}
+}
+
+func (job *BlockBackup) Cancel() {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+
+	if job.err == nil {
+		job.err = BlockBackupCancelledErr
+	}
+}
+
+func (job *BlockBackup) Status() BlockBackupStatus {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+
+	return job.BlockBackupStatus
+}
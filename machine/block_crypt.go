@@ -0,0 +1,147 @@
+package machine
+
+import (
+	"sync"
+
+	cryptdisk "github.com/multiverse-os/portalgun/vm/fs/cryptdisk"
+	unix "golang.org/x/sys/unix"
+)
+
+//
+// BlockCrypt --
+//
+// An encrypted image (see fs/cryptdisk). The image
+// header is plaintext, so we can attach the device and
+// report its size right away, but all I/O fails (with
+// EIO) until a passphrase is supplied over the control
+// socket. The guest shouldn't be started before then.
+//
+// Once unlocked, the master key is stashed in a memfd
+// so that it can be handed to the new VMM on re-exec
+// without asking for the passphrase again.
+//
+type BlockCrypt struct {
+	// The master key memfd.
+	// (Zero until the image is unlocked).
+	KeyFd int `json:"key-fd,omitempty"`
+
+	// The encrypted image.
+	file *BlockFile
+
+	// The plaintext header.
+	header *cryptdisk.Header
+
+	// Our disk (once unlocked).
+	disk *cryptdisk.Disk
+
+	// Closed when unlocked.
+	unlocked chan struct{}
+
+	lock sync.Mutex
+}
+
+func (crypt *BlockCrypt) open(file *BlockFile) error {
+	header, err := cryptdisk.ReadHeader(file)
+	if err != nil {
+		return err
+	}
+	crypt.file = file
+	crypt.header = header
+	crypt.unlocked = make(chan struct{})
+
+	// Were we unlocked before a re-exec?
+	if crypt.KeyFd != 0 {
+		key := make([]byte, cryptdisk.KeyBytes)
+		_, err = unix.Pread(crypt.KeyFd, key, 0)
+		if err != nil {
+			return err
+		}
+		disk, err := cryptdisk.UnlockWithKey(file, key)
+		if err != nil {
+			return err
+		}
+		crypt.disk = disk
+		close(crypt.unlocked)
+	}
+
+	return nil
+}
+
+func (crypt *BlockCrypt) Unlock(passphrase []byte) error {
+	crypt.lock.Lock()
+	defer crypt.lock.Unlock()
+
+	if crypt.disk != nil {
+		return BlockAlreadyUnlockedErr
+	}
+
+	disk, err := cryptdisk.Unlock(crypt.file, passphrase)
+	if err != nil {
+		return err
+	}
+
+	// Stash the key for re-exec.
+	// NOTE: This is deliberately not CLOEXEC.
+	fd, err := unix.MemfdCreate("key", 0)
+	if err != nil {
+		return err
+	}
+	_, err = unix.Pwrite(fd, disk.Key(), 0)
+	if err != nil {
+		unix.Close(fd)
+		return err
+	}
+
+	crypt.KeyFd = fd
+	crypt.disk = disk
+	close(crypt.unlocked)
+	return nil
+}
+
+func (crypt *BlockCrypt) isUnlocked() bool {
+	select {
+	case <-crypt.unlocked:
+		return true
+	default:
+		return false
+	}
+}
+
+func (crypt *BlockCrypt) ReadAt(data []byte, offset int64) (int, error) {
+	if !crypt.isUnlocked() {
+		return 0, unix.EIO
+	}
+	return crypt.disk.ReadAt(data, offset)
+}
+
+func (crypt *BlockCrypt) WriteAt(data []byte, offset int64) (int, error) {
+	if !crypt.isUnlocked() {
+		return 0, unix.EIO
+	}
+	return crypt.disk.WriteAt(data, offset)
+}
+
+func (crypt *BlockCrypt) Flush() error {
+	// Nothing is written until we're unlocked,
+	// so there's no need to check here.
+	return crypt.file.Flush()
+}
+
+func (crypt *BlockCrypt) ReadOnly() bool {
+	return false
+}
+
+func (crypt *BlockCrypt) Size() (int64, error) {
+	return int64(crypt.header.Size), nil
+}
+
+func (crypt *BlockCrypt) BlockSize() int {
+	return cryptdisk.SectorSize
+}
+
+func (crypt *BlockCrypt) Close() error {
+	if crypt.KeyFd != 0 {
+		unix.Close(crypt.KeyFd)
+	}
+	return crypt.file.Close()
+}
@@ -0,0 +1,208 @@
+package machine
+
+import (
+	"sync"
+)
+
+//
+// The default tracking granularity.
+//
+const BlockDirtyGranularity = 64 * 1024
+
+//
+// BlockDirty --
+//
+// A bitmap of the regions of a disk written since the
+// last backup. The bitmap is saved with the device, so
+// it survives a re-exec and incremental backups remain
+// valid across upgrades.
+//
+type BlockDirty struct {
+	// Bytes per bit.
+	Granularity int64 `json:"granularity"`
+
+	// The bitmap itself.
+	Bitmap []byte `json:"bitmap"`
+
+	// Has a full backup completed?
+	// (Incrementals are meaningless until then).
+	Base bool `json:"base"`
+
+	// The running backup (if any).
+	job *BlockBackup
+
+	lock sync.Mutex
+}
+
+func (dirty *BlockDirty) init(size int64) {
+	dirty.lock.Lock()
+	defer dirty.lock.Unlock()
+
+	if dirty.Granularity <= 0 {
+		dirty.Granularity = BlockDirtyGranularity
+	}
+
+	bits := (size + dirty.Granularity - 1) / dirty.Granularity
+	if int64(len(dirty.Bitmap)) != (bits+7)/8 {
+		// New, or the disk has changed size.
+		// Whatever we had is no longer meaningful.
+		dirty.Bitmap = make([]byte, (bits+7)/8)
+		dirty.Base = false
+	}
+}
+
+//
+// Record a write (or trim).
+// Returns the running backup, which must be
+// given a chance to copy out the old data.
+//
+func (dirty *BlockDirty) mark(offset int64, length int64) *BlockBackup {
+	dirty.lock.Lock()
+	defer dirty.lock.Unlock()
+
+	if length <= 0 {
+		return dirty.job
+	}
+	first := offset / dirty.Granularity
+	last := (offset + length - 1) / dirty.Granularity
+	for index := first; index <= last && index/8 < int64(len(dirty.Bitmap)); index += 1 {
+		dirty.Bitmap[index/8] |= 1 << uint(index%8)
+	}
+
+	return dirty.job
+}
+
+//
+// Mark the whole disk (e.g. after it reverts).
+//
+func (dirty *BlockDirty) markAll() {
+	dirty.lock.Lock()
+	defer dirty.lock.Unlock()
+
+	for i := range dirty.Bitmap {
+		dirty.Bitmap[i] = 0xff
+	}
+}
+
+//
+// Take the bitmap for a new backup job.
+// The live bitmap is cleared, and starts tracking
+// writes made after this point.
+//
+func (dirty *BlockDirty) start(job *BlockBackup) error {
+	dirty.lock.Lock()
+	defer dirty.lock.Unlock()
+
+	if dirty.job != nil {
+		return BlockBackupRunningErr
+	}
+	if job.Incremental && !dirty.Base {
+		return BlockNoBaseBackupErr
+	}
+
+	snapshot := make([]byte, len(dirty.Bitmap))
+	if job.Incremental {
+		copy(snapshot, dirty.Bitmap)
+	} else {
+		for i := range snapshot {
+			snapshot[i] = 0xff
+		}
+	}
+	for i := range dirty.Bitmap {
+		dirty.Bitmap[i] = 0
+	}
+
+	job.snapshot = snapshot
+	dirty.job = job
+	return nil
+}
+
+//
+// A backup job is done.
+// If it failed, the regions it covered are still
+// dirty with respect to the last good backup.
+//
+func (dirty *BlockDirty) finish(job *BlockBackup, err error) {
+	dirty.lock.Lock()
+	defer dirty.lock.Unlock()
+
+	if err != nil {
+		mergeBitmap(dirty.Bitmap, job.snapshot)
+	} else if !job.Incremental {
+		dirty.Base = true
+	}
+	if dirty.job == job {
+		dirty.job = nil
+	}
+}
+
+//
+// Prepare the bitmap for saving.
+// A running backup will not survive a re-exec, so
+// we fold its regions back into the saved bitmap.
+// If they no longer line up (the disk has changed
+// size under the job), we can't save it faithfully.
+//
+func (dirty *BlockDirty) save() error {
+	dirty.lock.Lock()
+	defer dirty.lock.Unlock()
+
+	if dirty.job != nil {
+		if len(dirty.job.snapshot) != len(dirty.Bitmap) {
+			return BlockDirtyMismatchErr
+		}
+		mergeBitmap(dirty.Bitmap, dirty.job.snapshot)
+	}
+
+	return nil
+}
+
+func mergeBitmap(bitmap []byte, other []byte) {
+	for i := 0; i < len(bitmap) && i < len(other); i += 1 {
+		bitmap[i] |= other[i]
+	}
+}
+
+//
+// BlockTracker --
+//
+// Wraps a backend, recording all writes in a dirty
+// bitmap. This sits in front of whatever backend is
+// in use, so writes from NBD exports are tracked too.
+//
+type BlockTracker struct {
+	BlockBackend
+
+	dirty *BlockDirty
+}
+
+func (tracker *BlockTracker) before(offset int64, length int64) {
+	job := tracker.dirty.mark(offset, length)
+	if job != nil {
+		job.before(offset, length)
+	}
+}
+
+func (tracker *BlockTracker) WriteAt(data []byte, offset int64) (int, error) {
+	tracker.before(offset, int64(len(data)))
+	return tracker.BlockBackend.WriteAt(data, offset)
+}
+
+func (tracker *BlockTracker) Trim(offset int64, length int64) error {
+	trimmer, ok := tracker.BlockBackend.(BlockTrimmer)
+	if !ok {
+		return BlockNoDiscardErr
+	}
+	tracker.before(offset, length)
+	return trimmer.Trim(offset, length)
+}
+
+func (tracker *BlockTracker) CanTrim() bool {
+	trimmer, ok := tracker.BlockBackend.(BlockTrimmer)
+	return ok && trimmer.CanTrim()
+}
+
+func (tracker *BlockTracker) ReadOnly() bool {
+	readonly, ok := tracker.BlockBackend.(BlockReadOnly)
+	return ok && readonly.ReadOnly()
+}
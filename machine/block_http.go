@@ -0,0 +1,90 @@
+package machine
+
+import (
+	httpdisk "github.com/multiverse-os/portalgun/vm/fs/httpdisk"
+)
+
+//
+// BlockHttp --
+//
+// A read-only disk fetched on demand from an HTTP
+// server using range requests. Fetched chunks are
+// kept in a local (sparse) cache file, and the set of
+// cached chunks is saved with the device, so the cache
+// stays warm across a re-exec.
+//
+type BlockHttp struct {
+	// The image URL.
+	Url string `json:"url"`
+
+	// The local cache file.
+	Cache int `json:"cache"`
+
+	// Fetch size (in bytes).
+	ChunkSize int64 `json:"chunk-size"`
+
+	// Chunks to read ahead on sequential access.
+	Prefetch int `json:"prefetch"`
+
+	// Cached chunks, and the image version.
+	Cached []byte `json:"cached"`
+	ETag   string `json:"etag"`
+
+	// Our disk.
+	disk *httpdisk.Disk
+}
+
+func (remote *BlockHttp) open() error {
+	disk, err := httpdisk.Open(
+		remote.Url,
+		NewBlockFile(remote.Cache),
+		httpdisk.Options{
+			ChunkSize: remote.ChunkSize,
+			Prefetch:  remote.Prefetch,
+			Cached:    remote.Cached,
+			ETag:      remote.ETag,
+		})
+	if err != nil {
+		return err
+	}
+
+	remote.disk = disk
+	remote.sync()
+	return nil
+}
+
+func (remote *BlockHttp) sync() {
+	remote.Cached = remote.disk.Cached()
+	remote.ETag = remote.disk.ETag()
+}
+
+func (remote *BlockHttp) ReadAt(data []byte, offset int64) (int, error) {
+	return remote.disk.ReadAt(data, offset)
+}
+
+func (remote *BlockHttp) WriteAt(data []byte, offset int64) (int, error) {
+	return remote.disk.WriteAt(data, offset)
+}
+
+func (remote *BlockHttp) Flush() error {
+	// Nothing is ever dirty, but this is
+	// a good time to snapshot the cache state.
+	remote.sync()
+	return nil
+}
+
+func (remote *BlockHttp) ReadOnly() bool {
+	return true
+}
+
+func (remote *BlockHttp) Size() (int64, error) {
+	return remote.disk.Size()
+}
+
+func (remote *BlockHttp) BlockSize() int {
+	return 512
+}
+
+func (remote *BlockHttp) Close() error {
+	return NewBlockFile(remote.Cache).Close()
+}
@@ -0,0 +1,81 @@
+package machine
+
+import (
+	nbd "github.com/multiverse-os/portalgun/vm/fs/nbd"
+)
+
+//
+// BlockNbd --
+//
+// A disk served by a remote NBD server.
+//
+// We only serialize the address, and reconnect on
+// Attach(). Our socket is opened CLOEXEC by the net
+// package, so it doesn't survive a re-exec anyways.
+// Any writes we've acknowledged to the guest have
+// already been acknowledged by the server.
+//
+type BlockNbd struct {
+	// Either "unix" or "tcp".
+	Network string `json:"network"`
+
+	// The server address (or socket path).
+	Address string `json:"address"`
+
+	// The export name.
+	Export string `json:"export"`
+
+	// Our connection.
+	client *nbd.Client
+}
+
+func (remote *BlockNbd) open() error {
+	network := remote.Network
+	if network == "" {
+		network = "unix"
+	}
+
+	client, err := nbd.Dial(network, remote.Address, remote.Export)
+	if err != nil {
+		return err
+	}
+
+	remote.client = client
+	return nil
+}
+
+func (remote *BlockNbd) ReadAt(data []byte, offset int64) (int, error) {
+	return remote.client.ReadAt(data, offset)
+}
+
+func (remote *BlockNbd) WriteAt(data []byte, offset int64) (int, error) {
+	return remote.client.WriteAt(data, offset)
+}
+
+func (remote *BlockNbd) Flush() error {
+	return remote.client.Flush()
+}
+
+func (remote *BlockNbd) Trim(offset int64, length int64) error {
+	return remote.client.Trim(offset, length)
+}
+
+func (remote *BlockNbd) CanTrim() bool {
+	return remote.client.CanTrim()
+}
+
+func (remote *BlockNbd) ReadOnly() bool {
+	return remote.client.ReadOnly()
+}
+
+func (remote *BlockNbd) Size() (int64, error) {
+	return remote.client.Size()
+}
+
+func (remote *BlockNbd) BlockSize() int {
+	return 512
+}
+
+func (remote *BlockNbd) Close() error {
+	return remote.client.Close()
+}
@@ -0,0 +1,448 @@
+package machine
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+	"syscall"
+)
+
+//
+// BlockOverlay --
+//
+// A copy-on-write overlay over a read-only base image.
+//
+// Reads go to the base image unless the cluster has been
+// written, in which case they come from the delta file.
+// The delta file is laid out as follows:
+//
+//   [header][allocation bitmap][data]
+//
+// The data area is addressed identically to the disk
+// (i.e. cluster N lives at data offset + N * cluster size),
+// and we rely on the host filesystem to keep it sparse.
+// The bitmap is kept on disk at all times, so the overlay
+// can be reopened after a re-exec (or by another process)
+// using nothing but the delta file itself.
+//
+type BlockOverlay struct {
+	// The delta file.
+	Delta int `json:"delta"`
+
+	// The cluster size for new deltas.
+	// (Existing deltas use the size in the header).
+	ClusterSize int `json:"cluster-size"`
+
+	// The base image.
+	base *BlockFile
+
+	// Our delta geometry.
+	size        int64
+	cluster     int64
+	data_offset int64
+
+	// Allocated clusters.
+	bitmap []byte
+
+	// Serialize against commit & discard.
+	lock sync.RWMutex
+}
+
+const (
+	BlockOverlayMagic          = "NOVMCOW\x00"
+	BlockOverlayVersion        = 1
+	BlockOverlayHeaderSize     = 4096
+	BlockOverlayDefaultCluster = 64 * 1024
+)
+
+//
+// On-disk header offsets.
+//
+const (
+	blockOverlayOffsetMagic   = 0
+	blockOverlayOffsetVersion = 8
+	blockOverlayOffsetCluster = 12
+	blockOverlayOffsetSize    = 16
+	blockOverlayOffsetData    = 24
+)
+
+func (overlay *BlockOverlay) open(base *BlockFile) error {
+
+	overlay.base = base
+
+	size, err := base.Size()
+	if err != nil {
+		return err
+	}
+
+	var stat syscall.Stat_t
+	err = syscall.Fstat(overlay.Delta, &stat)
+	if err != nil {
+		return err
+	}
+
+	if stat.Size == 0 {
+		// Fresh delta.
+		return overlay.create(size)
+	}
+
+	// Read the existing header.
+	header := make([]byte, BlockOverlayHeaderSize)
+	_, err = NewBlockFile(overlay.Delta).ReadAt(header, 0)
+	if err != nil {
+		return err
+	}
+	if string(header[:8]) != BlockOverlayMagic ||
+		binary.LittleEndian.Uint32(header[blockOverlayOffsetVersion:]) != BlockOverlayVersion {
+		return BlockOverlayInvalidErr
+	}
+
+	overlay.cluster = int64(binary.LittleEndian.Uint32(header[blockOverlayOffsetCluster:]))
+	overlay.size = int64(binary.LittleEndian.Uint64(header[blockOverlayOffsetSize:]))
+	overlay.data_offset = int64(binary.LittleEndian.Uint64(header[blockOverlayOffsetData:]))
+
+	// The base must not have changed underneath us.
+	if overlay.size != size {
+		return BlockOverlayMismatchErr
+	}
+	if overlay.cluster == 0 ||
+		(overlay.cluster-1)&overlay.cluster != 0 ||
+		overlay.data_offset < BlockOverlayHeaderSize+overlay.bitmapSize() {
+		return BlockOverlayInvalidErr
+	}
+
+	// Load the allocation bitmap.
+	overlay.bitmap = make([]byte, overlay.bitmapSize())
+	_, err = NewBlockFile(overlay.Delta).ReadAt(
+		overlay.bitmap,
+		BlockOverlayHeaderSize)
+	return err
+}
+
+func (overlay *BlockOverlay) create(size int64) error {
+
+	overlay.size = size
+	overlay.cluster = int64(overlay.ClusterSize)
+	if overlay.cluster == 0 {
+		overlay.cluster = BlockOverlayDefaultCluster
+	}
+	if overlay.cluster < 512 || (overlay.cluster-1)&overlay.cluster != 0 {
+		return BlockOverlayInvalidErr
+	}
+
+	// Align the data to a cluster boundary.
+	overlay.bitmap = make([]byte, overlay.bitmapSize())
+	overlay.data_offset = BlockOverlayHeaderSize + int64(len(overlay.bitmap))
+	overlay.data_offset = (overlay.data_offset + overlay.cluster - 1) &^ (overlay.cluster - 1)
+
+	header := make([]byte, BlockOverlayHeaderSize)
+	copy(header[blockOverlayOffsetMagic:], BlockOverlayMagic)
+	binary.LittleEndian.PutUint32(header[blockOverlayOffsetVersion:], BlockOverlayVersion)
+	binary.LittleEndian.PutUint32(header[blockOverlayOffsetCluster:], uint32(overlay.cluster))
+	binary.LittleEndian.PutUint64(header[blockOverlayOffsetSize:], uint64(overlay.size))
+	binary.LittleEndian.PutUint64(header[blockOverlayOffsetData:], uint64(overlay.data_offset))
+
+	delta := NewBlockFile(overlay.Delta)
+	_, err := delta.WriteAt(header, 0)
+	if err != nil {
+		return err
+	}
+	_, err = delta.WriteAt(overlay.bitmap, BlockOverlayHeaderSize)
+	if err != nil {
+		return err
+	}
+
+	return delta.Flush()
+}
+
+func (overlay *BlockOverlay) bitmapSize() int64 {
+	clusters := (overlay.size + overlay.cluster - 1) / overlay.cluster
+	return (clusters + 7) / 8
+}
+
+func (overlay *BlockOverlay) isAllocated(cluster int64) bool {
+	return overlay.bitmap[cluster/8]&(1<<uint(cluster%8)) != 0
+}
+
+func (overlay *BlockOverlay) allocate(cluster int64) error {
+
+	overlay.bitmap[cluster/8] |= 1 << uint(cluster%8)
+
+	// Persist just the byte that changed.
+	_, err := NewBlockFile(overlay.Delta).WriteAt(
+		overlay.bitmap[cluster/8:cluster/8+1],
+		BlockOverlayHeaderSize+cluster/8)
+	return err
+}
+
+//
+// Walk the clusters covered by [offset, offset+length).
+//
+func (overlay *BlockOverlay) walk(
+	offset int64,
+	length int,
+	fn func(cluster int64, cluster_offset int64, start int, end int) error) error {
+
+	done := 0
+
+	for done < length {
+		pos := offset + int64(done)
+		cluster := pos / overlay.cluster
+		cluster_offset := pos % overlay.cluster
+
+		chunk := int(overlay.cluster - cluster_offset)
+		if chunk > length-done {
+			chunk = length - done
+		}
+
+		err := fn(cluster, cluster_offset, done, done+chunk)
+		if err != nil {
+			return err
+		}
+		done += chunk
+	}
+
+	return nil
+}
+
+func (overlay *BlockOverlay) ReadAt(data []byte, offset int64) (int, error) {
+	overlay.lock.RLock()
+	defer overlay.lock.RUnlock()
+
+	if offset >= overlay.size {
+		return 0, io.EOF
+	}
+	short := false
+	if offset+int64(len(data)) > overlay.size {
+		data = data[:overlay.size-offset]
+		short = true
+	}
+
+	delta := NewBlockFile(overlay.Delta)
+
+	err := overlay.walk(offset, len(data),
+		func(cluster int64, cluster_offset int64, start int, end int) error {
+			var err error
+			if overlay.isAllocated(cluster) {
+				_, err = delta.ReadAt(
+					data[start:end],
+					overlay.data_offset+cluster*overlay.cluster+cluster_offset)
+			} else {
+				_, err = overlay.base.ReadAt(
+					data[start:end],
+					cluster*overlay.cluster+cluster_offset)
+			}
+			return err
+		})
+	if err != nil {
+		return 0, err
+	}
+
+	if short {
+		return len(data), io.EOF
+	}
+	return len(data), nil
+}
+
+func (overlay *BlockOverlay) WriteAt(data []byte, offset int64) (int, error) {
+	overlay.lock.Lock()
+	defer overlay.lock.Unlock()
+
+	if offset+int64(len(data)) > overlay.size {
+		return 0, syscall.ENOSPC
+	}
+
+	delta := NewBlockFile(overlay.Delta)
+
+	err := overlay.walk(offset, len(data),
+		func(cluster int64, cluster_offset int64, start int, end int) error {
+
+			cluster_start := cluster * overlay.cluster
+
+			if !overlay.isAllocated(cluster) && int64(end-start) != overlay.cluster {
+				// Partial write of a fresh cluster.
+				// We need to copy up the rest from the base.
+				length := overlay.cluster
+				if cluster_start+length > overlay.size {
+					length = overlay.size - cluster_start
+				}
+				copy_up := make([]byte, length)
+				_, err := overlay.base.ReadAt(copy_up, cluster_start)
+				if err != nil && err != io.EOF {
+					return err
+				}
+				copy(copy_up[cluster_offset:], data[start:end])
+				_, err = delta.WriteAt(copy_up, overlay.data_offset+cluster_start)
+				if err != nil {
+					return err
+				}
+			} else {
+				_, err := delta.WriteAt(
+					data[start:end],
+					overlay.data_offset+cluster_start+cluster_offset)
+				if err != nil {
+					return err
+				}
+			}
+
+			if !overlay.isAllocated(cluster) {
+				return overlay.allocate(cluster)
+			}
+			return nil
+		})
+	if err != nil {
+		return 0, err
+	}
+
+	return len(data), nil
+}
+
+func (overlay *BlockOverlay) Flush() error {
+	return NewBlockFile(overlay.Delta).Flush()
+}
+
+func (overlay *BlockOverlay) Size() (int64, error) {
+	return overlay.size, nil
+}
+
+func (overlay *BlockOverlay) BlockSize() int {
+	return overlay.base.BlockSize()
+}
+
+func (overlay *BlockOverlay) Close() error {
+	syscall.Close(overlay.Delta)
+	return overlay.base.Close()
+}
+
+//
+// Allocated clusters (for inspection).
+//
+func (overlay *BlockOverlay) Allocated() int64 {
+	overlay.lock.RLock()
+	defer overlay.lock.RUnlock()
+
+	count := int64(0)
+	for cluster := int64(0); cluster*overlay.cluster < overlay.size; cluster += 1 {
+		if overlay.isAllocated(cluster) {
+			count += 1
+		}
+	}
+	return count
+}
+
+//
+// Drop all changes in the delta.
+//
+func (overlay *BlockOverlay) Discard() error {
+	overlay.lock.Lock()
+	defer overlay.lock.Unlock()
+
+	return overlay.reset()
+}
+
+func (overlay *BlockOverlay) reset() error {
+
+	// Clear the bitmap first, so that a crash
+	// part way through leaves a consistent delta.
+	for i := 0; i < len(overlay.bitmap); i += 1 {
+		overlay.bitmap[i] = 0
+	}
+	delta := NewBlockFile(overlay.Delta)
+	_, err := delta.WriteAt(overlay.bitmap, BlockOverlayHeaderSize)
+	if err != nil {
+		return err
+	}
+	err = delta.Flush()
+	if err != nil {
+		return err
+	}
+
+	// Release all the data blocks.
+	return syscall.Ftruncate(overlay.Delta, overlay.data_offset)
+}
+
+//
+// Write the merged image to path, switch to
+// it as our new base and drop the delta.
+//
+// The new base is returned, so that the
+// device can record the new descriptor.
+//
+func (overlay *BlockOverlay) Commit(path string) (int, error) {
+	overlay.lock.Lock()
+	defer overlay.lock.Unlock()
+
+	fd, err := syscall.Open(
+		path,
+		syscall.O_RDWR|syscall.O_CREAT|syscall.O_EXCL,
+		0644)
+	if err != nil {
+		return -1, err
+	}
+	target := NewBlockFile(fd)
+
+	cleanup := func(err error) (int, error) {
+		target.Close()
+		syscall.Unlink(path)
+		return -1, err
+	}
+
+	err = syscall.Ftruncate(fd, overlay.size)
+	if err != nil {
+		return cleanup(err)
+	}
+
+	// Copy everything across, leaving
+	// holes wherever the cluster is zero.
+	delta := NewBlockFile(overlay.Delta)
+	data := make([]byte, overlay.cluster)
+	for offset := int64(0); offset < overlay.size; offset += overlay.cluster {
+		chunk := data
+		if offset+overlay.cluster > overlay.size {
+			chunk = data[:overlay.size-offset]
+		}
+		cluster := offset / overlay.cluster
+		if overlay.isAllocated(cluster) {
+			_, err = delta.ReadAt(chunk, overlay.data_offset+offset)
+		} else {
+			_, err = overlay.base.ReadAt(chunk, offset)
+		}
+		if err != nil && err != io.EOF {
+			return cleanup(err)
+		}
+		if isZero(chunk) {
+			continue
+		}
+		_, err = target.WriteAt(chunk, offset)
+		if err != nil {
+			return cleanup(err)
+		}
+	}
+	err = target.Flush()
+	if err != nil {
+		return cleanup(err)
+	}
+
+	// Reopen read-only.
+	// (Note that we don't open this CLOEXEC,
+	// so that it persists across a re-exec).
+	base_fd, err := syscall.Open(path, syscall.O_RDONLY, 0)
+	if err != nil {
+		return cleanup(err)
+	}
+	target.Close()
+
+	// Swap bases and empty the delta.
+	overlay.base.Close()
+	overlay.base = NewBlockFile(base_fd)
+	return base_fd, overlay.reset()
+}
+
+func isZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
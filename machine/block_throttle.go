@@ -0,0 +1,165 @@
+package machine
+
+import (
+	"sync"
+	"time"
+)
+
+//
+// BlockLimit --
+//
+// A single token bucket limit. The rate is in
+// operations (or bytes) per second, and the burst
+// is the size of the bucket. A zero rate means
+// the limit is not enforced at all.
+//
+type BlockLimit struct {
+	Rate  uint64 `json:"rate"`
+	Burst uint64 `json:"burst"`
+}
+
+//
+// BlockLimits --
+//
+// The full set of limits for a block device.
+//
+type BlockLimits struct {
+	ReadIops  BlockLimit `json:"read-iops"`
+	WriteIops BlockLimit `json:"write-iops"`
+	ReadBps   BlockLimit `json:"read-bps"`
+	WriteBps  BlockLimit `json:"write-bps"`
+}
+
+//
+// BlockThrottleStats --
+//
+// Counters for time spent waiting on limits.
+//
+type BlockThrottleStats struct {
+	// Requests which had to wait.
+	ReadsThrottled  uint64 `json:"reads-throttled"`
+	WritesThrottled uint64 `json:"writes-throttled"`
+
+	// Total time spent waiting (in ns).
+	ReadWait  int64 `json:"read-wait"`
+	WriteWait int64 `json:"write-wait"`
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (bucket *tokenBucket) take(
+	limit BlockLimit,
+	amount float64,
+	now time.Time) time.Duration {
+
+	if limit.Rate == 0 {
+		// Unlimited.
+		bucket.last = now
+		return 0
+	}
+
+	burst := float64(limit.Burst)
+	if burst < float64(limit.Rate) {
+		// We always allow at least a second's worth.
+		burst = float64(limit.Rate)
+	}
+
+	// Refill since our last request.
+	if !bucket.last.IsZero() {
+		bucket.tokens += now.Sub(bucket.last).Seconds() * float64(limit.Rate)
+	} else {
+		bucket.tokens = burst
+	}
+	if bucket.tokens > burst {
+		bucket.tokens = burst
+	}
+	bucket.last = now
+
+	// Take our tokens. We allow the bucket to go
+	// into debt, so that requests larger than the
+	// burst can still make progress. The caller
+	// waits until the debt has been paid off.
+	bucket.tokens -= amount
+	if bucket.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-bucket.tokens / float64(limit.Rate) * float64(time.Second))
+}
+
+//
+// BlockThrottle --
+//
+// Token bucket throttling for block requests.
+//
+type BlockThrottle struct {
+	BlockLimits
+	BlockThrottleStats
+
+	read_iops  tokenBucket
+	write_iops tokenBucket
+	read_bps   tokenBucket
+	write_bps  tokenBucket
+
+	lock sync.Mutex
+}
+
+func (throttle *BlockThrottle) SetLimits(limits BlockLimits) {
+	throttle.lock.Lock()
+	defer throttle.lock.Unlock()
+
+	throttle.BlockLimits = limits
+}
+
+func (throttle *BlockThrottle) Stats() BlockThrottleStats {
+	throttle.lock.Lock()
+	defer throttle.lock.Unlock()
+
+	return throttle.BlockThrottleStats
+}
+
+//
+// Block until a request of the given size is allowed.
+//
+func (throttle *BlockThrottle) Wait(write bool, length int) {
+	throttle.lock.Lock()
+
+	now := time.Now()
+	var wait time.Duration
+
+	if write {
+		iops := throttle.write_iops.take(throttle.WriteIops, 1, now)
+		bps := throttle.write_bps.take(throttle.WriteBps, float64(length), now)
+		wait = maxDuration(iops, bps)
+		if wait > 0 {
+			throttle.WritesThrottled += 1
+			throttle.WriteWait += int64(wait)
+		}
+	} else {
+		iops := throttle.read_iops.take(throttle.ReadIops, 1, now)
+		bps := throttle.read_bps.take(throttle.ReadBps, float64(length), now)
+		wait = maxDuration(iops, bps)
+		if wait > 0 {
+			throttle.ReadsThrottled += 1
+			throttle.ReadWait += int64(wait)
+		}
+	}
+
+	throttle.lock.Unlock()
+
+	// Sleep outside the lock, so limits
+	// can still be adjusted in the meantime.
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+func maxDuration(a time.Duration, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
+}
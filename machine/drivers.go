@@ -23,4 +23,10 @@ var drivers = map[string]Driver{
 	"virtio-mmio-net":     NewVirtioMMIONet,
 	"virtio-pci-fs":       NewVirtioPCIFs,
 	"virtio-mmio-fs":      NewVirtioMMIOFs,
+	"virtio-pci-vsock":    NewVirtioPciVsock,
+	"virtio-mmio-vsock":   NewVirtioMmioVsock,
+	"virtio-pci-scsi":     NewVirtioPciScsi,
+	"virtio-mmio-scsi":    NewVirtioMmioScsi,
+	"virtio-pci-fuse":     NewVirtioPciFuse,
+	"virtio-mmio-fuse":    NewVirtioMmioFuse,
 }
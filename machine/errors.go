@@ -33,6 +33,40 @@ var (
 	// Virtio errors.
 	VirtioInvalidQueueSizeErr      = errors.New("Invalid VirtIO queue size!")
 	VirtioUnsupportedVnetHeaderErr = errors.New("Unsupported vnet header size.")
+	VirtioNetBadCommandErr         = errors.New("Bad virtio-net control command.")
+	VirtioNetTooManyQueuesErr      = errors.New("Too many virtio-net queues.")
+	VirtioNetNoTapErr              = errors.New("Multiple queues require a tap name.")
+	VirtioNetNoAnnounceErr         = errors.New("Guest does not support announce.")
+	VirtioNetCaptureRunningErr     = errors.New("Capture already running!")
+	VirtioNetNoCaptureErr          = errors.New("No capture running.")
+	VirtioNetBadRuleErr            = errors.New("Invalid firewall rule.")
+	VirtioNetNoFirewallErr         = errors.New("No firewall configured.")
+	VirtioNetVhostErr              = errors.New("Not supported with vhost-net.")
+	VirtioVsockInvalidCidErr       = errors.New("Invalid vsock guest cid.")
+	VirtioVsockNoPathErr           = errors.New("No vsock socket path.")
+	VirtioConsoleBadPortErr        = errors.New("Invalid console port.")
+	VirtioConsolePortExistsErr     = errors.New("Console port already exists.")
+	VirtioConsoleTooManyPortsErr   = errors.New("Too many console ports.")
+	VirtioConsoleNoPortErr         = errors.New("No such console port.")
+	VirtioConsoleNotConsoleErr     = errors.New("Port is not a console.")
+	VirtioScsiBadLunErr            = errors.New("Invalid scsi lun.")
+	VirtioScsiLunExistsErr         = errors.New("Scsi lun already exists.")
+	VirtioScsiNoLunErr             = errors.New("No such scsi lun.")
+	VirtioFuseInvalidTagErr        = errors.New("Invalid virtio-fs tag (must be 1-36 bytes).")
+	// Block errors.
+	BlockOverlayInvalidErr  = errors.New("Invalid overlay delta!")
+	BlockOverlayMismatchErr = errors.New("Overlay delta does not match base!")
+	BlockNoOverlayErr       = errors.New("Block device has no overlay.")
+	BlockNoDiscardErr       = errors.New("Block device does not support discard.")
+	BlockAlreadyExportedErr = errors.New("Block device already exported!")
+	BlockNotExportedErr     = errors.New("Block device not exported!")
+	BlockNotEncryptedErr    = errors.New("Block device is not encrypted.")
+	BlockAlreadyUnlockedErr = errors.New("Block device already unlocked!")
+	BlockBackupRunningErr   = errors.New("Backup already running!")
+	BlockNoBaseBackupErr    = errors.New("No full backup to increment from.")
+	BlockNoBackupErr        = errors.New("No backup job.")
+	BlockBackupCancelledErr = errors.New("Backup cancelled.")
+	BlockDirtyMismatchErr   = errors.New("Dirty bitmap does not match backup!")
 	// I/O memoize errors.
 	// This is an internal-only error which is returned from
 	// a write handler. When this is returned (and the cache
@@ -86,6 +86,7 @@ func (mmio *MmioDevice) Attach(vm *kvm.VirtualMachine, model *Model) error {
 			if _, ok := model.InterruptMap[irq]; !ok {
 				model.InterruptMap[irq] = mmio
 				mmio.InterruptNumber = irq
+				break
 			}
 		}
 	}
@@ -2,6 +2,7 @@ package machine
 
 import (
 	"math"
+	"sync"
 
 	kvm "github.com/multiverse-os/portalgun/vm/kvm"
 )
@@ -64,6 +65,19 @@ type MsiXDevice struct {
 
 	// Our saved interrupt function.
 	msi_interrupt func(addr kvm.Pointer, data uint32) error
+
+	// Vectors sent by the kernel (via irqfds),
+	// keyed by the eventfd.
+	irqfds     map[int]*msiIrqFd
+	irqfd_lock sync.Mutex
+
+	vm *kvm.VirtualMachine
+}
+
+type msiIrqFd struct {
+	vector int
+	gsi    uint32
+	bound  bool
 }
 
 func (msix *MsiXEntry) Read(offset uint64, size uint) (uint64, error) {
@@ -129,7 +143,7 @@ func (msix *MsiXDevice) IsMasked(vector int) bool {
 	if msix.MsiXConf.Control.Value&PciMsiXControlMasked != 0 {
 		return true
 	}
-	entry := msix.FindEntry(int(vector / 8))
+	entry := msix.FindEntry(vector)
 	if entry != nil && entry.Control.Value&PciMsiXEntryControlMasked != 0 {
 		return true
 	}
@@ -198,6 +212,7 @@ func (msix *MsiXDevice) Write(offset uint64, size uint, value uint64) error {
 	entry.MsiXDevice = msix
 
 	defer msix.CheckPending(int(offset / PciMsiXEntrySize))
+	defer msix.syncIrqFds()
 	return entry.Write(offset%PciMsiXEntrySize, size, value)
 }
 
@@ -227,6 +242,7 @@ func (msix *MsiXConf) Write(offset uint64, size uint, value uint64) error {
 	case 0:
 		msix.Debug("msix write control %x @ %x", value, offset)
 		defer msix.MsiXDevice.CheckAllPending()
+		defer msix.MsiXDevice.syncIrqFds()
 		return msix.Control.Write(0, size, value)
 	case 2:
 		msix.Debug("msix write table-offset %x @ %x", value, offset)
@@ -310,6 +326,7 @@ func (msix *MsiXDevice) Attach(vm *kvm.VirtualMachine, model *Model) error {
 	msix.msi_interrupt = func(addr kvm.Pointer, data uint32) error {
 		return vm.SignalMSI(addr, data, 0)
 	}
+	msix.vm = vm
 
 	// Attach to the PciBus.
 	return msix.PciDevice.Attach(vm, model)
@@ -353,3 +370,101 @@ func (msix *MsiXDevice) SendInterrupt(vector int) error {
 
 	return msix.msi_interrupt(kvm.Pointer(paddr), uint32(data))
 }
+
+//
+// Have the kernel send the given vector whenever the
+// eventfd is signalled (via an irqfd), rather than us.
+//
+// This only holds while MSI-X is enabled and the vector
+// is unmasked (as the kernel knows nothing of either).
+// Otherwise the irqfd is unbound, and the caller is left
+// to read the eventfd and SendInterrupt() as usual, which
+// takes care of the pending bit.
+//
+func (msix *MsiXDevice) BindVector(vm *kvm.VirtualMachine, vector int, fd int) error {
+	msix.irqfd_lock.Lock()
+	defer msix.irqfd_lock.Unlock()
+
+	// On restore, queues start before we're attached.
+	msix.vm = vm
+
+	entry := msix.FindEntry(vector)
+	if entry == nil {
+		return PciMSIErrorErr
+	}
+	gsi, err := msix.vm.NewMsiRoute(
+		kvm.Pointer(entry.Address.Value),
+		uint32(entry.Data.Value))
+	if err != nil {
+		return err
+	}
+
+	if msix.irqfds == nil {
+		msix.irqfds = make(map[int]*msiIrqFd)
+	}
+	irqfd := &msiIrqFd{vector: vector, gsi: gsi}
+	msix.irqfds[fd] = irqfd
+	return msix.syncIrqFd(fd, irqfd)
+}
+
+func (msix *MsiXDevice) UnbindVector(fd int) error {
+	msix.irqfd_lock.Lock()
+	defer msix.irqfd_lock.Unlock()
+
+	irqfd, ok := msix.irqfds[fd]
+	if !ok {
+		return nil
+	}
+	delete(msix.irqfds, fd)
+	if irqfd.bound {
+		err := msix.vm.SetIrqFd(fd, irqfd.gsi, true)
+		if err != nil {
+			return err
+		}
+	}
+	return msix.vm.FreeMsiRoute(irqfd.gsi)
+}
+
+//
+// Bring an irqfd in line with its vector.
+// (The irqfd_lock must be held).
+//
+func (msix *MsiXDevice) syncIrqFd(fd int, irqfd *msiIrqFd) error {
+	entry := msix.FindEntry(irqfd.vector)
+	if msix.IsMSIXEnabled() && !msix.IsMasked(irqfd.vector) {
+		// The guest may have moved it.
+		err := msix.vm.SetMsiRoute(
+			irqfd.gsi,
+			kvm.Pointer(entry.Address.Value),
+			uint32(entry.Data.Value))
+		if err != nil {
+			return err
+		}
+		if !irqfd.bound {
+			err = msix.vm.SetIrqFd(fd, irqfd.gsi, false)
+			if err != nil {
+				return err
+			}
+			irqfd.bound = true
+		}
+	} else if irqfd.bound {
+		err := msix.vm.SetIrqFd(fd, irqfd.gsi, true)
+		if err != nil {
+			return err
+		}
+		irqfd.bound = false
+	}
+	return nil
+}
+
+func (msix *MsiXDevice) syncIrqFds() {
+	msix.irqfd_lock.Lock()
+	defer msix.irqfd_lock.Unlock()
+
+	for fd, irqfd := range msix.irqfds {
+		err := msix.syncIrqFd(fd, irqfd)
+		if err != nil {
+			msix.Debug("msix irqfd for vector %d: %s", irqfd.vector, err.Error())
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package machine
+
+import (
+	vswitch "github.com/multiverse-os/portalgun/vm/net/vswitch"
+)
+
+//
+// VirtioNetSwitch --
+//
+// A port on a portal-switch (a private L2 network
+// shared with other VMs). The connection is preserved
+// across a re-exec.
+//
+type VirtioNetSwitch struct {
+	// The switch socket.
+	Path string `json:"path"`
+
+	// Our access VLAN (zero for a trunk).
+	Vlan uint16 `json:"vlan,omitempty"`
+
+	// Isolated from other isolated ports?
+	Isolated bool `json:"isolated,omitempty"`
+
+	// Our connection.
+	Fd int `json:"fd,omitempty"`
+}
+
+func (port *VirtioNetSwitch) open() (int, error) {
+	// Already connected (after a re-exec)?
+	if port.Fd != 0 {
+		return port.Fd, nil
+	}
+
+	fd, err := vswitch.Connect(port.Path, vswitch.PortConfig{
+		Vlan:     port.Vlan,
+		Isolated: port.Isolated,
+	})
+	if err != nil {
+		return -1, err
+	}
+	port.Fd = fd
+	return fd, nil
+}
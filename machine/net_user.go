@@ -0,0 +1,94 @@
+package machine
+
+import (
+	"net"
+	"os"
+
+	slirp "github.com/multiverse-os/portalgun/vm/net/slirp"
+	unix "golang.org/x/sys/unix"
+)
+
+//
+// A host port forwarded into the guest.
+//
+type VirtioNetForward struct {
+	// Either "tcp" or "udp".
+	Proto string `json:"proto"`
+
+	// The host address to listen on.
+	Host string `json:"host"`
+
+	// The guest port.
+	Port uint16 `json:"port"`
+}
+
+//
+// VirtioNetUser --
+//
+// User-mode networking (no tap required).
+//
+// The device end of a datagram socketpair is used in
+// place of a tap fd, and the other end is served by an
+// in-process NAT stack. Both ends are preserved across a
+// re-exec, but the stack itself is not: open connections
+// through it will be reset.
+//
+type VirtioNetUser struct {
+	// The network (e.g. "10.0.2.0/24").
+	Network string `json:"network,omitempty"`
+
+	// The host DNS server (host:port).
+	Resolver string `json:"resolver,omitempty"`
+
+	// Forwarded ports.
+	Forwards []VirtioNetForward `json:"forwards,omitempty"`
+
+	// The stack end of our socketpair.
+	Fd int `json:"fd,omitempty"`
+
+	// Our stack.
+	stack *slirp.Stack
+}
+
+//
+// Start the stack, and return the device fd.
+//
+func (user *VirtioNetUser) open(fd int) (int, error) {
+	config := slirp.Config{
+		Resolver: user.Resolver,
+	}
+	if user.Network != "" {
+		_, network, err := net.ParseCIDR(user.Network)
+		if err != nil {
+			return -1, err
+		}
+		config.Network = network
+	}
+	for _, forward := range user.Forwards {
+		config.Forwards = append(config.Forwards, slirp.Forward{
+			Proto: forward.Proto,
+			Host:  forward.Host,
+			Port:  forward.Port,
+		})
+	}
+
+	// Already open (after a re-exec)?
+	if user.Fd == 0 {
+		// NOTE: Not CLOEXEC, as for taps.
+		fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_DGRAM, 0)
+		if err != nil {
+			return -1, err
+		}
+		fd = fds[0]
+		user.Fd = fds[1]
+	}
+
+	stack, err := slirp.New(config)
+	if err != nil {
+		return -1, err
+	}
+	user.stack = stack
+
+	go stack.Serve(os.NewFile(uintptr(user.Fd), "slirp"))
+	return fd, nil
+}
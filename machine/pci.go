@@ -82,6 +82,10 @@ type PciCapability struct {
 	// The pci capability id.
 	Id byte `json:"id"`
 
+	// Our key in the map, if it's not the id.
+	// (Vendor capabilities may appear many times).
+	Key byte `json:"key,omitempty"`
+
 	// The handlers.
 	IoOperations `json:"-"`
 
@@ -431,6 +435,13 @@ func (pcidevice *PciDevice) RebuildBars() {
 	}
 }
 
+//
+// Where the given bar is mapped (zero if it isn't).
+//
+func (pcidevice *PciDevice) BarAddress(bar uint) kvm.Pointer {
+	return kvm.Pointer(pcidevice.Config.Get32(int(0x10+bar*4)) & ^uint32(0xf))
+}
+
 func (pcidevice *PciDevice) RebuildCapabilities() {
 
 	// Already done, we don't mess with it.
@@ -536,7 +547,11 @@ func (capmap *PciCapabilityMap) UnmarshalJSON(data []byte) error {
 	for _, pcicap := range caps {
 
 		// Lookup the existing capability.
-		usecap, ok := (*capmap)[pcicap.Id]
+		key := pcicap.Id
+		if pcicap.Key != 0 {
+			key = pcicap.Key
+		}
+		usecap, ok := (*capmap)[key]
 		if !ok {
 			return PciCapabilityMismatch
 		}
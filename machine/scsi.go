@@ -0,0 +1,542 @@
+package machine
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+//
+// SCSI disk emulation --
+//
+// This is the subset of SBC & SPC that Linux actually
+// uses for a disk. Every LUN is a direct-access device
+// with 512 byte blocks, backed by a BlockBackend.
+//
+
+//
+// Status.
+//
+const (
+	ScsiStatusGood           = 0x00
+	ScsiStatusCheckCondition = 0x02
+)
+
+//
+// Sense keys.
+//
+const (
+	ScsiSenseNoSense        = 0x0
+	ScsiSenseMediumError    = 0x3
+	ScsiSenseIllegalRequest = 0x5
+	ScsiSenseDataProtect    = 0x7
+)
+
+//
+// Additional sense codes (and qualifiers).
+//
+const (
+	ScsiAscNone              = 0x0000
+	ScsiAscWriteError        = 0x0c00
+	ScsiAscReadError         = 0x1100
+	ScsiAscParamListLength   = 0x1a00
+	ScsiAscInvalidOpcode     = 0x2000
+	ScsiAscLbaOutOfRange     = 0x2100
+	ScsiAscInvalidField      = 0x2400
+	ScsiAscLunNotSupported   = 0x2500
+	ScsiAscInvalidParamField = 0x2600
+	ScsiAscWriteProtected    = 0x2700
+)
+
+//
+// Commands.
+//
+const (
+	ScsiTestUnitReady  = 0x00
+	ScsiRequestSense   = 0x03
+	ScsiInquiry        = 0x12
+	ScsiModeSense6     = 0x1a
+	ScsiReadCapacity10 = 0x25
+	ScsiRead10         = 0x28
+	ScsiWrite10        = 0x2a
+	ScsiSyncCache10    = 0x35
+	ScsiUnmap          = 0x42
+	ScsiModeSense10    = 0x5a
+	ScsiRead16         = 0x88
+	ScsiWrite16        = 0x8a
+	ScsiSyncCache16    = 0x91
+	ScsiServiceIn16    = 0x9e
+	ScsiReportLuns     = 0xa0
+
+	// Service actions (for ScsiServiceIn16).
+	ScsiReadCapacity16 = 0x10
+
+	// Force unit access (for writes, in byte 1).
+	ScsiFua = 0x08
+)
+
+//
+// Vital product data pages.
+//
+const (
+	ScsiVpdSupported    = 0x00
+	ScsiVpdSerial       = 0x80
+	ScsiVpdIdentify     = 0x83
+	ScsiVpdBlockLimits  = 0xb0
+	ScsiVpdBlockDevice  = 0xb1
+	ScsiVpdProvisioning = 0xb2
+)
+
+//
+// Mode pages.
+//
+const (
+	ScsiModeCaching = 0x08
+	ScsiModeControl = 0x0a
+	ScsiModeAll     = 0x3f
+)
+
+const (
+	ScsiBlockSize   = 512
+	ScsiSenseLength = 18
+	ScsiVendor      = "PORTALGN"
+	ScsiProduct     = "VIRTUAL-DISK"
+	ScsiRevision    = "0001"
+
+	// The most descriptors in an UNMAP.
+	ScsiMaxUnmapDescriptors = 256
+)
+
+//
+// A command in flight.
+//
+// Data-out (from the guest) and data-in (to the guest)
+// are both left in the buffer, at the given offsets.
+//
+type scsiCommand struct {
+	cdb []byte
+
+	buf     *VirtioBuffer
+	out     int
+	out_len int
+	in      int
+	in_len  int
+
+	// The result.
+	status  byte
+	sense   []byte
+	written int
+}
+
+//
+// Fixed format sense data.
+//
+func scsiSense(key byte, asc int) []byte {
+	sense := make([]byte, ScsiSenseLength)
+	sense[0] = 0x70
+	sense[2] = key
+	sense[7] = ScsiSenseLength - 8
+	sense[12] = byte(asc >> 8)
+	sense[13] = byte(asc)
+	return sense
+}
+
+func (cmd *scsiCommand) check(key byte, asc int) {
+	cmd.status = ScsiStatusCheckCondition
+	cmd.sense = scsiSense(key, asc)
+}
+
+//
+// Return data, up to what the guest asked for.
+//
+func (cmd *scsiCommand) reply(data []byte, alloc int) {
+	if len(data) > alloc {
+		data = data[:alloc]
+	}
+	if len(data) > cmd.in_len {
+		data = data[:cmd.in_len]
+	}
+	cmd.written = cmd.buf.CopyIn(cmd.in, data)
+}
+
+func (cmd *scsiCommand) get16(offset int) int {
+	return int(binary.BigEndian.Uint16(cmd.cdb[offset:]))
+}
+
+func (cmd *scsiCommand) get32(offset int) uint32 {
+	return binary.BigEndian.Uint32(cmd.cdb[offset:])
+}
+
+//
+// Padded ASCII, as used by INQUIRY.
+//
+func scsiString(value string, length int) []byte {
+	data := []byte(fmt.Sprintf("%-*s", length, value))
+	return data[:length]
+}
+
+//
+// Commands for a LUN that isn't there. The target
+// is, so INQUIRY & REPORT LUNS still work.
+//
+func (device *VirtioScsiDevice) executeMissing(target int, cmd *scsiCommand) {
+	switch cmd.cdb[0] {
+	case ScsiInquiry:
+		if cmd.cdb[1]&1 != 0 {
+			cmd.check(ScsiSenseIllegalRequest, ScsiAscLunNotSupported)
+			return
+		}
+		data := make([]byte, 36)
+		data[0] = 0x7f
+		data[4] = byte(len(data) - 5)
+		cmd.reply(data, cmd.get16(3))
+
+	case ScsiReportLuns:
+		device.reportLuns(target, cmd)
+
+	case ScsiRequestSense:
+		cmd.reply(
+			scsiSense(ScsiSenseIllegalRequest, ScsiAscLunNotSupported),
+			int(cmd.cdb[4]))
+
+	default:
+		cmd.check(ScsiSenseIllegalRequest, ScsiAscLunNotSupported)
+	}
+}
+
+func (device *VirtioScsiDevice) reportLuns(target int, cmd *scsiCommand) {
+	luns := device.targetLuns(target)
+	data := make([]byte, 8+8*len(luns))
+	binary.BigEndian.PutUint32(data[0:], uint32(8*len(luns)))
+	for i, lun := range luns {
+		entry := data[8+8*i:]
+		if lun < 256 {
+			entry[1] = byte(lun)
+		} else {
+			// Flat addressing.
+			entry[0] = 0x40 | byte(lun>>8)
+			entry[1] = byte(lun)
+		}
+	}
+	cmd.reply(data, int(cmd.get32(6)))
+}
+
+func (lun *VirtioScsiLun) execute(device *VirtioScsiDevice, cmd *scsiCommand) {
+	switch cmd.cdb[0] {
+	case ScsiTestUnitReady:
+		break
+
+	case ScsiRequestSense:
+		// We never have deferred errors.
+		cmd.reply(
+			scsiSense(ScsiSenseNoSense, ScsiAscNone),
+			int(cmd.cdb[4]))
+
+	case ScsiInquiry:
+		lun.inquiry(cmd)
+
+	case ScsiReportLuns:
+		device.reportLuns(lun.Target, cmd)
+
+	case ScsiReadCapacity10:
+		data := make([]byte, 8)
+		last := lun.blocks - 1
+		if last > 0xffffffff {
+			// The guest must use READ CAPACITY (16).
+			last = 0xffffffff
+		}
+		binary.BigEndian.PutUint32(data[0:], uint32(last))
+		binary.BigEndian.PutUint32(data[4:], ScsiBlockSize)
+		cmd.reply(data, len(data))
+
+	case ScsiServiceIn16:
+		if cmd.cdb[1]&0x1f != ScsiReadCapacity16 {
+			cmd.check(ScsiSenseIllegalRequest, ScsiAscInvalidOpcode)
+			return
+		}
+		data := make([]byte, 32)
+		binary.BigEndian.PutUint64(data[0:], lun.blocks-1)
+		binary.BigEndian.PutUint32(data[8:], ScsiBlockSize)
+		data[13] = lun.physicalExponent()
+		if lun.canTrim() {
+			// Logical block provisioning.
+			data[14] = 0x80
+		}
+		cmd.reply(data, int(cmd.get32(10)))
+
+	case ScsiRead10:
+		lun.read(cmd, uint64(cmd.get32(2)), uint64(cmd.get16(7)))
+	case ScsiRead16:
+		lun.read(cmd, binary.BigEndian.Uint64(cmd.cdb[2:]), uint64(cmd.get32(10)))
+	case ScsiWrite10:
+		lun.write(cmd, uint64(cmd.get32(2)), uint64(cmd.get16(7)))
+	case ScsiWrite16:
+		lun.write(cmd, binary.BigEndian.Uint64(cmd.cdb[2:]), uint64(cmd.get32(10)))
+
+	case ScsiSyncCache10, ScsiSyncCache16:
+		err := lun.backend.Flush()
+		if err != nil {
+			device.Debug("lun %d:%d flush err -> %s", lun.Target, lun.Lun, err.Error())
+			cmd.check(ScsiSenseMediumError, ScsiAscWriteError)
+		}
+
+	case ScsiUnmap:
+		lun.unmap(device, cmd)
+
+	case ScsiModeSense6:
+		lun.modeSense(cmd, false)
+	case ScsiModeSense10:
+		lun.modeSense(cmd, true)
+
+	default:
+		device.Debug("lun %d:%d unknown command %x", lun.Target, lun.Lun, cmd.cdb[0])
+		cmd.check(ScsiSenseIllegalRequest, ScsiAscInvalidOpcode)
+	}
+}
+
+func (lun *VirtioScsiLun) canTrim() bool {
+	trimmer, ok := lun.backend.(BlockTrimmer)
+	return ok && trimmer.CanTrim() && !lun.ReadOnly
+}
+
+//
+// Physical blocks, as a power of two of our blocks.
+//
+func (lun *VirtioScsiLun) physicalExponent() byte {
+	exponent := byte(0)
+	for size := lun.backend.BlockSize(); size > ScsiBlockSize && exponent < 15; size >>= 1 {
+		exponent += 1
+	}
+	return exponent
+}
+
+func (lun *VirtioScsiLun) serial() string {
+	if lun.Serial != "" {
+		return lun.Serial
+	}
+	return fmt.Sprintf("%d-%d", lun.Target, lun.Lun)
+}
+
+func (lun *VirtioScsiLun) inquiry(cmd *scsiCommand) {
+	alloc := cmd.get16(3)
+
+	if cmd.cdb[1]&1 == 0 {
+		if cmd.cdb[2] != 0 {
+			cmd.check(ScsiSenseIllegalRequest, ScsiAscInvalidField)
+			return
+		}
+		data := make([]byte, 36)
+		data[2] = 0x05 // SPC-3.
+		data[3] = 0x12 // HiSup, format 2.
+		data[4] = byte(len(data) - 5)
+		data[7] = 0x02 // Command queueing.
+		copy(data[8:], scsiString(ScsiVendor, 8))
+		copy(data[16:], scsiString(ScsiProduct, 16))
+		copy(data[32:], scsiString(ScsiRevision, 4))
+		cmd.reply(data, alloc)
+		return
+	}
+
+	var page []byte
+	switch cmd.cdb[2] {
+	case ScsiVpdSupported:
+		page = []byte{
+			ScsiVpdSupported,
+			ScsiVpdSerial,
+			ScsiVpdIdentify,
+			ScsiVpdBlockLimits,
+			ScsiVpdBlockDevice,
+			ScsiVpdProvisioning,
+		}
+
+	case ScsiVpdSerial:
+		page = []byte(lun.serial())
+
+	case ScsiVpdIdentify:
+		// A T10 vendor designator, in ASCII.
+		id := append(scsiString(ScsiVendor, 8), lun.serial()...)
+		page = append([]byte{0x02, 0x01, 0x00, byte(len(id))}, id...)
+
+	case ScsiVpdBlockLimits:
+		page = make([]byte, 0x3c)
+		if lun.canTrim() {
+			binary.BigEndian.PutUint32(page[16:], 0xffffffff)
+			binary.BigEndian.PutUint32(page[20:], ScsiMaxUnmapDescriptors)
+			granularity := uint32(1) << lun.physicalExponent()
+			binary.BigEndian.PutUint32(page[24:], granularity)
+		}
+
+	case ScsiVpdBlockDevice:
+		// Not rotating.
+		page = make([]byte, 0x3c)
+		binary.BigEndian.PutUint16(page[0:], 1)
+
+	case ScsiVpdProvisioning:
+		page = make([]byte, 4)
+		if lun.canTrim() {
+			// UNMAP, thin provisioned.
+			page[1] = 0x80
+			page[2] = 0x02
+		}
+
+	default:
+		cmd.check(ScsiSenseIllegalRequest, ScsiAscInvalidField)
+		return
+	}
+
+	data := make([]byte, 4+len(page))
+	data[1] = cmd.cdb[2]
+	binary.BigEndian.PutUint16(data[2:], uint16(len(page)))
+	copy(data[4:], page)
+	cmd.reply(data, alloc)
+}
+
+//
+// Check a range, returning the byte offset & length.
+//
+func (lun *VirtioScsiLun) extent(cmd *scsiCommand, lba uint64, blocks uint64) (int64, int, bool) {
+	if lba > lun.blocks || blocks > lun.blocks-lba {
+		cmd.check(ScsiSenseIllegalRequest, ScsiAscLbaOutOfRange)
+		return 0, 0, false
+	}
+	return int64(lba * ScsiBlockSize), int(blocks * ScsiBlockSize), true
+}
+
+func (lun *VirtioScsiLun) read(cmd *scsiCommand, lba uint64, blocks uint64) {
+	offset, length, ok := lun.extent(cmd, lba, blocks)
+	if !ok {
+		return
+	}
+	if length > cmd.in_len {
+		cmd.check(ScsiSenseIllegalRequest, ScsiAscInvalidField)
+		return
+	}
+
+	n, err := cmd.buf.PReadAt(lun.backend, offset, cmd.in, length)
+	cmd.written = n
+	if err != nil {
+		cmd.check(ScsiSenseMediumError, ScsiAscReadError)
+	}
+}
+
+func (lun *VirtioScsiLun) write(cmd *scsiCommand, lba uint64, blocks uint64) {
+	if lun.ReadOnly {
+		cmd.check(ScsiSenseDataProtect, ScsiAscWriteProtected)
+		return
+	}
+	offset, length, ok := lun.extent(cmd, lba, blocks)
+	if !ok {
+		return
+	}
+	if length > cmd.out_len {
+		cmd.check(ScsiSenseIllegalRequest, ScsiAscInvalidField)
+		return
+	}
+
+	_, err := cmd.buf.PWriteAt(lun.backend, offset, cmd.out, length)
+	if err == nil && cmd.cdb[1]&ScsiFua != 0 {
+		// It must be on disk before we say so.
+		err = lun.backend.Flush()
+	}
+	if err != nil {
+		cmd.check(ScsiSenseMediumError, ScsiAscWriteError)
+	}
+}
+
+func (lun *VirtioScsiLun) unmap(device *VirtioScsiDevice, cmd *scsiCommand) {
+	if lun.ReadOnly {
+		cmd.check(ScsiSenseDataProtect, ScsiAscWriteProtected)
+		return
+	}
+	if !lun.canTrim() {
+		cmd.check(ScsiSenseIllegalRequest, ScsiAscInvalidOpcode)
+		return
+	}
+
+	length := cmd.get16(7)
+	if length == 0 {
+		return
+	}
+	if length < 8 || length > cmd.out_len {
+		cmd.check(ScsiSenseIllegalRequest, ScsiAscParamListLength)
+		return
+	}
+	params := make([]byte, length)
+	cmd.buf.CopyOut(cmd.out, params)
+
+	descriptors := int(binary.BigEndian.Uint16(params[2:])) / 16
+	if descriptors > ScsiMaxUnmapDescriptors || 8+16*descriptors > length {
+		cmd.check(ScsiSenseIllegalRequest, ScsiAscInvalidParamField)
+		return
+	}
+
+	trimmer := lun.backend.(BlockTrimmer)
+	for i := 0; i < descriptors; i += 1 {
+		descriptor := params[8+16*i:]
+		offset, length, ok := lun.extent(
+			cmd,
+			binary.BigEndian.Uint64(descriptor[0:]),
+			uint64(binary.BigEndian.Uint32(descriptor[8:])))
+		if !ok {
+			return
+		}
+		err := trimmer.Trim(offset, int64(length))
+		if err != nil {
+			device.Debug("lun %d:%d unmap err -> %s", lun.Target, lun.Lun, err.Error())
+			cmd.check(ScsiSenseMediumError, ScsiAscWriteError)
+			return
+		}
+	}
+}
+
+func (lun *VirtioScsiLun) modeSense(cmd *scsiCommand, long bool) {
+	page := cmd.cdb[2] & 0x3f
+	changeable := cmd.cdb[2]>>6 == 1
+	subpage := cmd.cdb[3]
+	if subpage != 0 && !(page == ScsiModeAll && subpage == 0xff) {
+		cmd.check(ScsiSenseIllegalRequest, ScsiAscInvalidField)
+		return
+	}
+
+	var pages []byte
+	if page == ScsiModeCaching || page == ScsiModeAll {
+		caching := make([]byte, 20)
+		caching[0] = ScsiModeCaching
+		caching[1] = byte(len(caching) - 2)
+		if !changeable {
+			// Write cache enabled.
+			caching[2] = 0x04
+		}
+		pages = append(pages, caching...)
+	}
+	if page == ScsiModeControl || page == ScsiModeAll {
+		control := make([]byte, 12)
+		control[0] = ScsiModeControl
+		control[1] = byte(len(control) - 2)
+		pages = append(pages, control...)
+	}
+	if pages == nil {
+		cmd.check(ScsiSenseIllegalRequest, ScsiAscInvalidField)
+		return
+	}
+
+	// Device specific: write protect, and DPO/FUA.
+	specific := byte(0x10)
+	if lun.ReadOnly {
+		specific |= 0x80
+	}
+
+	var data []byte
+	var alloc int
+	if long {
+		data = make([]byte, 8, 8+len(pages))
+		binary.BigEndian.PutUint16(data[0:], uint16(6+len(pages)))
+		data[3] = specific
+		alloc = cmd.get16(7)
+	} else {
+		data = make([]byte, 4, 4+len(pages))
+		data[0] = byte(3 + len(pages))
+		data[2] = specific
+		alloc = int(cmd.cdb[4])
+	}
+	cmd.reply(append(data, pages...), alloc)
+}
@@ -0,0 +1,269 @@
+package machine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+//
+// A file, and a count of flushes.
+//
+type testBackend struct {
+	*BlockFile
+	flushes int
+}
+
+func (backend *testBackend) Flush() error {
+	backend.flushes += 1
+	return backend.BlockFile.Flush()
+}
+
+func newTestScsi(t *testing.T, blocks int) (*VirtioScsiDevice, *testBackend) {
+	path := filepath.Join(t.TempDir(), "disk")
+	if err := ioutil.WriteFile(path, make([]byte, blocks*ScsiBlockSize), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fd, err := syscall.Open(path, syscall.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lun := &VirtioScsiLun{VirtioScsiLunInfo: VirtioScsiLunInfo{
+		Target: 0,
+		Lun:    1,
+		Fd:     fd,
+	}}
+	if err := lun.open(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lun.backend.Close() })
+	backend := &testBackend{BlockFile: lun.backend.(*BlockFile)}
+	lun.backend = backend
+
+	return &VirtioScsiDevice{Luns: []*VirtioScsiLun{lun}}, backend
+}
+
+//
+// Run a command against the given LUN (on target 0),
+// with the data-out and room for in_len of data-in.
+//
+func runScsi(
+	t *testing.T,
+	device *VirtioScsiDevice,
+	id int,
+	cdb []byte,
+	out []byte,
+	in_len int) (*scsiCommand, []byte) {
+
+	in := make([]byte, in_len)
+	buf := NewVirtioBuffer(0, false)
+	buf.Append(append([]byte(nil), out...))
+	buf.readable = len(out)
+	buf.Append(in)
+
+	cmd := &scsiCommand{
+		cdb:     append(cdb, make([]byte, 16)...)[:16],
+		buf:     buf,
+		out:     0,
+		out_len: len(out),
+		in:      len(out),
+		in_len:  in_len,
+	}
+	address := []byte{1, 0, 0x40 | byte(id>>8), byte(id), 0, 0, 0, 0}
+	if response := device.execute(address, cmd); response != VirtioScsiSOk {
+		t.Fatalf("%x: response %d", cdb[0], response)
+	}
+	return cmd, in[:cmd.written]
+}
+
+func checkGood(t *testing.T, cmd *scsiCommand) {
+	if cmd.status != ScsiStatusGood {
+		t.Fatalf("%x: status %d, sense %x", cmd.cdb[0], cmd.status, cmd.sense)
+	}
+}
+
+func checkSense(t *testing.T, cmd *scsiCommand, key byte, asc int) {
+	if cmd.status != ScsiStatusCheckCondition ||
+		cmd.sense[2] != key ||
+		int(cmd.sense[12])<<8|int(cmd.sense[13]) != asc {
+		t.Fatalf("%x: status %d, sense %x", cmd.cdb[0], cmd.status, cmd.sense)
+	}
+}
+
+func TestScsiInquiry(t *testing.T) {
+	device, _ := newTestScsi(t, 64)
+
+	cmd, data := runScsi(t, device, 1, []byte{ScsiInquiry, 0, 0, 0, 255}, nil, 255)
+	checkGood(t, cmd)
+	if len(data) != 36 || data[0] != 0 ||
+		!bytes.Equal(data[8:16], []byte(ScsiVendor)) {
+		t.Fatalf("standard inquiry: %x", data)
+	}
+
+	// Only what was asked for.
+	cmd, data = runScsi(t, device, 1, []byte{ScsiInquiry, 0, 0, 0, 5}, nil, 255)
+	checkGood(t, cmd)
+	if len(data) != 5 {
+		t.Fatalf("allocation length ignored: %d", len(data))
+	}
+
+	cmd, data = runScsi(t, device, 1, []byte{ScsiInquiry, 1, ScsiVpdSupported, 0, 255}, nil, 255)
+	checkGood(t, cmd)
+	if len(data) < 4 || data[1] != ScsiVpdSupported || int(data[3]) != len(data)-4 {
+		t.Fatalf("supported pages: %x", data)
+	}
+	for _, page := range data[4:] {
+		cmd, data := runScsi(t, device, 1, []byte{ScsiInquiry, 1, page, 0, 255}, nil, 255)
+		checkGood(t, cmd)
+		if len(data) < 4 || data[1] != page ||
+			int(binary.BigEndian.Uint16(data[2:])) != len(data)-4 {
+			t.Fatalf("page %x: %x", page, data)
+		}
+	}
+
+	cmd, data = runScsi(t, device, 1, []byte{ScsiInquiry, 1, ScsiVpdSerial, 0, 255}, nil, 255)
+	checkGood(t, cmd)
+	if string(data[4:]) != "0-1" {
+		t.Fatalf("serial: %q", data[4:])
+	}
+
+	cmd, _ = runScsi(t, device, 1, []byte{ScsiInquiry, 1, 0x42, 0, 255}, nil, 255)
+	checkSense(t, cmd, ScsiSenseIllegalRequest, ScsiAscInvalidField)
+
+	// A missing LUN on the same target.
+	cmd, data = runScsi(t, device, 2, []byte{ScsiInquiry, 0, 0, 0, 255}, nil, 255)
+	checkGood(t, cmd)
+	if data[0] != 0x7f {
+		t.Fatalf("missing lun: %x", data)
+	}
+}
+
+func TestScsiReadCapacity16(t *testing.T) {
+	device, _ := newTestScsi(t, 64)
+
+	cdb := []byte{ScsiServiceIn16, ScsiReadCapacity16, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 32}
+	cmd, data := runScsi(t, device, 1, cdb, nil, 32)
+	checkGood(t, cmd)
+	if len(data) != 32 ||
+		binary.BigEndian.Uint64(data[0:]) != 63 ||
+		binary.BigEndian.Uint32(data[8:]) != ScsiBlockSize {
+		t.Fatalf("capacity: %x", data)
+	}
+	if data[14]&0x80 == 0 {
+		t.Fatalf("provisioning not reported")
+	}
+
+	cdb[1] = 0x11
+	cmd, _ = runScsi(t, device, 1, cdb, nil, 32)
+	checkSense(t, cmd, ScsiSenseIllegalRequest, ScsiAscInvalidOpcode)
+}
+
+func TestScsiReadWrite(t *testing.T) {
+	device, backend := newTestScsi(t, 64)
+	data := bytes.Repeat([]byte("0123456789abcdef"), 2*ScsiBlockSize/16)
+
+	// WRITE (10) of two blocks at 3.
+	cmd, _ := runScsi(t, device, 1, []byte{ScsiWrite10, 0, 0, 0, 0, 3, 0, 0, 2}, data, 0)
+	checkGood(t, cmd)
+	if backend.flushes != 0 {
+		t.Fatalf("flushed without FUA")
+	}
+
+	// READ (16) of the same.
+	cdb := []byte{ScsiRead16, 0, 0, 0, 0, 0, 0, 0, 0, 3, 0, 0, 0, 2}
+	cmd, read := runScsi(t, device, 1, cdb, nil, len(data))
+	checkGood(t, cmd)
+	if !bytes.Equal(read, data) {
+		t.Fatalf("read back differs")
+	}
+
+	// WRITE (16) with FUA, read by READ (10).
+	cdb = []byte{ScsiWrite16, ScsiFua, 0, 0, 0, 0, 0, 0, 0, 62, 0, 0, 0, 2}
+	cmd, _ = runScsi(t, device, 1, cdb, data, 0)
+	checkGood(t, cmd)
+	if backend.flushes != 1 {
+		t.Fatalf("FUA write not flushed")
+	}
+	cmd, read = runScsi(t, device, 1, []byte{ScsiRead10, 0, 0, 0, 0, 62, 0, 0, 2}, nil, len(data))
+	checkGood(t, cmd)
+	if !bytes.Equal(read, data) {
+		t.Fatalf("read back differs")
+	}
+
+	// Off the end.
+	cmd, _ = runScsi(t, device, 1, []byte{ScsiRead10, 0, 0, 0, 0, 63, 0, 0, 2}, nil, len(data))
+	checkSense(t, cmd, ScsiSenseIllegalRequest, ScsiAscLbaOutOfRange)
+	cdb = []byte{ScsiWrite16, 0, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 2}
+	cmd, _ = runScsi(t, device, 1, cdb, data, 0)
+	checkSense(t, cmd, ScsiSenseIllegalRequest, ScsiAscLbaOutOfRange)
+
+	// More than the guest gave us.
+	cmd, _ = runScsi(t, device, 1, []byte{ScsiWrite10, 0, 0, 0, 0, 0, 0, 0, 4}, data, 0)
+	checkSense(t, cmd, ScsiSenseIllegalRequest, ScsiAscInvalidField)
+}
+
+func TestScsiUnmap(t *testing.T) {
+	device, _ := newTestScsi(t, 64)
+	data := bytes.Repeat([]byte{0xaa}, 4*ScsiBlockSize)
+	cmd, _ := runScsi(t, device, 1, []byte{ScsiWrite10, 0, 0, 0, 0, 0, 0, 0, 4}, data, 0)
+	checkGood(t, cmd)
+
+	// One descriptor: blocks 1 & 2.
+	params := make([]byte, 24)
+	binary.BigEndian.PutUint16(params[0:], 22)
+	binary.BigEndian.PutUint16(params[2:], 16)
+	binary.BigEndian.PutUint64(params[8:], 1)
+	binary.BigEndian.PutUint32(params[16:], 2)
+	cmd, _ = runScsi(t, device, 1, []byte{ScsiUnmap, 0, 0, 0, 0, 0, 0, 0, 24}, params, 0)
+	checkGood(t, cmd)
+
+	cmd, read := runScsi(t, device, 1, []byte{ScsiRead10, 0, 0, 0, 0, 0, 0, 0, 4}, nil, len(data))
+	checkGood(t, cmd)
+	expected := append([]byte(nil), data...)
+	copy(expected[ScsiBlockSize:3*ScsiBlockSize], make([]byte, 2*ScsiBlockSize))
+	if !bytes.Equal(read, expected) {
+		t.Fatalf("unmapped blocks not zeroed")
+	}
+
+	// A descriptor past the end.
+	binary.BigEndian.PutUint64(params[8:], 63)
+	cmd, _ = runScsi(t, device, 1, []byte{ScsiUnmap, 0, 0, 0, 0, 0, 0, 0, 24}, params, 0)
+	checkSense(t, cmd, ScsiSenseIllegalRequest, ScsiAscLbaOutOfRange)
+
+	// A parameter list that's too short.
+	cmd, _ = runScsi(t, device, 1, []byte{ScsiUnmap, 0, 0, 0, 0, 0, 0, 0, 4}, params, 0)
+	checkSense(t, cmd, ScsiSenseIllegalRequest, ScsiAscParamListLength)
+}
+
+func TestScsiReportLuns(t *testing.T) {
+	device, _ := newTestScsi(t, 64)
+	device.Luns = append(device.Luns, &VirtioScsiLun{
+		VirtioScsiLunInfo: VirtioScsiLunInfo{Target: 0, Lun: 300},
+	})
+	device.Luns = append(device.Luns, &VirtioScsiLun{
+		VirtioScsiLunInfo: VirtioScsiLunInfo{Target: 1, Lun: 0},
+	})
+
+	cdb := []byte{ScsiReportLuns, 0, 0, 0, 0, 0, 0, 0, 0, 255}
+	cmd, data := runScsi(t, device, 1, cdb, nil, 255)
+	checkGood(t, cmd)
+	expected := []byte{
+		0, 0, 0, 16, 0, 0, 0, 0,
+		0x00, 1, 0, 0, 0, 0, 0, 0,
+		0x41, 44, 0, 0, 0, 0, 0, 0,
+	}
+	if !bytes.Equal(data, expected) {
+		t.Fatalf("got %x, expected %x", data, expected)
+	}
+
+	// Also from a LUN that isn't there.
+	cmd, data = runScsi(t, device, 2, cdb, nil, 255)
+	checkGood(t, cmd)
+	if !bytes.Equal(data, expected) {
+		t.Fatalf("got %x, expected %x", data, expected)
+	}
+}
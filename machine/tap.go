@@ -0,0 +1,102 @@
+package machine
+
+import (
+	"syscall"
+
+	unix "golang.org/x/sys/unix"
+)
+
+//
+// Open a queue on the named tap device.
+//
+// If multiqueue is set, the device is opened with
+// IFF_MULTI_QUEUE and this may be called repeatedly
+// to get one fd per queue. (The tap must either not
+// exist yet, or have been created as multi-queue).
+//
+// NOTE: The fd is deliberately not CLOEXEC, so that
+// it is preserved across a re-exec.
+//
+func OpenTap(name string, vnet bool, multiqueue bool) (int, error) {
+	fd, err := syscall.Open("/dev/net/tun", syscall.O_RDWR, 0)
+	if err != nil {
+		return -1, err
+	}
+
+	ifr, err := unix.NewIfreq(name)
+	if err != nil {
+		syscall.Close(fd)
+		return -1, err
+	}
+	flags := uint16(unix.IFF_TAP | unix.IFF_NO_PI)
+	if vnet {
+		flags |= unix.IFF_VNET_HDR
+	}
+	if multiqueue {
+		flags |= unix.IFF_MULTI_QUEUE
+	}
+	ifr.SetUint16(flags)
+
+	err = unix.IoctlIfreq(fd, unix.TUNSETIFF, ifr)
+	if err != nil {
+		syscall.Close(fd)
+		return -1, err
+	}
+
+	return fd, nil
+}
+
+//
+// Enable or disable a queue on a multi-queue tap.
+// The kernel only steers packets to enabled queues.
+//
+func SetTapQueue(fd int, enabled bool) error {
+	ifr, err := unix.NewIfreq("")
+	if err != nil {
+		return err
+	}
+	if enabled {
+		ifr.SetUint16(unix.IFF_ATTACH_QUEUE)
+	} else {
+		ifr.SetUint16(unix.IFF_DETACH_QUEUE)
+	}
+
+	return unix.IoctlIfreq(fd, unix.TUNSETQUEUE, ifr)
+}
+
+//
+// Find the name of the tap behind an fd.
+//
+func TapName(fd int) (string, error) {
+	ifr, err := unix.NewIfreq("")
+	if err != nil {
+		return "", err
+	}
+	err = unix.IoctlIfreq(fd, unix.TUNGETIFF, ifr)
+	if err != nil {
+		return "", err
+	}
+	return ifr.Name(), nil
+}
+
+//
+// Is the named interface up, with carrier?
+//
+func TapCarrier(name string) (bool, error) {
+	sock, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return false, err
+	}
+	defer unix.Close(sock)
+
+	ifr, err := unix.NewIfreq(name)
+	if err != nil {
+		return false, err
+	}
+	err = unix.IoctlIfreq(sock, unix.SIOCGIFFLAGS, ifr)
+	if err != nil {
+		return false, err
+	}
+	flags := ifr.Uint16()
+	return flags&unix.IFF_UP != 0 && flags&unix.IFF_RUNNING != 0, nil
+}
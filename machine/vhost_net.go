@@ -0,0 +1,593 @@
+package machine
+
+import (
+	"encoding/binary"
+	"os"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	kvm "github.com/multiverse-os/portalgun/vm/kvm"
+	unix "golang.org/x/sys/unix"
+)
+
+//
+// Vhost ioctls.
+//
+const (
+	VhostGetFeatures   = 0x8008af00
+	VhostSetFeatures   = 0x4008af00
+	VhostSetOwner      = 0x0000af01
+	VhostSetMemTable   = 0x4008af03
+	VhostSetVringNum   = 0x4008af10
+	VhostSetVringAddr  = 0x4028af11
+	VhostSetVringBase  = 0x4008af12
+	VhostGetVringBase  = 0xc008af12
+	VhostSetVringKick  = 0x4008af20
+	VhostSetVringCall  = 0x4008af21
+	VhostNetSetBackend = 0x4008af30
+)
+
+//
+// Vhost features.
+//
+const (
+	VhostNetFVirtioNetHdr = 1 << 27
+)
+
+//
+// The features we pass through to vhost.
+// (These are the ones that change how the rings
+// or the headers look; the rest are for the tap).
+//
+const VhostNetFeatures = uint64(
+	VirtioNetFMrgRxbuf | VirtioRingFEventIdx | VirtioRingFIndirectDesc |
+		VirtioFVersion1)
+
+type vhostVringState struct {
+	index uint32
+	num   uint32
+}
+
+type vhostVringFile struct {
+	index uint32
+	fd    int32
+}
+
+type vhostIoEvent struct {
+	addr  kvm.Pointer
+	size  uint
+	bound bool
+}
+
+type vhostVringAddr struct {
+	index uint32
+	flags uint32
+	desc  uint64
+	used  uint64
+	avail uint64
+	log   uint64
+}
+
+//
+// VhostNet --
+//
+// The rx and tx queues of a virtio-net device, handed
+// over to /dev/vhost-net so that the kernel moves packets
+// between the rings and the tap directly.
+//
+// Once a queue is running, its kick eventfd is bound to
+// the notify register (an ioeventfd), so kicks go to the
+// kernel without exiting to us at all. Completions come
+// back on the call eventfd, which is bound to the queue's
+// MSI-X vector (an irqfd) while it's enabled & unmasked.
+//
+// Either may not be bound (e.g. legacy interrupts, which
+// need the ISR set, or an address already taken). Then
+// kicks still trap and are passed along by Kick(), and
+// calls are relayed by interrupts() as the right interrupt.
+//
+// If the kernel won't take a queue, we give both back to
+// the userspace path (see fallback()).
+//
+// None of this survives a re-exec: the kernel holds onto
+// our address space, so the fds are CLOEXEC and we just
+// set everything up again from the saved ring indices.
+//
+type VhostNet struct {
+	nic   *VirtioNetDevice
+	vm    *kvm.VirtualMachine
+	model *Model
+
+	fd       int
+	features uint64
+
+	// Our memory table (built on first use).
+	memory []uint64
+
+	// Per-queue eventfds. We read the calls via the
+	// poller, so we keep the raw fd on the side (as
+	// File.Fd() would make it blocking again).
+	kicks    [2]int
+	calls    [2]*os.File
+	call_fds [2]int
+
+	// Which queues are running.
+	running [2]bool
+
+	// What we've bound in KVM.
+	ioevents [2]vhostIoEvent
+	irqfds   [2]bool
+
+	// Have we changed the tap's header size?
+	vnet_hdr bool
+
+	paused int
+
+	lock sync.Mutex
+}
+
+func vhostIoctl(fd int, request uintptr, arg unsafe.Pointer) error {
+	_, _, e := syscall.Syscall(
+		syscall.SYS_IOCTL,
+		uintptr(fd),
+		request,
+		uintptr(arg))
+	if e != 0 {
+		return e
+	}
+	return nil
+}
+
+//
+// Open vhost-net for the given device.
+//
+// An error here just means that we can't use vhost,
+// and the caller should stick with the userspace path.
+//
+func openVhostNet(nic *VirtioNetDevice, vm *kvm.VirtualMachine, model *Model) (*VhostNet, error) {
+	fd, err := syscall.Open(
+		"/dev/vhost-net",
+		syscall.O_RDWR|syscall.O_CLOEXEC,
+		0)
+	if err != nil {
+		return nil, err
+	}
+
+	vhost := &VhostNet{
+		nic:   nic,
+		vm:    vm,
+		model: model,
+		fd:    fd,
+		kicks: [2]int{-1, -1},
+	}
+
+	err = vhostIoctl(fd, VhostSetOwner, nil)
+	if err == nil {
+		err = vhostIoctl(fd, VhostGetFeatures, unsafe.Pointer(&vhost.features))
+	}
+	if err == nil && nic.Vnet == 0 &&
+		vhost.features&VhostNetFVirtioNetHdr == 0 {
+		// We'd need vhost to deal with the header.
+		err = VirtioNetVhostErr
+	}
+	for i := 0; i < 2 && err == nil; i += 1 {
+		vhost.kicks[i], err = unix.Eventfd(0, unix.EFD_CLOEXEC)
+		if err == nil {
+			vhost.call_fds[i], err = unix.Eventfd(0, unix.EFD_CLOEXEC|unix.EFD_NONBLOCK)
+		}
+		if err == nil {
+			vhost.calls[i] = os.NewFile(uintptr(vhost.call_fds[i]), "vhost-call")
+		}
+	}
+	if err != nil {
+		vhost.close()
+		return nil, err
+	}
+
+	return vhost, nil
+}
+
+func (vhost *VhostNet) close() {
+	for i := 0; i < 2; i += 1 {
+		if vhost.kicks[i] >= 0 {
+			syscall.Close(vhost.kicks[i])
+		}
+		if vhost.calls[i] != nil {
+			vhost.calls[i].Close()
+		}
+	}
+	syscall.Close(vhost.fd)
+}
+
+//
+// Relay completions to the guest.
+//
+func (vhost *VhostNet) interrupts(vchannel *VirtioChannel) {
+	call := vhost.calls[vchannel.Channel]
+	buffer := make([]byte, 8)
+	for {
+		_, err := call.Read(buffer)
+		if err != nil {
+			return
+		}
+		vchannel.Interrupt(true)
+	}
+}
+
+//
+// Build our memory table from the guest's user memory.
+//
+func (vhost *VhostNet) memoryTable() error {
+	var regions []*TypedMemoryRegion
+	for _, region := range vhost.model.MemoryMap {
+		if region.MemoryType == MemoryTypeUser && len(region.user) > 0 {
+			regions = append(regions, region)
+		}
+	}
+
+	// This is a struct vhost_memory, which is a
+	// count followed by (guest, size, host, flags).
+	table := make([]uint64, 1+4*len(regions))
+	table[0] = uint64(len(regions))
+	for i, region := range regions {
+		table[1+4*i] = uint64(region.Start)
+		table[2+4*i] = region.Size
+		table[3+4*i] = uint64(uintptr(unsafe.Pointer(&region.user[0])))
+	}
+
+	err := vhostIoctl(vhost.fd, VhostSetMemTable, unsafe.Pointer(&table[0]))
+	if err != nil {
+		return err
+	}
+	vhost.memory = table
+	return nil
+}
+
+//
+// Set the tap's header size to match the guest.
+// (Only if the tap deals with headers at all).
+//
+func (vhost *VhostNet) setHeaderSize(size int) error {
+	if vhost.nic.Vnet == 0 {
+		return nil
+	}
+	return unix.IoctlSetPointerInt(vhost.nic.Fd, unix.TUNSETVNETHDRSZ, size)
+}
+
+func (vhost *VhostNet) setBackend(index uint32, fd int) error {
+	file := vhostVringFile{index: index, fd: int32(fd)}
+	return vhostIoctl(vhost.fd, VhostNetSetBackend, unsafe.Pointer(&file))
+}
+
+//
+// Stop the kernel touching the ring, and
+// save where it got to (as if we'd consumed it).
+//
+func (vhost *VhostNet) detach(vchannel *VirtioChannel) error {
+	err := vhost.setBackend(uint32(vchannel.Channel), -1)
+	if err != nil {
+		return err
+	}
+	state := vhostVringState{index: uint32(vchannel.Channel)}
+	err = vhostIoctl(vhost.fd, VhostGetVringBase, unsafe.Pointer(&state))
+	if err != nil {
+		return err
+	}
+	vchannel.Consumed = uint16(state.num)
+	return nil
+}
+
+//
+// Bind the queue's kicks and calls in KVM, if we can.
+// Neither is needed for things to work, so failures are
+// only noted (see above).
+//
+func (vhost *VhostNet) bindEvents(vchannel *VirtioChannel) {
+	index := vchannel.Channel
+
+	addr, size, ok := vhost.nic.notifyAddress(index)
+	if ok {
+		kick := &kvm.EventFd{Fd: vhost.kicks[index]}
+		err := vhost.vm.SetEventFd(kick, addr, size, false, false, true, uint64(index))
+		if err == nil {
+			vhost.ioevents[index] = vhostIoEvent{addr, size, true}
+		} else {
+			vhost.nic.Debug("vqueue#%d no ioeventfd: %s", index, err.Error())
+		}
+	}
+
+	if vhost.nic.msix != nil && vchannel.QueueVec.Value != 0xffff {
+		err := vhost.nic.msix.BindVector(
+			vhost.vm,
+			int(vchannel.QueueVec.Value),
+			vhost.call_fds[index])
+		if err == nil {
+			vhost.irqfds[index] = true
+		} else {
+			vhost.nic.Debug("vqueue#%d no irqfd: %s", index, err.Error())
+		}
+	}
+}
+
+func (vhost *VhostNet) unbindEvents(index uint) {
+	ioevent := vhost.ioevents[index]
+	if ioevent.bound {
+		kick := &kvm.EventFd{Fd: vhost.kicks[index]}
+		vhost.vm.SetEventFd(kick, ioevent.addr, ioevent.size, false, true, true, uint64(index))
+		vhost.ioevents[index] = vhostIoEvent{}
+	}
+	if vhost.irqfds[index] {
+		vhost.nic.msix.UnbindVector(vhost.call_fds[index])
+		vhost.irqfds[index] = false
+	}
+}
+
+func (vhost *VhostNet) Start(vchannel *VirtioChannel) error {
+	vhost.lock.Lock()
+	defer vhost.lock.Unlock()
+
+	err := vhost.start(vchannel)
+	if err != nil {
+		vhost.fallback(err)
+	}
+	return nil
+}
+
+func (vhost *VhostNet) start(vchannel *VirtioChannel) error {
+	index := vchannel.Channel
+	if vhost.running[index] || !vchannel.active() {
+		return nil
+	}
+	if vhost.memory == nil {
+		err := vhost.memoryTable()
+		if err != nil {
+			return err
+		}
+	}
+
+	// The rings look the way the guest asked.
+	features := vhost.nic.GetFeatures() & vhost.features & VhostNetFeatures
+	if vhost.nic.Vnet == 0 {
+		features |= VhostNetFVirtioNetHdr
+	}
+	err := vhostIoctl(vhost.fd, VhostSetFeatures, unsafe.Pointer(&features))
+	if err != nil {
+		return err
+	}
+	if !vhost.vnet_hdr && vhost.nic.headerSize() != VirtioNetHeaderSize {
+		err = vhost.setHeaderSize(vhost.nic.headerSize())
+		if err != nil {
+			return err
+		}
+		vhost.vnet_hdr = true
+	}
+
+	state := vhostVringState{index: uint32(index), num: uint32(vchannel.QueueSize.Value)}
+	err = vhostIoctl(vhost.fd, VhostSetVringNum, unsafe.Pointer(&state))
+	if err != nil {
+		return err
+	}
+	state.num = uint32(vchannel.Consumed)
+	err = vhostIoctl(vhost.fd, VhostSetVringBase, unsafe.Pointer(&state))
+	if err != nil {
+		return err
+	}
+
+	desc, avail, used := vchannel.ringAddresses()
+	addr := vhostVringAddr{
+		index: uint32(index),
+		desc:  uint64(desc),
+		avail: uint64(avail),
+		used:  uint64(used),
+	}
+	err = vhostIoctl(vhost.fd, VhostSetVringAddr, unsafe.Pointer(&addr))
+	if err != nil {
+		return err
+	}
+
+	kick := vhostVringFile{index: uint32(index), fd: int32(vhost.kicks[index])}
+	err = vhostIoctl(vhost.fd, VhostSetVringKick, unsafe.Pointer(&kick))
+	if err != nil {
+		return err
+	}
+	call := vhostVringFile{index: uint32(index), fd: int32(vhost.call_fds[index])}
+	err = vhostIoctl(vhost.fd, VhostSetVringCall, unsafe.Pointer(&call))
+	if err != nil {
+		return err
+	}
+
+	if vhost.paused == 0 {
+		err = vhost.setBackend(uint32(index), vhost.nic.Fd)
+		if err != nil {
+			return err
+		}
+	}
+	vhost.running[index] = true
+	vhost.bindEvents(vchannel)
+	vhost.nic.Debug("vqueue#%d vhost running @ %d", index, vchannel.Consumed)
+
+	// The guest may have queued buffers already.
+	vhost.kick(index)
+	return nil
+}
+
+func (vhost *VhostNet) Stop(vchannel *VirtioChannel) error {
+	vhost.lock.Lock()
+	defer vhost.lock.Unlock()
+
+	return vhost.stop(vchannel)
+}
+
+func (vhost *VhostNet) stop(vchannel *VirtioChannel) error {
+	index := vchannel.Channel
+	if !vhost.running[index] {
+		return nil
+	}
+	vhost.unbindEvents(index)
+	if vhost.paused == 0 {
+		err := vhost.detach(vchannel)
+		if err != nil {
+			return err
+		}
+	}
+	vhost.running[index] = false
+	vhost.nic.Debug("vqueue#%d vhost stopped @ %d", index, vchannel.Consumed)
+
+	if vhost.vnet_hdr && !vhost.running[0] && !vhost.running[1] {
+		vhost.vnet_hdr = false
+		return vhost.setHeaderSize(VirtioNetHeaderSize)
+	}
+	return nil
+}
+
+//
+// Give both queues back to the userspace path, and
+// close up. (The lock must be held).
+//
+// The rings are left where the kernel got to, so we
+// just carry on from there. The tap goes back to the
+// header size we read and write it with.
+//
+func (vhost *VhostNet) fallback(err error) {
+	nic := vhost.nic
+	nic.Debug("vhost failed, falling back: %s", err.Error())
+
+	for i := uint(0); i < 2; i += 1 {
+		err := vhost.stop(nic.Channels[i])
+		if err != nil {
+			nic.Debug("vqueue#%d vhost stop: %s", i, err.Error())
+		}
+		nic.Channels[i].Offload(nil)
+	}
+	if vhost.vnet_hdr {
+		vhost.setHeaderSize(VirtioNetHeaderSize)
+		vhost.vnet_hdr = false
+	}
+	nic.vhost = nil
+	vhost.close()
+
+	// The guest may have queued buffers already.
+	for i := uint(0); i < 2; i += 1 {
+		nic.notify(i)
+	}
+}
+
+func (vhost *VhostNet) kick(index uint) {
+	value := make([]byte, 8)
+	binary.LittleEndian.PutUint64(value, 1)
+	unix.Write(vhost.kicks[index], value)
+}
+
+func (vhost *VhostNet) Kick(vchannel *VirtioChannel) {
+	vhost.kick(vchannel.Channel)
+}
+
+//
+// Pause the kernel (e.g. for a save).
+// The ring indices are saved in the channels.
+//
+func (vhost *VhostNet) pause() error {
+	vhost.lock.Lock()
+	defer vhost.lock.Unlock()
+
+	vhost.paused += 1
+	if vhost.paused > 1 {
+		return nil
+	}
+	for index, running := range vhost.running {
+		if running {
+			err := vhost.detach(vhost.nic.Channels[uint(index)])
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (vhost *VhostNet) resume() error {
+	vhost.lock.Lock()
+	defer vhost.lock.Unlock()
+
+	vhost.paused -= 1
+	if vhost.paused > 0 {
+		return nil
+	}
+	for index, running := range vhost.running {
+		if running {
+			err := vhost.setBackend(uint32(index), vhost.nic.Fd)
+			if err != nil {
+				return err
+			}
+			vhost.kick(uint(index))
+		}
+	}
+	return nil
+}
+
+//
+// Hand our data queues to vhost, if we can.
+//
+// Only a single queue pair on a tap will do, and nothing
+// can be looking at the packets on the way through (so no
+// firewall, and receive filtering is left to the tap).
+//
+func (nic *VirtioNetDevice) openVhost(vm *kvm.VirtualMachine, model *Model) {
+	switch {
+	case nic.User != nil || nic.Switch != nil:
+		nic.Debug("vhost needs a tap")
+		return
+	case nic.Queues > 1:
+		nic.Debug("vhost needs a single queue pair")
+		return
+	case nic.Firewall != nil:
+		nic.Debug("vhost not used with a firewall")
+		return
+	case nic.HasFeatures(VirtioFRingPacked):
+		nic.Debug("vhost needs split rings")
+		return
+	}
+
+	vhost, err := openVhostNet(nic, vm, model)
+	if err != nil {
+		nic.Debug("vhost unavailable: %s", err.Error())
+		return
+	}
+
+	for i := uint(0); i < 2; i += 1 {
+		vchannel := nic.Channels[i]
+
+		// Any buffers we took but didn't finish with (if we
+		// were saved without vhost) were taken in order, so we
+		// just give them back by rewinding.
+		vchannel.Consumed -= uint16(len(vchannel.Outstanding))
+		vchannel.Outstanding = make(VirtioBufferSet)
+		vchannel.Offload(vhost)
+	}
+	nic.vhost = vhost
+
+	// We only hand split rings over.
+	nic.ClearFeatures(VirtioFRingPacked)
+}
+
+func (nic *VirtioNetDevice) Pause(manual bool) error {
+	err := nic.VirtioDevice.Pause(manual)
+	if err != nil || nic.vhost == nil {
+		return err
+	}
+	err = nic.vhost.pause()
+	if err != nil {
+		nic.vhost.resume()
+		nic.VirtioDevice.Unpause(manual)
+	}
+	return err
+}
+
+func (nic *VirtioNetDevice) Unpause(manual bool) error {
+	err := nic.VirtioDevice.Unpause(manual)
+	if err != nil || nic.vhost == nil {
+		return err
+	}
+	return nic.vhost.resume()
+}
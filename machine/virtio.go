@@ -1,28 +1,33 @@
 package machine
 
-//const __u16 VirtioDescFNext = VRING_DESC_F_NEXT;
-//const __u16 VirtioDescFWrite = VRING_DESC_F_WRITE;
-//const __u16 VirtioDescFIndirect = VRING_DESC_F_INDIRECT;
-
 import (
 	"encoding/json"
 	"log"
 	"math"
 	"sync/atomic"
-	"unsafe"
 
 	kvm "github.com/multiverse-os/portalgun/vm/kvm"
+	ring "github.com/multiverse-os/portalgun/vm/virtio/ring"
 )
 
 //
 // Virtio status.
 //
 const (
-	VirtioStatusReboot   = 0x0
-	VirtioStatusAck      = 0x1
-	VirtioStatusDriver   = 0x2
-	VirtioStatusDriverOk = 0x4
-	VirtioStatusFailed   = 0x80
+	VirtioStatusReboot     = 0x0
+	VirtioStatusAck        = 0x1
+	VirtioStatusDriver     = 0x2
+	VirtioStatusDriverOk   = 0x4
+	VirtioStatusFeaturesOk = 0x8
+	VirtioStatusFailed     = 0x80
+)
+
+//
+// Virtio interrupt status.
+//
+const (
+	VirtioIsrQueue  = 0x1
+	VirtioIsrConfig = 0x2
 )
 
 //
@@ -38,13 +43,18 @@ const (
 	VirtioTypeRpMsg    = 7
 	VirtioTypeScsi     = 8
 	VirtioType9p       = 9
+	VirtioTypeVsock    = 19
+	VirtioTypeFs       = 26
 )
 
 //
 // Generic features.
 //
 const (
-	VirtioRingFEventIdx = 1 << 29
+	VirtioRingFIndirectDesc = 1 << 28
+	VirtioRingFEventIdx     = 1 << 29
+	VirtioFVersion1         = 1 << 32
+	VirtioFRingPacked       = 1 << 34
 )
 
 //
@@ -99,133 +109,138 @@ type VirtioChannel struct {
 	// Our outstanding buffers.
 	Outstanding VirtioBufferSet `json:"outstanding"`
 
-	// The queue size.
+	// The queue size (and the most we allow).
 	QueueSize Register `json:"queue-size"`
+	QueueMax  uint64   `json:"queue-max,omitempty"`
 
-	// The address written.
+	// The address written (legacy).
 	QueueAddress Register `json:"queue-address"`
 
+	// The addresses written, and whether it's
+	// enabled (modern). The driver and device areas
+	// are the available and used rings for split rings.
+	QueueEnable Register `json:"queue-enable"`
+	QueueDesc   Register `json:"queue-desc"`
+	QueueDriver Register `json:"queue-driver"`
+	QueueDevice Register `json:"queue-device"`
+
+	// Our packed ring state (if it's packed).
+	Packed *ring.PackedState `json:"packed,omitempty"`
+
 	// Our MSI-X Vectors.
 	CfgVec   Register `json:"config-vector"`
 	QueueVec Register `json:"queue-vector"`
 
+	// Kicks from the driver, buffers consumed & returned,
+	// and interrupts sent. With EVENT_IDX, there should be
+	// far fewer kicks and interrupts than buffers.
+	Kicks      uint64 `json:"kicks"`
+	Buffers    uint64 `json:"buffers"`
+	Returned   uint64 `json:"returned"`
+	Interrupts uint64 `json:"interrupts"`
+
 	// Our underlying ring.
-	vring C.struct_vring
+	ring virtioRing
+
+	// Handled elsewhere?
+	offload VirtioOffload
+}
+
+//
+// VirtioOffload --
+//
+// A queue may be handed off to something else (e.g. the
+// kernel, via vhost). While a queue is offloaded we never
+// touch the ring ourselves: notifications are passed along
+// via Kick(), and Start() and Stop() are called as the
+// driver brings the device up and resets it.
+//
+type VirtioOffload interface {
+	Start(vchannel *VirtioChannel) error
+	Stop(vchannel *VirtioChannel) error
+	Kick(vchannel *VirtioChannel)
 }
 
-func (vchannel *VirtioChannel) processOne(n uint16) error {
+//
+// Offload this queue.
+// This must be called before the device is attached.
+//
+func (vchannel *VirtioChannel) Offload(offload VirtioOffload) {
+	vchannel.offload = offload
+}
 
-	var buf *VirtioBuffer
-	var addr C.__u64
-	var length C.__u32
-	var buf_flags C.__u16
-	var next C.__u16
-	index := C.__u16(n)
+func (vchannel *VirtioChannel) processOne(n uint16, segments []ring.Segment) error {
 
 	vchannel.Debug(
 		"vqueue#%d incoming slot [%d]",
 		vchannel.Channel,
-		index)
+		n)
 
-	for {
-		// Read the entry.
-		C.vring_get_index(
-			&vchannel.vring,
-			index,
-			&addr,
-			&length,
-			&buf_flags,
-			&next)
-
-		// Append our buffer.
-		has_next := (buf_flags & C.__u16(C.VirtioDescFNext)) != C.__u16(0)
-		is_write := (buf_flags & C.__u16(C.VirtioDescFWrite)) != C.__u16(0)
-		is_indirect := (buf_flags & C.__u16(C.VirtioDescFIndirect)) != C.__u16(0)
-
-		// Do we have a buffer?
-		if buf == nil {
-			buf = NewVirtioBuffer(uint16(index), !is_write)
-		}
+	// Readable segments always come first.
+	buf := NewVirtioBuffer(n, !segments[0].Write)
 
-		if is_indirect {
-			// FIXME: Map all indirect buffers.
-			log.Printf("WARNING: Indirect buffers not supported.")
-
-		} else {
-			// Map the given address.
-			vchannel.Debug("vqueue#%d map [%x-%x]",
-				vchannel.Channel,
-				kvm.Pointer(addr),
-				uint64(addr)+uint64(length)-1)
+	for _, segment := range segments {
+		// Map the given address.
+		vchannel.Debug("vqueue#%d map [%x-%x]",
+			vchannel.Channel,
+			segment.Addr,
+			segment.Addr+uint64(segment.Length)-1)
 
-			data, err := vchannel.VirtioDevice.mmap(
-				kvm.Pointer(addr),
-				uint64(length))
+		data, err := vchannel.VirtioDevice.mmap(
+			kvm.Pointer(segment.Addr),
+			uint64(segment.Length))
 
-			if err != nil {
-				log.Printf(
-					"Unable to map [%x,%x]? Flags are %x, next is %x.",
-					addr,
-					addr+C.__u64(length)-1,
-					buf_flags,
-					next)
-				return err
-			}
-
-			// Append this segment.
-			buf.Append(data)
+		if err != nil {
+			log.Printf(
+				"Unable to map [%x,%x]?",
+				segment.Addr,
+				segment.Addr+uint64(segment.Length)-1)
+			return err
 		}
 
-		// Are we finished?
-		if !has_next {
-			// Send these buffers.
-			vchannel.Debug(
-				"vqueue#%d processing slot [%d]",
-				vchannel.Channel,
-				buf.index)
-
-			// Mark this as outstanding.
-			vchannel.Outstanding[uint16(buf.index)] = true
-			vchannel.incoming <- buf
-			break
-
-		} else {
-			// Keep chaining.
-			index = next
-			vchannel.Debug(
-				"vqueue#%d next slot [%d]",
-				vchannel.Channel,
-				index)
-			continue
+		// Append this segment.
+		buf.Append(data)
+		if !segment.Write {
+			buf.readable += len(data)
 		}
 	}
 
+	// Send these buffers.
+	vchannel.Debug(
+		"vqueue#%d processing slot [%d]",
+		vchannel.Channel,
+		buf.index)
+
+	// Mark this as outstanding.
+	vchannel.Outstanding[uint16(buf.index)] = true
+	vchannel.incoming <- buf
+
 	// We're good.
 	return nil
 }
 
-func (vchannel *VirtioChannel) consumeOne() (bool, error) {
+func (vchannel *VirtioChannel) invalid(n uint16, err error) error {
+	log.Printf(
+		"Invalid buffer [%d] on vqueue#%d: %s",
+		n,
+		vchannel.Channel,
+		err.Error())
+	return err
+}
 
-	var flags C.__u16
-	var index C.__u16
-	var used_event C.__u16
+func (vchannel *VirtioChannel) consumeOne() (bool, error) {
 
 	// Fetch the next buffer.
-	// FIXME: We are currently not using the flags or the
-	// used_event on the incoming queue. We will need to
-	// support this eventually (notifying when we are short).
-	if C.vring_get_buf(
-		&vchannel.vring,
-		C.__u16(vchannel.Consumed),
-		&flags,
-		&index,
-		&used_event) != 0 {
-
-		// We're up a buffer.
-		vchannel.Consumed += 1
+	// This walks the chain (including any indirect table).
+	index, segments, ok, err := vchannel.ring.next()
+	if err != nil {
+		return false, vchannel.invalid(index, err)
+	}
+	if ok {
+		atomic.AddUint64(&vchannel.Buffers, 1)
 
 		// Process the buffer.
-		err := vchannel.processOne(uint16(index))
+		err := vchannel.processOne(index, segments)
 		if err != nil {
 			return false, err
 		}
@@ -236,11 +251,37 @@ func (vchannel *VirtioChannel) consumeOne() (bool, error) {
 	return false, nil
 }
 
+func (vchannel *VirtioChannel) consumeAll() error {
+
+	// No need for kicks while we're busy.
+	vchannel.ring.disableNotify()
+
+	for {
+		found, err := vchannel.consumeOne()
+		if err != nil {
+			return err
+		}
+		if found {
+			continue
+		}
+
+		// Ask for a kick on the next buffer. If one
+		// snuck in before we asked, we keep going.
+		if !vchannel.ring.enableNotify() {
+			return nil
+		}
+	}
+}
+
 func (vchannel *VirtioChannel) consumeOutstanding() error {
 
 	// Resubmit outstanding buffers.
 	for index, _ := range vchannel.Outstanding {
-		err := vchannel.processOne(index)
+		segments, err := vchannel.ring.buffer(index)
+		if err != nil {
+			return vchannel.invalid(index, err)
+		}
+		err = vchannel.processOne(index, segments)
 		if err != nil {
 			return err
 		}
@@ -262,14 +303,11 @@ func (vchannel *VirtioChannel) ProcessIncoming() error {
 		// should now be empty.
 		atomic.StoreInt32(&vchannel.pending, 0)
 
-		for {
-			found, err := vchannel.consumeOne()
+		if vchannel.offload == nil {
+			err := vchannel.consumeAll()
 			if err != nil {
 				return err
 			}
-			if !found {
-				break
-			}
 		}
 
 		// No longer active.
@@ -291,31 +329,24 @@ func (vchannel *VirtioChannel) ProcessOutgoing() error {
 			vchannel.Channel,
 			buf.index)
 
-		var evt_interrupt C.int
-		var no_interrupt C.int
-		C.vring_put_buf(
-			&vchannel.vring,
-			C.__u16(buf.index),
-			C.__u32(buf.length),
-			&evt_interrupt,
-			&no_interrupt)
-
-		if vchannel.HasFeatures(VirtioRingFEventIdx) {
-			// This is used the event index.
-			if evt_interrupt != C.int(0) {
-				// Interrupt the guest.
-				vchannel.Interrupt(true)
-			}
-		} else {
-			// We have no event index.
-			if no_interrupt == C.int(0) {
-				// Interrupt the guest.
-				vchannel.Interrupt(true)
-			}
-		}
+		// Any chained buffers go in with it, and
+		// we interrupt only once they're all there.
+		bufs := append([]*VirtioBuffer{buf}, buf.chain...)
 
 		// Remove from our outstanding list.
-		delete(vchannel.Outstanding, uint16(buf.index))
+		// (The driver may reuse these right away.)
+		for _, next := range bufs {
+			delete(vchannel.Outstanding, uint16(next.index))
+		}
+
+		// This uses the event index, if we have one.
+		interrupt := vchannel.ring.put(bufs)
+		atomic.AddUint64(&vchannel.Returned, uint64(len(bufs)))
+
+		if interrupt {
+			// Interrupt the guest.
+			vchannel.Interrupt(true)
+		}
 
 		// We can release until the next buffer comes back.
 		vchannel.VirtioDevice.Release()
@@ -325,6 +356,9 @@ func (vchannel *VirtioChannel) ProcessOutgoing() error {
 }
 
 func (vchannel *VirtioChannel) Interrupt(queue bool) {
+	if queue {
+		atomic.AddUint64(&vchannel.Interrupts, 1)
+	}
 	if vchannel.VirtioDevice.IsMSIXEnabled() {
 		if queue {
 			// Send on the specified queue vector.
@@ -374,9 +408,14 @@ type VirtioDevice struct {
 	HostFeatures  Register `json:"host-features"`
 	GuestFeatures Register `json:"guest-features"`
 	QueueSelect   Register `json:"queue-select"`
-	QueueNotify   Register `json:"queue-notify"`
-	DeviceStatus  Register `json:"device-status"`
-	IsrStatus     Register `json:"isr-status"`
+
+	// The feature words selected (modern).
+	DeviceFeatureSelect Register `json:"device-feature-select"`
+	DriverFeatureSelect Register `json:"driver-feature-select"`
+
+	QueueNotify  Register `json:"queue-notify"`
+	DeviceStatus Register `json:"device-status"`
+	IsrStatus    Register `json:"isr-status"`
 
 	// Our host map function.
 	mmap func(kvm.Pointer, uint64) ([]byte, error)
@@ -502,16 +541,7 @@ func (reg *VirtioConf) Write(offset uint64, size uint, value uint64) error {
 
 	case VirtioOffsetQueueNotify:
 		// Notify the queue if necessary.
-		if queue, ok := reg.VirtioDevice.Channels[uint(value)]; ok {
-			if queue.QueueAddress.Value != 0 {
-				// Do we need a notification?
-				// We do this to avoid blocking when there are
-				// already pending notifications in the channel.
-				if atomic.CompareAndSwapInt32(&queue.pending, 0, 1) {
-					queue.notifications <- VirtioNotification{}
-				}
-			}
-		}
+		reg.VirtioDevice.notify(uint(value))
 		err := reg.QueueNotify.Write(0, size, value)
 		if err != nil {
 			return err
@@ -521,36 +551,7 @@ func (reg *VirtioConf) Write(offset uint64, size uint, value uint64) error {
 		return SaveIO
 
 	case VirtioOffsetStatus:
-		if value == VirtioStatusReboot {
-			reg.Device.Debug("reboot")
-			for _, vchannel := range reg.VirtioDevice.Channels {
-				err := vchannel.QueueAddress.Write(0, 8, 0)
-				if err != nil {
-					return err
-				}
-				err = vchannel.remap()
-				if err != nil {
-					return err
-				}
-			}
-		}
-		if reg.DeviceStatus.Value&VirtioStatusAck == 0 &&
-			value&VirtioStatusAck != 0 {
-			reg.Device.Debug("ack")
-		}
-		if reg.DeviceStatus.Value&VirtioStatusDriver == 0 &&
-			value&VirtioStatusDriver != 0 {
-			reg.Device.Debug("driver")
-		}
-		if reg.DeviceStatus.Value&VirtioStatusDriverOk == 0 &&
-			value&VirtioStatusDriverOk != 0 {
-			reg.Device.Debug("driver-ok")
-		}
-		if reg.DeviceStatus.Value&VirtioStatusFailed == 0 &&
-			value&VirtioStatusFailed != 0 {
-			reg.Device.Debug("failed")
-		}
-		return reg.DeviceStatus.Write(0, size, value)
+		return reg.VirtioDevice.setStatus(size, value)
 
 	case VirtioOffsetIsr:
 		return reg.IsrStatus.Write(0, size, value)
@@ -593,41 +594,250 @@ func (reg *VirtioConf) Write(offset uint64, size uint, value uint64) error {
 	return nil
 }
 
+//
+// A kick from the driver (by either transport).
+//
+func (virtio *VirtioDevice) notify(index uint) {
+	queue, ok := virtio.Channels[index]
+	if !ok {
+		return
+	}
+
+	atomic.AddUint64(&queue.Kicks, 1)
+	if queue.offload != nil {
+		queue.offload.Kick(queue)
+	} else if queue.active() {
+		// Do we need a notification?
+		// We do this to avoid blocking when there are
+		// already pending notifications in the channel.
+		if atomic.CompareAndSwapInt32(&queue.pending, 0, 1) {
+			queue.notifications <- VirtioNotification{}
+		}
+	}
+}
+
+//
+// Where the driver writes to kick the given queue, and
+// how wide the write is. (What's written is the index).
+// This is only known once the driver has set us up.
+//
+func (virtio *VirtioDevice) notifyAddress(index uint) (kvm.Pointer, uint, bool) {
+	if base, _, _, ok := virtio.VirtioMmio(); ok {
+		return base + VirtioMmioQueueNotify, 4, true
+	}
+	if virtio.msix == nil {
+		return 0, 0, false
+	}
+	if virtio.HasFeatures(VirtioFVersion1) {
+		base := virtio.msix.BarAddress(VirtioPciModernBar)
+		addr := base + VirtioPciNotifyOffset + kvm.Pointer(index*VirtioPciNotifyMultiplier)
+		return addr, 2, base != 0
+	}
+	base := virtio.msix.BarAddress(0)
+	return base + VirtioOffsetQueueNotify, 2, base != 0
+}
+
+//
+// A status write from the driver (by either transport).
+//
+func (virtio *VirtioDevice) setStatus(size uint, value uint64) error {
+	if value == VirtioStatusReboot {
+		virtio.Device.Debug("reboot")
+		for _, vchannel := range virtio.Channels {
+			err := vchannel.reset()
+			if err != nil {
+				return err
+			}
+		}
+		virtio.GuestFeatures.Value = 0
+	}
+	if virtio.DeviceStatus.Value&VirtioStatusAck == 0 &&
+		value&VirtioStatusAck != 0 {
+		virtio.Device.Debug("ack")
+	}
+	if virtio.DeviceStatus.Value&VirtioStatusDriver == 0 &&
+		value&VirtioStatusDriver != 0 {
+		virtio.Device.Debug("driver")
+	}
+	if virtio.DeviceStatus.Value&VirtioStatusFeaturesOk == 0 &&
+		value&VirtioStatusFeaturesOk != 0 {
+		// We won't accept features we didn't offer.
+		// (The driver reads this back to check.)
+		if virtio.GuestFeatures.Value&^virtio.HostFeatures.Value != 0 {
+			virtio.Device.Debug("features refused")
+			value &^= VirtioStatusFeaturesOk
+		} else {
+			virtio.Device.Debug("features-ok")
+		}
+	}
+	if virtio.DeviceStatus.Value&VirtioStatusDriverOk == 0 &&
+		value&VirtioStatusDriverOk != 0 {
+		virtio.Device.Debug("driver-ok")
+		for _, vchannel := range virtio.Channels {
+			if vchannel.offload != nil {
+				err := vchannel.offload.Start(vchannel)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if virtio.DeviceStatus.Value&VirtioStatusFailed == 0 &&
+		value&VirtioStatusFailed != 0 {
+		virtio.Device.Debug("failed")
+	}
+	return virtio.DeviceStatus.Write(0, size, value)
+}
+
 func (vchannel *VirtioChannel) remap() error {
 
-	if vchannel.QueueAddress.Value != 0 {
-		// Can we map this address?
-		vchannel_size := C.vring_size(
-			C.uint(vchannel.QueueSize.Value),
-			kvm.PageSize)
+	memory := virtioMemory{vchannel.VirtioDevice}
+	size := uint16(vchannel.QueueSize.Value)
 
-		mmap, err := vchannel.VirtioDevice.mmap(
-			kvm.Pointer(4096*vchannel.QueueAddress.Value),
-			uint64(vchannel_size))
+	switch {
+	case vchannel.QueueEnable.Value != 0 &&
+		vchannel.HasFeatures(VirtioFRingPacked):
+		// Can we map these addresses?
+		if vchannel.Packed == nil {
+			vchannel.Packed = ring.NewPackedState()
+		}
+		packed, err := ring.NewPacked(
+			memory,
+			size,
+			vchannel.QueueDesc.Value,
+			vchannel.QueueDriver.Value,
+			vchannel.QueueDevice.Value,
+			vchannel.Packed)
 
 		if err != nil {
 			return err
 		}
+		vchannel.ring = &virtioPackedRing{vchannel, packed}
+
+	case vchannel.QueueEnable.Value != 0:
+		split, err := ring.NewSplit(
+			memory,
+			size,
+			vchannel.QueueDesc.Value,
+			vchannel.QueueDriver.Value,
+			vchannel.QueueDevice.Value)
 
-		// Initialize the ring.
-		C.vring_init(
-			&vchannel.vring,
-			C.uint(vchannel.QueueSize.Value),
-			unsafe.Pointer(&mmap[0]),
+		if err != nil {
+			return err
+		}
+		vchannel.ring = &virtioSplitRing{vchannel, split}
+
+	case vchannel.QueueAddress.Value != 0:
+		split, err := ring.NewLegacySplit(
+			memory,
+			size,
+			4096*vchannel.QueueAddress.Value,
 			kvm.PageSize)
 
-		// Notify the consumer.
-		vchannel.notifications <- VirtioNotification{}
+		if err != nil {
+			return err
+		}
+		vchannel.ring = &virtioSplitRing{vchannel, split}
 
-	} else {
+	default:
 		// Leave the address cleared. No notifcations
 		// will be processed as per the Write() function.
 		vchannel.Consumed = 0
+		vchannel.Packed = nil
+		return nil
 	}
 
+	// Notify the consumer.
+	vchannel.notifications <- VirtioNotification{}
+
 	return nil
 }
 
+//
+// Is the queue set up (either way)?
+//
+func (vchannel *VirtioChannel) active() bool {
+	return vchannel.QueueAddress.Value != 0 ||
+		vchannel.QueueEnable.Value != 0
+}
+
+//
+// Back to how the driver found it.
+//
+func (vchannel *VirtioChannel) reset() error {
+	if vchannel.offload != nil {
+		err := vchannel.offload.Stop(vchannel)
+		if err != nil {
+			return err
+		}
+	}
+
+	vchannel.QueueAddress.Value = 0
+	vchannel.QueueEnable.Value = 0
+	vchannel.QueueDesc.Value = 0
+	vchannel.QueueDriver.Value = 0
+	vchannel.QueueDevice.Value = 0
+	if vchannel.QueueMax != 0 {
+		vchannel.QueueSize.Value = vchannel.QueueMax
+	}
+	return vchannel.remap()
+}
+
+//
+// Queue setup from a modern driver (by either transport).
+// None of this can change once the queue is enabled.
+//
+func (vchannel *VirtioChannel) setSize(size uint, value uint64) error {
+	// We only take smaller powers of two.
+	if vchannel.QueueEnable.Value != 0 ||
+		value == 0 ||
+		value&(value-1) != 0 ||
+		(vchannel.QueueMax != 0 && value > vchannel.QueueMax) {
+		vchannel.Debug("invalid queue size %d", value)
+		return nil
+	}
+	return vchannel.QueueSize.Write(0, size, value)
+}
+
+func (vchannel *VirtioChannel) setAddress(
+	register *Register,
+	offset uint64,
+	size uint,
+	value uint64) error {
+
+	if vchannel.QueueEnable.Value != 0 {
+		return nil
+	}
+	return register.Write(offset, size, value)
+}
+
+func (vchannel *VirtioChannel) enable() error {
+	if vchannel.QueueEnable.Value != 0 {
+		return nil
+	}
+	vchannel.QueueEnable.Value = 1
+	return vchannel.remap()
+}
+
+//
+// The host addresses of our descriptor table,
+// available ring and used ring (once mapped).
+//
+func (vchannel *VirtioChannel) ringAddresses() (uintptr, uintptr, uintptr) {
+	return vchannel.ring.addresses()
+}
+
+//
+// Guest memory, as seen by the ring.
+//
+type virtioMemory struct {
+	*VirtioDevice
+}
+
+func (memory virtioMemory) Map(addr uint64, size uint64) ([]byte, error) {
+	return memory.VirtioDevice.mmap(kvm.Pointer(addr), size)
+}
+
 func (vchannel *VirtioChannel) start() error {
 
 	// Can't have size 0 or a non power of 2.
@@ -650,7 +860,13 @@ func (vchannel *VirtioChannel) start() error {
 
 	// Is this a valid vqueue?
 	// If so, then we retrigger any outstanding buffers.
-	if vchannel.QueueAddress.Value != 0 {
+	// (Or if it's offloaded, we hand it back over).
+	if vchannel.offload != nil {
+		if vchannel.active() &&
+			vchannel.DeviceStatus.Value&VirtioStatusDriverOk != 0 {
+			return vchannel.offload.Start(vchannel)
+		}
+	} else if vchannel.active() {
 		err := vchannel.consumeOutstanding()
 		if err != nil {
 			return err
@@ -673,6 +889,7 @@ func NewVirtioChannel(n uint, size uint) *VirtioChannel {
 	vchannel := new(VirtioChannel)
 	vchannel.Channel = n
 	vchannel.QueueSize.Value = uint64(size)
+	vchannel.QueueMax = uint64(size)
 	vchannel.Outstanding = make(VirtioBufferSet)
 	vchannel.notifications = make(chan VirtioNotification, 1)
 	vchannel.init()
@@ -684,8 +901,8 @@ func NewVirtioDevice(device Device) *VirtioDevice {
 	virtio := &VirtioDevice{Device: device}
 	virtio.Config = NewRam(0)
 	virtio.Channels = make(VirtioChannelMap)
-	virtio.IsrStatus.readclr = 0x1
-	virtio.SetFeatures(VirtioRingFEventIdx)
+	virtio.IsrStatus.readclr = VirtioIsrQueue | VirtioIsrConfig
+	virtio.SetFeatures(VirtioRingFEventIdx | VirtioRingFIndirectDesc)
 	return virtio
 }
 
@@ -719,72 +936,26 @@ func NewPciVirtioDevice(
 	device.PciBarSizes[0] = kvm.PageSize
 	device.PciBarOps[0] = &VirtioConf{virtio}
 
-	return virtio, msix_device.init(info)
-}
-
-type VirtioMmioConf struct {
-	class int
-}
-
-func (reg *VirtioMmioConf) Read(offset uint64, size uint) (uint64, error) {
-
-	switch offset {
-	case 0x0:
-		// Magic value: 'virt'
-		return 0x76697274, nil
-	case 0x4:
-		// Device version.
-		return 1, nil
-	case 0x8:
-		// Device Id.
-		return uint64(reg.class), nil
-	case 0xc:
-		// Device vendor.
-		return VirtioPciVendor, nil
-	}
+	// And the modern interface alongside.
+	virtio.addModern(device)
 
-	return math.MaxUint64, nil
+	return virtio, msix_device.init(info)
 }
 
-func (reg *VirtioMmioConf) Write(offset uint64, size uint, value uint64) error {
-	return nil
+func (virtio *VirtioDevice) SetFeatures(features uint64) {
+	virtio.HostFeatures.Value = virtio.HostFeatures.Value | features
 }
 
-type VirtioMmioDevice struct {
-	MmioDevice
+func (virtio *VirtioDevice) ClearFeatures(features uint64) {
+	virtio.HostFeatures.Value = virtio.HostFeatures.Value &^ features
 }
 
-func NewMmioVirtioDevice(
-	info *DeviceInfo,
-	class int) (*VirtioDevice, error) {
-
-	// Create our Mmio device.
-	device := &VirtioMmioDevice{}
-
-	// Create our new device.
-	virtio := NewVirtioDevice(device)
-
-	// Set our I/O regions.
-	device.MmioDevice.IoMap = IoMap{
-		// Carve our special ports for our device info.
-		MemoryRegion{0, 0x10}: &VirtioMmioConf{class},
-		// The rest will be standard virtio control registers.
-		MemoryRegion{0x10, 0xe0}: &VirtioConf{virtio},
-	}
-
-	return virtio, device.init(info)
-}
-
-func (virtio *VirtioDevice) SetFeatures(features uint32) {
-	virtio.HostFeatures.Value = virtio.HostFeatures.Value | uint64(features)
-}
-
-func (virtio *VirtioDevice) HasFeatures(features uint32) bool {
+func (virtio *VirtioDevice) HasFeatures(features uint64) bool {
 	return (virtio.GetFeatures() & features) == features
 }
 
-func (virtio *VirtioDevice) GetFeatures() uint32 {
-	return uint32(virtio.GuestFeatures.Value & virtio.HostFeatures.Value)
+func (virtio *VirtioDevice) GetFeatures() uint64 {
+	return virtio.GuestFeatures.Value & virtio.HostFeatures.Value
 }
 
 func (virtio *VirtioDevice) Attach(vm *kvm.VirtualMachine, model *Model) error {
@@ -821,7 +992,24 @@ func (virtio *VirtioDevice) IsMSIXEnabled() bool {
 func (virtio *VirtioDevice) Interrupt() error {
 	// Just send a standrd interrupt,
 	// with an updated status register.
-	virtio.IsrStatus.Value = virtio.IsrStatus.Value | 0x1
+	virtio.IsrStatus.Value = virtio.IsrStatus.Value | VirtioIsrQueue
+	return virtio.Device.Interrupt()
+}
+
+//
+// Tell the guest that our config space has changed.
+//
+func (virtio *VirtioDevice) ConfigInterrupt() error {
+	if virtio.IsMSIXEnabled() {
+		// The config vector is set with the first queue selected.
+		vchannel, ok := virtio.Channels[0]
+		if !ok || vchannel.CfgVec.Value == 0xffff {
+			return nil
+		}
+		return virtio.msix.SendInterrupt(int(vchannel.CfgVec.Value))
+	}
+
+	virtio.IsrStatus.Value = virtio.IsrStatus.Value | VirtioIsrConfig
 	return virtio.Device.Interrupt()
 }
 
@@ -1,8 +1,9 @@
 package machine
 
 import (
-	"syscall"
+	"net"
 
+	nbd "github.com/multiverse-os/portalgun/vm/fs/nbd"
 	kvm "github.com/multiverse-os/portalgun/vm/kvm"
 )
 
@@ -14,9 +15,29 @@ const (
 	VirtioBlockTOut      = 1
 	VirtioBlockTFlush    = 4
 	VirtioBlockTFlushOut = 5
+	VirtioBlockTDiscard  = 11
 	VirtioBlockTBarrier  = 0x80000000
 )
 
+//
+// Features.
+//
+const (
+	VirtioBlockFReadOnly = 1 << 5
+	VirtioBlockFFlush    = 1 << 9
+	VirtioBlockFDiscard  = 1 << 13
+)
+
+//
+// Config space.
+//
+const (
+	VirtioBlockConfigLen        = 60
+	VirtioBlockMaxDiscardOffset = 36
+	VirtioBlockMaxDiscardSegs   = 40
+	VirtioBlockDiscardAlignment = 44
+)
+
 //
 // Status values.
 const (
@@ -32,7 +53,38 @@ type VirtioBlockDevice struct {
 	Dev string `json:"dev"`
 
 	// The backing file.
+	// (When using an overlay, this is the base image).
 	Fd int `json:"fd"`
+
+	// Copy-on-write overlay?
+	Overlay *BlockOverlay `json:"overlay,omitempty"`
+
+	// Remote NBD disk?
+	// (When set, Fd is not used).
+	Nbd *BlockNbd `json:"nbd,omitempty"`
+
+	// Read-only HTTP disk?
+	// (When set, Fd is not used).
+	Http *BlockHttp `json:"http,omitempty"`
+
+	// Encrypted image?
+	// (When set, Fd is the encrypted image).
+	Crypt *BlockCrypt `json:"crypt,omitempty"`
+
+	// Writes since the last backup.
+	Dirty *BlockDirty `json:"dirty,omitempty"`
+
+	// I/O limits & counters.
+	Throttle *BlockThrottle `json:"throttle,omitempty"`
+
+	// Our backend.
+	backend BlockBackend
+
+	// Our NBD export (if running).
+	export *nbd.Server
+
+	// The last backup job.
+	backup *BlockBackup
 }
 
 func (device *VirtioBlockDevice) processRequests(
@@ -58,9 +110,17 @@ func (device *VirtioBlockDevice) processRequests(
 		// Our status byte.
 		status := &Ram{buf.Map(buf.Length()-1, 1)}
 
+		// Wait for our turn.
 		switch int(cmd_type) {
 		case VirtioBlockTIn:
-			_, err := buf.PRead(device.Fd, offset, 16, buf.Length()-17)
+			device.Throttle.Wait(false, buf.Length()-17)
+		case VirtioBlockTOut:
+			device.Throttle.Wait(true, buf.Length()-17)
+		}
+
+		switch int(cmd_type) {
+		case VirtioBlockTIn:
+			_, err := buf.PReadAt(device.backend, offset, 16, buf.Length()-17)
 			if err != nil {
 				device.Debug(
 					"read err [%x,%x] -> %s",
@@ -78,7 +138,7 @@ func (device *VirtioBlockDevice) processRequests(
 			break
 
 		case VirtioBlockTOut:
-			_, err := buf.PWrite(device.Fd, offset, 16, buf.Length()-17)
+			_, err := buf.PWriteAt(device.backend, offset, 16, buf.Length()-17)
 			if err != nil {
 				device.Debug(
 					"write err [%x,%x] -> %s",
@@ -95,6 +155,30 @@ func (device *VirtioBlockDevice) processRequests(
 			}
 			break
 
+		case VirtioBlockTFlush:
+			fallthrough
+		case VirtioBlockTFlushOut:
+			err := device.backend.Flush()
+			if err != nil {
+				device.Debug("flush err -> %s", err.Error())
+				status.Set8(0, VirtioBlockSIoErr)
+			} else {
+				device.Debug("flush ok")
+				status.Set8(0, VirtioBlockSOk)
+			}
+			break
+
+		case VirtioBlockTDiscard:
+			err := device.discard(buf)
+			if err != nil {
+				device.Debug("discard err -> %s", err.Error())
+				status.Set8(0, VirtioBlockSIoErr)
+			} else {
+				device.Debug("discard ok")
+				status.Set8(0, VirtioBlockSOk)
+			}
+			break
+
 		default:
 			device.Debug("unknown command '%d'?", cmd_type)
 			status.Set8(0, VirtioBlockSUnsupported)
@@ -108,6 +192,30 @@ func (device *VirtioBlockDevice) processRequests(
 	return nil
 }
 
+func (device *VirtioBlockDevice) discard(buf *VirtioBuffer) error {
+
+	trimmer, ok := device.backend.(BlockTrimmer)
+	if !ok {
+		return BlockNoDiscardErr
+	}
+
+	// Each segment is 16 bytes:
+	// sector (64), number of sectors (32), flags (32).
+	segments := &Ram{make([]byte, buf.Length()-17)}
+	buf.CopyOut(16, segments.Data)
+
+	for i := 0; i+16 <= segments.Size(); i += 16 {
+		sector := segments.Get64(i)
+		count := segments.Get32(i + 8)
+		err := trimmer.Trim(int64(512*sector), int64(512*uint64(count)))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func NewVirtioMmioBlock(info *DeviceInfo) (Device, error) {
 	device, err := NewMmioVirtioDevice(info, VirtioTypeBlock)
 	device.Channels[0] = NewVirtioChannel(0, 256)
@@ -126,20 +234,263 @@ func (block *VirtioBlockDevice) Attach(vm *kvm.VirtualMachine, model *Model) err
 		return err
 	}
 
+	// Open our backend.
+	err = block.open()
+	if err != nil {
+		return err
+	}
+
+	// Ensure we have a throttle.
+	// (With no limits set, this is a no-op).
+	if block.Throttle == nil {
+		block.Throttle = new(BlockThrottle)
+	}
+
 	// Setup our config space.
-	var stat syscall.Stat_t
-	err = syscall.Fstat(block.Fd, &stat)
+	size, err := block.backend.Size()
 	if err != nil {
 		return err
 	}
-	block.Config.GrowTo(24)
-	block.Config.Set64(0, uint64(stat.Size)/512) // Total # of blocks.
-	block.Config.Set32(8, 512)                   // Max segment size.
-	block.Config.Set32(12, 1024)                 // Max # of segments per req.
-	block.Config.Set16(20, uint16(stat.Blksize))
+	block.Config.GrowTo(VirtioBlockConfigLen)
+	block.Config.Set64(0, uint64(size)/512) // Total # of blocks.
+	block.Config.Set32(8, 512)              // Max segment size.
+	block.Config.Set32(12, 1024)            // Max # of segments per req.
+	block.Config.Set16(20, uint16(block.backend.BlockSize()))
+	block.SetFeatures(VirtioBlockFFlush)
 
-	// Start our network process.
+	// Optional backend features.
+	if readonly, ok := block.backend.(BlockReadOnly); ok && readonly.ReadOnly() {
+		block.SetFeatures(VirtioBlockFReadOnly)
+	}
+	if trimmer, ok := block.backend.(BlockTrimmer); ok && trimmer.CanTrim() {
+		block.Config.Set32(VirtioBlockMaxDiscardOffset, 1<<22)
+		block.Config.Set32(VirtioBlockMaxDiscardSegs, 1)
+		block.Config.Set32(VirtioBlockDiscardAlignment, 8)
+		block.SetFeatures(VirtioBlockFDiscard)
+	}
+
+	// Start our block process.
 	go block.processRequests(block.Channels[0])
 
 	return nil
 }
+
+func (block *VirtioBlockDevice) open() error {
+	err := block.openBackend()
+	if err != nil {
+		return err
+	}
+
+	// Track all writes.
+	size, err := block.backend.Size()
+	if err != nil {
+		return err
+	}
+	if block.Dirty == nil {
+		block.Dirty = new(BlockDirty)
+	}
+	block.Dirty.init(size)
+	block.backend = &BlockTracker{
+		BlockBackend: block.backend,
+		dirty:        block.Dirty,
+	}
+
+	return nil
+}
+
+func (block *VirtioBlockDevice) openBackend() error {
+
+	// A remote disk?
+	if block.Nbd != nil {
+		if block.Overlay != nil {
+			return BlockOverlayInvalidErr
+		}
+		err := block.Nbd.open()
+		if err != nil {
+			return err
+		}
+		block.backend = block.Nbd
+		return nil
+	}
+
+	// An HTTP image?
+	if block.Http != nil {
+		if block.Overlay != nil {
+			return BlockOverlayInvalidErr
+		}
+		err := block.Http.open()
+		if err != nil {
+			return err
+		}
+		block.backend = block.Http
+		return nil
+	}
+
+	// A local file, possibly with an overlay.
+	base := NewBlockFile(block.Fd)
+	if block.Crypt != nil {
+		if block.Overlay != nil {
+			return BlockOverlayInvalidErr
+		}
+		err := block.Crypt.open(base)
+		if err != nil {
+			return err
+		}
+		block.backend = block.Crypt
+		return nil
+	}
+	if block.Overlay != nil {
+		err := block.Overlay.open(base)
+		if err != nil {
+			return err
+		}
+		block.backend = block.Overlay
+	} else {
+		block.backend = base
+	}
+
+	return nil
+}
+
+func (block *VirtioBlockDevice) Save(vm *kvm.VirtualMachine) error {
+
+	// Make sure everything we've acknowledged
+	// (including the overlay bitmap) is on disk.
+	if block.Dirty != nil {
+		err := block.Dirty.save()
+		if err != nil {
+			return err
+		}
+	}
+	if block.backend != nil {
+		err := block.backend.Flush()
+		if err != nil {
+			return err
+		}
+	}
+
+	return block.VirtioDevice.Save(vm)
+}
+
+func (block *VirtioBlockDevice) SetLimits(limits BlockLimits) {
+	block.Throttle.SetLimits(limits)
+}
+
+func (block *VirtioBlockDevice) ThrottleStats() BlockThrottleStats {
+	return block.Throttle.Stats()
+}
+
+func (block *VirtioBlockDevice) Commit(path string) error {
+	if block.Overlay == nil {
+		return BlockNoOverlayErr
+	}
+
+	fd, err := block.Overlay.Commit(path)
+	if fd >= 0 {
+		// The old base is gone.
+		block.Fd = fd
+	}
+	return err
+}
+
+//
+// Supply the passphrase for an encrypted image.
+// Guest I/O fails until this is done.
+//
+func (block *VirtioBlockDevice) Unlock(passphrase []byte) error {
+	if block.Crypt == nil {
+		return BlockNotEncryptedErr
+	}
+
+	return block.Crypt.Unlock(passphrase)
+}
+
+func (block *VirtioBlockDevice) Discard() error {
+	if block.Overlay == nil {
+		return BlockNoOverlayErr
+	}
+
+	err := block.Overlay.Discard()
+	if err != nil {
+		return err
+	}
+
+	// Everything may have changed.
+	block.Dirty.markAll()
+	return nil
+}
+
+//
+// Serve our disk over NBD (for host tools).
+// The export is not preserved across a re-exec.
+//
+func (block *VirtioBlockDevice) Export(
+	network string,
+	address string,
+	readonly bool) error {
+
+	if block.export != nil {
+		return BlockAlreadyExportedErr
+	}
+
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+
+	block.export = nbd.NewServer(&nbd.Export{
+		Name:     block.Name(),
+		Backend:  block.backend,
+		ReadOnly: readonly,
+	})
+	block.export.Debug = block.IsDebugging()
+	go block.export.Serve(listener)
+
+	return nil
+}
+
+func (block *VirtioBlockDevice) Unexport() error {
+	if block.export == nil {
+		return BlockNotExportedErr
+	}
+
+	err := block.export.Close()
+	block.export = nil
+	return err
+}
+
+//
+// Start a backup job.
+// Only one may run at a time.
+//
+func (block *VirtioBlockDevice) Backup(target string, incremental bool) error {
+	tracker := block.backend.(*BlockTracker)
+	job, err := NewBlockBackup(
+		tracker.BlockBackend,
+		block.Dirty,
+		target,
+		incremental)
+	if err != nil {
+		return err
+	}
+
+	block.backup = job
+	return nil
+}
+
+func (block *VirtioBlockDevice) BackupStatus() (BlockBackupStatus, error) {
+	if block.backup == nil {
+		return BlockBackupStatus{}, BlockNoBackupErr
+	}
+
+	return block.backup.Status(), nil
+}
+
+func (block *VirtioBlockDevice) BackupCancel() error {
+	if block.backup == nil {
+		return BlockNoBackupErr
+	}
+
+	block.backup.Cancel()
+	return nil
+}
@@ -1,6 +1,7 @@
 package machine
 
 import (
+	"io"
 	"syscall"
 	"unsafe"
 )
@@ -17,6 +18,14 @@ type VirtioBuffer struct {
 	index    uint16
 	length   int
 	readonly bool
+
+	// How much of it is device-readable.
+	// (The rest, after this, is writable).
+	readable int
+
+	// Buffers to be returned along with this one.
+	// (The guest expects to see these together).
+	chain []*VirtioBuffer
 }
 
 func NewVirtioBuffer(index uint16, readonly bool) *VirtioBuffer {
@@ -37,10 +46,18 @@ func (buf *VirtioBuffer) Length() int {
 	return buf.length
 }
 
+func (buf *VirtioBuffer) Readable() int {
+	return buf.readable
+}
+
 func (buf *VirtioBuffer) SetLength(length int) {
 	buf.length = length
 }
 
+func (buf *VirtioBuffer) Chain(next *VirtioBuffer) {
+	buf.chain = append(buf.chain, next)
+}
+
 func (buf *VirtioBuffer) Gather(
 	offset int,
 	length int) ([]unsafe.Pointer, []C.int) {
@@ -139,6 +156,73 @@ func (buf *VirtioBuffer) PRead(
 	return buf.doIO(fd, fd_offset, buf_offset, length, C.int(0))
 }
 
+func (buf *VirtioBuffer) Segments(
+	offset int,
+	length int) [][]byte {
+
+	segments := make([][]byte, 0, len(buf.data))
+
+	for _, data := range buf.data {
+		if length == 0 {
+			break
+		}
+		if offset >= len(data) {
+			offset -= len(data)
+			continue
+		}
+
+		data = data[offset:]
+		offset = 0
+		if len(data) > length {
+			data = data[:length]
+		}
+
+		segments = append(segments, data)
+		length -= len(data)
+	}
+
+	return segments
+}
+
+func (buf *VirtioBuffer) PReadAt(
+	reader io.ReaderAt,
+	offset int64,
+	buf_offset int,
+	length int) (int, error) {
+
+	// Read directly into each segment.
+	// This keeps things zero-copy for any
+	// backend that can implement ReadAt().
+	done := 0
+	for _, data := range buf.Segments(buf_offset, length) {
+		n, err := reader.ReadAt(data, offset+int64(done))
+		done += n
+		if err != nil {
+			return done, err
+		}
+	}
+
+	return done, nil
+}
+
+func (buf *VirtioBuffer) PWriteAt(
+	writer io.WriterAt,
+	offset int64,
+	buf_offset int,
+	length int) (int, error) {
+
+	done := 0
+	for _, data := range buf.Segments(buf_offset, length) {
+		n, err := writer.WriteAt(data, offset+int64(done))
+		done += n
+		if err != nil {
+			return done, err
+		}
+	}
+
+	return done, nil
+}
+
 func (buf *VirtioBuffer) Map(
 	offset int,
 	length int) []byte {
@@ -198,3 +282,17 @@ func (buf *VirtioBuffer) CopyOut(
 
 	return copied
 }
+
+func (buf *VirtioBuffer) CopyIn(
+	offset int,
+	input []byte) int {
+
+	copied := 0
+
+	for _, data := range buf.Segments(offset, len(input)) {
+		copy(data, input[copied:])
+		copied += len(data)
+	}
+
+	return copied
+}
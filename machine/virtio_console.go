@@ -32,30 +32,62 @@ type VirtioConsoleDevice struct {
 	write_lock sync.Mutex
 
 	Opened bool `json:"opened"`
+
+	// Has the guest driver said hello?
+	Ready bool `json:"ready"`
+
+	// The most ports we'll have (including port 0).
+	MaxPorts int `json:"max-ports"`
+
+	// Our named ports.
+	Ports []*VirtioConsolePort `json:"ports"`
+
+	ports_lock sync.Mutex
+
+	// Queued control messages.
+	ctrl chan virtioConsoleCtrl
 }
 
+type virtioConsoleCtrl struct {
+	port  int
+	event int
+	value int
+	data  []byte
+}
+
+//
+// Queue a control message for the guest.
+// These are sent in order, as buffers are available.
+//
 func (device *VirtioConsoleDevice) sendCtrl(
 	port int,
 	event int,
-	value int) error {
+	value int,
+	data []byte) error {
 
-	buf := <-device.Channels[2].incoming
+	device.ctrl <- virtioConsoleCtrl{port, event, value, data}
+	return nil
+}
 
-	header := &Ram{buf.Map(0, 8)}
+func (device *VirtioConsoleDevice) processCtrl() {
+	for msg := range device.ctrl {
+		buf := <-device.Channels[2].incoming
 
-	if header.Size() < 8 {
-		buf.length = 0
-		device.Channels[2].outgoing <- buf
-		return nil
-	}
+		if buf.Length() < 8+len(msg.data) {
+			buf.length = 0
+			device.Channels[2].outgoing <- buf
+			continue
+		}
 
-	header.Set32(0, uint32(port))
-	header.Set16(4, uint16(event))
-	header.Set16(6, uint16(value))
-	buf.length = 8
+		stream := NewVirtioStream(buf, 0)
+		stream.Write32(uint32(msg.port))
+		stream.Write16(uint16(msg.event))
+		stream.Write16(uint16(msg.value))
+		stream.WriteBytes(msg.data)
+		buf.length = 8 + len(msg.data)
 
-	device.Channels[2].outgoing <- buf
-	return nil
+		device.Channels[2].outgoing <- buf
+	}
 }
 
 func (device *VirtioConsoleDevice) ctrlConsole(
@@ -82,7 +114,13 @@ func (device *VirtioConsoleDevice) ctrlConsole(
 		switch int(event) {
 		case VirtioConsoleDeviceReady:
 			vchannel.Debug("device-ready")
-			device.sendCtrl(0, VirtioConsolePortAdd, 1)
+			device.sendCtrl(0, VirtioConsolePortAdd, 1, nil)
+			device.ports_lock.Lock()
+			device.Ready = true
+			for _, port := range device.Ports {
+				device.sendCtrl(port.Id, VirtioConsolePortAdd, 1, nil)
+			}
+			device.ports_lock.Unlock()
 			break
 
 		case VirtioConsolePortAdd:
@@ -98,13 +136,19 @@ func (device *VirtioConsoleDevice) ctrlConsole(
 
 			if id == 0 && value == 1 {
 				// No, this is not a console.
-				device.sendCtrl(0, VirtioConsolePortConsole, 0)
-				device.sendCtrl(0, VirtioConsolePortOpen, 1)
+				device.sendCtrl(0, VirtioConsolePortConsole, 0, nil)
+				device.sendCtrl(0, VirtioConsolePortOpen, 1, nil)
 				if !device.Opened {
 					device.Opened = true
 					device.read_lock.Unlock()
 					device.write_lock.Unlock()
 				}
+			} else if port := device.port(int(id)); port != nil {
+				if value == 1 {
+					device.portReady(port)
+				} else {
+					device.Debug("port %s failed", port.Name)
+				}
 			}
 			break
 
@@ -118,6 +162,11 @@ func (device *VirtioConsoleDevice) ctrlConsole(
 
 		case VirtioConsolePortOpen:
 			vchannel.Debug("port-open")
+			if port := device.port(int(id)); port != nil {
+				port.lock.Lock()
+				port.Open = value == 1
+				port.lock.Unlock()
+			}
 			break
 
 		case VirtioConsolePortName:
@@ -138,18 +187,17 @@ func setupConsole(device *VirtioDevice) (Device, error) {
 	// Set our features.
 	device.SetFeatures(VirtioConsoleFMultiPort)
 
-	// We only support a single port.
-	// (The worst multi-port device in history).
-	device.Config.GrowTo(8)
-	device.Config.Set32(4, 1)
-
+	// Port 0 and the control queues.
+	// (Other ports are set up when attached).
 	device.Channels[0] = NewVirtioChannel(0, 128)
 	device.Channels[1] = NewVirtioChannel(1, 128)
 	device.Channels[2] = NewVirtioChannel(2, 32)
 	device.Channels[3] = NewVirtioChannel(3, 32)
 
 	return &VirtioConsoleDevice{
-		VirtioDevice: device}, nil
+		VirtioDevice: device,
+		MaxPorts:     VirtioConsoleMaxPorts,
+	}, nil
 }
 
 func NewVirtioMmioConsole(info *DeviceInfo) (Device, error) {
@@ -171,6 +219,41 @@ func NewVirtioPciConsole(info *DeviceInfo) (Device, error) {
 }
 
 func (console *VirtioConsoleDevice) Attach(vm *kvm.VirtualMachine, model *Model) error {
+	if console.MaxPorts < 1 {
+		console.MaxPorts = 1
+	}
+
+	// The guest sees the number of ports,
+	// and a pair of queues for each.
+	console.Config.GrowTo(8)
+	console.Config.Set32(4, uint32(console.MaxPorts))
+	for id := 1; id < console.MaxPorts; id += 1 {
+		for _, i := range []uint{uint(2*id + 2), uint(2*id + 3)} {
+			if _, ok := console.Channels[i]; !ok {
+				console.Channels[i] = NewVirtioChannel(i, 128)
+			}
+		}
+	}
+
+	// Bring our ports back.
+	// Any host connections were lost.
+	console.ctrl = make(chan virtioConsoleCtrl, VirtioConsoleCtrlQueue)
+	for _, port := range console.Ports {
+		if port.Id <= 0 || port.Id >= console.MaxPorts {
+			return VirtioConsoleBadPortErr
+		}
+		if port.Connected {
+			port.Connected = false
+			if console.Ready {
+				console.sendCtrl(port.Id, VirtioConsolePortOpen, 0, nil)
+			}
+		}
+		err := console.openPort(port)
+		if err != nil {
+			return err
+		}
+	}
+
 	err := console.VirtioDevice.Attach(vm, model)
 	if err != nil {
 		return err
@@ -184,6 +267,10 @@ func (console *VirtioConsoleDevice) Attach(vm *kvm.VirtualMachine, model *Model)
 
 	// Start our console process.
 	go console.ctrlConsole(console.Channels[3])
+	go console.processCtrl()
+	for id := 1; id < console.MaxPorts; id += 1 {
+		go console.writePort(id)
+	}
 
 	return nil
 }
@@ -0,0 +1,538 @@
+package machine
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	unix "golang.org/x/sys/unix"
+)
+
+//
+// Console port limits.
+//
+const (
+	VirtioConsoleMaxPorts       = 16
+	VirtioConsoleMaxName        = 255
+	VirtioConsoleCtrlQueue      = 64
+	VirtioConsoleResizeInterval = time.Second
+)
+
+//
+// VirtioConsolePortInfo --
+//
+// A named port (other than port 0, which is our
+// channel to the agent). The guest sees this as
+// /dev/virtio-ports/<name>, or as an hvc if it's a
+// console. On the host it's backed by exactly one of
+// a unix socket (we listen, one client at a time),
+// a pty, or a file (output only).
+//
+type VirtioConsolePortInfo struct {
+	// The port number.
+	Id int `json:"id"`
+
+	// The name the guest sees.
+	Name string `json:"name"`
+
+	// Is this a console?
+	Console bool `json:"console,omitempty"`
+
+	// Listen on this unix socket.
+	Socket string `json:"socket,omitempty"`
+
+	// Allocate a pty.
+	Pty bool `json:"pty,omitempty"`
+
+	// Append output to this file.
+	File string `json:"file,omitempty"`
+
+	// Our pty master. This is deliberately not
+	// CLOEXEC, so that it survives a re-exec.
+	Fd int `json:"fd,omitempty"`
+
+	// Where to find the pty.
+	PtyPath string `json:"pty-path,omitempty"`
+
+	// The console size.
+	Cols uint16 `json:"cols,omitempty"`
+	Rows uint16 `json:"rows,omitempty"`
+
+	// Is the host side connected?
+	Connected bool `json:"connected,omitempty"`
+
+	// Does the guest have it open?
+	Open bool `json:"open,omitempty"`
+}
+
+type VirtioConsolePort struct {
+	VirtioConsolePortInfo
+
+	// Where guest output goes (nil to discard).
+	output io.Writer
+
+	// Our host side.
+	listener *net.UnixListener
+	conn     *net.UnixConn
+	file     *os.File
+
+	removed bool
+
+	lock sync.Mutex
+}
+
+func (port *VirtioConsolePortInfo) validate() error {
+	backends := 0
+	if port.Socket != "" {
+		backends += 1
+	}
+	if port.Pty {
+		backends += 1
+	}
+	if port.File != "" {
+		backends += 1
+	}
+	if backends != 1 ||
+		port.Name == "" ||
+		len(port.Name) > VirtioConsoleMaxName {
+		return VirtioConsoleBadPortErr
+	}
+	return nil
+}
+
+//
+// Open a pty, in raw mode.
+//
+func openPty() (int, string, error) {
+	fd, err := unix.Open("/dev/ptmx", unix.O_RDWR|unix.O_NOCTTY, 0)
+	if err != nil {
+		return -1, "", err
+	}
+	err = unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0)
+	if err != nil {
+		unix.Close(fd)
+		return -1, "", err
+	}
+	n, err := unix.IoctlGetInt(fd, unix.TIOCGPTN)
+	if err != nil {
+		unix.Close(fd)
+		return -1, "", err
+	}
+
+	termios, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err == nil {
+		termios.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK |
+			unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+		termios.Oflag &^= unix.OPOST
+		termios.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+		termios.Cflag &^= unix.CSIZE | unix.PARENB
+		termios.Cflag |= unix.CS8
+		err = unix.IoctlSetTermios(fd, unix.TCSETS, termios)
+	}
+	if err != nil {
+		unix.Close(fd)
+		return -1, "", err
+	}
+
+	return fd, fmt.Sprintf("/dev/pts/%d", n), nil
+}
+
+//
+// Start the host side of a port.
+// (Either fresh, or after a re-exec).
+//
+func (console *VirtioConsoleDevice) openPort(port *VirtioConsolePort) error {
+	switch {
+	case port.Socket != "":
+		os.Remove(port.Socket)
+		listener, err := net.ListenUnix(
+			"unix",
+			&net.UnixAddr{Name: port.Socket, Net: "unix"})
+		if err != nil {
+			return err
+		}
+		port.listener = listener
+		go console.acceptPort(port, listener)
+
+	case port.Pty:
+		if port.Fd == 0 {
+			fd, path, err := openPty()
+			if err != nil {
+				return err
+			}
+			port.Fd = fd
+			port.PtyPath = path
+		}
+		err := syscall.SetNonblock(port.Fd, true)
+		if err != nil {
+			return err
+		}
+		port.file = os.NewFile(uintptr(port.Fd), port.PtyPath)
+		port.output = port.file
+		go console.readPort(port, port.file)
+		if port.Console {
+			go console.pollSize(port)
+		}
+
+	case port.File != "":
+		file, err := os.OpenFile(
+			port.File,
+			os.O_WRONLY|os.O_CREATE|os.O_APPEND|syscall.O_CLOEXEC,
+			0644)
+		if err != nil {
+			return err
+		}
+		port.file = file
+		port.output = file
+	}
+
+	return nil
+}
+
+//
+// Is the host side there?
+//
+func (port *VirtioConsolePort) connected() bool {
+	port.lock.Lock()
+	defer port.lock.Unlock()
+	return port.output != nil
+}
+
+//
+// Shut down the host side.
+//
+func (port *VirtioConsolePort) close() {
+	port.lock.Lock()
+	defer port.lock.Unlock()
+
+	port.removed = true
+	port.output = nil
+	if port.listener != nil {
+		port.listener.Close()
+		os.Remove(port.Socket)
+	}
+	if port.conn != nil {
+		port.conn.Close()
+	}
+	if port.file != nil {
+		port.file.Close()
+	}
+}
+
+//
+// Accept host connections (one at a time).
+//
+func (console *VirtioConsoleDevice) acceptPort(
+	port *VirtioConsolePort,
+	listener *net.UnixListener) {
+
+	for {
+		conn, err := listener.AcceptUnix()
+		if err != nil {
+			return
+		}
+
+		port.lock.Lock()
+		if port.removed || port.conn != nil {
+			port.lock.Unlock()
+			conn.Close()
+			continue
+		}
+		port.conn = conn
+		port.output = conn
+		port.Connected = true
+		port.lock.Unlock()
+
+		console.Debug("port %s connected", port.Name)
+		console.sendCtrl(port.Id, VirtioConsolePortOpen, 1, nil)
+
+		go func() {
+			console.readPort(port, conn)
+
+			port.lock.Lock()
+			removed := port.removed
+			port.conn = nil
+			port.output = nil
+			port.Connected = false
+			port.lock.Unlock()
+			conn.Close()
+
+			if !removed {
+				console.Debug("port %s disconnected", port.Name)
+				console.sendCtrl(port.Id, VirtioConsolePortOpen, 0, nil)
+			}
+		}()
+	}
+}
+
+//
+// Host -> guest.
+//
+func (console *VirtioConsoleDevice) readPort(port *VirtioConsolePort, input io.Reader) {
+	vchannel := console.Channels[uint(2*port.Id+2)]
+	data := make([]byte, 4096)
+
+	for {
+		n, err := input.Read(data)
+		if err != nil {
+			if port.Pty && err != io.EOF && !port.isRemoved() {
+				// Nobody has the pty open.
+				time.Sleep(VirtioConsoleResizeInterval)
+				continue
+			}
+			return
+		}
+
+		for offset := 0; offset < n; {
+			buf := <-vchannel.incoming
+			copied := buf.CopyIn(0, data[offset:n])
+			buf.SetLength(copied)
+			vchannel.outgoing <- buf
+			offset += copied
+			if copied == 0 {
+				break
+			}
+		}
+	}
+}
+
+func (port *VirtioConsolePort) isRemoved() bool {
+	port.lock.Lock()
+	defer port.lock.Unlock()
+	return port.removed
+}
+
+//
+// Guest -> host, for the given port number.
+// (This keeps running as ports come and go).
+//
+func (console *VirtioConsoleDevice) writePort(id int) {
+	vchannel := console.Channels[uint(2*id+3)]
+	data := make([]byte, 4096)
+
+	for buf := range vchannel.incoming {
+		var output io.Writer
+		if port := console.port(id); port != nil {
+			port.lock.Lock()
+			output = port.output
+			port.lock.Unlock()
+		}
+
+		for offset := 0; offset < buf.Length() && output != nil; {
+			n := buf.CopyOut(offset, data)
+			if n == 0 {
+				break
+			}
+			_, err := output.Write(data[:n])
+			if err != nil {
+				break
+			}
+			offset += n
+		}
+
+		buf.SetLength(0)
+		vchannel.outgoing <- buf
+	}
+}
+
+//
+// Follow the size of the pty (as set by whoever
+// has the other side open).
+//
+func (console *VirtioConsoleDevice) pollSize(port *VirtioConsolePort) {
+	for !port.isRemoved() {
+		size, err := unix.IoctlGetWinsize(port.Fd, unix.TIOCGWINSZ)
+		if err == nil && size.Col != 0 && size.Row != 0 {
+			port.lock.Lock()
+			changed := size.Col != port.Cols || size.Row != port.Rows
+			port.lock.Unlock()
+			if changed {
+				console.resize(port, size.Col, size.Row)
+			}
+		}
+		time.Sleep(VirtioConsoleResizeInterval)
+	}
+}
+
+func (console *VirtioConsoleDevice) resize(
+	port *VirtioConsolePort,
+	cols uint16,
+	rows uint16) {
+
+	port.lock.Lock()
+	port.Cols = cols
+	port.Rows = rows
+	port.lock.Unlock()
+
+	console.Debug("port %s resized to %dx%d", port.Name, cols, rows)
+	console.sendResize(port)
+}
+
+func (console *VirtioConsoleDevice) sendResize(port *VirtioConsolePort) {
+	port.lock.Lock()
+	size := []byte{
+		byte(port.Cols), byte(port.Cols >> 8),
+		byte(port.Rows), byte(port.Rows >> 8),
+	}
+	send := port.Cols != 0 && port.Rows != 0
+	port.lock.Unlock()
+
+	if send {
+		console.sendCtrl(port.Id, VirtioConsolePortResize, 0, size)
+	}
+}
+
+//
+// Find a port by number.
+//
+func (console *VirtioConsoleDevice) port(id int) *VirtioConsolePort {
+	console.ports_lock.Lock()
+	defer console.ports_lock.Unlock()
+	for _, port := range console.Ports {
+		if port.Id == id {
+			return port
+		}
+	}
+	return nil
+}
+
+//
+// Tell the guest about a port, once it's ready.
+//
+func (console *VirtioConsoleDevice) portReady(port *VirtioConsolePort) {
+	if port.Console {
+		console.sendCtrl(port.Id, VirtioConsolePortConsole, 1, nil)
+		console.sendResize(port)
+	}
+	console.sendCtrl(port.Id, VirtioConsolePortName, 0, []byte(port.Name))
+	if port.connected() {
+		console.sendCtrl(port.Id, VirtioConsolePortOpen, 1, nil)
+	}
+}
+
+//
+// Add a port.
+//
+// The port number is picked for you, and the
+// port is returned as it was added (including
+// the path to the pty, if there is one).
+//
+func (console *VirtioConsoleDevice) AddPort(config VirtioConsolePortInfo) (VirtioConsolePortInfo, error) {
+	err := config.validate()
+	if err != nil {
+		return VirtioConsolePortInfo{}, err
+	}
+
+	console.ports_lock.Lock()
+	used := make(map[int]bool)
+	for _, existing := range console.Ports {
+		if existing.Name == config.Name {
+			console.ports_lock.Unlock()
+			return VirtioConsolePortInfo{}, VirtioConsolePortExistsErr
+		}
+		used[existing.Id] = true
+	}
+	id := 1
+	for used[id] {
+		id += 1
+	}
+	if id >= console.MaxPorts {
+		console.ports_lock.Unlock()
+		return VirtioConsolePortInfo{}, VirtioConsoleTooManyPortsErr
+	}
+
+	port := &VirtioConsolePort{
+		VirtioConsolePortInfo: VirtioConsolePortInfo{
+			Id:      id,
+			Name:    config.Name,
+			Console: config.Console,
+			Socket:  config.Socket,
+			Pty:     config.Pty,
+			File:    config.File,
+			Cols:    config.Cols,
+			Rows:    config.Rows,
+		},
+	}
+	err = console.openPort(port)
+	if err != nil {
+		console.ports_lock.Unlock()
+		return VirtioConsolePortInfo{}, err
+	}
+	console.Ports = append(console.Ports, port)
+	ready := console.Ready
+	console.ports_lock.Unlock()
+
+	if ready {
+		console.sendCtrl(port.Id, VirtioConsolePortAdd, 1, nil)
+	}
+
+	return port.info(), nil
+}
+
+//
+// Remove a port (by name).
+//
+func (console *VirtioConsoleDevice) RemovePort(name string) error {
+	console.ports_lock.Lock()
+	var port *VirtioConsolePort
+	for i, existing := range console.Ports {
+		if existing.Name == name {
+			port = existing
+			console.Ports = append(console.Ports[:i], console.Ports[i+1:]...)
+			break
+		}
+	}
+	ready := console.Ready
+	console.ports_lock.Unlock()
+
+	if port == nil {
+		return VirtioConsoleNoPortErr
+	}
+
+	port.close()
+	if ready {
+		console.sendCtrl(port.Id, VirtioConsolePortRemove, 0, nil)
+	}
+	return nil
+}
+
+//
+// Set the size of a console port.
+//
+func (console *VirtioConsoleDevice) ResizePort(name string, cols uint16, rows uint16) error {
+	for _, port := range console.PortList() {
+		if port.Name == name {
+			if !port.Console {
+				return VirtioConsoleNotConsoleErr
+			}
+			if current := console.port(port.Id); current != nil {
+				console.resize(current, cols, rows)
+			}
+			return nil
+		}
+	}
+	return VirtioConsoleNoPortErr
+}
+
+func (port *VirtioConsolePort) info() VirtioConsolePortInfo {
+	port.lock.Lock()
+	defer port.lock.Unlock()
+	return port.VirtioConsolePortInfo
+}
+
+//
+// All our ports.
+//
+func (console *VirtioConsoleDevice) PortList() []VirtioConsolePortInfo {
+	console.ports_lock.Lock()
+	defer console.ports_lock.Unlock()
+	ports := make([]VirtioConsolePortInfo, 0, len(console.Ports))
+	for _, port := range console.Ports {
+		ports = append(ports, port.info())
+	}
+	return ports
+}
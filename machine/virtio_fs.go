@@ -2,6 +2,7 @@ package machine
 
 import (
 	"log"
+	"os"
 
 	plan9 "github.com/multiverse-os/portalgun/vm/fs/plan9"
 	kvm "github.com/multiverse-os/portalgun/vm/kvm"
@@ -125,3 +126,25 @@ func (fs *VirtioFsDevice) Attach(vm *kvm.VirtualMachine, model *Model) error {
 
 	return nil
 }
+
+//
+// Write out the changes in our write layer as a tar
+// archive at the given path. (This doesn't pause the
+// guest, so anything being written may be torn).
+//
+func (fs *VirtioFsDevice) ExportChanges(path string) error {
+	output, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	err = fs.Fs.Export(output)
+	close_err := output.Close()
+	if err == nil {
+		err = close_err
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
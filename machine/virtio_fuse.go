@@ -0,0 +1,159 @@
+package machine
+
+import (
+	fuse "github.com/multiverse-os/portalgun/vm/fs/fuse"
+	plan9 "github.com/multiverse-os/portalgun/vm/fs/plan9"
+	kvm "github.com/multiverse-os/portalgun/vm/kvm"
+)
+
+//
+// Config space.
+//
+const (
+	VirtioFuseTagLen          = 36
+	VirtioFuseNumQueuesOffset = 36
+	VirtioFuseConfigLen       = 40
+)
+
+//
+// The queues.
+// (We use a single request queue).
+//
+const (
+	VirtioFuseHiprioQueue      = 0
+	VirtioFuseRequestQueue     = 1
+	VirtioFuseHiprioQueueSize  = 64
+	VirtioFuseRequestQueueSize = 512
+	VirtioFuseNumRequestQueues = 1
+)
+
+//
+// VirtioFuseDevice --
+//
+// A virtio-fs device. This serves the same overlay as the
+// 9P device (the read & write layers are configured the
+// same way), but speaks FUSE, which is far cheaper for
+// metadata-heavy workloads.
+//
+type VirtioFuseDevice struct {
+	*VirtioDevice
+
+	// Our filesystem tag.
+	Tag string `json:"tag"`
+
+	// Debug fs operations?
+	Debugfs bool `json:"debugfs"`
+
+	// How long the guest may cache things.
+	Cache fuse.CacheMode `json:"cache"`
+
+	// The underlying overlay.
+	plan9.Fs
+
+	// Our FUSE server (and its nodes).
+	Fuse fuse.Server `json:"fuse"`
+}
+
+func (fs *VirtioFuseDevice) process(vchannel *VirtioChannel, buf *VirtioBuffer) {
+	buf.SetLength(fs.Fuse.Handle(buf))
+	vchannel.outgoing <- buf
+}
+
+//
+// The high priority queue carries only FORGET and INTERRUPT,
+// which are cheap and have no replies. These are handled
+// inline, since they must not wait behind other requests.
+//
+func (fs *VirtioFuseDevice) processHiprio(vchannel *VirtioChannel) error {
+
+	for buf := range vchannel.incoming {
+		fs.process(vchannel, buf)
+	}
+
+	return nil
+}
+
+func (fs *VirtioFuseDevice) processRequests(vchannel *VirtioChannel) error {
+
+	for buf := range vchannel.incoming {
+		go fs.process(vchannel, buf)
+	}
+
+	return nil
+}
+
+func setupFuse(device *VirtioDevice) (Device, error) {
+
+	// Create our channels.
+	device.Channels[VirtioFuseHiprioQueue] = NewVirtioChannel(
+		VirtioFuseHiprioQueue, VirtioFuseHiprioQueueSize)
+	device.Channels[VirtioFuseRequestQueue] = NewVirtioChannel(
+		VirtioFuseRequestQueue, VirtioFuseRequestQueueSize)
+
+	// Initialize our FS.
+	fs := new(VirtioFuseDevice)
+	fs.VirtioDevice = device
+	fs.Tag = "default"
+	fs.Cache = fuse.CacheAuto
+
+	return fs, fs.Init()
+}
+
+func NewVirtioMmioFuse(info *DeviceInfo) (Device, error) {
+	device, err := NewMmioVirtioDevice(info, VirtioTypeFs)
+	if err != nil {
+		return nil, err
+	}
+
+	return setupFuse(device)
+}
+
+func NewVirtioPciFuse(info *DeviceInfo) (Device, error) {
+	device, err := NewPciVirtioDevice(info, PciClassMisc, VirtioTypeFs, 16)
+	if err != nil {
+		return nil, err
+	}
+
+	return setupFuse(device)
+}
+
+func (fs *VirtioFuseDevice) Attach(vm *kvm.VirtualMachine, model *Model) error {
+
+	// Make sure the config reflects our tag.
+	// (This is not NUL-terminated if it's the full length).
+	tag_bytes := []byte(fs.Tag)
+	if len(tag_bytes) == 0 || len(tag_bytes) > VirtioFuseTagLen {
+		return VirtioFuseInvalidTagErr
+	}
+	fs.Config.GrowTo(VirtioFuseConfigLen)
+	for i := 0; i < VirtioFuseTagLen; i += 1 {
+		if i < len(tag_bytes) {
+			fs.Config.Set8(i, uint8(tag_bytes[i]))
+		} else {
+			fs.Config.Set8(i, 0)
+		}
+	}
+	fs.Config.Set32(VirtioFuseNumQueuesOffset, VirtioFuseNumRequestQueues)
+
+	err := fs.VirtioDevice.Attach(vm, model)
+	if err != nil {
+		return err
+	}
+
+	// Ensure the file system is sane.
+	err = fs.Fs.Attach()
+	if err != nil {
+		return err
+	}
+	fs.Fuse.Debug = fs.Debugfs
+	err = fs.Fuse.Attach(&fs.Fs, fs.Cache)
+	if err != nil {
+		return err
+	}
+
+	// Start our backend processes.
+	go fs.processHiprio(fs.Channels[VirtioFuseHiprioQueue])
+	go fs.processRequests(fs.Channels[VirtioFuseRequestQueue])
+
+	return nil
+}
@@ -0,0 +1,306 @@
+package machine
+
+import (
+	kvm "github.com/multiverse-os/portalgun/vm/kvm"
+)
+
+//
+// Virtio over MMIO (version 2) --
+//
+// There's no way for the guest to discover these devices,
+// so the kernel is told where they are on the command line
+// (see VirtioMmio() below). Otherwise, they work just like
+// the modern PCI devices: the same queue setup, features
+// and status, with a simpler register layout.
+//
+
+//
+// Register offsets.
+//
+const (
+	VirtioMmioMagicValue        = 0x000
+	VirtioMmioVersion           = 0x004
+	VirtioMmioDeviceId          = 0x008
+	VirtioMmioVendorId          = 0x00c
+	VirtioMmioDeviceFeatures    = 0x010
+	VirtioMmioDeviceFeaturesSel = 0x014
+	VirtioMmioDriverFeatures    = 0x020
+	VirtioMmioDriverFeaturesSel = 0x024
+	VirtioMmioQueueSel          = 0x030
+	VirtioMmioQueueNumMax       = 0x034
+	VirtioMmioQueueNum          = 0x038
+	VirtioMmioQueueReady        = 0x044
+	VirtioMmioQueueNotify       = 0x050
+	VirtioMmioInterruptStatus   = 0x060
+	VirtioMmioInterruptAck      = 0x064
+	VirtioMmioStatus            = 0x070
+	VirtioMmioQueueDescLow      = 0x080
+	VirtioMmioQueueDescHigh     = 0x084
+	VirtioMmioQueueDriverLow    = 0x090
+	VirtioMmioQueueDriverHigh   = 0x094
+	VirtioMmioQueueDeviceLow    = 0x0a0
+	VirtioMmioQueueDeviceHigh   = 0x0a4
+	VirtioMmioConfigGeneration  = 0x0fc
+	VirtioMmioConfigOffset      = 0x100
+)
+
+const (
+	// 'virt'
+	VirtioMmioMagic = 0x74726976
+
+	// The only version we speak.
+	VirtioMmioVersion2 = 2
+
+	// The size of our registers & config.
+	VirtioMmioSize = 0x200
+)
+
+//
+// Where we put devices without an address.
+// Each gets its own page from here.
+//
+const (
+	VirtioMmioBase = 0xd0000000
+	VirtioMmioSlot = 0x1000
+)
+
+type VirtioMmioConf struct {
+	*VirtioDevice
+
+	class int
+}
+
+func (reg *VirtioMmioConf) queue() (*VirtioChannel, bool) {
+	queue, ok := reg.VirtioDevice.Channels[uint(reg.QueueSelect.Value)]
+	return queue, ok
+}
+
+func (reg *VirtioMmioConf) Read(offset uint64, size uint) (uint64, error) {
+
+	switch offset {
+	case VirtioMmioMagicValue:
+		return VirtioMmioMagic, nil
+
+	case VirtioMmioVersion:
+		return VirtioMmioVersion2, nil
+
+	case VirtioMmioDeviceId:
+		return uint64(reg.class), nil
+
+	case VirtioMmioVendorId:
+		return VirtioPciVendor, nil
+
+	case VirtioMmioDeviceFeatures:
+		if reg.DeviceFeatureSelect.Value > 1 {
+			return 0, nil
+		}
+		return reg.HostFeatures.Read(4*reg.DeviceFeatureSelect.Value, size)
+
+	case VirtioMmioInterruptStatus:
+		// This is cleared by an explicit ack.
+		return reg.IsrStatus.Value, nil
+
+	case VirtioMmioStatus:
+		return reg.DeviceStatus.Read(0, size)
+
+	case VirtioMmioConfigGeneration:
+		// Our config changes are all single fields.
+		return 0, nil
+	}
+
+	// The rest are per-queue.
+	queue, ok := reg.queue()
+	if !ok {
+		// We return zero if the queue doesn't exist.
+		return 0, nil
+	}
+
+	switch offset {
+	case VirtioMmioQueueNumMax:
+		return queue.QueueMax, nil
+	case VirtioMmioQueueNum:
+		return queue.QueueSize.Read(0, size)
+	case VirtioMmioQueueReady:
+		return queue.QueueEnable.Read(0, size)
+	case VirtioMmioQueueDescLow, VirtioMmioQueueDescHigh:
+		return queue.QueueDesc.Read(offset-VirtioMmioQueueDescLow, size)
+	case VirtioMmioQueueDriverLow, VirtioMmioQueueDriverHigh:
+		return queue.QueueDriver.Read(offset-VirtioMmioQueueDriverLow, size)
+	case VirtioMmioQueueDeviceLow, VirtioMmioQueueDeviceHigh:
+		return queue.QueueDevice.Read(offset-VirtioMmioQueueDeviceLow, size)
+	}
+
+	return 0, nil
+}
+
+func (reg *VirtioMmioConf) Write(offset uint64, size uint, value uint64) error {
+
+	switch offset {
+	case VirtioMmioDeviceFeaturesSel:
+		return reg.DeviceFeatureSelect.Write(0, size, value)
+
+	case VirtioMmioDriverFeaturesSel:
+		return reg.DriverFeatureSelect.Write(0, size, value)
+
+	case VirtioMmioDriverFeatures:
+		if reg.DriverFeatureSelect.Value > 1 {
+			return nil
+		}
+		return reg.GuestFeatures.Write(4*reg.DriverFeatureSelect.Value, size, value)
+
+	case VirtioMmioQueueSel:
+		return reg.QueueSelect.Write(0, size, value)
+
+	case VirtioMmioQueueNotify:
+		// Notify the queue if necessary.
+		reg.VirtioDevice.notify(uint(value))
+		err := reg.QueueNotify.Write(0, size, value)
+		if err != nil {
+			return err
+		}
+
+		// This is a saveable register.
+		return SaveIO
+
+	case VirtioMmioInterruptAck:
+		reg.IsrStatus.Value = reg.IsrStatus.Value &^ value
+		return nil
+
+	case VirtioMmioStatus:
+		return reg.VirtioDevice.setStatus(size, value)
+	}
+
+	// The rest are per-queue.
+	queue, ok := reg.queue()
+	if !ok {
+		return nil
+	}
+
+	switch offset {
+	case VirtioMmioQueueNum:
+		return queue.setSize(size, value)
+
+	case VirtioMmioQueueReady:
+		// Unlike PCI, the driver may take a queue
+		// down again (when it's done with it).
+		if value == 0 {
+			if queue.QueueEnable.Value == 0 {
+				return nil
+			}
+			return queue.reset()
+		}
+		return queue.enable()
+
+	case VirtioMmioQueueDescLow, VirtioMmioQueueDescHigh:
+		return queue.setAddress(&queue.QueueDesc, offset-VirtioMmioQueueDescLow, size, value)
+	case VirtioMmioQueueDriverLow, VirtioMmioQueueDriverHigh:
+		return queue.setAddress(&queue.QueueDriver, offset-VirtioMmioQueueDriverLow, size, value)
+	case VirtioMmioQueueDeviceLow, VirtioMmioQueueDeviceHigh:
+		return queue.setAddress(&queue.QueueDevice, offset-VirtioMmioQueueDeviceLow, size, value)
+	}
+
+	return nil
+}
+
+//
+// The device config, after the registers.
+//
+type VirtioMmioConfig struct {
+	*VirtioDevice
+}
+
+func (reg *VirtioMmioConfig) Read(offset uint64, size uint) (uint64, error) {
+	reg.Debug("virtio read @ %x (mmio)", offset)
+	return reg.VirtioDevice.Config.Read(offset, size)
+}
+
+func (reg *VirtioMmioConfig) Write(offset uint64, size uint, value uint64) error {
+	reg.Debug("virtio write @ %x (mmio)", offset)
+	return reg.VirtioDevice.Config.Write(offset, size, value)
+}
+
+type VirtioMmioDevice struct {
+	MmioDevice
+
+	// For sending interrupts.
+	vm *kvm.VirtualMachine
+}
+
+func NewMmioVirtioDevice(
+	info *DeviceInfo,
+	class int) (*VirtioDevice, error) {
+
+	// Create our Mmio device.
+	device := &VirtioMmioDevice{}
+
+	// Create our new device.
+	virtio := NewVirtioDevice(device)
+
+	// Set our I/O regions.
+	device.MmioDevice.IoMap = IoMap{
+		// The registers.
+		MemoryRegion{0, VirtioMmioConfigOffset}: &VirtioMmioConf{virtio, class},
+
+		// The device's own config.
+		MemoryRegion{VirtioMmioConfigOffset, VirtioMmioSize - VirtioMmioConfigOffset}: &VirtioMmioConfig{virtio},
+	}
+
+	// Version 2 is a modern interface.
+	virtio.SetFeatures(VirtioFVersion1 | VirtioFRingPacked)
+
+	return virtio, device.init(info)
+}
+
+//
+// Devices that the kernel needs to be told about.
+//
+type virtioMmio interface {
+	VirtioMmio() (kvm.Pointer, uint64, kvm.Irq, bool)
+}
+
+func virtioMmioUsed(model *Model, addr kvm.Pointer) bool {
+	for _, device := range model.Devices() {
+		mmio, ok := device.(virtioMmio)
+		if !ok {
+			continue
+		}
+		other, _, _, ok := mmio.VirtioMmio()
+		if ok && other == addr {
+			return true
+		}
+	}
+	return false
+}
+
+func (device *VirtioMmioDevice) Attach(vm *kvm.VirtualMachine, model *Model) error {
+
+	// Find a free slot, if we weren't given an address.
+	if device.Offset == 0 {
+		device.Offset = VirtioMmioBase
+		for virtioMmioUsed(model, device.Offset) {
+			device.Offset += VirtioMmioSlot
+		}
+	}
+
+	device.vm = vm
+	return device.MmioDevice.Attach(vm, model)
+}
+
+func (device *VirtioMmioDevice) Interrupt() error {
+	device.vm.Interrupt(device.InterruptNumber, true)
+	device.vm.Interrupt(device.InterruptNumber, false)
+	return nil
+}
+
+//
+// Where the kernel should look for this device:
+// its address, the size of its registers and its
+// interrupt. The last is false if it's not MMIO.
+//
+func (virtio *VirtioDevice) VirtioMmio() (kvm.Pointer, uint64, kvm.Irq, bool) {
+	device, ok := virtio.Device.(*VirtioMmioDevice)
+	if !ok {
+		return 0, 0, 0, false
+	}
+	return device.Offset, VirtioMmioSize, device.InterruptNumber, true
+}
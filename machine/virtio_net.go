@@ -2,22 +2,35 @@ package machine
 
 import (
 	"crypto/rand"
+	"encoding/binary"
+	"io"
 	"net"
+	"sync"
+	"syscall"
 
 	kvm "github.com/multiverse-os/portalgun/vm/kvm"
+	pcap "github.com/multiverse-os/portalgun/vm/net/pcap"
+	unix "golang.org/x/sys/unix"
 )
 
 //
 // Virtio Net Features
 //
 const (
-	VirtioNetFCsum     uint32 = 1 << 0
-	VirtioNetFMac             = 1 << 5
-	VirtioNetFHostTso4        = 1 << 11
-	VirtioNetFHostTso6        = 1 << 12
-	VirtioNetFHostEcn         = 1 << 13
-	VirtioNetFHostUfo         = 1 << 14
-	VirtioNetFStatus          = 1 << 16
+	VirtioNetFCsum          = 1 << 0
+	VirtioNetFMac           = 1 << 5
+	VirtioNetFHostTso4      = 1 << 11
+	VirtioNetFHostTso6      = 1 << 12
+	VirtioNetFHostEcn       = 1 << 13
+	VirtioNetFHostUfo       = 1 << 14
+	VirtioNetFMrgRxbuf      = 1 << 15
+	VirtioNetFStatus        = 1 << 16
+	VirtioNetFCtrlVq        = 1 << 17
+	VirtioNetFCtrlRx        = 1 << 18
+	VirtioNetFCtrlVlan      = 1 << 19
+	VirtioNetFGuestAnnounce = 1 << 21
+	VirtioNetFMq            = 1 << 22
+	VirtioNetFCtrlMacAddr   = 1 << 23
 )
 
 //
@@ -37,13 +50,24 @@ const (
 	VirtioNetStatusOffset = (VirtioNetMacOffset + VirtioNetMacLen)
 	VirtioNetStatusLen    = 2
 	VirtioNetConfigLen    = (VirtioNetMacLen + VirtioNetStatusLen)
+	VirtioNetPairsOffset  = (VirtioNetStatusOffset + VirtioNetStatusLen)
+	VirtioNetPairsLen     = 2
 )
 
 //
 // VirtioNet VLAN support
 //
 const (
-	VirtioNetHeaderSize = 10
+	VirtioNetHeaderSize    = 10
+	VirtioNetMrgHeaderSize = 12
+)
+
+//
+// Queue limits.
+//
+const (
+	VirtioNetMaxQueues = 8
+	VirtioNetMaxPacket = 65536
 )
 
 type VirtioNetDevice struct {
@@ -60,53 +84,330 @@ type VirtioNetDevice struct {
 
 	// Hardware offloads supported by tap device?
 	Offload bool `json:"offload"`
+
+	// The tap device name.
+	// If set, we open the tap ourselves (one fd
+	// per queue pair) rather than using Fd.
+	Tap string `json:"tap,omitempty"`
+
+	// Number of queue pairs offered.
+	Queues int `json:"queues,omitempty"`
+
+	// Our tap queue fds (when opened by us).
+	Fds []int `json:"fds,omitempty"`
+
+	// Queue pairs in use by the guest.
+	Pairs int `json:"pairs,omitempty"`
+
+	// Receive filtering (via the control queue).
+	Filter VirtioNetFilter `json:"filter"`
+
+	// Administratively down?
+	LinkDown bool `json:"link-down,omitempty"`
+
+	// Follow the tap's carrier?
+	Carrier bool `json:"carrier,omitempty"`
+
+	// User-mode networking.
+	// If set, we don't need a tap at all.
+	User *VirtioNetUser `json:"user,omitempty"`
+
+	// A port on a portal-switch.
+	// (Also in place of a tap).
+	Switch *VirtioNetSwitch `json:"switch,omitempty"`
+
+	// Egress filtering & rate limits.
+	Firewall *VirtioNetFirewall `json:"firewall,omitempty"`
+
+	// Hand the data queues to the kernel (vhost-net)?
+	// We fall back to doing it ourselves if we can't.
+	Vhost bool `json:"vhost,omitempty"`
+
+	// The current mac.
+	mac net.HardwareAddr
+
+	filter_lock sync.RWMutex
+
+	// The tap's carrier (if followed).
+	carrier bool
+
+	// Waiting on the guest to announce?
+	announce bool
+
+	link_lock sync.Mutex
+
+	// Our packet capture (if running).
+	capture      *VirtioNetCapture
+	capture_lock sync.RWMutex
+
+	firewall_lock sync.RWMutex
+
+	// Our vhost (if running).
+	vhost *VhostNet
 }
 
-func (device *VirtioNetDevice) processPackets(
-	vchannel *VirtioChannel,
-	recv bool) error {
+func (nic *VirtioNetDevice) processPackets(vchannel *VirtioChannel) error {
+
+	// Our scratch space for mergeable receives.
+	var scratch []byte
 
 	for buf := range vchannel.incoming {
 
-		header := buf.Map(0, VirtioNetHeaderSize)
+		var err error
+		pair := int(vchannel.Channel / 2)
+
+		switch {
+		case vchannel.Channel == nic.controlQueue():
+			nic.processControl(buf)
+
+		case vchannel.Channel%2 == 0:
+			if nic.HasFeatures(VirtioNetFMrgRxbuf) {
+				if scratch == nil {
+					scratch = make([]byte, VirtioNetMaxPacket+nic.Vnet)
+				}
+				err = nic.receiveMerged(vchannel, buf, nic.fd(pair), scratch)
+			} else {
+				err = nic.receive(buf, nic.fd(pair))
+			}
+
+		default:
+			err = nic.transmit(buf, nic.fd(pair))
+		}
 
-		// Legit?
-		if len(header) < VirtioNetHeaderSize {
+		if err == io.EOF {
+			// Our backend has gone away (e.g. the switch
+			// closed our port), so nothing more will come.
+			nic.Debug("vqueue#%d closed", vchannel.Channel)
+			buf.SetLength(0)
 			vchannel.outgoing <- buf
+			return nil
+		}
+		if err != nil {
+			// The packet is dropped, but the buffer
+			// must still go back (or the ring stalls).
+			nic.Debug("vqueue#%d err -> %s", vchannel.Channel, err.Error())
+			if vchannel.Channel%2 == 0 {
+				buf.SetLength(0)
+			}
+		}
+
+		// Done.
+		vchannel.outgoing <- buf
+	}
+
+	return nil
+}
+
+func (nic *VirtioNetDevice) fd(pair int) int {
+	if pair < len(nic.Fds) {
+		return nic.Fds[pair]
+	}
+	return nic.Fd
+}
+
+//
+// Modern drivers always have room for num_buffers.
+// (Though without mergeable buffers, it's always 1).
+//
+func (nic *VirtioNetDevice) headerSize() int {
+	if nic.HasFeatures(VirtioNetFMrgRxbuf) || nic.HasFeatures(VirtioFVersion1) {
+		return VirtioNetMrgHeaderSize
+	}
+	return VirtioNetHeaderSize
+}
+
+//
+// Receive a packet directly into the guest buffer.
+//
+func (nic *VirtioNetDevice) receive(buf *VirtioBuffer, fd int) error {
+
+	// Should we pass the virtio net header to the tap device as the vnet
+	// header or strip it off? (The tap's header lands just before the
+	// packet, which is after num_buffers if we have it).
+	header := nic.headerSize()
+	pktStart := header - nic.Vnet
+
+	frame := make([]byte, 16)
+	for {
+		n, err := buf.Read(fd, pktStart, buf.Length()-pktStart)
+		if err == syscall.EINTR || err == syscall.EAGAIN {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if n == 0 {
+			return io.EOF
+		}
+		if n < nic.Vnet+14 {
+			// Not even an ethernet header.
 			continue
 		}
 
-		// Should we pass the virtio net header to the tap device as the vnet
-		// header or strip it off?
-		pktStart := VirtioNetHeaderSize - device.Vnet
-		pktEnd := buf.Length() - pktStart
+		// Filtered?
+		total := pktStart + n - header
+		length := buf.CopyOut(header, frame)
+		if length > total {
+			length = total
+		}
+		if nic.accept(frame[:length]) {
+			nic.receiveHeader(buf, header)
+			buf.SetLength(pktStart + n)
+			if firewall := nic.firewall(); firewall != nil {
+				firewall.throttle(false, total)
+			}
+			if capture := nic.capturing(); capture != nil {
+				data := make([]byte, capture.snap(total))
+				buf.CopyOut(header, data)
+				capture.packet(data, total, pcap.DirectionInbound)
+			}
+			return nil
+		}
+	}
+}
 
-		// Doing send or recv?
-		if recv {
-			buf.Read(device.Fd, pktStart, pktEnd)
-		} else {
-			buf.Write(device.Fd, pktStart, pktEnd)
+//
+// Fill in the header for a packet in a single buffer.
+//
+func (nic *VirtioNetDevice) receiveHeader(buf *VirtioBuffer, header int) {
+	fields := make([]byte, header)
+	if nic.Vnet != 0 {
+		// Move the tap's header into place.
+		buf.CopyOut(header-nic.Vnet, fields[:nic.Vnet])
+	}
+	if header == VirtioNetMrgHeaderSize {
+		binary.LittleEndian.PutUint16(fields[VirtioNetHeaderSize:], 1)
+	}
+	buf.CopyIn(0, fields)
+}
+
+//
+// Receive a packet via scratch space, and spread it
+// across as many guest buffers as necessary.
+//
+func (nic *VirtioNetDevice) receiveMerged(
+	vchannel *VirtioChannel,
+	buf *VirtioBuffer,
+	fd int,
+	scratch []byte) error {
+
+	var n int
+	var err error
+	for {
+		n, err = syscall.Read(fd, scratch)
+		if err == syscall.EINTR || err == syscall.EAGAIN {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if n == 0 {
+			return io.EOF
 		}
+		if n >= nic.Vnet+14 && nic.accept(scratch[nic.Vnet:n]) {
+			break
+		}
+	}
 
-		// Done.
-		vchannel.outgoing <- buf
+	// Build our header.
+	header := make([]byte, VirtioNetMrgHeaderSize)
+	copy(header, scratch[:nic.Vnet])
+	packet := scratch[nic.Vnet:n]
+	if firewall := nic.firewall(); firewall != nil {
+		firewall.throttle(false, len(packet))
+	}
+	if capture := nic.capturing(); capture != nil {
+		capture.packet(packet, len(packet), pcap.DirectionInbound)
 	}
 
+	buf.CopyIn(0, header)
+	copied := buf.CopyIn(VirtioNetMrgHeaderSize, packet)
+	buf.SetLength(VirtioNetMrgHeaderSize + copied)
+	packet = packet[copied:]
+
+	count := 1
+	for len(packet) > 0 {
+		next, ok := <-vchannel.incoming
+		if !ok {
+			return nil
+		}
+		copied = next.CopyIn(0, packet)
+		next.SetLength(copied)
+		packet = packet[copied:]
+		buf.Chain(next)
+		count += 1
+	}
+
+	// Fill in num_buffers.
+	binary.LittleEndian.PutUint16(header[VirtioNetHeaderSize:], uint16(count))
+	buf.CopyIn(VirtioNetHeaderSize, header[VirtioNetHeaderSize:])
 	return nil
 }
 
+func (nic *VirtioNetDevice) transmit(buf *VirtioBuffer, fd int) error {
+
+	header := nic.headerSize()
+	if buf.Length() < header {
+		return nil
+	}
+
+	if firewall := nic.firewall(); firewall != nil {
+		frame := make([]byte, VirtioNetFirewallHeader)
+		frame = frame[:buf.CopyOut(header, frame)]
+		if !firewall.egress(frame, nic.currentMac()) {
+			// Dropped.
+			return nil
+		}
+		firewall.throttle(true, buf.Length()-header)
+	}
+
+	if capture := nic.capturing(); capture != nil {
+		total := buf.Length() - header
+		data := make([]byte, capture.snap(total))
+		buf.CopyOut(header, data)
+		capture.packet(data, total, pcap.DirectionOutbound)
+	}
+
+	var err error
+	switch nic.Vnet {
+	case 0:
+		// Strip the header.
+		_, err = buf.Write(fd, header, buf.Length()-header)
+	case header:
+		// Pass it all.
+		_, err = buf.Write(fd, 0, buf.Length())
+	default:
+		// Pass the header, without num_buffers.
+		segments := buf.Segments(0, nic.Vnet)
+		segments = append(segments, buf.Segments(header, buf.Length()-header)...)
+		_, err = unix.Writev(fd, segments)
+	}
+
+	if err == syscall.EINTR || err == syscall.EAGAIN {
+		// Dropped.
+		return nil
+	}
+	return err
+}
+
 func NewVirtioMmioNet(info *DeviceInfo) (Device, error) {
 	device, err := NewMmioVirtioDevice(info, VirtioTypeNet)
 	device.Channels[0] = NewVirtioChannel(0, 256)
 	device.Channels[1] = NewVirtioChannel(1, 256)
-	return &VirtioNetDevice{VirtioDevice: device}, err
+	return &VirtioNetDevice{
+		VirtioDevice: device,
+		// Until the guest says otherwise.
+		Filter: VirtioNetFilter{Promisc: true},
+	}, err
 }
 
 func NewVirtioPciNet(info *DeviceInfo) (Device, error) {
 	device, err := NewPciVirtioDevice(info, PciClassNetwork, VirtioTypeNet, 16)
 	device.Channels[0] = NewVirtioChannel(0, 256)
 	device.Channels[1] = NewVirtioChannel(1, 256)
-	return &VirtioNetDevice{VirtioDevice: device}, err
+	return &VirtioNetDevice{
+		VirtioDevice: device,
+		// Until the guest says otherwise.
+		Filter: VirtioNetFilter{Promisc: true},
+	}, err
 }
 
 func (nic *VirtioNetDevice) Attach(vm *kvm.VirtualMachine, model *Model) error {
@@ -120,6 +421,20 @@ func (nic *VirtioNetDevice) Attach(vm *kvm.VirtualMachine, model *Model) error {
 			VirtioNetFHostEcn | VirtioNetFHostUfo)
 	}
 
+	// Open our tap queues.
+	err := nic.openQueues()
+	if err != nil {
+		return err
+	}
+
+	// Restore our rules.
+	if nic.Firewall != nil {
+		err = nic.Firewall.compile()
+		if err != nil {
+			return err
+		}
+	}
+
 	// Set up our Config space.
 	nic.Config.GrowTo(VirtioNetConfigLen)
 
@@ -141,25 +456,154 @@ func (nic *VirtioNetDevice) Attach(vm *kvm.VirtualMachine, model *Model) error {
 		mac[2] = 0x46
 	}
 	nic.SetFeatures(VirtioNetFMac)
-	for i := 0; i < len(mac); i += 1 {
-		nic.Config.Set8(VirtioNetMacOffset+i, mac[i])
-	}
+	nic.setMac(mac)
 
-	// Add status bits. In the future we should
-	// be polling the underlying physical/tap device
-	// for link-up and announce status. For now,
-	// just emulate the status-less "always up" behavior.
+	// Add status bits. The link is up unless we've
+	// been told otherwise, or we're following the tap.
 	nic.SetFeatures(VirtioNetFStatus)
-	nic.Config.Set16(VirtioNetStatusOffset, VirtioNetLinkUp)
+	err = nic.initLink()
+	if err != nil {
+		return err
+	}
+
+	// Receive filtering, announcements & large packets.
+	nic.SetFeatures(VirtioNetFCtrlVq | VirtioNetFCtrlRx | VirtioNetFCtrlVlan |
+		VirtioNetFCtrlMacAddr | VirtioNetFGuestAnnounce | VirtioNetFMrgRxbuf)
 
-	err := nic.VirtioDevice.Attach(vm, model)
+	// Multiple queues?
+	if nic.Queues > 1 {
+		nic.SetFeatures(VirtioNetFMq)
+		nic.Config.GrowTo(VirtioNetPairsOffset + VirtioNetPairsLen)
+		nic.Config.Set16(VirtioNetPairsOffset, uint16(nic.Queues))
+	}
+
+	// Ensure we have all our channels.
+	// The control queue comes after all the pairs.
+	for i := 0; i < 2*nic.Queues+1; i += 1 {
+		if _, ok := nic.Channels[uint(i)]; !ok {
+			size := uint(256)
+			if i == 2*nic.Queues {
+				size = 64
+			}
+			nic.Channels[uint(i)] = NewVirtioChannel(uint(i), size)
+		}
+	}
+
+	// Try to hand off the data queues.
+	if nic.Vhost {
+		nic.openVhost(vm, model)
+	}
+
+	// Are we being restored under a running driver?
+	restored := nic.DeviceStatus.Value&VirtioStatusDriverOk != 0
+
+	err = nic.VirtioDevice.Attach(vm, model)
 	if err != nil {
 		return err
 	}
 
-	// Start our network process.
-	go nic.processPackets(nic.Channels[0], true)
-	go nic.processPackets(nic.Channels[1], false)
+	// Start our network processes.
+	for _, vchannel := range nic.Channels {
+		go nic.processPackets(vchannel)
+	}
+	if vhost := nic.vhost; vhost != nil {
+		go vhost.interrupts(nic.Channels[0])
+		go vhost.interrupts(nic.Channels[1])
+	}
+
+	// We may have moved; let the network know.
+	if restored && nic.HasFeatures(VirtioNetFGuestAnnounce) {
+		err = nic.Announce()
+		if err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
+
+func (nic *VirtioNetDevice) openQueues() error {
+	if nic.Queues <= 0 {
+		nic.Queues = 1
+	}
+	if nic.Queues > VirtioNetMaxQueues {
+		return VirtioNetTooManyQueuesErr
+	}
+	if nic.User != nil {
+		// A single queue, without any vnet header.
+		if nic.Queues > 1 {
+			return VirtioNetTooManyQueuesErr
+		}
+		if nic.Vnet != 0 {
+			return VirtioUnsupportedVnetHeaderErr
+		}
+		fd, err := nic.User.open(nic.Fd)
+		if err != nil {
+			return err
+		}
+		nic.Fd = fd
+		return nil
+	}
+	if nic.Switch != nil {
+		if nic.Queues > 1 {
+			return VirtioNetTooManyQueuesErr
+		}
+		if nic.Vnet != 0 {
+			return VirtioUnsupportedVnetHeaderErr
+		}
+		fd, err := nic.Switch.open()
+		if err != nil {
+			return err
+		}
+		nic.Fd = fd
+		return nil
+	}
+	if nic.Tap == "" {
+		// Just the one fd we were given.
+		if nic.Queues > 1 {
+			return VirtioNetNoTapErr
+		}
+		return nil
+	}
+
+	// Already open (after a re-exec)?
+	if len(nic.Fds) == nic.Queues {
+		return nil
+	}
+
+	for i := 0; i < nic.Queues; i += 1 {
+		fd, err := OpenTap(nic.Tap, nic.Vnet > 0, nic.Queues > 1)
+		if err != nil {
+			for _, fd := range nic.Fds {
+				syscall.Close(fd)
+			}
+			nic.Fds = nil
+			return err
+		}
+		nic.Fds = append(nic.Fds, fd)
+	}
+	nic.Fd = nic.Fds[0]
+
+	// All queues start attached, but the guest
+	// only uses the first pair until told otherwise.
+	nic.Pairs = nic.Queues
+	return nic.setPairs(1)
+}
+
+//
+// Set our mac address.
+// (Either at startup, or by the guest).
+//
+func (nic *VirtioNetDevice) setMac(mac net.HardwareAddr) {
+	nic.mac = mac
+	nic.Mac = mac.String()
+	for i := 0; i < len(mac); i += 1 {
+		nic.Config.Set8(VirtioNetMacOffset+i, mac[i])
+	}
+}
+
+func (nic *VirtioNetDevice) currentMac() net.HardwareAddr {
+	nic.filter_lock.RLock()
+	defer nic.filter_lock.RUnlock()
+	return nic.mac
+}
@@ -0,0 +1,241 @@
+package machine
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	pcap "github.com/multiverse-os/portalgun/vm/net/pcap"
+)
+
+//
+// How many frames we'll queue for the writer.
+//
+const VirtioNetCaptureQueue = 1024
+
+type VirtioNetCaptureStats struct {
+	// Frames written.
+	Packets uint64 `json:"packets"`
+
+	// Bytes written (before truncation).
+	Bytes uint64 `json:"bytes"`
+
+	// Frames that didn't match the filter.
+	Filtered uint64 `json:"filtered"`
+
+	// Frames dropped (the writer was behind).
+	Dropped uint64 `json:"dropped"`
+
+	// Why the capture failed (if it did).
+	Error string `json:"error,omitempty"`
+}
+
+type virtioNetFrame struct {
+	timestamp time.Time
+	data      []byte
+	length    int
+	direction int
+}
+
+//
+// VirtioNetCapture --
+//
+// A running capture. Frames are filtered and queued from
+// the packet path, and written out by a separate goroutine
+// so that a slow consumer doesn't stall the guest (we drop
+// frames instead). Captures do not survive a re-exec.
+//
+type VirtioNetCapture struct {
+	output  io.WriteCloser
+	writer  *pcap.Writer
+	filter  pcap.Filter
+	snaplen int
+
+	frames chan virtioNetFrame
+	done   chan struct{}
+
+	stats VirtioNetCaptureStats
+	lock  sync.Mutex
+}
+
+func (capture *VirtioNetCapture) run(frames chan virtioNetFrame) {
+	defer close(capture.done)
+
+	for frame := range frames {
+		err := capture.writer.WritePacket(
+			frame.timestamp,
+			frame.data,
+			frame.length,
+			frame.direction)
+
+		capture.lock.Lock()
+		if err != nil {
+			capture.stats.Error = err.Error()
+		} else {
+			capture.stats.Packets += 1
+			capture.stats.Bytes += uint64(frame.length)
+		}
+		capture.lock.Unlock()
+
+		if err != nil {
+			// Keep draining, but stop writing.
+			for range frames {
+			}
+			return
+		}
+	}
+}
+
+//
+// How much of a frame we want.
+//
+func (capture *VirtioNetCapture) snap(length int) int {
+	if capture.snaplen > 0 && length > capture.snaplen {
+		return capture.snaplen
+	}
+	return length
+}
+
+//
+// Capture a frame.
+// The data may already be truncated to snap(length).
+//
+func (capture *VirtioNetCapture) packet(data []byte, length int, direction int) {
+	capture.lock.Lock()
+	defer capture.lock.Unlock()
+
+	if capture.frames == nil {
+		// Stopped.
+		return
+	}
+	if !capture.filter(data) {
+		capture.stats.Filtered += 1
+		return
+	}
+
+	frame := virtioNetFrame{
+		timestamp: time.Now(),
+		data:      append([]byte(nil), data[:capture.snap(len(data))]...),
+		length:    length,
+		direction: direction,
+	}
+	select {
+	case capture.frames <- frame:
+	default:
+		capture.stats.Dropped += 1
+	}
+}
+
+func (capture *VirtioNetCapture) Stats() VirtioNetCaptureStats {
+	capture.lock.Lock()
+	defer capture.lock.Unlock()
+	return capture.stats
+}
+
+func (capture *VirtioNetCapture) stop() VirtioNetCaptureStats {
+	capture.lock.Lock()
+	frames := capture.frames
+	capture.frames = nil
+	capture.lock.Unlock()
+
+	close(frames)
+	<-capture.done
+	capture.output.Close()
+	return capture.Stats()
+}
+
+//
+// Start capturing to a file (if path is set), or
+// streaming to the given address (e.g. a unix socket
+// that something like wireshark is reading from).
+//
+func (nic *VirtioNetDevice) StartCapture(
+	path string,
+	network string,
+	address string,
+	snaplen int,
+	filter string) error {
+
+	compiled, err := pcap.Compile(filter)
+	if err != nil {
+		return err
+	}
+
+	if nic.vhost != nil {
+		// The packets never come past us.
+		return VirtioNetVhostErr
+	}
+
+	nic.capture_lock.Lock()
+	defer nic.capture_lock.Unlock()
+	if nic.capture != nil {
+		return VirtioNetCaptureRunningErr
+	}
+
+	var output io.WriteCloser
+	if path != "" {
+		output, err = os.OpenFile(
+			path,
+			os.O_WRONLY|os.O_CREATE|os.O_TRUNC|syscall.O_CLOEXEC,
+			0644)
+	} else {
+		if network == "" {
+			network = "unix"
+		}
+		output, err = net.Dial(network, address)
+	}
+	if err != nil {
+		return err
+	}
+
+	writer, err := pcap.NewWriter(output, snaplen)
+	if err != nil {
+		output.Close()
+		return err
+	}
+
+	frames := make(chan virtioNetFrame, VirtioNetCaptureQueue)
+	nic.capture = &VirtioNetCapture{
+		output:  output,
+		writer:  writer,
+		filter:  compiled,
+		snaplen: snaplen,
+		frames:  frames,
+		done:    make(chan struct{}),
+	}
+	go nic.capture.run(frames)
+
+	return nil
+}
+
+func (nic *VirtioNetDevice) StopCapture() (VirtioNetCaptureStats, error) {
+	nic.capture_lock.Lock()
+	capture := nic.capture
+	nic.capture = nil
+	nic.capture_lock.Unlock()
+
+	if capture == nil {
+		return VirtioNetCaptureStats{}, VirtioNetNoCaptureErr
+	}
+	return capture.stop(), nil
+}
+
+func (nic *VirtioNetDevice) CaptureStats() (VirtioNetCaptureStats, error) {
+	capture := nic.capturing()
+	if capture == nil {
+		return VirtioNetCaptureStats{}, VirtioNetNoCaptureErr
+	}
+	return capture.Stats(), nil
+}
+
+//
+// The running capture (or nil).
+//
+func (nic *VirtioNetDevice) capturing() *VirtioNetCapture {
+	nic.capture_lock.RLock()
+	defer nic.capture_lock.RUnlock()
+	return nic.capture
+}
@@ -0,0 +1,269 @@
+package machine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+)
+
+//
+// Control classes & commands.
+//
+const (
+	VirtioNetCtrlRx             = 0
+	VirtioNetCtrlRxPromisc      = 0
+	VirtioNetCtrlRxAllMulti     = 1
+	VirtioNetCtrlMac            = 1
+	VirtioNetCtrlMacTableSet    = 0
+	VirtioNetCtrlMacAddrSet     = 1
+	VirtioNetCtrlVlan           = 2
+	VirtioNetCtrlVlanAdd        = 0
+	VirtioNetCtrlVlanDel        = 1
+	VirtioNetCtrlAnnounce       = 3
+	VirtioNetCtrlAnnounceAck    = 0
+	VirtioNetCtrlMq             = 4
+	VirtioNetCtrlMqVqPairsSet   = 0
+	VirtioNetCtrlMqVqPairsMin   = 1
+	VirtioNetCtrlMqVqPairsMax   = 0x8000
+	VirtioNetCtrlOk             = 0
+	VirtioNetCtrlErr            = 1
+	VirtioNetCtrlMaxMacEntries  = 64
+	VirtioNetCtrlVlanBitmapSize = 4096 / 8
+)
+
+//
+// VirtioNetFilter --
+//
+// The receive filter, as set by the guest over
+// the control queue. This is only applied if the
+// guest has negotiated the relevant features.
+//
+type VirtioNetFilter struct {
+	// Receive everything?
+	Promisc bool `json:"promisc"`
+
+	// Receive all multicast?
+	AllMulti bool `json:"all-multi"`
+
+	// Additional addresses to accept.
+	Unicast   []net.HardwareAddr `json:"unicast"`
+	Multicast []net.HardwareAddr `json:"multicast"`
+
+	// Accepted VLAN ids (a bitmap).
+	Vlans []byte `json:"vlans"`
+}
+
+func (nic *VirtioNetDevice) controlQueue() uint {
+	if nic.HasFeatures(VirtioNetFMq) {
+		return uint(2 * nic.Queues)
+	}
+	return 2
+}
+
+//
+// Should we pass this frame to the guest?
+//
+func (nic *VirtioNetDevice) accept(frame []byte) bool {
+	if len(frame) < 14 {
+		return false
+	}
+
+	nic.filter_lock.RLock()
+	defer nic.filter_lock.RUnlock()
+
+	if nic.HasFeatures(VirtioNetFCtrlVlan) &&
+		binary.BigEndian.Uint16(frame[12:14]) == 0x8100 {
+
+		if len(frame) < 16 {
+			return false
+		}
+		vid := binary.BigEndian.Uint16(frame[14:16]) & 0xfff
+		if nic.Filter.Vlans == nil ||
+			nic.Filter.Vlans[vid/8]&(1<<(vid%8)) == 0 {
+			return false
+		}
+	}
+
+	if !nic.HasFeatures(VirtioNetFCtrlRx) || nic.Filter.Promisc {
+		return true
+	}
+
+	dest := frame[0:6]
+	if dest[0]&1 != 0 {
+		// Broadcast or multicast.
+		if bytes.Equal(dest, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}) {
+			return true
+		}
+		if nic.Filter.AllMulti {
+			return true
+		}
+		for _, mac := range nic.Filter.Multicast {
+			if bytes.Equal(dest, mac) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if bytes.Equal(dest, nic.mac) {
+		return true
+	}
+	for _, mac := range nic.Filter.Unicast {
+		if bytes.Equal(dest, mac) {
+			return true
+		}
+	}
+	return false
+}
+
+func (nic *VirtioNetDevice) processControl(buf *VirtioBuffer) {
+
+	// The last byte is our ack.
+	if buf.Length() < 3 {
+		return
+	}
+	command := make([]byte, buf.Length()-1)
+	buf.CopyOut(0, command)
+
+	status := byte(VirtioNetCtrlOk)
+	err := nic.control(command[0], command[1], command[2:])
+	if err != nil {
+		nic.Debug("ctrl %d/%d err -> %s", command[0], command[1], err.Error())
+		status = VirtioNetCtrlErr
+	} else {
+		nic.Debug("ctrl %d/%d ok", command[0], command[1])
+	}
+
+	buf.CopyIn(buf.Length()-1, []byte{status})
+}
+
+func (nic *VirtioNetDevice) control(class byte, cmd byte, data []byte) error {
+	switch class {
+	case VirtioNetCtrlRx:
+		if !nic.HasFeatures(VirtioNetFCtrlRx) || len(data) < 1 {
+			return VirtioNetBadCommandErr
+		}
+		nic.filter_lock.Lock()
+		defer nic.filter_lock.Unlock()
+		switch cmd {
+		case VirtioNetCtrlRxPromisc:
+			nic.Filter.Promisc = data[0] != 0
+		case VirtioNetCtrlRxAllMulti:
+			nic.Filter.AllMulti = data[0] != 0
+		default:
+			return VirtioNetBadCommandErr
+		}
+		return nil
+
+	case VirtioNetCtrlMac:
+		switch cmd {
+		case VirtioNetCtrlMacTableSet:
+			if !nic.HasFeatures(VirtioNetFCtrlRx) {
+				return VirtioNetBadCommandErr
+			}
+			unicast, rest, err := parseMacTable(data)
+			if err != nil {
+				return err
+			}
+			multicast, _, err := parseMacTable(rest)
+			if err != nil {
+				return err
+			}
+			nic.filter_lock.Lock()
+			defer nic.filter_lock.Unlock()
+			nic.Filter.Unicast = unicast
+			nic.Filter.Multicast = multicast
+			return nil
+
+		case VirtioNetCtrlMacAddrSet:
+			if !nic.HasFeatures(VirtioNetFCtrlMacAddr) || len(data) < 6 {
+				return VirtioNetBadCommandErr
+			}
+			nic.filter_lock.Lock()
+			defer nic.filter_lock.Unlock()
+			nic.setMac(net.HardwareAddr(data[:6]))
+			return nil
+		}
+		return VirtioNetBadCommandErr
+
+	case VirtioNetCtrlVlan:
+		if !nic.HasFeatures(VirtioNetFCtrlVlan) || len(data) < 2 {
+			return VirtioNetBadCommandErr
+		}
+		vid := binary.LittleEndian.Uint16(data) & 0xfff
+		nic.filter_lock.Lock()
+		defer nic.filter_lock.Unlock()
+		if nic.Filter.Vlans == nil {
+			nic.Filter.Vlans = make([]byte, VirtioNetCtrlVlanBitmapSize)
+		}
+		switch cmd {
+		case VirtioNetCtrlVlanAdd:
+			nic.Filter.Vlans[vid/8] |= 1 << (vid % 8)
+		case VirtioNetCtrlVlanDel:
+			nic.Filter.Vlans[vid/8] &^= 1 << (vid % 8)
+		default:
+			return VirtioNetBadCommandErr
+		}
+		return nil
+
+	case VirtioNetCtrlAnnounce:
+		if !nic.HasFeatures(VirtioNetFGuestAnnounce) ||
+			cmd != VirtioNetCtrlAnnounceAck {
+			return VirtioNetBadCommandErr
+		}
+		nic.announced()
+		return nil
+
+	case VirtioNetCtrlMq:
+		if !nic.HasFeatures(VirtioNetFMq) ||
+			cmd != VirtioNetCtrlMqVqPairsSet ||
+			len(data) < 2 {
+			return VirtioNetBadCommandErr
+		}
+		return nic.setPairs(int(binary.LittleEndian.Uint16(data)))
+	}
+
+	return VirtioNetBadCommandErr
+}
+
+func parseMacTable(data []byte) ([]net.HardwareAddr, []byte, error) {
+	if len(data) < 4 {
+		return nil, nil, VirtioNetBadCommandErr
+	}
+	entries := int(binary.LittleEndian.Uint32(data))
+	data = data[4:]
+	if entries > VirtioNetCtrlMaxMacEntries || len(data) < 6*entries {
+		return nil, nil, VirtioNetBadCommandErr
+	}
+
+	macs := make([]net.HardwareAddr, entries)
+	for i := 0; i < entries; i += 1 {
+		macs[i] = net.HardwareAddr(append([]byte(nil), data[6*i:6*i+6]...))
+	}
+	return macs, data[6*entries:], nil
+}
+
+//
+// Set the number of active queue pairs.
+// On a multi-queue tap, we detach the unused queues
+// so that the kernel doesn't steer packets to them.
+//
+func (nic *VirtioNetDevice) setPairs(pairs int) error {
+	if pairs < VirtioNetCtrlMqVqPairsMin || pairs > nic.Queues {
+		return VirtioNetBadCommandErr
+	}
+
+	for i := 1; i < len(nic.Fds); i += 1 {
+		enabled := i < pairs
+		if enabled == (i < nic.Pairs) {
+			continue
+		}
+		err := SetTapQueue(nic.Fds[i], enabled)
+		if err != nil {
+			return err
+		}
+	}
+
+	nic.Pairs = pairs
+	return nil
+}
@@ -0,0 +1,538 @@
+package machine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+)
+
+//
+// How much of each frame we look at.
+//
+const VirtioNetFirewallHeader = 256
+
+//
+// VirtioNetRule --
+//
+// An egress rule. Rules are checked in order, and the
+// first match decides. Empty fields match anything.
+//
+type VirtioNetRule struct {
+	// Either "allow" or "deny".
+	Action string `json:"action"`
+
+	// The destination (e.g. "10.1.0.0/16").
+	Network string `json:"network,omitempty"`
+
+	// One of "tcp", "udp", "icmp" or "icmpv6".
+	Proto string `json:"proto,omitempty"`
+
+	// Destination ports (an inclusive range).
+	// If only Port is set, just that port.
+	Port    uint16 `json:"port,omitempty"`
+	PortEnd uint16 `json:"port-end,omitempty"`
+
+	// Frames matched.
+	Hits uint64 `json:"hits"`
+
+	network *net.IPNet
+	proto   int
+}
+
+//
+// VirtioNetLimits --
+//
+// Token bucket limits on each direction. Transmit is
+// guest to network, receive is network to guest. We shape
+// rather than drop: a guest that exceeds its limits simply
+// has its queues serviced more slowly.
+//
+type VirtioNetLimits struct {
+	TxPps BlockLimit `json:"tx-pps"`
+	TxBps BlockLimit `json:"tx-bps"`
+	RxPps BlockLimit `json:"rx-pps"`
+	RxBps BlockLimit `json:"rx-bps"`
+}
+
+type VirtioNetFirewallStats struct {
+	// Transmitted frames allowed & denied.
+	Allowed uint64 `json:"allowed"`
+	Denied  uint64 `json:"denied"`
+
+	// Transmitted frames with a bad source.
+	Spoofed uint64 `json:"spoofed"`
+
+	// Frames which had to wait (and for how long, in ns).
+	TxThrottled uint64 `json:"tx-throttled"`
+	RxThrottled uint64 `json:"rx-throttled"`
+	TxWait      int64  `json:"tx-wait"`
+	RxWait      int64  `json:"rx-wait"`
+}
+
+//
+// VirtioNetFirewallConfig --
+//
+// Filtering & rate limits for a network device.
+//
+// ARP and IPv6 neighbor discovery are always allowed (subject
+// to anti-spoofing), as nothing works without them. Anything
+// else that is not IP falls through to the default.
+//
+type VirtioNetFirewallConfig struct {
+	Rules []VirtioNetRule `json:"rules"`
+
+	// What to do when no rule matches
+	// ("allow" or "deny", default "allow").
+	Default string `json:"default,omitempty"`
+
+	// Drop frames not from our mac (and addresses)?
+	AntiSpoof bool `json:"anti-spoof,omitempty"`
+
+	// The guest's addresses. If empty, only
+	// the source mac is checked.
+	Addresses []string `json:"addresses,omitempty"`
+
+	Limits VirtioNetLimits `json:"limits"`
+
+	addresses []net.IP
+}
+
+//
+// VirtioNetFirewall --
+//
+// The firewall in the data path.
+//
+type VirtioNetFirewall struct {
+	VirtioNetFirewallConfig
+	VirtioNetFirewallStats
+
+	tx_pps tokenBucket
+	tx_bps tokenBucket
+	rx_pps tokenBucket
+	rx_bps tokenBucket
+
+	lock sync.Mutex
+}
+
+//
+// Validate and prepare our rules.
+//
+func (firewall *VirtioNetFirewallConfig) compile() error {
+	switch firewall.Default {
+	case "", "allow", "deny":
+	default:
+		return VirtioNetBadRuleErr
+	}
+
+	for i := range firewall.Rules {
+		rule := &firewall.Rules[i]
+		switch rule.Action {
+		case "allow", "deny":
+		default:
+			return VirtioNetBadRuleErr
+		}
+
+		rule.network = nil
+		if rule.Network != "" {
+			_, network, err := net.ParseCIDR(rule.Network)
+			if err != nil {
+				ip := net.ParseIP(rule.Network)
+				if ip == nil {
+					return VirtioNetBadRuleErr
+				}
+				bits := 8 * net.IPv6len
+				if ip.To4() != nil {
+					ip = ip.To4()
+					bits = 8 * net.IPv4len
+				}
+				network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+			}
+			rule.network = network
+		}
+
+		switch rule.Proto {
+		case "":
+			rule.proto = -1
+		case "tcp":
+			rule.proto = 6
+		case "udp":
+			rule.proto = 17
+		case "icmp":
+			rule.proto = 1
+		case "icmpv6":
+			rule.proto = 58
+		default:
+			return VirtioNetBadRuleErr
+		}
+
+		if rule.PortEnd != 0 && rule.PortEnd < rule.Port {
+			return VirtioNetBadRuleErr
+		}
+		if rule.Port != 0 && rule.proto != 6 && rule.proto != 17 {
+			return VirtioNetBadRuleErr
+		}
+	}
+
+	firewall.addresses = nil
+	for _, address := range firewall.Addresses {
+		ip := net.ParseIP(address)
+		if ip == nil {
+			return VirtioNetBadRuleErr
+		}
+		firewall.addresses = append(firewall.addresses, ip)
+	}
+
+	return nil
+}
+
+//
+// The headers we care about.
+//
+type virtioNetHeaders struct {
+	ethertype uint16
+	sender    net.HardwareAddr
+	src       net.IP
+	dst       net.IP
+	proto     int
+	port      int
+	icmp      int
+}
+
+//
+// The most extension headers we'll walk through.
+// (Anything longer than this is not legitimate).
+//
+const VirtioNetMaxExtensions = 8
+
+//
+// Parse what we need from a frame.
+//
+// If we can't find the transport header of an IP packet,
+// or it's a fragment other than the first (and so has no
+// transport header), this fails and the frame is dropped.
+// Otherwise the ports could be hidden from the rules.
+//
+func parseHeaders(frame []byte) (headers virtioNetHeaders, ok bool) {
+	headers.proto = -1
+	headers.port = -1
+	headers.icmp = -1
+
+	if len(frame) < 14 {
+		return headers, false
+	}
+	headers.ethertype = binary.BigEndian.Uint16(frame[12:14])
+	data := frame[14:]
+	for headers.ethertype == 0x8100 ||
+		headers.ethertype == 0x88a8 ||
+		headers.ethertype == 0x9100 {
+		// Any number of (stacked) VLAN tags.
+		if len(data) < 4 {
+			return headers, false
+		}
+		headers.ethertype = binary.BigEndian.Uint16(data[2:4])
+		data = data[4:]
+	}
+
+	var transport []byte
+	switch headers.ethertype {
+	case 0x0806:
+		if len(data) < 28 {
+			return headers, false
+		}
+		headers.sender = net.HardwareAddr(data[8:14])
+		headers.src = net.IP(data[14:18])
+		headers.dst = net.IP(data[24:28])
+		return headers, true
+
+	case 0x0800:
+		if len(data) < 20 {
+			return headers, false
+		}
+		ihl := int(data[0]&0xf) * 4
+		if ihl < 20 || ihl > len(data) {
+			return headers, false
+		}
+		headers.src = net.IP(data[12:16])
+		headers.dst = net.IP(data[16:20])
+		headers.proto = int(data[9])
+		if binary.BigEndian.Uint16(data[6:8])&0x1fff != 0 {
+			return headers, false
+		}
+		transport = data[ihl:]
+
+	case 0x86dd:
+		if len(data) < 40 {
+			return headers, false
+		}
+		headers.src = net.IP(data[8:24])
+		headers.dst = net.IP(data[24:40])
+		next := int(data[6])
+		offset := 40
+
+		for i := 0; ; i += 1 {
+			if i > VirtioNetMaxExtensions {
+				return headers, false
+			}
+			if next != 0 && next != 43 && next != 60 &&
+				next != 51 && next != 44 {
+				break
+			}
+			if len(data) < offset+8 {
+				return headers, false
+			}
+			var length int
+			switch next {
+			case 0, 43, 60:
+				// Hop-by-hop, routing & destination options.
+				length = (int(data[offset+1]) + 1) * 8
+			case 51:
+				// Authentication.
+				length = (int(data[offset+1]) + 2) * 4
+			case 44:
+				// Fragment.
+				if binary.BigEndian.Uint16(data[offset+2:offset+4])&0xfff8 != 0 {
+					return headers, false
+				}
+				length = 8
+			}
+			next = int(data[offset])
+			offset += length
+		}
+		if offset > len(data) {
+			return headers, false
+		}
+		headers.proto = next
+		transport = data[offset:]
+
+	default:
+		return headers, true
+	}
+
+	switch headers.proto {
+	case 6, 17:
+		if len(transport) < 4 {
+			return headers, false
+		}
+		headers.port = int(binary.BigEndian.Uint16(transport[2:4]))
+	case 1, 58:
+		if len(transport) < 1 {
+			return headers, false
+		}
+		headers.icmp = int(transport[0])
+	}
+	return headers, true
+}
+
+//
+// Is this source address acceptable?
+//
+func (firewall *VirtioNetFirewallConfig) validSource(ip net.IP) bool {
+	if len(firewall.addresses) == 0 || ip.IsUnspecified() {
+		// Nothing configured, or still configuring
+		// (e.g. DHCP, or duplicate address detection).
+		return true
+	}
+	if ip.To4() == nil && ip.IsLinkLocalUnicast() {
+		return true
+	}
+	for _, address := range firewall.addresses {
+		if address.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// Should this frame from the guest go out?
+//
+func (firewall *VirtioNetFirewall) egress(frame []byte, mac net.HardwareAddr) bool {
+	headers, ok := parseHeaders(frame)
+
+	firewall.lock.Lock()
+	defer firewall.lock.Unlock()
+
+	if !ok {
+		firewall.Denied += 1
+		return false
+	}
+
+	if firewall.AntiSpoof {
+		spoofed := !bytes.Equal(frame[6:12], mac)
+		if headers.sender != nil && !bytes.Equal(headers.sender, mac) {
+			// A lie in ARP.
+			spoofed = true
+		}
+		if headers.src != nil && !firewall.validSource(headers.src) {
+			spoofed = true
+		}
+		if spoofed {
+			firewall.Spoofed += 1
+			return false
+		}
+	}
+
+	allow := firewall.match(&headers)
+	if allow {
+		firewall.Allowed += 1
+	} else {
+		firewall.Denied += 1
+	}
+	return allow
+}
+
+//
+// Check the rules.
+// The firewall lock must be held.
+//
+func (firewall *VirtioNetFirewallConfig) match(headers *virtioNetHeaders) bool {
+	// Always allowed.
+	if headers.ethertype == 0x0806 ||
+		(headers.proto == 58 && headers.icmp >= 133 && headers.icmp <= 137) {
+		return true
+	}
+
+	if headers.dst != nil {
+		for i := range firewall.Rules {
+			rule := &firewall.Rules[i]
+			if rule.network != nil && !rule.network.Contains(headers.dst) {
+				continue
+			}
+			if rule.proto >= 0 && rule.proto != headers.proto {
+				continue
+			}
+			if rule.Port != 0 {
+				end := rule.PortEnd
+				if end == 0 {
+					end = rule.Port
+				}
+				if headers.port < int(rule.Port) || headers.port > int(end) {
+					continue
+				}
+			}
+			rule.Hits += 1
+			return rule.Action == "allow"
+		}
+	}
+
+	return firewall.Default != "deny"
+}
+
+//
+// Wait until a frame of the given length is allowed.
+//
+func (firewall *VirtioNetFirewall) throttle(tx bool, length int) {
+	firewall.lock.Lock()
+
+	now := time.Now()
+	var wait time.Duration
+	if tx {
+		pps := firewall.tx_pps.take(firewall.Limits.TxPps, 1, now)
+		bps := firewall.tx_bps.take(firewall.Limits.TxBps, float64(length), now)
+		wait = maxDuration(pps, bps)
+		if wait > 0 {
+			firewall.TxThrottled += 1
+			firewall.TxWait += int64(wait)
+		}
+	} else {
+		pps := firewall.rx_pps.take(firewall.Limits.RxPps, 1, now)
+		bps := firewall.rx_bps.take(firewall.Limits.RxBps, float64(length), now)
+		wait = maxDuration(pps, bps)
+		if wait > 0 {
+			firewall.RxThrottled += 1
+			firewall.RxWait += int64(wait)
+		}
+	}
+
+	firewall.lock.Unlock()
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+//
+// Replace our configuration (keeping the counters).
+//
+func (firewall *VirtioNetFirewall) set(config VirtioNetFirewallConfig) {
+	firewall.lock.Lock()
+	defer firewall.lock.Unlock()
+
+	firewall.VirtioNetFirewallConfig = config
+}
+
+func (firewall *VirtioNetFirewall) Config() VirtioNetFirewallConfig {
+	firewall.lock.Lock()
+	defer firewall.lock.Unlock()
+
+	config := firewall.VirtioNetFirewallConfig
+	config.Rules = append([]VirtioNetRule(nil), config.Rules...)
+	return config
+}
+
+func (firewall *VirtioNetFirewall) Stats() VirtioNetFirewallStats {
+	firewall.lock.Lock()
+	defer firewall.lock.Unlock()
+
+	return firewall.VirtioNetFirewallStats
+}
+
+//
+// The firewall (or nil).
+//
+func (nic *VirtioNetDevice) firewall() *VirtioNetFirewall {
+	nic.firewall_lock.RLock()
+	defer nic.firewall_lock.RUnlock()
+	return nic.Firewall
+}
+
+//
+// Set our rules & limits.
+//
+func (nic *VirtioNetDevice) SetFirewall(config VirtioNetFirewallConfig) error {
+	if nic.vhost != nil {
+		return VirtioNetVhostErr
+	}
+	err := config.compile()
+	if err != nil {
+		return err
+	}
+
+	nic.firewall_lock.Lock()
+	defer nic.firewall_lock.Unlock()
+
+	if nic.Firewall == nil {
+		nic.Firewall = &VirtioNetFirewall{VirtioNetFirewallConfig: config}
+		return nil
+	}
+	nic.Firewall.set(config)
+	return nil
+}
+
+//
+// Remove all rules & limits.
+//
+func (nic *VirtioNetDevice) ClearFirewall() {
+	nic.firewall_lock.Lock()
+	defer nic.firewall_lock.Unlock()
+
+	nic.Firewall = nil
+}
+
+func (nic *VirtioNetDevice) FirewallConfig() (VirtioNetFirewallConfig, error) {
+	firewall := nic.firewall()
+	if firewall == nil {
+		return VirtioNetFirewallConfig{}, VirtioNetNoFirewallErr
+	}
+	return firewall.Config(), nil
+}
+
+func (nic *VirtioNetDevice) FirewallStats() (VirtioNetFirewallStats, error) {
+	firewall := nic.firewall()
+	if firewall == nil {
+		return VirtioNetFirewallStats{}, VirtioNetNoFirewallErr
+	}
+	return firewall.Stats(), nil
+}
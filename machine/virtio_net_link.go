@@ -0,0 +1,135 @@
+package machine
+
+import (
+	"time"
+)
+
+//
+// How often we check the tap's carrier.
+//
+const VirtioNetCarrierInterval = time.Second
+
+//
+// The current link status, as the guest sees it.
+// The link lock must be held.
+//
+func (nic *VirtioNetDevice) status() uint16 {
+	var status uint16
+	if !nic.LinkDown && (!nic.Carrier || nic.carrier) {
+		status |= VirtioNetLinkUp
+	}
+	if nic.announce {
+		status |= VirtioNetAnnounce
+	}
+	return status
+}
+
+//
+// Update the status in our config space,
+// and let the guest know if it has changed.
+// The link lock must be held.
+//
+func (nic *VirtioNetDevice) updateStatus(notify bool) error {
+	status := nic.status()
+	if nic.Config.Get16(VirtioNetStatusOffset) == status {
+		return nil
+	}
+
+	nic.Debug("status %x", status)
+	nic.Config.Set16(VirtioNetStatusOffset, status)
+	if notify {
+		return nic.ConfigInterrupt()
+	}
+	return nil
+}
+
+//
+// Bring the link up or down.
+//
+func (nic *VirtioNetDevice) SetLink(up bool) error {
+	nic.link_lock.Lock()
+	defer nic.link_lock.Unlock()
+
+	nic.LinkDown = !up
+	return nic.updateStatus(true)
+}
+
+//
+// Ask the guest to announce itself.
+//
+// The guest will send gratuitous ARPs (and the like)
+// and then acknowledge over the control queue. This is
+// done automatically after a restore.
+//
+func (nic *VirtioNetDevice) Announce() error {
+	if !nic.HasFeatures(VirtioNetFGuestAnnounce) {
+		return VirtioNetNoAnnounceErr
+	}
+
+	nic.link_lock.Lock()
+	defer nic.link_lock.Unlock()
+
+	nic.announce = true
+	return nic.updateStatus(true)
+}
+
+//
+// The guest has announced itself.
+//
+func (nic *VirtioNetDevice) announced() {
+	nic.link_lock.Lock()
+	defer nic.link_lock.Unlock()
+
+	nic.announce = false
+	nic.updateStatus(false)
+}
+
+//
+// Follow the carrier of our tap.
+// (So the guest sees the link go down when the
+// tap is brought down on the host).
+//
+func (nic *VirtioNetDevice) pollCarrier(name string) {
+	for {
+		time.Sleep(VirtioNetCarrierInterval)
+
+		up, err := TapCarrier(name)
+		if err != nil {
+			nic.Debug("carrier: %s", err.Error())
+		} else {
+			nic.link_lock.Lock()
+			nic.carrier = up
+			nic.updateStatus(true)
+			nic.link_lock.Unlock()
+		}
+	}
+}
+
+//
+// Set up our link status.
+//
+func (nic *VirtioNetDevice) initLink() error {
+	if nic.Carrier {
+		if nic.User != nil || nic.Switch != nil {
+			return VirtioNetNoTapErr
+		}
+		name := nic.Tap
+		if name == "" {
+			var err error
+			name, err = TapName(nic.Fd)
+			if err != nil {
+				return err
+			}
+		}
+		up, err := TapCarrier(name)
+		if err != nil {
+			return err
+		}
+		nic.carrier = up
+		go nic.pollCarrier(name)
+	}
+
+	// Always set (i.e. even if unchanged).
+	nic.Config.Set16(VirtioNetStatusOffset, nic.status())
+	return nil
+}
@@ -0,0 +1,434 @@
+package machine
+
+//
+// Modern (virtio 1.x) PCI --
+//
+// Modern drivers find the device's registers through a set of
+// vendor capabilities, each pointing at a region of a memory BAR.
+// We put them all in one BAR, and leave the legacy registers in
+// BAR 0 so older guests can still drive the device.
+//
+
+const (
+	PciCapabilityVendor = 0x09
+)
+
+//
+// Capability types.
+//
+const (
+	VirtioPciCapCommon = 1
+	VirtioPciCapNotify = 2
+	VirtioPciCapIsr    = 3
+	VirtioPciCapDevice = 4
+	VirtioPciCapPci    = 5
+)
+
+//
+// Our layout of the modern BAR.
+//
+const (
+	VirtioPciModernBar        = 2
+	VirtioPciCommonOffset     = 0x0000
+	VirtioPciCommonSize       = 0x38
+	VirtioPciIsrOffset        = 0x1000
+	VirtioPciDeviceOffset     = 0x2000
+	VirtioPciNotifyOffset     = 0x3000
+	VirtioPciRegionSize       = 0x1000
+	VirtioPciModernSize       = 0x4000
+	VirtioPciNotifyMultiplier = 4
+)
+
+//
+// Common configuration offsets.
+//
+const (
+	VirtioCommonDeviceFeatureSelect = 0x00
+	VirtioCommonDeviceFeature       = 0x04
+	VirtioCommonDriverFeatureSelect = 0x08
+	VirtioCommonDriverFeature       = 0x0c
+	VirtioCommonMsixConfig          = 0x10
+	VirtioCommonNumQueues           = 0x12
+	VirtioCommonStatus              = 0x14
+	VirtioCommonConfigGeneration    = 0x15
+	VirtioCommonQueueSelect         = 0x16
+	VirtioCommonQueueSize           = 0x18
+	VirtioCommonQueueMsixVector     = 0x1a
+	VirtioCommonQueueEnable         = 0x1c
+	VirtioCommonQueueNotifyOff      = 0x1e
+	VirtioCommonQueueDesc           = 0x20
+	VirtioCommonQueueDriver         = 0x28
+	VirtioCommonQueueDevice         = 0x30
+)
+
+//
+// The offsets of fields within our capabilities.
+// (These don't include the id & next pointer).
+//
+const (
+	virtioPciCapLen        = 0x0
+	virtioPciCapType       = 0x1
+	virtioPciCapBar        = 0x2
+	virtioPciCapOffset     = 0x6
+	virtioPciCapLength     = 0xa
+	virtioPciCapMultiplier = 0xe
+	virtioPciCapData       = 0xe
+	virtioPciCapSize       = 0xe
+	virtioPciCapExtSize    = 0x12
+)
+
+//
+// A queue's MSI-X vector, when there isn't one.
+//
+const VirtioNoVector = 0xffff
+
+type VirtioPciCommon struct {
+	*VirtioDevice
+}
+
+func (reg *VirtioPciCommon) queue() (*VirtioChannel, bool) {
+	queue, ok := reg.VirtioDevice.Channels[uint(reg.QueueSelect.Value)]
+	return queue, ok
+}
+
+//
+// The 64-bit fields may be accessed in two halves.
+//
+func field64(offset uint64, base uint64) (uint64, bool) {
+	return offset - base, offset >= base && offset < base+8
+}
+
+func (reg *VirtioPciCommon) Read(offset uint64, size uint) (uint64, error) {
+
+	switch offset {
+	case VirtioCommonDeviceFeatureSelect:
+		return reg.DeviceFeatureSelect.Read(0, size)
+
+	case VirtioCommonDeviceFeature:
+		if reg.DeviceFeatureSelect.Value > 1 {
+			return 0, nil
+		}
+		return reg.HostFeatures.Read(4*reg.DeviceFeatureSelect.Value, size)
+
+	case VirtioCommonDriverFeatureSelect:
+		return reg.DriverFeatureSelect.Read(0, size)
+
+	case VirtioCommonDriverFeature:
+		if reg.DriverFeatureSelect.Value > 1 {
+			return 0, nil
+		}
+		return reg.GuestFeatures.Read(4*reg.DriverFeatureSelect.Value, size)
+
+	case VirtioCommonMsixConfig:
+		if queue, ok := reg.VirtioDevice.Channels[0]; ok {
+			return queue.CfgVec.Read(0, size)
+		}
+		return VirtioNoVector, nil
+
+	case VirtioCommonNumQueues:
+		return uint64(len(reg.VirtioDevice.Channels)), nil
+
+	case VirtioCommonStatus:
+		return reg.DeviceStatus.Read(0, size)
+
+	case VirtioCommonConfigGeneration:
+		// Our config changes are all single fields.
+		return 0, nil
+
+	case VirtioCommonQueueSelect:
+		return reg.QueueSelect.Read(0, size)
+	}
+
+	// The rest are per-queue.
+	queue, ok := reg.queue()
+	if !ok {
+		// We return zero if the queue doesn't exist.
+		if offset == VirtioCommonQueueMsixVector {
+			return VirtioNoVector, nil
+		}
+		return 0, nil
+	}
+
+	switch offset {
+	case VirtioCommonQueueSize:
+		return queue.QueueSize.Read(0, size)
+	case VirtioCommonQueueMsixVector:
+		return queue.QueueVec.Read(0, size)
+	case VirtioCommonQueueEnable:
+		return queue.QueueEnable.Read(0, size)
+	case VirtioCommonQueueNotifyOff:
+		// Our notify addresses are by index (as for legacy).
+		return reg.QueueSelect.Value, nil
+	}
+	if field, ok := field64(offset, VirtioCommonQueueDesc); ok {
+		return queue.QueueDesc.Read(field, size)
+	}
+	if field, ok := field64(offset, VirtioCommonQueueDriver); ok {
+		return queue.QueueDriver.Read(field, size)
+	}
+	if field, ok := field64(offset, VirtioCommonQueueDevice); ok {
+		return queue.QueueDevice.Read(field, size)
+	}
+
+	return 0, nil
+}
+
+func (reg *VirtioPciCommon) Write(offset uint64, size uint, value uint64) error {
+
+	switch offset {
+	case VirtioCommonDeviceFeatureSelect:
+		return reg.DeviceFeatureSelect.Write(0, size, value)
+
+	case VirtioCommonDeviceFeature:
+		// This field is read-only.
+		return nil
+
+	case VirtioCommonDriverFeatureSelect:
+		return reg.DriverFeatureSelect.Write(0, size, value)
+
+	case VirtioCommonDriverFeature:
+		if reg.DriverFeatureSelect.Value > 1 {
+			return nil
+		}
+		return reg.GuestFeatures.Write(4*reg.DriverFeatureSelect.Value, size, value)
+
+	case VirtioCommonMsixConfig:
+		// This is per-device here, but we keep it
+		// with each queue for the legacy interface.
+		for _, queue := range reg.VirtioDevice.Channels {
+			err := queue.CfgVec.Write(0, size, value)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case VirtioCommonStatus:
+		return reg.VirtioDevice.setStatus(size, value)
+
+	case VirtioCommonQueueSelect:
+		return reg.QueueSelect.Write(0, size, value)
+	}
+
+	// The rest are per-queue.
+	queue, ok := reg.queue()
+	if !ok {
+		return nil
+	}
+
+	switch offset {
+	case VirtioCommonQueueSize:
+		return queue.setSize(size, value)
+
+	case VirtioCommonQueueMsixVector:
+		return queue.QueueVec.Write(0, size, value)
+
+	case VirtioCommonQueueEnable:
+		// The driver can't disable a queue (it resets).
+		if value == 0 {
+			return nil
+		}
+		return queue.enable()
+	}
+
+	if field, ok := field64(offset, VirtioCommonQueueDesc); ok {
+		return queue.setAddress(&queue.QueueDesc, field, size, value)
+	}
+	if field, ok := field64(offset, VirtioCommonQueueDriver); ok {
+		return queue.setAddress(&queue.QueueDriver, field, size, value)
+	}
+	if field, ok := field64(offset, VirtioCommonQueueDevice); ok {
+		return queue.setAddress(&queue.QueueDevice, field, size, value)
+	}
+
+	return nil
+}
+
+//
+// VirtioPciModern --
+//
+// The modern BAR, split into regions as above.
+//
+type VirtioPciModern struct {
+	*VirtioDevice
+
+	common *VirtioPciCommon
+}
+
+func (reg *VirtioPciModern) Read(offset uint64, size uint) (uint64, error) {
+
+	switch {
+	case offset < VirtioPciCommonOffset+VirtioPciCommonSize:
+		return reg.common.Read(offset-VirtioPciCommonOffset, size)
+
+	case offset == VirtioPciIsrOffset:
+		return reg.IsrStatus.Read(0, size)
+
+	case offset >= VirtioPciDeviceOffset &&
+		offset < VirtioPciDeviceOffset+VirtioPciRegionSize:
+		reg.Debug(
+			"virtio read @ %x->%x (modern)",
+			offset,
+			offset-VirtioPciDeviceOffset)
+		return reg.VirtioDevice.Config.Read(offset-VirtioPciDeviceOffset, size)
+	}
+
+	return 0, nil
+}
+
+func (reg *VirtioPciModern) Write(offset uint64, size uint, value uint64) error {
+
+	switch {
+	case offset < VirtioPciCommonOffset+VirtioPciCommonSize:
+		return reg.common.Write(offset-VirtioPciCommonOffset, size, value)
+
+	case offset >= VirtioPciDeviceOffset &&
+		offset < VirtioPciDeviceOffset+VirtioPciRegionSize:
+		reg.Debug(
+			"virtio write @ %x->%x (modern)",
+			offset,
+			offset-VirtioPciDeviceOffset)
+		return reg.VirtioDevice.Config.Write(offset-VirtioPciDeviceOffset, size, value)
+
+	case offset >= VirtioPciNotifyOffset &&
+		offset < VirtioPciNotifyOffset+VirtioPciRegionSize:
+		// Each queue has its own address.
+		reg.VirtioDevice.notify(
+			uint((offset - VirtioPciNotifyOffset) / VirtioPciNotifyMultiplier))
+
+		// This is a saveable register.
+		return SaveIO
+	}
+
+	return nil
+}
+
+//
+// VirtioPciCap --
+//
+// One of our vendor capabilities. These are read-only,
+// except for the PCI configuration access capability,
+// which is a window into the BAR for firmware.
+//
+type VirtioPciCap struct {
+	*Ram
+
+	// For the access capability.
+	bar *VirtioPciModern
+}
+
+func (capability *VirtioPciCap) window() (uint64, uint, bool) {
+	if capability.Get8(virtioPciCapBar) != VirtioPciModernBar {
+		return 0, 0, false
+	}
+	length := uint(capability.Get32(virtioPciCapLength))
+	if length != 1 && length != 2 && length != 4 {
+		return 0, 0, false
+	}
+	return uint64(capability.Get32(virtioPciCapOffset)), length, true
+}
+
+func (capability *VirtioPciCap) Read(offset uint64, size uint) (uint64, error) {
+	if capability.bar != nil && offset == virtioPciCapData {
+		if addr, length, ok := capability.window(); ok {
+			return capability.bar.Read(addr, length)
+		}
+	}
+	return capability.Ram.Read(offset, size)
+}
+
+func (capability *VirtioPciCap) Write(offset uint64, size uint, value uint64) error {
+	if capability.bar == nil {
+		return nil
+	}
+	switch {
+	case offset == virtioPciCapData:
+		if addr, length, ok := capability.window(); ok {
+			err := capability.bar.Write(addr, length, value)
+			if err == SaveIO {
+				// Only for real I/O.
+				return nil
+			}
+			return err
+		}
+		return nil
+	case offset >= virtioPciCapBar && offset < virtioPciCapData:
+		return capability.Ram.Write(offset, size, value)
+	}
+	return nil
+}
+
+func (pcidevice *PciDevice) addVirtioCap(
+	cfg_type byte,
+	offset uint32,
+	length uint32,
+	size uint64,
+	bar *VirtioPciModern) *VirtioPciCap {
+
+	capability := &VirtioPciCap{Ram: NewRam(int(size)), bar: bar}
+	capability.Set8(virtioPciCapLen, byte(size+2))
+	capability.Set8(virtioPciCapType, cfg_type)
+	if bar == nil {
+		capability.Set8(virtioPciCapBar, VirtioPciModernBar)
+		capability.Set32(virtioPciCapOffset, offset)
+		capability.Set32(virtioPciCapLength, length)
+	}
+
+	// These all share an id, so we key them apart.
+	pcidevice.Capabilities[PciCapabilityVendor<<4|cfg_type] = &PciCapability{
+		Id:           PciCapabilityVendor,
+		Key:          PciCapabilityVendor<<4 | cfg_type,
+		IoOperations: capability,
+		Size:         size,
+	}
+
+	return capability
+}
+
+//
+// Add the modern interface to the device.
+//
+func (virtio *VirtioDevice) addModern(pcidevice *PciDevice) {
+
+	modern := &VirtioPciModern{
+		VirtioDevice: virtio,
+		common:       &VirtioPciCommon{virtio},
+	}
+	pcidevice.PciBarSizes[VirtioPciModernBar] = VirtioPciModernSize
+	pcidevice.PciBarOps[VirtioPciModernBar] = modern
+
+	pcidevice.addVirtioCap(
+		VirtioPciCapCommon,
+		VirtioPciCommonOffset,
+		VirtioPciCommonSize,
+		virtioPciCapSize,
+		nil)
+	pcidevice.addVirtioCap(
+		VirtioPciCapIsr,
+		VirtioPciIsrOffset,
+		1,
+		virtioPciCapSize,
+		nil)
+	pcidevice.addVirtioCap(
+		VirtioPciCapDevice,
+		VirtioPciDeviceOffset,
+		VirtioPciRegionSize,
+		virtioPciCapSize,
+		nil)
+	notify := pcidevice.addVirtioCap(
+		VirtioPciCapNotify,
+		VirtioPciNotifyOffset,
+		VirtioPciRegionSize,
+		virtioPciCapExtSize,
+		nil)
+	notify.Set32(virtioPciCapMultiplier, VirtioPciNotifyMultiplier)
+	pcidevice.addVirtioCap(
+		VirtioPciCapPci,
+		0,
+		0,
+		virtioPciCapExtSize,
+		modern)
+
+	// Modern drivers need this.
+	virtio.SetFeatures(VirtioFVersion1 | VirtioFRingPacked)
+}
@@ -0,0 +1,39 @@
+package machine
+
+import (
+	"sync/atomic"
+	"testing"
+)
+
+func TestVirtioPciModernNotify(t *testing.T) {
+	// As for virtio-blk, the queue's channel
+	// number isn't the same as its index.
+	device := NewVirtioDevice(nil)
+	device.Channels[0] = NewVirtioChannel(1, 256)
+	queue := device.Channels[0]
+	queue.QueueEnable.Value = 1
+	modern := &VirtioPciModern{
+		VirtioDevice: device,
+		common:       &VirtioPciCommon{VirtioDevice: device},
+	}
+
+	// What the driver does to find the address.
+	err := modern.Write(VirtioPciCommonOffset+VirtioCommonQueueSelect, 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notify_off, err := modern.Read(VirtioPciCommonOffset+VirtioCommonQueueNotifyOff, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	modern.Write(VirtioPciNotifyOffset+notify_off*VirtioPciNotifyMultiplier, 2, 0)
+	if atomic.LoadUint64(&queue.Kicks) != 1 {
+		t.Fatalf("kick at notify_off %d missed the queue", notify_off)
+	}
+	select {
+	case <-queue.notifications:
+	default:
+		t.Fatalf("no notification")
+	}
+}
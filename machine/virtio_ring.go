@@ -0,0 +1,118 @@
+package machine
+
+import (
+	ring "github.com/multiverse-os/portalgun/vm/virtio/ring"
+)
+
+//
+// virtioRing --
+//
+// The two ring formats differ in how buffers are found
+// and given back, and in what state we need to keep. The
+// channel only deals with them through this interface.
+//
+type virtioRing interface {
+	// The next available buffer (if any).
+	next() (uint16, []ring.Segment, bool, error)
+
+	// A buffer we've already taken (on restore).
+	buffer(index uint16) ([]ring.Segment, error)
+
+	// Give buffers back. Returns true if the
+	// driver wants an interrupt for them.
+	put(bufs []*VirtioBuffer) bool
+
+	// Notification suppression.
+	disableNotify()
+	enableNotify() bool
+
+	// Host addresses of each part.
+	addresses() (uintptr, uintptr, uintptr)
+}
+
+//
+// Split rings keep their state in guest memory,
+// except for what we've consumed (Consumed).
+//
+type virtioSplitRing struct {
+	*VirtioChannel
+	split *ring.Split
+}
+
+func (vring *virtioSplitRing) next() (uint16, []ring.Segment, bool, error) {
+	head, ok := vring.split.Available(vring.Consumed)
+	if !ok {
+		return 0, nil, false, nil
+	}
+
+	// We're up a buffer.
+	vring.Consumed += 1
+
+	segments, err := vring.split.Chain(head)
+	return head, segments, true, err
+}
+
+func (vring *virtioSplitRing) buffer(index uint16) ([]ring.Segment, error) {
+	return vring.split.Chain(index)
+}
+
+func (vring *virtioSplitRing) put(bufs []*VirtioBuffer) bool {
+	old := vring.split.Used()
+	for _, buf := range bufs {
+		vring.split.Put(buf.index, uint32(buf.length))
+	}
+	return vring.split.NeedsInterrupt(old, vring.HasFeatures(VirtioRingFEventIdx))
+}
+
+func (vring *virtioSplitRing) disableNotify() {
+	vring.split.DisableNotify(vring.HasFeatures(VirtioRingFEventIdx))
+}
+
+func (vring *virtioSplitRing) enableNotify() bool {
+	return vring.split.EnableNotify(vring.Consumed, vring.HasFeatures(VirtioRingFEventIdx))
+}
+
+func (vring *virtioSplitRing) addresses() (uintptr, uintptr, uintptr) {
+	return vring.split.Addresses()
+}
+
+//
+// Packed rings keep everything in Packed, which
+// is saved along with the channel.
+//
+type virtioPackedRing struct {
+	*VirtioChannel
+	packed *ring.Packed
+}
+
+func (vring *virtioPackedRing) next() (uint16, []ring.Segment, bool, error) {
+	return vring.packed.Next()
+}
+
+func (vring *virtioPackedRing) buffer(index uint16) ([]ring.Segment, error) {
+	segments, ok := vring.packed.Buffer(index)
+	if !ok {
+		return nil, ring.InvalidDescriptor
+	}
+	return segments, nil
+}
+
+func (vring *virtioPackedRing) put(bufs []*VirtioBuffer) bool {
+	old := vring.packed.Used()
+	for _, buf := range bufs {
+		vring.packed.Put(buf.index, uint32(buf.length))
+	}
+	return vring.packed.NeedsInterrupt(old, vring.HasFeatures(VirtioRingFEventIdx))
+}
+
+func (vring *virtioPackedRing) disableNotify() {
+	vring.packed.DisableNotify(vring.HasFeatures(VirtioRingFEventIdx))
+}
+
+func (vring *virtioPackedRing) enableNotify() bool {
+	return vring.packed.EnableNotify(vring.HasFeatures(VirtioRingFEventIdx))
+}
+
+func (vring *virtioPackedRing) addresses() (uintptr, uintptr, uintptr) {
+	return vring.packed.Addresses()
+}
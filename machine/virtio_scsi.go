@@ -0,0 +1,574 @@
+package machine
+
+import (
+	"encoding/binary"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	kvm "github.com/multiverse-os/portalgun/vm/kvm"
+)
+
+//
+// Features.
+//
+const (
+	VirtioScsiFInOut   = 1 << 0
+	VirtioScsiFHotplug = 1 << 1
+	VirtioScsiFChange  = 1 << 2
+)
+
+//
+// Config space.
+//
+const (
+	VirtioScsiConfigLen        = 36
+	VirtioScsiNumQueuesOffset  = 0
+	VirtioScsiSegMaxOffset     = 4
+	VirtioScsiMaxSectorsOffset = 8
+	VirtioScsiCmdPerLunOffset  = 12
+	VirtioScsiEventSizeOffset  = 16
+	VirtioScsiSenseSizeOffset  = 20
+	VirtioScsiCdbSizeOffset    = 24
+	VirtioScsiMaxChannelOffset = 28
+	VirtioScsiMaxTargetOffset  = 30
+	VirtioScsiMaxLunOffset     = 32
+)
+
+//
+// Limits & defaults.
+// (The driver may change the sense & cdb sizes).
+//
+const (
+	VirtioScsiSenseSize  = 96
+	VirtioScsiCdbSize    = 32
+	VirtioScsiMaxSize    = 256
+	VirtioScsiMaxTarget  = 255
+	VirtioScsiMaxLun     = 16383
+	VirtioScsiEventSize  = 16
+	VirtioScsiEventQueue = 64
+)
+
+//
+// Response codes.
+//
+const (
+	VirtioScsiSOk               = 0
+	VirtioScsiSBadTarget        = 3
+	VirtioScsiSFailure          = 9
+	VirtioScsiSFunctionRejected = 11
+)
+
+//
+// Control requests.
+//
+const (
+	VirtioScsiTTmf         = 0
+	VirtioScsiTAnQuery     = 1
+	VirtioScsiTAnSubscribe = 2
+)
+
+//
+// Events.
+//
+const (
+	VirtioScsiTTransportReset = 1
+	VirtioScsiTEventsMissed   = 0x80000000
+	VirtioScsiEvtResetRescan  = 1
+	VirtioScsiEvtResetRemoved = 2
+)
+
+//
+// The request queues.
+//
+const (
+	VirtioScsiCtrlQueue    = 0
+	VirtioScsiEventQueueId = 1
+	VirtioScsiRequestQueue = 2
+)
+
+//
+// VirtioScsiLunInfo --
+//
+// A disk, as target & LUN. There's a single channel, and
+// a target exists as long as it has at least one LUN.
+//
+type VirtioScsiLunInfo struct {
+	Target int `json:"target"`
+	Lun    int `json:"lun"`
+
+	// The backing file (or block device).
+	Path string `json:"path"`
+
+	// Refuse writes?
+	ReadOnly bool `json:"readonly,omitempty"`
+
+	// What the guest sees as the serial.
+	// (Defaults to target-lun).
+	Serial string `json:"serial,omitempty"`
+
+	// The open file. This is deliberately not
+	// CLOEXEC, so that it survives a re-exec.
+	Fd int `json:"fd,omitempty"`
+}
+
+type VirtioScsiLun struct {
+	VirtioScsiLunInfo
+
+	backend BlockBackend
+
+	// The size (in ScsiBlockSize blocks).
+	blocks uint64
+
+	// Held for each command, and
+	// taken to remove the LUN.
+	lock sync.RWMutex
+}
+
+type VirtioScsiDevice struct {
+	*VirtioDevice
+
+	// Our disks.
+	Luns []*VirtioScsiLun `json:"luns"`
+
+	luns_lock sync.Mutex
+
+	// Queued hotplug events.
+	events chan virtioScsiEvent
+
+	// Did we drop any?
+	missed int32
+}
+
+type virtioScsiEvent struct {
+	target int
+	lun    int
+	reason uint32
+}
+
+func (info *VirtioScsiLunInfo) validate() error {
+	if info.Target < 0 || info.Target > VirtioScsiMaxTarget ||
+		info.Lun < 0 || info.Lun > VirtioScsiMaxLun ||
+		(info.Path == "" && info.Fd == 0) {
+		return VirtioScsiBadLunErr
+	}
+	return nil
+}
+
+//
+// Open the backing file (if it's not already open).
+//
+func (lun *VirtioScsiLun) open() error {
+	opened := false
+	if lun.Fd == 0 {
+		flags := syscall.O_RDWR
+		if lun.ReadOnly {
+			flags = syscall.O_RDONLY
+		}
+		fd, err := syscall.Open(lun.Path, flags, 0)
+		if err != nil {
+			return err
+		}
+		lun.Fd = fd
+		opened = true
+	}
+
+	lun.backend = NewBlockFile(lun.Fd)
+	size, err := lun.backend.Size()
+	if err == nil && size < ScsiBlockSize {
+		err = VirtioScsiBadLunErr
+	}
+	if err != nil {
+		if opened {
+			lun.backend.Close()
+			lun.Fd = 0
+		}
+		return err
+	}
+	lun.blocks = uint64(size) / ScsiBlockSize
+
+	return nil
+}
+
+//
+// Find a LUN. The caller holds luns_lock.
+//
+func (device *VirtioScsiDevice) lun(target int, id int) *VirtioScsiLun {
+	for _, lun := range device.Luns {
+		if lun.Target == target && lun.Lun == id {
+			return lun
+		}
+	}
+	return nil
+}
+
+//
+// All the LUNs on a target (in order).
+//
+func (device *VirtioScsiDevice) targetLuns(target int) []int {
+	device.luns_lock.Lock()
+	defer device.luns_lock.Unlock()
+	luns := make([]int, 0)
+	for _, lun := range device.Luns {
+		if lun.Target == target {
+			luns = append(luns, lun.Lun)
+		}
+	}
+	sort.Ints(luns)
+	return luns
+}
+
+//
+// Run a command against the addressed LUN,
+// returning the virtio response code.
+//
+func (device *VirtioScsiDevice) execute(address []byte, cmd *scsiCommand) byte {
+
+	// We have a single bus, and use the same
+	// LUN format as Linux (flat addressing).
+	if address[0] != 1 {
+		return VirtioScsiSBadTarget
+	}
+	target := int(address[1])
+	id := int(binary.BigEndian.Uint16(address[2:]) & 0x3fff)
+
+	device.luns_lock.Lock()
+	lun := device.lun(target, id)
+	present := lun != nil
+	for _, other := range device.Luns {
+		present = present || other.Target == target
+	}
+	if lun != nil {
+		lun.lock.RLock()
+	}
+	device.luns_lock.Unlock()
+
+	switch {
+	case lun != nil:
+		defer lun.lock.RUnlock()
+		lun.execute(device, cmd)
+	case present:
+		device.executeMissing(target, cmd)
+	default:
+		return VirtioScsiSBadTarget
+	}
+
+	return VirtioScsiSOk
+}
+
+func (device *VirtioScsiDevice) request(buf *VirtioBuffer) {
+
+	// The sizes are up to the driver.
+	cdb_size := int(device.Config.Get32(VirtioScsiCdbSizeOffset))
+	sense_size := int(device.Config.Get32(VirtioScsiSenseSizeOffset))
+	req_size := 19 + cdb_size
+	resp_size := 12 + sense_size
+	readable := buf.Readable()
+
+	// Legit?
+	if cdb_size < 16 || cdb_size > VirtioScsiMaxSize ||
+		sense_size > VirtioScsiMaxSize ||
+		readable < req_size ||
+		buf.Length()-readable < resp_size {
+		device.Debug("invalid request?")
+		buf.SetLength(0)
+		return
+	}
+
+	// The request header is:
+	// lun (8), id (64), task attr, prio, crn, cdb.
+	req := make([]byte, req_size)
+	buf.CopyOut(0, req)
+
+	cmd := &scsiCommand{
+		cdb:     req[19:],
+		buf:     buf,
+		out:     req_size,
+		out_len: readable - req_size,
+		in:      readable + resp_size,
+		in_len:  buf.Length() - readable - resp_size,
+	}
+	response := device.execute(req[0:8], cmd)
+
+	// The response is: sense_len, resid, status
+	// qualifier (16), status, response, sense.
+	sense := cmd.sense
+	if len(sense) > sense_size {
+		sense = sense[:sense_size]
+	}
+	resid := 0
+	if cmd.in_len > 0 {
+		resid = cmd.in_len - cmd.written
+	}
+	resp := make([]byte, resp_size)
+	binary.LittleEndian.PutUint32(resp[0:], uint32(len(sense)))
+	binary.LittleEndian.PutUint32(resp[4:], uint32(resid))
+	resp[10] = cmd.status
+	resp[11] = response
+	copy(resp[12:], sense)
+	buf.CopyIn(readable, resp)
+
+	buf.SetLength(resp_size + cmd.written)
+}
+
+func (device *VirtioScsiDevice) processRequests(
+	vchannel *VirtioChannel) error {
+
+	for buf := range vchannel.incoming {
+		device.request(buf)
+
+		// Done.
+		vchannel.outgoing <- buf
+	}
+
+	return nil
+}
+
+//
+// Task management & async notification.
+//
+// Commands are run to completion as they arrive, so
+// there's never anything to abort or reset. We don't
+// support any async notifications.
+//
+func (device *VirtioScsiDevice) processCtrl(
+	vchannel *VirtioChannel) error {
+
+	for buf := range vchannel.incoming {
+
+		header := &Ram{make([]byte, 4)}
+		buf.CopyOut(0, header.Data)
+		readable := buf.Readable()
+
+		var resp []byte
+		switch header.Get32(0) {
+		case VirtioScsiTTmf:
+			vchannel.Debug("tmf")
+			resp = []byte{VirtioScsiSOk}
+
+		case VirtioScsiTAnQuery, VirtioScsiTAnSubscribe:
+			vchannel.Debug("async notify")
+			resp = []byte{0, 0, 0, 0, VirtioScsiSOk}
+
+		default:
+			vchannel.Debug("unknown?")
+			resp = []byte{VirtioScsiSFunctionRejected}
+		}
+
+		buf.SetLength(buf.CopyIn(readable, resp))
+		vchannel.outgoing <- buf
+	}
+
+	return nil
+}
+
+//
+// Tell the guest a LUN has come or gone.
+//
+// Events are only sent if the guest asked for them.
+// If we have to drop some, the guest is told it
+// missed events (and rescans).
+//
+func (device *VirtioScsiDevice) sendEvent(target int, lun int, reason uint32) {
+	if !device.HasFeatures(VirtioScsiFHotplug) {
+		return
+	}
+	select {
+	case device.events <- virtioScsiEvent{target, lun, reason}:
+	default:
+		atomic.StoreInt32(&device.missed, 1)
+	}
+}
+
+func (device *VirtioScsiDevice) processEvents() {
+	for event := range device.events {
+		buf := <-device.Channels[VirtioScsiEventQueueId].incoming
+
+		data := &Ram{make([]byte, VirtioScsiEventSize)}
+		kind := uint32(VirtioScsiTTransportReset)
+		if atomic.SwapInt32(&device.missed, 0) != 0 {
+			kind |= VirtioScsiTEventsMissed
+		}
+		data.Set32(0, kind)
+		data.Set8(4, 1)
+		data.Set8(5, uint8(event.target))
+		data.Set8(6, 0x40|uint8(event.lun>>8))
+		data.Set8(7, uint8(event.lun))
+		data.Set32(12, event.reason)
+
+		buf.SetLength(buf.CopyIn(0, data.Data))
+		device.Channels[VirtioScsiEventQueueId].outgoing <- buf
+	}
+}
+
+func setupScsi(device *VirtioDevice) (Device, error) {
+
+	// Set our features.
+	device.SetFeatures(VirtioScsiFHotplug)
+
+	// The control, event and request queues.
+	device.Channels[VirtioScsiCtrlQueue] = NewVirtioChannel(VirtioScsiCtrlQueue, 32)
+	device.Channels[VirtioScsiEventQueueId] = NewVirtioChannel(VirtioScsiEventQueueId, 32)
+	device.Channels[VirtioScsiRequestQueue] = NewVirtioChannel(VirtioScsiRequestQueue, 256)
+
+	return &VirtioScsiDevice{VirtioDevice: device}, nil
+}
+
+func NewVirtioMmioScsi(info *DeviceInfo) (Device, error) {
+	device, err := NewMmioVirtioDevice(info, VirtioTypeScsi)
+	if err != nil {
+		return nil, err
+	}
+
+	return setupScsi(device)
+}
+
+func NewVirtioPciScsi(info *DeviceInfo) (Device, error) {
+	device, err := NewPciVirtioDevice(info, PciClassStorage, VirtioTypeScsi, 16)
+	if err != nil {
+		return nil, err
+	}
+
+	return setupScsi(device)
+}
+
+func (scsi *VirtioScsiDevice) Attach(vm *kvm.VirtualMachine, model *Model) error {
+
+	// Setup our config space.
+	scsi.Config.GrowTo(VirtioScsiConfigLen)
+	scsi.Config.Set32(VirtioScsiNumQueuesOffset, 1)
+	scsi.Config.Set32(VirtioScsiSegMaxOffset, 1024)
+	scsi.Config.Set32(VirtioScsiMaxSectorsOffset, 0xffff)
+	scsi.Config.Set32(VirtioScsiCmdPerLunOffset, 128)
+	scsi.Config.Set32(VirtioScsiEventSizeOffset, VirtioScsiEventSize)
+	if scsi.Config.Get32(VirtioScsiSenseSizeOffset) == 0 {
+		scsi.Config.Set32(VirtioScsiSenseSizeOffset, VirtioScsiSenseSize)
+		scsi.Config.Set32(VirtioScsiCdbSizeOffset, VirtioScsiCdbSize)
+	}
+	scsi.Config.Set16(VirtioScsiMaxTargetOffset, VirtioScsiMaxTarget)
+	scsi.Config.Set32(VirtioScsiMaxLunOffset, VirtioScsiMaxLun)
+
+	// Open our disks.
+	for i, lun := range scsi.Luns {
+		err := lun.validate()
+		if err != nil {
+			return err
+		}
+		if scsi.lun(lun.Target, lun.Lun) != scsi.Luns[i] {
+			return VirtioScsiLunExistsErr
+		}
+		err = lun.open()
+		if err != nil {
+			return err
+		}
+	}
+
+	err := scsi.VirtioDevice.Attach(vm, model)
+	if err != nil {
+		return err
+	}
+
+	// Start our processes.
+	scsi.events = make(chan virtioScsiEvent, VirtioScsiEventQueue)
+	go scsi.processCtrl(scsi.Channels[VirtioScsiCtrlQueue])
+	go scsi.processEvents()
+	go scsi.processRequests(scsi.Channels[VirtioScsiRequestQueue])
+
+	return nil
+}
+
+func (scsi *VirtioScsiDevice) Save(vm *kvm.VirtualMachine) error {
+
+	// Make sure everything we've acknowledged is on disk.
+	scsi.luns_lock.Lock()
+	for _, lun := range scsi.Luns {
+		if lun.backend != nil {
+			err := lun.backend.Flush()
+			if err != nil {
+				scsi.luns_lock.Unlock()
+				return err
+			}
+		}
+	}
+	scsi.luns_lock.Unlock()
+
+	return scsi.VirtioDevice.Save(vm)
+}
+
+//
+// Add a LUN.
+//
+// The guest is told, and will scan it. This is
+// returned as added (with the open file).
+//
+func (scsi *VirtioScsiDevice) AddLun(config VirtioScsiLunInfo) (VirtioScsiLunInfo, error) {
+	err := config.validate()
+	if err != nil {
+		return VirtioScsiLunInfo{}, err
+	}
+
+	scsi.luns_lock.Lock()
+	if scsi.lun(config.Target, config.Lun) != nil {
+		scsi.luns_lock.Unlock()
+		return VirtioScsiLunInfo{}, VirtioScsiLunExistsErr
+	}
+	lun := &VirtioScsiLun{VirtioScsiLunInfo: config}
+	err = lun.open()
+	if err != nil {
+		scsi.luns_lock.Unlock()
+		return VirtioScsiLunInfo{}, err
+	}
+	scsi.Luns = append(scsi.Luns, lun)
+	scsi.luns_lock.Unlock()
+
+	scsi.Debug("lun %d:%d added", lun.Target, lun.Lun)
+	scsi.sendEvent(lun.Target, lun.Lun, VirtioScsiEvtResetRescan)
+
+	return lun.VirtioScsiLunInfo, nil
+}
+
+//
+// Remove a LUN.
+//
+// Commands already running are allowed to finish,
+// and anything after sees the LUN as gone.
+//
+func (scsi *VirtioScsiDevice) RemoveLun(target int, id int) error {
+	scsi.luns_lock.Lock()
+	var lun *VirtioScsiLun
+	for i, existing := range scsi.Luns {
+		if existing.Target == target && existing.Lun == id {
+			lun = existing
+			scsi.Luns = append(scsi.Luns[:i], scsi.Luns[i+1:]...)
+			break
+		}
+	}
+	scsi.luns_lock.Unlock()
+
+	if lun == nil {
+		return VirtioScsiNoLunErr
+	}
+
+	lun.lock.Lock()
+	lun.backend.Flush()
+	lun.backend.Close()
+	lun.lock.Unlock()
+
+	scsi.Debug("lun %d:%d removed", target, id)
+	scsi.sendEvent(target, id, VirtioScsiEvtResetRemoved)
+	return nil
+}
+
+//
+// All our LUNs.
+//
+func (scsi *VirtioScsiDevice) LunList() []VirtioScsiLunInfo {
+	scsi.luns_lock.Lock()
+	defer scsi.luns_lock.Unlock()
+	luns := make([]VirtioScsiLunInfo, 0, len(scsi.Luns))
+	for _, lun := range scsi.Luns {
+		luns = append(luns, lun.VirtioScsiLunInfo)
+	}
+	return luns
+}
@@ -0,0 +1,687 @@
+package machine
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	kvm "github.com/multiverse-os/portalgun/vm/kvm"
+)
+
+//
+// VirtioVsock Operations
+//
+const (
+	VirtioVsockOpInvalid       = 0
+	VirtioVsockOpRequest       = 1
+	VirtioVsockOpResponse      = 2
+	VirtioVsockOpRst           = 3
+	VirtioVsockOpShutdown      = 4
+	VirtioVsockOpRw            = 5
+	VirtioVsockOpCreditUpdate  = 6
+	VirtioVsockOpCreditRequest = 7
+)
+
+//
+// VirtioVsock Shutdown Flags
+//
+const (
+	VirtioVsockShutdownRcv  = 1 << 0
+	VirtioVsockShutdownSend = 1 << 1
+)
+
+//
+// VirtioVsock Constants
+//
+const (
+	VirtioVsockHostCid       = 2
+	VirtioVsockTypeStream    = 1
+	VirtioVsockHeaderSize    = 44
+	VirtioVsockEventReset    = 0
+	VirtioVsockMaxPayload    = 4096
+	VirtioVsockBufferSize    = 256 * 1024
+	VirtioVsockConnectTime   = 2 * time.Second
+	VirtioVsockFirstHostPort = 1 << 30
+)
+
+//
+// The rx packets we'll queue for the guest.
+//
+const VirtioVsockRxQueue = 256
+
+type vsockHeader struct {
+	src_cid   uint64
+	dst_cid   uint64
+	src_port  uint32
+	dst_port  uint32
+	length    uint32
+	typ       uint16
+	op        uint16
+	flags     uint32
+	buf_alloc uint32
+	fwd_cnt   uint32
+}
+
+type vsockPacket struct {
+	vsockHeader
+	data []byte
+}
+
+//
+// Connections are keyed by (host port, guest port).
+//
+type vsockKey struct {
+	host  uint32
+	guest uint32
+}
+
+//
+// A single stream, between a guest port
+// and a unix socket on the host.
+//
+type vsockConn struct {
+	key  vsockKey
+	conn *net.UnixConn
+
+	// Established? (Host-initiated connections
+	// wait for the guest to respond).
+	established bool
+
+	// What the guest has told us about its buffer,
+	// and how much we've sent it.
+	peer_alloc uint32
+	peer_fwd   uint32
+	tx_cnt     uint32
+
+	// Data from the guest, waiting for the socket.
+	pending       [][]byte
+	pending_bytes int
+
+	// How much we've passed on, and told the guest.
+	fwd_cnt  uint32
+	reported uint32
+
+	// The guest won't send anything more.
+	shutdown bool
+	closed   bool
+
+	lock sync.Mutex
+	cond *sync.Cond
+}
+
+//
+// VirtioVsockDevice --
+//
+// Host-guest sockets. Connections from the guest to
+// port N on the host are made to the unix socket at
+// <path>_N. Connections from the host are made to the
+// unix socket at <path>, by writing "CONNECT N\n" and
+// waiting for "OK <host port>\n" (as with firecracker).
+//
+// Streams don't survive a re-exec; the guest is told
+// to reset its transport when we come back.
+//
+type VirtioVsockDevice struct {
+	*VirtioDevice
+
+	// The guest's context id.
+	Cid uint64 `json:"cid"`
+
+	// The host-side unix socket path.
+	Path string `json:"path"`
+
+	listener *net.UnixListener
+
+	conns map[vsockKey]*vsockConn
+	next  uint32
+
+	rx chan vsockPacket
+
+	conns_lock sync.Mutex
+}
+
+func (header *vsockHeader) read(stream *VirtioStream) {
+	header.src_cid = stream.Read64()
+	header.dst_cid = stream.Read64()
+	header.src_port = stream.Read32()
+	header.dst_port = stream.Read32()
+	header.length = stream.Read32()
+	header.typ = stream.Read16()
+	header.op = stream.Read16()
+	header.flags = stream.Read32()
+	header.buf_alloc = stream.Read32()
+	header.fwd_cnt = stream.Read32()
+}
+
+func (header *vsockHeader) write(stream *VirtioStream) {
+	stream.Write64(header.src_cid)
+	stream.Write64(header.dst_cid)
+	stream.Write32(header.src_port)
+	stream.Write32(header.dst_port)
+	stream.Write32(header.length)
+	stream.Write16(header.typ)
+	stream.Write16(header.op)
+	stream.Write32(header.flags)
+	stream.Write32(header.buf_alloc)
+	stream.Write32(header.fwd_cnt)
+}
+
+func (vsock *VirtioVsockDevice) lookup(key vsockKey) *vsockConn {
+	vsock.conns_lock.Lock()
+	defer vsock.conns_lock.Unlock()
+	return vsock.conns[key]
+}
+
+func (vsock *VirtioVsockDevice) add(conn *vsockConn) {
+	vsock.conns_lock.Lock()
+	defer vsock.conns_lock.Unlock()
+	vsock.conns[conn.key] = conn
+}
+
+//
+// Drop a connection (and close the socket).
+//
+func (vsock *VirtioVsockDevice) remove(conn *vsockConn) {
+	vsock.conns_lock.Lock()
+	if vsock.conns[conn.key] == conn {
+		delete(vsock.conns, conn.key)
+	}
+	vsock.conns_lock.Unlock()
+
+	conn.lock.Lock()
+	conn.closed = true
+	conn.cond.Broadcast()
+	conn.lock.Unlock()
+	conn.conn.Close()
+}
+
+//
+// Queue a packet for the guest.
+//
+// The credit fields are filled in here for
+// established connections (every packet carries
+// them, so the guest is always up to date).
+//
+func (vsock *VirtioVsockDevice) send(key vsockKey, op uint16, flags uint32, data []byte) {
+	packet := vsockPacket{
+		vsockHeader: vsockHeader{
+			src_cid:  VirtioVsockHostCid,
+			dst_cid:  vsock.Cid,
+			src_port: key.host,
+			dst_port: key.guest,
+			length:   uint32(len(data)),
+			typ:      VirtioVsockTypeStream,
+			op:       op,
+			flags:    flags,
+		},
+		data: data,
+	}
+
+	if conn := vsock.lookup(key); conn != nil {
+		conn.lock.Lock()
+		packet.buf_alloc = VirtioVsockBufferSize
+		packet.fwd_cnt = conn.fwd_cnt
+		conn.reported = conn.fwd_cnt
+		conn.lock.Unlock()
+	}
+
+	vsock.rx <- packet
+}
+
+func (vsock *VirtioVsockDevice) reset(key vsockKey) {
+	vsock.send(key, VirtioVsockOpRst, 0, nil)
+}
+
+//
+// Fill guest receive buffers.
+//
+func (vsock *VirtioVsockDevice) receive() {
+	for packet := range vsock.rx {
+		buf := <-vsock.Channels[0].incoming
+
+		stream := NewVirtioStream(buf, 0)
+		packet.write(stream)
+		stream.WriteBytes(packet.data)
+		buf.SetLength(VirtioVsockHeaderSize + len(packet.data))
+
+		vsock.Channels[0].outgoing <- buf
+	}
+}
+
+//
+// Process guest transmit buffers.
+//
+func (vsock *VirtioVsockDevice) transmit() {
+	for buf := range vsock.Channels[1].incoming {
+		var packet vsockPacket
+		stream := NewVirtioStream(buf, 0)
+		if stream.ReadLeft() >= VirtioVsockHeaderSize {
+			packet.read(stream)
+			if int(packet.length) <= stream.ReadLeft() {
+				packet.data = stream.ReadBytes(int(packet.length))
+			} else {
+				packet.op = VirtioVsockOpInvalid
+			}
+		}
+
+		// We've got everything out of it.
+		buf.SetLength(0)
+		vsock.Channels[1].outgoing <- buf
+
+		vsock.handle(&packet)
+	}
+}
+
+func (vsock *VirtioVsockDevice) handle(packet *vsockPacket) {
+	key := vsockKey{host: packet.dst_port, guest: packet.src_port}
+
+	if packet.src_cid != vsock.Cid ||
+		packet.dst_cid != VirtioVsockHostCid ||
+		packet.typ != VirtioVsockTypeStream {
+		vsock.Debug("bad packet %d:%d -> %d:%d",
+			packet.src_cid, packet.src_port,
+			packet.dst_cid, packet.dst_port)
+		if packet.op != VirtioVsockOpRst {
+			vsock.reset(key)
+		}
+		return
+	}
+
+	conn := vsock.lookup(key)
+	established := false
+	if conn != nil {
+		// Always update our view of the guest's buffer.
+		conn.lock.Lock()
+		conn.peer_alloc = packet.buf_alloc
+		conn.peer_fwd = packet.fwd_cnt
+		established = conn.established
+		conn.cond.Broadcast()
+		conn.lock.Unlock()
+	}
+
+	switch packet.op {
+	case VirtioVsockOpRequest:
+		if conn != nil {
+			vsock.reset(key)
+			return
+		}
+		vsock.connect(key, packet)
+
+	case VirtioVsockOpResponse:
+		if conn == nil || established {
+			vsock.reset(key)
+			return
+		}
+		vsock.established(conn)
+
+	case VirtioVsockOpRw:
+		if conn == nil {
+			vsock.reset(key)
+			return
+		}
+		conn.lock.Lock()
+		if !conn.shutdown && len(packet.data) > 0 {
+			conn.pending = append(conn.pending, packet.data)
+			conn.pending_bytes += len(packet.data)
+			conn.cond.Broadcast()
+		}
+		conn.lock.Unlock()
+
+	case VirtioVsockOpCreditUpdate:
+		// Handled above.
+		if conn == nil {
+			vsock.reset(key)
+		}
+
+	case VirtioVsockOpCreditRequest:
+		if conn == nil {
+			vsock.reset(key)
+			return
+		}
+		vsock.send(key, VirtioVsockOpCreditUpdate, 0, nil)
+
+	case VirtioVsockOpShutdown:
+		if conn == nil {
+			vsock.reset(key)
+			return
+		}
+		if packet.flags&VirtioVsockShutdownRcv != 0 &&
+			packet.flags&VirtioVsockShutdownSend != 0 {
+			// All done.
+			vsock.remove(conn)
+			vsock.reset(key)
+			return
+		}
+		if packet.flags&VirtioVsockShutdownSend != 0 {
+			// Let the writer finish up.
+			conn.lock.Lock()
+			conn.shutdown = true
+			conn.cond.Broadcast()
+			conn.lock.Unlock()
+		}
+
+	case VirtioVsockOpRst:
+		if conn != nil {
+			vsock.remove(conn)
+		}
+
+	default:
+		vsock.reset(key)
+	}
+}
+
+func newVsockConn(key vsockKey, conn *net.UnixConn) *vsockConn {
+	vconn := &vsockConn{key: key, conn: conn}
+	vconn.cond = sync.NewCond(&vconn.lock)
+	return vconn
+}
+
+//
+// The guest is connecting to a host port.
+//
+func (vsock *VirtioVsockDevice) connect(key vsockKey, packet *vsockPacket) {
+	path := fmt.Sprintf("%s_%d", vsock.Path, key.host)
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		vsock.Debug("connect %s: %s", path, err.Error())
+		vsock.reset(key)
+		return
+	}
+
+	vconn := newVsockConn(key, conn)
+	vconn.peer_alloc = packet.buf_alloc
+	vconn.peer_fwd = packet.fwd_cnt
+	vsock.add(vconn)
+
+	vsock.Debug("guest port %d -> %s", key.guest, path)
+	vsock.send(key, VirtioVsockOpResponse, 0, nil)
+	vsock.start(vconn)
+}
+
+//
+// The guest has accepted a connection from the host.
+//
+func (vsock *VirtioVsockDevice) established(conn *vsockConn) {
+	_, err := conn.conn.Write([]byte(fmt.Sprintf("OK %d\n", conn.key.host)))
+	if err != nil {
+		vsock.remove(conn)
+		vsock.reset(conn.key)
+		return
+	}
+	vsock.start(conn)
+}
+
+func (vsock *VirtioVsockDevice) start(conn *vsockConn) {
+	conn.lock.Lock()
+	conn.established = true
+	conn.lock.Unlock()
+
+	go vsock.reader(conn)
+	go vsock.writer(conn)
+}
+
+//
+// How much more the guest can take.
+// The conn lock must be held.
+//
+func (conn *vsockConn) credit() uint32 {
+	inflight := conn.tx_cnt - conn.peer_fwd
+	if inflight >= conn.peer_alloc {
+		return 0
+	}
+	return conn.peer_alloc - inflight
+}
+
+//
+// Socket -> guest, within the guest's credit.
+//
+func (vsock *VirtioVsockDevice) reader(conn *vsockConn) {
+	for {
+		conn.lock.Lock()
+		credit := conn.credit()
+		for credit == 0 && !conn.closed {
+			conn.cond.Wait()
+			credit = conn.credit()
+		}
+		closed := conn.closed
+		conn.lock.Unlock()
+		if closed {
+			return
+		}
+
+		if credit > VirtioVsockMaxPayload {
+			credit = VirtioVsockMaxPayload
+		}
+		data := make([]byte, credit)
+		n, err := conn.conn.Read(data)
+		if n > 0 {
+			conn.lock.Lock()
+			conn.tx_cnt += uint32(n)
+			conn.lock.Unlock()
+			vsock.send(conn.key, VirtioVsockOpRw, 0, data[:n])
+		}
+		if err != nil {
+			// The host is done. The guest
+			// will reset once it's read everything.
+			conn.lock.Lock()
+			closed := conn.closed
+			conn.lock.Unlock()
+			if !closed {
+				vsock.send(
+					conn.key,
+					VirtioVsockOpShutdown,
+					VirtioVsockShutdownRcv|VirtioVsockShutdownSend,
+					nil)
+			}
+			return
+		}
+	}
+}
+
+//
+// Guest -> socket.
+//
+func (vsock *VirtioVsockDevice) writer(conn *vsockConn) {
+	for {
+		conn.lock.Lock()
+		for len(conn.pending) == 0 && !conn.shutdown && !conn.closed {
+			conn.cond.Wait()
+		}
+		if conn.closed || len(conn.pending) == 0 {
+			shutdown := conn.shutdown && !conn.closed
+			conn.lock.Unlock()
+			if shutdown {
+				conn.conn.CloseWrite()
+			}
+			return
+		}
+		data := conn.pending[0]
+		conn.pending = conn.pending[1:]
+		conn.lock.Unlock()
+
+		_, err := conn.conn.Write(data)
+		if err != nil {
+			vsock.remove(conn)
+			vsock.reset(conn.key)
+			return
+		}
+
+		// Let the guest know there's more room, once
+		// there's a reasonable amount (or we're idle).
+		conn.lock.Lock()
+		conn.pending_bytes -= len(data)
+		conn.fwd_cnt += uint32(len(data))
+		update := conn.fwd_cnt-conn.reported >= VirtioVsockBufferSize/4 ||
+			(conn.pending_bytes == 0 && conn.fwd_cnt != conn.reported)
+		conn.lock.Unlock()
+		if update {
+			vsock.send(conn.key, VirtioVsockOpCreditUpdate, 0, nil)
+		}
+	}
+}
+
+//
+// Accept connections from the host.
+//
+func (vsock *VirtioVsockDevice) accept() {
+	for {
+		conn, err := vsock.listener.AcceptUnix()
+		if err != nil {
+			return
+		}
+		go vsock.hostConnect(conn)
+	}
+}
+
+func (vsock *VirtioVsockDevice) hostConnect(conn *net.UnixConn) {
+	// Read the "CONNECT <port>" line.
+	// We read a byte at a time, so that we
+	// don't swallow any data that follows.
+	conn.SetReadDeadline(time.Now().Add(VirtioVsockConnectTime))
+	line, err := bufio.NewReaderSize(&byteReader{conn}, 16).ReadString('\n')
+	conn.SetReadDeadline(time.Time{})
+	fields := strings.Fields(line)
+	if err != nil || len(fields) != 2 || fields[0] != "CONNECT" {
+		vsock.Debug("bad connect: %q", line)
+		conn.Close()
+		return
+	}
+	port, err := strconv.ParseUint(fields[1], 10, 32)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	vsock.conns_lock.Lock()
+	key := vsockKey{guest: uint32(port)}
+	for {
+		key.host = vsock.next
+		vsock.next += 1
+		if vsock.next < VirtioVsockFirstHostPort {
+			vsock.next = VirtioVsockFirstHostPort
+		}
+		if _, ok := vsock.conns[key]; !ok {
+			break
+		}
+	}
+	vconn := newVsockConn(key, conn)
+	vsock.conns[key] = vconn
+	vsock.conns_lock.Unlock()
+
+	vsock.Debug("host port %d -> guest port %d", key.host, key.guest)
+	vsock.send(key, VirtioVsockOpRequest, 0, nil)
+
+	// Give up if the guest doesn't answer.
+	time.AfterFunc(VirtioVsockConnectTime, func() {
+		vconn.lock.Lock()
+		established := vconn.established || vconn.closed
+		vconn.lock.Unlock()
+		if !established {
+			vsock.remove(vconn)
+			vsock.reset(key)
+		}
+	})
+}
+
+//
+// A reader that reads one byte at a time.
+//
+type byteReader struct {
+	conn *net.UnixConn
+}
+
+func (reader *byteReader) Read(p []byte) (int, error) {
+	if len(p) > 1 {
+		p = p[:1]
+	}
+	return reader.conn.Read(p)
+}
+
+//
+// Tell the guest to drop all its connections.
+//
+func (vsock *VirtioVsockDevice) resetTransport() {
+	buf := <-vsock.Channels[2].incoming
+	stream := NewVirtioStream(buf, 0)
+	stream.Write32(VirtioVsockEventReset)
+	buf.SetLength(4)
+	vsock.Channels[2].outgoing <- buf
+}
+
+func setupVsock(device *VirtioDevice) (Device, error) {
+	device.Channels[0] = NewVirtioChannel(0, 128)
+	device.Channels[1] = NewVirtioChannel(1, 128)
+	device.Channels[2] = NewVirtioChannel(2, 16)
+
+	return &VirtioVsockDevice{
+		VirtioDevice: device,
+		Cid:          3,
+	}, nil
+}
+
+func NewVirtioMmioVsock(info *DeviceInfo) (Device, error) {
+	device, err := NewMmioVirtioDevice(info, VirtioTypeVsock)
+	if err != nil {
+		return nil, err
+	}
+
+	return setupVsock(device)
+}
+
+func NewVirtioPciVsock(info *DeviceInfo) (Device, error) {
+	device, err := NewPciVirtioDevice(info, PciClassCommunications, VirtioTypeVsock, 16)
+	if err != nil {
+		return nil, err
+	}
+
+	return setupVsock(device)
+}
+
+func (vsock *VirtioVsockDevice) Attach(vm *kvm.VirtualMachine, model *Model) error {
+	if vsock.Cid <= VirtioVsockHostCid || vsock.Cid > 0xffffffff {
+		return VirtioVsockInvalidCidErr
+	}
+	if vsock.Path == "" {
+		return VirtioVsockNoPathErr
+	}
+
+	vsock.Config.GrowTo(8)
+	vsock.Config.Set64(0, vsock.Cid)
+
+	vsock.conns = make(map[vsockKey]*vsockConn)
+	vsock.next = VirtioVsockFirstHostPort
+	vsock.rx = make(chan vsockPacket, VirtioVsockRxQueue)
+
+	// Listen for the host side.
+	os.Remove(vsock.Path)
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: vsock.Path, Net: "unix"})
+	if err != nil {
+		return err
+	}
+	vsock.listener = listener
+
+	// Are we being restored under a running driver?
+	restored := vsock.DeviceStatus.Value&VirtioStatusDriverOk != 0
+
+	err = vsock.VirtioDevice.Attach(vm, model)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+
+	go vsock.receive()
+	go vsock.transmit()
+	go vsock.accept()
+
+	// Anything the guest had open is gone.
+	if restored {
+		go vsock.resetTransport()
+	}
+
+	return nil
+}
@@ -0,0 +1,10 @@
+package pcap
+
+import (
+	"errors"
+)
+
+// Global errors.
+var (
+	InvalidFilter = errors.New("invalid capture filter")
+)
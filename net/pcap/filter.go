@@ -0,0 +1,337 @@
+package pcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"strings"
+)
+
+//
+// Filter --
+//
+// A small subset of the tcpdump filter language,
+// evaluated directly against Ethernet frames.
+//
+// Primitives are: ether [src|dst] host MAC, [src|dst] host
+// IP, [src|dst] port N, arp, ip, ip6, tcp, udp, icmp, vlan,
+// broadcast and multicast. These can be combined with
+// and (&&), or (||), not (!) and parentheses.
+//
+type Filter func(frame []byte) bool
+
+//
+// Everything matches the empty filter.
+//
+func Compile(expression string) (Filter, error) {
+	parser := &parser{tokens: tokenize(expression)}
+	if len(parser.tokens) == 0 {
+		return func([]byte) bool { return true }, nil
+	}
+
+	filter, err := parser.or()
+	if err != nil {
+		return nil, err
+	}
+	if parser.position != len(parser.tokens) {
+		return nil, InvalidFilter
+	}
+	return filter, nil
+}
+
+func tokenize(expression string) []string {
+	expression = strings.NewReplacer(
+		"(", " ( ",
+		")", " ) ",
+		"&&", " and ",
+		"||", " or ",
+		"!", " not ").Replace(expression)
+	return strings.Fields(expression)
+}
+
+type parser struct {
+	tokens   []string
+	position int
+}
+
+func (parser *parser) peek() string {
+	if parser.position < len(parser.tokens) {
+		return parser.tokens[parser.position]
+	}
+	return ""
+}
+
+func (parser *parser) next() string {
+	token := parser.peek()
+	if token != "" {
+		parser.position += 1
+	}
+	return token
+}
+
+func (parser *parser) or() (Filter, error) {
+	left, err := parser.and()
+	if err != nil {
+		return nil, err
+	}
+	for parser.peek() == "or" {
+		parser.next()
+		right, err := parser.and()
+		if err != nil {
+			return nil, err
+		}
+		a, b := left, right
+		left = func(frame []byte) bool { return a(frame) || b(frame) }
+	}
+	return left, nil
+}
+
+func (parser *parser) and() (Filter, error) {
+	left, err := parser.not()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		// As in tcpdump, "udp port 53" is an implicit and.
+		switch parser.peek() {
+		case "and":
+			parser.next()
+		case "or", ")", "":
+			return left, nil
+		}
+		right, err := parser.not()
+		if err != nil {
+			return nil, err
+		}
+		a, b := left, right
+		left = func(frame []byte) bool { return a(frame) && b(frame) }
+	}
+}
+
+func (parser *parser) not() (Filter, error) {
+	switch parser.peek() {
+	case "not":
+		parser.next()
+		inner, err := parser.not()
+		if err != nil {
+			return nil, err
+		}
+		return func(frame []byte) bool { return !inner(frame) }, nil
+
+	case "(":
+		parser.next()
+		inner, err := parser.or()
+		if err != nil {
+			return nil, err
+		}
+		if parser.next() != ")" {
+			return nil, InvalidFilter
+		}
+		return inner, nil
+	}
+	return parser.primitive()
+}
+
+//
+// Which end of a packet to match.
+//
+const (
+	either = iota
+	source
+	destination
+)
+
+func (parser *parser) direction() int {
+	switch parser.peek() {
+	case "src":
+		parser.next()
+		return source
+	case "dst":
+		parser.next()
+		return destination
+	}
+	return either
+}
+
+func (parser *parser) primitive() (Filter, error) {
+	switch parser.peek() {
+	case "arp":
+		parser.next()
+		return etherType(0x0806), nil
+	case "ip":
+		parser.next()
+		return etherType(0x0800), nil
+	case "ip6":
+		parser.next()
+		return etherType(0x86dd), nil
+	case "tcp":
+		parser.next()
+		return protocol(6), nil
+	case "udp":
+		parser.next()
+		return protocol(17), nil
+	case "icmp":
+		parser.next()
+		return protocol(1), nil
+	case "vlan":
+		parser.next()
+		return func(frame []byte) bool {
+			return len(frame) >= 14 && binary.BigEndian.Uint16(frame[12:14]) == 0x8100
+		}, nil
+	case "broadcast":
+		parser.next()
+		return func(frame []byte) bool {
+			return len(frame) >= 6 && bytes.Equal(frame[0:6], net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+		}, nil
+	case "multicast":
+		parser.next()
+		return func(frame []byte) bool {
+			return len(frame) >= 6 && frame[0]&1 != 0
+		}, nil
+	case "ether":
+		parser.next()
+		direction := parser.direction()
+		if parser.peek() == "host" {
+			parser.next()
+		}
+		mac, err := net.ParseMAC(parser.next())
+		if err != nil {
+			return nil, InvalidFilter
+		}
+		return etherHost(direction, mac), nil
+	}
+
+	direction := parser.direction()
+	switch parser.next() {
+	case "host":
+		ip := net.ParseIP(parser.next())
+		if ip == nil {
+			return nil, InvalidFilter
+		}
+		return host(direction, ip), nil
+	case "port":
+		port, err := strconv.ParseUint(parser.next(), 10, 16)
+		if err != nil {
+			return nil, InvalidFilter
+		}
+		return portFilter(direction, uint16(port)), nil
+	}
+	return nil, InvalidFilter
+}
+
+//
+// The ethertype and payload, skipping any VLAN tag.
+//
+func payload(frame []byte) (uint16, []byte) {
+	if len(frame) < 14 {
+		return 0, nil
+	}
+	kind := binary.BigEndian.Uint16(frame[12:14])
+	frame = frame[14:]
+	if kind == 0x8100 && len(frame) >= 4 {
+		kind = binary.BigEndian.Uint16(frame[2:4])
+		frame = frame[4:]
+	}
+	return kind, frame
+}
+
+//
+// The addresses, protocol and transport header.
+//
+func network(frame []byte) (net.IP, net.IP, byte, []byte) {
+	kind, data := payload(frame)
+	switch kind {
+	case 0x0800:
+		if len(data) < 20 {
+			break
+		}
+		ihl := int(data[0]&0xf) * 4
+		if ihl < 20 || ihl > len(data) {
+			break
+		}
+		var transport []byte
+		if binary.BigEndian.Uint16(data[6:8])&0x1fff == 0 {
+			// Only the first fragment has ports.
+			transport = data[ihl:]
+		}
+		return net.IP(data[12:16]), net.IP(data[16:20]), data[9], transport
+	case 0x86dd:
+		if len(data) < 40 {
+			break
+		}
+		return net.IP(data[8:24]), net.IP(data[24:40]), data[6], data[40:]
+	}
+	return nil, nil, 0, nil
+}
+
+func etherType(kind uint16) Filter {
+	return func(frame []byte) bool {
+		actual, _ := payload(frame)
+		return actual == kind
+	}
+}
+
+func protocol(proto byte) Filter {
+	return func(frame []byte) bool {
+		src, _, actual, _ := network(frame)
+		if src == nil {
+			return false
+		}
+		if proto == 1 && actual == 58 {
+			// ICMPv6 counts.
+			return true
+		}
+		return actual == proto
+	}
+}
+
+func match(direction int, src bool, dst bool) bool {
+	switch direction {
+	case source:
+		return src
+	case destination:
+		return dst
+	}
+	return src || dst
+}
+
+func etherHost(direction int, mac net.HardwareAddr) Filter {
+	return func(frame []byte) bool {
+		if len(frame) < 14 {
+			return false
+		}
+		return match(
+			direction,
+			bytes.Equal(frame[6:12], mac),
+			bytes.Equal(frame[0:6], mac))
+	}
+}
+
+func host(direction int, ip net.IP) Filter {
+	return func(frame []byte) bool {
+		src, dst, _, _ := network(frame)
+		if src == nil {
+			// Look inside ARP, too.
+			kind, data := payload(frame)
+			if kind != 0x0806 || len(data) < 28 {
+				return false
+			}
+			src, dst = net.IP(data[14:18]), net.IP(data[24:28])
+		}
+		return match(direction, src.Equal(ip), dst.Equal(ip))
+	}
+}
+
+func portFilter(direction int, port uint16) Filter {
+	return func(frame []byte) bool {
+		src, _, proto, transport := network(frame)
+		if src == nil || (proto != 6 && proto != 17) || len(transport) < 4 {
+			return false
+		}
+		return match(
+			direction,
+			binary.BigEndian.Uint16(transport[0:2]) == port,
+			binary.BigEndian.Uint16(transport[2:4]) == port)
+	}
+}
@@ -0,0 +1,141 @@
+package pcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+//
+// Build an Ethernet/IPv4 frame.
+//
+func frame(proto byte, src, dst [4]byte, sport, dport uint16) []byte {
+	data := make([]byte, 14+20+8)
+	copy(data[0:6], []byte{0x52, 0x54, 0, 0, 0, 2})
+	copy(data[6:12], []byte{0x52, 0x54, 0, 0, 0, 1})
+	binary.BigEndian.PutUint16(data[12:14], 0x0800)
+	ip := data[14:]
+	ip[0] = 0x45
+	ip[9] = proto
+	copy(ip[12:16], src[:])
+	copy(ip[16:20], dst[:])
+	binary.BigEndian.PutUint16(ip[20:22], sport)
+	binary.BigEndian.PutUint16(ip[22:24], dport)
+	return data
+}
+
+func TestWriter(t *testing.T) {
+	var output bytes.Buffer
+	writer, err := NewWriter(&output, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet := frame(6, [4]byte{10, 0, 2, 15}, [4]byte{10, 0, 2, 2}, 1234, 80)
+	timestamp := time.Unix(1, 500)
+	err = writer.WritePacket(timestamp, packet, len(packet), DirectionOutbound)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Walk the blocks.
+	data := output.Bytes()
+	var kinds []uint32
+	for len(data) > 0 {
+		if len(data) < 12 {
+			t.Fatalf("short block (%d)", len(data))
+		}
+		kind := binary.LittleEndian.Uint32(data[0:4])
+		length := binary.LittleEndian.Uint32(data[4:8])
+		if length%4 != 0 || int(length) > len(data) {
+			t.Fatalf("bad block length %d", length)
+		}
+		if binary.LittleEndian.Uint32(data[length-4:length]) != length {
+			t.Fatalf("trailing length mismatch")
+		}
+		kinds = append(kinds, kind)
+
+		if kind == blockPacket {
+			body := data[8 : length-4]
+			ns := uint64(binary.LittleEndian.Uint32(body[4:8]))<<32 |
+				uint64(binary.LittleEndian.Uint32(body[8:12]))
+			if ns != uint64(timestamp.UnixNano()) {
+				t.Fatalf("wrong timestamp %d", ns)
+			}
+			if binary.LittleEndian.Uint32(body[12:16]) != 16 {
+				t.Fatalf("not truncated")
+			}
+			if binary.LittleEndian.Uint32(body[16:20]) != uint32(len(packet)) {
+				t.Fatalf("wrong original length")
+			}
+			if !bytes.Equal(body[20:36], packet[:16]) {
+				t.Fatalf("wrong data")
+			}
+			options := body[36:]
+			if binary.LittleEndian.Uint16(options[0:2]) != optionFlags ||
+				binary.LittleEndian.Uint32(options[4:8]) != DirectionOutbound {
+				t.Fatalf("wrong flags")
+			}
+		}
+		data = data[length:]
+	}
+
+	expected := []uint32{blockSection, blockInterface, blockPacket}
+	if len(kinds) != len(expected) {
+		t.Fatalf("expected %d blocks, got %d", len(expected), len(kinds))
+	}
+	for i := range kinds {
+		if kinds[i] != expected[i] {
+			t.Fatalf("block %d is %x", i, kinds[i])
+		}
+	}
+}
+
+func TestFilter(t *testing.T) {
+	tcp := frame(6, [4]byte{10, 0, 2, 15}, [4]byte{1, 1, 1, 1}, 40000, 443)
+	udp := frame(17, [4]byte{10, 0, 2, 15}, [4]byte{10, 0, 2, 3}, 5353, 53)
+	arp := make([]byte, 14+28)
+	binary.BigEndian.PutUint16(arp[12:14], 0x0806)
+	copy(arp[14+14:14+18], []byte{10, 0, 2, 15})
+	copy(arp[14+24:14+28], []byte{10, 0, 2, 2})
+	for i := 0; i < 6; i += 1 {
+		arp[i] = 0xff
+	}
+
+	tests := []struct {
+		expression string
+		tcp        bool
+		udp        bool
+		arp        bool
+	}{
+		{"", true, true, true},
+		{"tcp", true, false, false},
+		{"udp port 53", false, true, false},
+		{"dst port 53", false, true, false},
+		{"src port 53", false, false, false},
+		{"arp or tcp", true, false, true},
+		{"not arp", true, true, false},
+		{"ip and !(port 443)", false, true, false},
+		{"host 10.0.2.2", false, false, true},
+		{"src host 10.0.2.15 && (tcp || udp)", true, true, false},
+		{"broadcast", false, false, true},
+		{"ether src 52:54:00:00:00:01", true, true, false},
+	}
+
+	for _, test := range tests {
+		filter, err := Compile(test.expression)
+		if err != nil {
+			t.Fatalf("%q: %s", test.expression, err)
+		}
+		if filter(tcp) != test.tcp || filter(udp) != test.udp || filter(arp) != test.arp {
+			t.Errorf("%q: got %v %v %v", test.expression, filter(tcp), filter(udp), filter(arp))
+		}
+	}
+
+	for _, bad := range []string{"port", "host nope", "(tcp", "tcp )", "frob"} {
+		_, err := Compile(bad)
+		if err != InvalidFilter {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+}
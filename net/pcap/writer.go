@@ -0,0 +1,146 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+//
+// pcapng --
+//
+// We write a single section, with a single Ethernet
+// interface, and one enhanced packet block per frame.
+// Everything is little-endian (readers use the byte
+// order magic to figure that out).
+//
+
+const (
+	blockSection   = 0x0a0d0d0a
+	blockInterface = 0x00000001
+	blockPacket    = 0x00000006
+
+	byteOrderMagic = 0x1a2b3c4d
+
+	optionEnd     = 0
+	optionTsresol = 9
+	optionFlags   = 2
+
+	LinkTypeEthernet = 1
+)
+
+//
+// Packet directions (as in epb_flags).
+//
+const (
+	DirectionUnknown  = 0
+	DirectionInbound  = 1
+	DirectionOutbound = 2
+)
+
+type Writer struct {
+	output  io.Writer
+	snaplen int
+}
+
+func pad(n int) int {
+	return (4 - n%4) % 4
+}
+
+//
+// Write a block (type, length, body, length).
+// The body must be padded already.
+//
+func (writer *Writer) block(kind uint32, body []byte) error {
+	length := uint32(12 + len(body))
+	data := make([]byte, length)
+	binary.LittleEndian.PutUint32(data[0:4], kind)
+	binary.LittleEndian.PutUint32(data[4:8], length)
+	copy(data[8:], body)
+	binary.LittleEndian.PutUint32(data[length-4:], length)
+	_, err := writer.output.Write(data)
+	return err
+}
+
+func option(body []byte, code uint16, value []byte) []byte {
+	header := make([]byte, 4)
+	binary.LittleEndian.PutUint16(header[0:2], code)
+	binary.LittleEndian.PutUint16(header[2:4], uint16(len(value)))
+	body = append(body, header...)
+	body = append(body, value...)
+	return append(body, make([]byte, pad(len(value)))...)
+}
+
+//
+// Start a capture.
+// Frames are truncated to snaplen (if non-zero).
+//
+func NewWriter(output io.Writer, snaplen int) (*Writer, error) {
+	writer := &Writer{output: output, snaplen: snaplen}
+
+	section := make([]byte, 16)
+	binary.LittleEndian.PutUint32(section[0:4], byteOrderMagic)
+	binary.LittleEndian.PutUint16(section[4:6], 1)
+	binary.LittleEndian.PutUint16(section[6:8], 0)
+	binary.LittleEndian.PutUint64(section[8:16], ^uint64(0))
+	err := writer.block(blockSection, section)
+	if err != nil {
+		return nil, err
+	}
+
+	// Nanosecond timestamps.
+	iface := make([]byte, 8)
+	binary.LittleEndian.PutUint16(iface[0:2], LinkTypeEthernet)
+	binary.LittleEndian.PutUint32(iface[4:8], uint32(snaplen))
+	iface = option(iface, optionTsresol, []byte{9})
+	iface = option(iface, optionEnd, nil)
+	err = writer.block(blockInterface, iface)
+	if err != nil {
+		return nil, err
+	}
+
+	return writer, nil
+}
+
+//
+// Truncate a frame to our snaplen.
+//
+func (writer *Writer) Truncate(data []byte) []byte {
+	if writer.snaplen > 0 && len(data) > writer.snaplen {
+		return data[:writer.snaplen]
+	}
+	return data
+}
+
+//
+// Write a frame.
+// The data may already be truncated, so we are
+// given the original length separately.
+//
+func (writer *Writer) WritePacket(
+	timestamp time.Time,
+	data []byte,
+	length int,
+	direction int) error {
+
+	data = writer.Truncate(data)
+	ns := uint64(timestamp.UnixNano())
+
+	body := make([]byte, 20, 20+len(data)+pad(len(data))+16)
+	binary.LittleEndian.PutUint32(body[0:4], 0)
+	binary.LittleEndian.PutUint32(body[4:8], uint32(ns>>32))
+	binary.LittleEndian.PutUint32(body[8:12], uint32(ns))
+	binary.LittleEndian.PutUint32(body[12:16], uint32(len(data)))
+	binary.LittleEndian.PutUint32(body[16:20], uint32(length))
+	body = append(body, data...)
+	body = append(body, make([]byte, pad(len(data)))...)
+
+	if direction != DirectionUnknown {
+		flags := make([]byte, 4)
+		binary.LittleEndian.PutUint32(flags, uint32(direction))
+		body = option(body, optionFlags, flags)
+		body = option(body, optionEnd, nil)
+	}
+
+	return writer.block(blockPacket, body)
+}
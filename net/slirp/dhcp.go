@@ -0,0 +1,191 @@
+package slirp
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+//
+// A minimal DHCP server.
+// Each guest mac gets an address (starting from the
+// configured guest address), and we hand out ourselves
+// as the router and DNS server.
+//
+
+const (
+	DhcpServerPort = 67
+	DhcpClientPort = 68
+
+	dhcpBootRequest = 1
+	dhcpBootReply   = 2
+	dhcpMagic       = 0x63825363
+	dhcpHeader      = 240
+
+	dhcpDiscover = 1
+	dhcpOffer    = 2
+	dhcpRequest  = 3
+	dhcpAck      = 5
+	dhcpNak      = 6
+	dhcpRelease  = 7
+
+	optionPad       = 0
+	optionMask      = 1
+	optionRouter    = 3
+	optionDns       = 6
+	optionBroadcast = 28
+	optionRequested = 50
+	optionLease     = 51
+	optionType      = 53
+	optionServer    = 54
+	optionEnd       = 255
+
+	dhcpLeaseTime = 86400
+)
+
+func dhcpOptions(data []byte) map[byte][]byte {
+	options := make(map[byte][]byte)
+	for len(data) > 0 {
+		code := data[0]
+		if code == optionEnd {
+			break
+		}
+		if code == optionPad {
+			data = data[1:]
+			continue
+		}
+		if len(data) < 2 || int(data[1])+2 > len(data) {
+			break
+		}
+		options[code] = data[2 : 2+data[1]]
+		data = data[2+data[1]:]
+	}
+	return options
+}
+
+//
+// Pick an address for the given mac.
+// The stack lock must be held.
+//
+func (stack *Stack) lease(mac net.HardwareAddr) net.IP {
+	if ip, ok := stack.leases[mac.String()]; ok {
+		return ip
+	}
+
+	next := stack.config.Guest.To4()
+	for {
+		taken := false
+		for _, ip := range stack.leases {
+			if ip.Equal(next) {
+				taken = true
+				break
+			}
+		}
+		if !taken {
+			break
+		}
+		candidate := make(net.IP, 4)
+		binary.BigEndian.PutUint32(candidate, binary.BigEndian.Uint32(next)+1)
+		if !stack.config.Network.Contains(candidate) {
+			return nil
+		}
+		next = candidate
+	}
+
+	stack.leases[mac.String()] = next
+	return next
+}
+
+func (stack *Stack) dhcp(source net.HardwareAddr, segment *udp) {
+	data := segment.payload
+	if len(data) < dhcpHeader ||
+		data[0] != dhcpBootRequest ||
+		binary.BigEndian.Uint32(data[236:240]) != dhcpMagic {
+		return
+	}
+
+	chaddr := net.HardwareAddr(data[28:34])
+	options := dhcpOptions(data[dhcpHeader:])
+	kind, ok := options[optionType]
+	if !ok || len(kind) != 1 {
+		return
+	}
+
+	var reply byte
+	ip := stack.lease(chaddr)
+	switch kind[0] {
+	case dhcpDiscover:
+		reply = dhcpOffer
+	case dhcpRequest:
+		reply = dhcpAck
+		requested := net.IP(options[optionRequested])
+		if requested == nil && !net.IP(data[12:16]).IsUnspecified() {
+			// Renewing (ciaddr is set).
+			requested = net.IP(data[12:16])
+		}
+		if requested != nil && !requested.Equal(ip) {
+			reply = dhcpNak
+		}
+	case dhcpRelease:
+		delete(stack.leases, chaddr.String())
+		return
+	default:
+		return
+	}
+	if ip == nil {
+		stack.debug("dhcp: out of addresses")
+		return
+	}
+	stack.debug("dhcp: %s -> %s (%d)", chaddr, ip, reply)
+
+	response := make([]byte, dhcpHeader, 512)
+	response[0] = dhcpBootReply
+	response[1] = data[1]
+	response[2] = data[2]
+	copy(response[4:8], data[4:8])     // xid
+	copy(response[10:12], data[10:12]) // flags
+	if reply != dhcpNak {
+		copy(response[16:20], ip) // yiaddr
+	}
+	copy(response[20:24], stack.config.Gateway.To4()) // siaddr
+	copy(response[28:44], data[28:44])                // chaddr
+	binary.BigEndian.PutUint32(response[236:240], dhcpMagic)
+
+	option := func(code byte, value []byte) {
+		response = append(response, code, byte(len(value)))
+		response = append(response, value...)
+	}
+	option(optionType, []byte{reply})
+	option(optionServer, stack.config.Gateway.To4())
+	if reply != dhcpNak {
+		lease := make([]byte, 4)
+		binary.BigEndian.PutUint32(lease, dhcpLeaseTime)
+		broadcast := make(net.IP, 4)
+		for i := 0; i < 4; i += 1 {
+			broadcast[i] = stack.config.Network.IP.To4()[i] | ^stack.config.Network.Mask[i]
+		}
+		option(optionLease, lease)
+		option(optionMask, stack.config.Network.Mask)
+		option(optionRouter, stack.config.Gateway.To4())
+		option(optionDns, stack.config.Dns.To4())
+		option(optionBroadcast, broadcast)
+	}
+	response = append(response, optionEnd)
+
+	// The guest has no address yet; broadcast.
+	stack.id += 1
+	payload := buildUdp(
+		stack.config.Gateway,
+		DhcpServerPort,
+		net.IPv4bcast,
+		DhcpClientPort,
+		response)
+	stack.send(
+		Broadcast,
+		EtherTypeIPv4,
+		buildIPv4(stack.id, ProtoUdp, stack.config.Gateway, net.IPv4bcast, payload))
+
+	// Remember where it lives.
+	if reply == dhcpAck {
+		stack.learn(ip, source)
+	}
+}
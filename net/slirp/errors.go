@@ -0,0 +1,11 @@
+package slirp
+
+import (
+	"errors"
+)
+
+// Global errors.
+var (
+	InvalidNetwork = errors.New("network must be IPv4")
+	InvalidForward = errors.New("forward proto must be tcp or udp")
+)
@@ -0,0 +1,245 @@
+package slirp
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+//
+// Wire formats.
+//
+// We only deal with what we need: Ethernet II, ARP
+// for IPv4, IPv4 (without options or fragments), ICMP
+// echo, UDP and TCP. All headers are big-endian.
+//
+
+const (
+	EtherTypeIPv4 = 0x0800
+	EtherTypeArp  = 0x0806
+	EtherHeader   = 14
+
+	ArpRequest = 1
+	ArpReply   = 2
+	ArpLength  = 28
+
+	ProtoIcmp = 1
+	ProtoTcp  = 6
+	ProtoUdp  = 17
+
+	IPv4Header = 20
+	UdpHeader  = 8
+	TcpHeader  = 20
+	IcmpHeader = 8
+
+	IcmpEchoReply   = 0
+	IcmpEchoRequest = 8
+
+	TcpFin = 0x01
+	TcpSyn = 0x02
+	TcpRst = 0x04
+	TcpPsh = 0x08
+	TcpAck = 0x10
+
+	Mtu = 1500
+	Mss = Mtu - IPv4Header - TcpHeader
+)
+
+var Broadcast = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+type ipv4 struct {
+	proto   byte
+	src     net.IP
+	dst     net.IP
+	payload []byte
+}
+
+func parseIPv4(data []byte) (*ipv4, bool) {
+	if len(data) < IPv4Header || data[0]>>4 != 4 {
+		return nil, false
+	}
+	ihl := int(data[0]&0xf) * 4
+	total := int(binary.BigEndian.Uint16(data[2:4]))
+	if ihl < IPv4Header || total < ihl || total > len(data) {
+		return nil, false
+	}
+
+	// We don't do fragments.
+	frag := binary.BigEndian.Uint16(data[6:8])
+	if frag&0x3fff != 0 {
+		return nil, false
+	}
+	if checksum(data[:ihl], 0) != 0 {
+		return nil, false
+	}
+
+	return &ipv4{
+		proto:   data[9],
+		src:     net.IP(data[12:16]),
+		dst:     net.IP(data[16:20]),
+		payload: data[ihl:total],
+	}, true
+}
+
+func buildIPv4(id uint16, proto byte, src net.IP, dst net.IP, payload []byte) []byte {
+	packet := make([]byte, IPv4Header+len(payload))
+	packet[0] = 0x45
+	binary.BigEndian.PutUint16(packet[2:4], uint16(len(packet)))
+	binary.BigEndian.PutUint16(packet[4:6], id)
+	binary.BigEndian.PutUint16(packet[6:8], 0x4000) // Don't fragment.
+	packet[8] = 64
+	packet[9] = proto
+	copy(packet[12:16], src.To4())
+	copy(packet[16:20], dst.To4())
+	binary.BigEndian.PutUint16(packet[10:12], checksum(packet[:IPv4Header], 0))
+	copy(packet[IPv4Header:], payload)
+	return packet
+}
+
+//
+// The internet checksum. Over a packet that
+// includes its checksum field, this gives zero.
+//
+func checksum(data []byte, initial uint32) uint16 {
+	sum := initial
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return ^uint16(sum)
+}
+
+func pseudoHeader(proto byte, src net.IP, dst net.IP, length int) uint32 {
+	src = src.To4()
+	dst = dst.To4()
+	sum := uint32(binary.BigEndian.Uint16(src[0:2])) +
+		uint32(binary.BigEndian.Uint16(src[2:4])) +
+		uint32(binary.BigEndian.Uint16(dst[0:2])) +
+		uint32(binary.BigEndian.Uint16(dst[2:4]))
+	return sum + uint32(proto) + uint32(length)
+}
+
+type udp struct {
+	srcPort uint16
+	dstPort uint16
+	payload []byte
+}
+
+func parseUdp(packet *ipv4) (*udp, bool) {
+	data := packet.payload
+	if len(data) < UdpHeader {
+		return nil, false
+	}
+	length := int(binary.BigEndian.Uint16(data[4:6]))
+	if length < UdpHeader || length > len(data) {
+		return nil, false
+	}
+	if binary.BigEndian.Uint16(data[6:8]) != 0 &&
+		checksum(data[:length], pseudoHeader(ProtoUdp, packet.src, packet.dst, length)) != 0 {
+		return nil, false
+	}
+
+	return &udp{
+		srcPort: binary.BigEndian.Uint16(data[0:2]),
+		dstPort: binary.BigEndian.Uint16(data[2:4]),
+		payload: data[UdpHeader:length],
+	}, true
+}
+
+func buildUdp(src net.IP, srcPort uint16, dst net.IP, dstPort uint16, payload []byte) []byte {
+	data := make([]byte, UdpHeader+len(payload))
+	binary.BigEndian.PutUint16(data[0:2], srcPort)
+	binary.BigEndian.PutUint16(data[2:4], dstPort)
+	binary.BigEndian.PutUint16(data[4:6], uint16(len(data)))
+	copy(data[UdpHeader:], payload)
+	sum := checksum(data, pseudoHeader(ProtoUdp, src, dst, len(data)))
+	if sum == 0 {
+		sum = 0xffff
+	}
+	binary.BigEndian.PutUint16(data[6:8], sum)
+	return data
+}
+
+type tcp struct {
+	srcPort uint16
+	dstPort uint16
+	seq     uint32
+	ack     uint32
+	flags   byte
+	window  uint16
+	mss     int
+	payload []byte
+}
+
+func parseTcp(packet *ipv4) (*tcp, bool) {
+	data := packet.payload
+	if len(data) < TcpHeader {
+		return nil, false
+	}
+	offset := int(data[12]>>4) * 4
+	if offset < TcpHeader || offset > len(data) {
+		return nil, false
+	}
+	if checksum(data, pseudoHeader(ProtoTcp, packet.src, packet.dst, len(data))) != 0 {
+		return nil, false
+	}
+
+	segment := &tcp{
+		srcPort: binary.BigEndian.Uint16(data[0:2]),
+		dstPort: binary.BigEndian.Uint16(data[2:4]),
+		seq:     binary.BigEndian.Uint32(data[4:8]),
+		ack:     binary.BigEndian.Uint32(data[8:12]),
+		flags:   data[13],
+		window:  binary.BigEndian.Uint16(data[14:16]),
+		payload: data[offset:],
+	}
+
+	// Look for an MSS option.
+	options := data[TcpHeader:offset]
+	for len(options) > 0 {
+		kind := options[0]
+		if kind == 0 {
+			break
+		}
+		if kind == 1 {
+			options = options[1:]
+			continue
+		}
+		if len(options) < 2 || int(options[1]) < 2 || int(options[1]) > len(options) {
+			break
+		}
+		if kind == 2 && options[1] == 4 {
+			segment.mss = int(binary.BigEndian.Uint16(options[2:4]))
+		}
+		options = options[options[1]:]
+	}
+
+	return segment, true
+}
+
+func buildTcp(src net.IP, dst net.IP, segment *tcp) []byte {
+	header := TcpHeader
+	if segment.mss != 0 {
+		header += 4
+	}
+	data := make([]byte, header+len(segment.payload))
+	binary.BigEndian.PutUint16(data[0:2], segment.srcPort)
+	binary.BigEndian.PutUint16(data[2:4], segment.dstPort)
+	binary.BigEndian.PutUint32(data[4:8], segment.seq)
+	binary.BigEndian.PutUint32(data[8:12], segment.ack)
+	data[12] = byte(header/4) << 4
+	data[13] = segment.flags
+	binary.BigEndian.PutUint16(data[14:16], segment.window)
+	if segment.mss != 0 {
+		data[20] = 2
+		data[21] = 4
+		binary.BigEndian.PutUint16(data[22:24], uint16(segment.mss))
+	}
+	copy(data[header:], segment.payload)
+	binary.BigEndian.PutUint16(data[16:18], checksum(data, pseudoHeader(ProtoTcp, src, dst, len(data))))
+	return data
+}
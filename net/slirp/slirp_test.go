@@ -0,0 +1,500 @@
+package slirp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	unix "golang.org/x/sys/unix"
+)
+
+var guestMac = net.HardwareAddr{0x52, 0x54, 0x00, 0x12, 0x34, 0x56}
+
+//
+// A fake guest, on the other end of a socketpair.
+//
+type testGuest struct {
+	t     *testing.T
+	stack *Stack
+	conn  *os.File
+	ip    net.IP
+}
+
+func newGuest(t *testing.T, config Config) *testGuest {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_DGRAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Non-blocking, so the read deadlines work.
+	for _, fd := range fds {
+		if err := unix.SetNonblock(fd, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stack, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := os.NewFile(uintptr(fds[0]), "stack")
+	go stack.Serve(server)
+
+	guest := &testGuest{
+		t:     t,
+		stack: stack,
+		conn:  os.NewFile(uintptr(fds[1]), "guest"),
+		ip:    stack.config.Guest,
+	}
+	t.Cleanup(func() {
+		stack.Close()
+		server.Close()
+		guest.conn.Close()
+	})
+	return guest
+}
+
+func (guest *testGuest) send(dest net.HardwareAddr, ethertype uint16, payload []byte) {
+	frame := make([]byte, EtherHeader+len(payload))
+	copy(frame[0:6], dest)
+	copy(frame[6:12], guestMac)
+	binary.BigEndian.PutUint16(frame[12:14], ethertype)
+	copy(frame[EtherHeader:], payload)
+	_, err := guest.conn.Write(frame)
+	if err != nil {
+		guest.t.Fatal(err)
+	}
+}
+
+func (guest *testGuest) sendIP(proto byte, dst net.IP, payload []byte) {
+	guest.send(guest.stack.mac, EtherTypeIPv4, buildIPv4(1, proto, guest.ip, dst, payload))
+}
+
+//
+// Tell the stack where the guest is, and wait until
+// it knows (so it won't have to ask with an ARP).
+//
+func (guest *testGuest) announce() {
+	gateway := guest.stack.config.Gateway
+	guest.sendIP(ProtoUdp, gateway, buildUdp(guest.ip, 9, gateway, 9, nil))
+
+	var key [4]byte
+	copy(key[:], guest.ip.To4())
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		guest.stack.lock.Lock()
+		_, ok := guest.stack.neighbors[key]
+		guest.stack.lock.Unlock()
+		if ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			guest.t.Fatal("guest not learned")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (guest *testGuest) sendTcp(dst net.IP, segment *tcp) {
+	guest.sendIP(ProtoTcp, dst, buildTcp(guest.ip, dst, segment))
+}
+
+//
+// Wait for a frame of the given type.
+//
+func (guest *testGuest) recv(ethertype uint16) []byte {
+	guest.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buffer := make([]byte, 65536)
+	for {
+		n, err := guest.conn.Read(buffer)
+		if err != nil {
+			guest.t.Fatal(err)
+		}
+		frame := buffer[:n]
+		if binary.BigEndian.Uint16(frame[12:14]) == ethertype {
+			return append([]byte(nil), frame[EtherHeader:]...)
+		}
+	}
+}
+
+func (guest *testGuest) recvIP(proto byte) *ipv4 {
+	for {
+		packet, ok := parseIPv4(guest.recv(EtherTypeIPv4))
+		if !ok {
+			guest.t.Fatal("bad ip packet")
+		}
+		if packet.proto == proto {
+			return packet
+		}
+	}
+}
+
+func (guest *testGuest) recvTcp() *tcp {
+	packet := guest.recvIP(ProtoTcp)
+	segment, ok := parseTcp(packet)
+	if !ok {
+		guest.t.Fatal("bad tcp segment")
+	}
+	return segment
+}
+
+func listenPort(t *testing.T, address net.Addr) uint16 {
+	_, port, _ := net.SplitHostPort(address.String())
+	value, err := strconv.Atoi(port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return uint16(value)
+}
+
+func TestArp(t *testing.T) {
+	guest := newGuest(t, Config{})
+
+	request := make([]byte, ArpLength)
+	binary.BigEndian.PutUint16(request[0:2], 1)
+	binary.BigEndian.PutUint16(request[2:4], EtherTypeIPv4)
+	request[4] = 6
+	request[5] = 4
+	binary.BigEndian.PutUint16(request[6:8], ArpRequest)
+	copy(request[8:14], guestMac)
+	copy(request[14:18], guest.ip.To4())
+	copy(request[24:28], guest.stack.config.Gateway.To4())
+	guest.send(Broadcast, EtherTypeArp, request)
+
+	reply := guest.recv(EtherTypeArp)
+	if binary.BigEndian.Uint16(reply[6:8]) != ArpReply {
+		t.Fatalf("expected reply, got %d", binary.BigEndian.Uint16(reply[6:8]))
+	}
+	if !bytes.Equal(reply[8:14], guest.stack.mac) {
+		t.Fatalf("wrong mac %s", net.HardwareAddr(reply[8:14]))
+	}
+	if !bytes.Equal(reply[14:18], guest.stack.config.Gateway.To4()) {
+		t.Fatalf("wrong ip %s", net.IP(reply[14:18]))
+	}
+}
+
+func TestDhcp(t *testing.T) {
+	guest := newGuest(t, Config{})
+
+	exchange := func(kind byte, requested net.IP) (byte, net.IP) {
+		request := make([]byte, dhcpHeader)
+		request[0] = dhcpBootRequest
+		request[1] = 1
+		request[2] = 6
+		binary.BigEndian.PutUint32(request[4:8], 0x1234)
+		copy(request[28:34], guestMac)
+		binary.BigEndian.PutUint32(request[236:240], dhcpMagic)
+		request = append(request, optionType, 1, kind)
+		if requested != nil {
+			request = append(request, optionRequested, 4)
+			request = append(request, requested.To4()...)
+		}
+		request = append(request, optionEnd)
+
+		payload := buildUdp(net.IPv4zero, DhcpClientPort, net.IPv4bcast, DhcpServerPort, request)
+		guest.send(
+			Broadcast,
+			EtherTypeIPv4,
+			buildIPv4(1, ProtoUdp, net.IPv4zero, net.IPv4bcast, payload))
+
+		packet := guest.recvIP(ProtoUdp)
+		segment, ok := parseUdp(packet)
+		if !ok || segment.dstPort != DhcpClientPort {
+			t.Fatal("bad dhcp reply")
+		}
+		if binary.BigEndian.Uint32(segment.payload[4:8]) != 0x1234 {
+			t.Fatal("wrong xid")
+		}
+		options := dhcpOptions(segment.payload[dhcpHeader:])
+		if !net.IP(options[optionRouter]).Equal(guest.stack.config.Gateway) &&
+			options[optionType][0] != dhcpNak {
+			t.Fatalf("wrong router %s", net.IP(options[optionRouter]))
+		}
+		return options[optionType][0], net.IP(segment.payload[16:20])
+	}
+
+	kind, ip := exchange(dhcpDiscover, nil)
+	if kind != dhcpOffer || !ip.Equal(guest.ip) {
+		t.Fatalf("expected offer of %s, got %d %s", guest.ip, kind, ip)
+	}
+	kind, ip = exchange(dhcpRequest, ip)
+	if kind != dhcpAck || !ip.Equal(guest.ip) {
+		t.Fatalf("expected ack of %s, got %d %s", guest.ip, kind, ip)
+	}
+	kind, _ = exchange(dhcpRequest, net.IPv4(10, 0, 2, 99))
+	if kind != dhcpNak {
+		t.Fatalf("expected nak, got %d", kind)
+	}
+}
+
+func TestUdp(t *testing.T) {
+	guest := newGuest(t, Config{})
+
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go func() {
+		buffer := make([]byte, 1500)
+		for {
+			n, address, err := server.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			server.WriteTo(bytes.ToUpper(buffer[:n]), address)
+		}
+	}()
+
+	gateway := guest.stack.config.Gateway
+	port := listenPort(t, server.LocalAddr())
+	guest.sendIP(ProtoUdp, gateway, buildUdp(guest.ip, 5000, gateway, port, []byte("hello")))
+
+	packet := guest.recvIP(ProtoUdp)
+	segment, ok := parseUdp(packet)
+	if !ok {
+		t.Fatal("bad udp reply")
+	}
+	if segment.srcPort != port || segment.dstPort != 5000 || !packet.src.Equal(gateway) {
+		t.Fatalf("wrong ports %d -> %d", segment.srcPort, segment.dstPort)
+	}
+	if string(segment.payload) != "HELLO" {
+		t.Fatalf("wrong payload %q", segment.payload)
+	}
+}
+
+func TestTcp(t *testing.T) {
+	guest := newGuest(t, Config{})
+
+	server, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go func() {
+		conn, err := server.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(conn, conn)
+		conn.Close()
+	}()
+
+	gateway := guest.stack.config.Gateway
+	port := listenPort(t, server.Addr())
+	segment := func(flags byte, seq uint32, ack uint32, payload []byte) *tcp {
+		return &tcp{
+			srcPort: 5000,
+			dstPort: port,
+			seq:     seq,
+			ack:     ack,
+			flags:   flags,
+			window:  TcpWindow,
+			payload: payload,
+		}
+	}
+
+	// Handshake.
+	seq := uint32(1000)
+	guest.sendTcp(gateway, segment(TcpSyn, seq, 0, nil))
+	reply := guest.recvTcp()
+	if reply.flags != TcpSyn|TcpAck || reply.ack != seq+1 || reply.mss == 0 {
+		t.Fatalf("expected syn-ack, got %x", reply.flags)
+	}
+	seq += 1
+	ack := reply.seq + 1
+	guest.sendTcp(gateway, segment(TcpAck, seq, ack, nil))
+
+	// Data is echoed back.
+	guest.sendTcp(gateway, segment(TcpAck|TcpPsh, seq, ack, []byte("ping")))
+	seq += 4
+	var echoed []byte
+	for len(echoed) < 4 {
+		reply = guest.recvTcp()
+		if len(reply.payload) == 0 {
+			continue
+		}
+		if reply.seq != ack {
+			t.Fatalf("unexpected seq %d (want %d)", reply.seq, ack)
+		}
+		echoed = append(echoed, reply.payload...)
+		ack += uint32(len(reply.payload))
+		guest.sendTcp(gateway, segment(TcpAck, seq, ack, nil))
+	}
+	if string(echoed) != "ping" {
+		t.Fatalf("wrong echo %q", echoed)
+	}
+
+	// Close; the server follows.
+	guest.sendTcp(gateway, segment(TcpFin|TcpAck, seq, ack, nil))
+	seq += 1
+	for {
+		reply = guest.recvTcp()
+		if reply.flags&TcpFin != 0 {
+			break
+		}
+	}
+	if reply.ack != seq {
+		t.Fatalf("fin not acked (%d, want %d)", reply.ack, seq)
+	}
+	guest.sendTcp(gateway, segment(TcpAck, seq, reply.seq+1, nil))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		guest.stack.lock.Lock()
+		count := len(guest.stack.tcp)
+		guest.stack.lock.Unlock()
+		if count == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("connection not cleaned up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTcpRefused(t *testing.T) {
+	guest := newGuest(t, Config{})
+
+	// Find a port that's not listening.
+	server, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listenPort(t, server.Addr())
+	server.Close()
+
+	guest.sendTcp(guest.stack.config.Gateway, &tcp{
+		srcPort: 5000,
+		dstPort: port,
+		seq:     1000,
+		flags:   TcpSyn,
+		window:  TcpWindow,
+	})
+	reply := guest.recvTcp()
+	if reply.flags&TcpRst == 0 || reply.ack != 1001 {
+		t.Fatalf("expected rst, got %x", reply.flags)
+	}
+}
+
+func TestForward(t *testing.T) {
+	guest := newGuest(t, Config{
+		Forwards: []Forward{{Proto: "tcp", Host: "127.0.0.1:0", Port: 22}},
+	})
+
+	// The stack needs to know where the guest is.
+	gateway := guest.stack.config.Gateway
+	guest.announce()
+
+	addresses := guest.stack.Addresses()
+	if len(addresses) != 1 {
+		t.Fatalf("expected one address, got %d", len(addresses))
+	}
+	host, err := net.Dial("tcp", addresses[0].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host.Close()
+
+	syn := guest.recvTcp()
+	if syn.flags != TcpSyn || syn.dstPort != 22 {
+		t.Fatalf("expected syn to port 22, got %x to %d", syn.flags, syn.dstPort)
+	}
+	seq := uint32(5000)
+	guest.sendTcp(gateway, &tcp{
+		srcPort: 22,
+		dstPort: syn.srcPort,
+		seq:     seq,
+		ack:     syn.seq + 1,
+		flags:   TcpSyn | TcpAck,
+		window:  TcpWindow,
+	})
+	seq += 1
+	ack := guest.recvTcp()
+	if ack.flags != TcpAck || ack.ack != seq {
+		t.Fatalf("expected ack, got %x", ack.flags)
+	}
+
+	// Host -> guest.
+	host.Write([]byte("hello"))
+	data := guest.recvTcp()
+	if string(data.payload) != "hello" {
+		t.Fatalf("wrong data %q", data.payload)
+	}
+
+	// Guest -> host.
+	guest.sendTcp(gateway, &tcp{
+		srcPort: 22,
+		dstPort: syn.srcPort,
+		seq:     seq,
+		ack:     data.seq + uint32(len(data.payload)),
+		flags:   TcpAck | TcpPsh,
+		window:  TcpWindow,
+		payload: []byte("world"),
+	})
+	buffer := make([]byte, 5)
+	host.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadFull(host, buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buffer) != "world" {
+		t.Fatalf("wrong data %q", buffer)
+	}
+}
+
+func TestUdpForward(t *testing.T) {
+	guest := newGuest(t, Config{
+		Forwards: []Forward{{Proto: "udp", Host: "127.0.0.1:0", Port: 53}},
+	})
+
+	// The stack needs to know where the guest is.
+	gateway := guest.stack.config.Gateway
+	guest.announce()
+
+	host, err := net.Dial("udp", guest.stack.Addresses()[0].String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host.Close()
+
+	// Host -> guest.
+	host.Write([]byte("query"))
+	packet := guest.recvIP(ProtoUdp)
+	segment, ok := parseUdp(packet)
+	if !ok || segment.dstPort != 53 || string(segment.payload) != "query" {
+		t.Fatalf("bad forwarded packet")
+	}
+
+	// Guest -> host.
+	guest.sendIP(ProtoUdp, gateway, buildUdp(guest.ip, 53, gateway, segment.srcPort, []byte("answer")))
+	buffer := make([]byte, 16)
+	host.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := host.Read(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buffer[:n]) != "answer" {
+		t.Fatalf("wrong data %q", buffer[:n])
+	}
+
+	// The client's port is given up with the listener.
+	guest.stack.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		guest.stack.lock.Lock()
+		left := len(guest.stack.udpForwards)
+		guest.stack.lock.Unlock()
+		if left == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d forwarded clients left", left)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
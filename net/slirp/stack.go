@@ -0,0 +1,464 @@
+package slirp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//
+// A host port forwarded into the guest.
+//
+type Forward struct {
+	// Either "tcp" or "udp".
+	Proto string
+
+	// The host address to listen on (e.g. "127.0.0.1:2222").
+	Host string
+
+	// The guest port to connect to.
+	Port uint16
+}
+
+//
+// Config --
+//
+// The virtual network. Any fields left unset get the
+// usual slirp defaults (10.0.2.0/24, with the gateway
+// at .2, DNS at .3 and the guest at .15).
+//
+// The gateway address maps to the host's loopback.
+//
+type Config struct {
+	Network *net.IPNet
+	Gateway net.IP
+	Dns     net.IP
+	Guest   net.IP
+
+	// Host DNS server (defaults to /etc/resolv.conf).
+	Resolver string
+
+	// Host ports forwarded to the guest.
+	Forwards []Forward
+
+	// Log what we're doing?
+	Debug bool
+}
+
+//
+// A connection key.
+//
+type flow struct {
+	guest      [4]byte
+	guestPort  uint16
+	remote     [4]byte
+	remotePort uint16
+}
+
+func newFlow(guest net.IP, guestPort uint16, remote net.IP, remotePort uint16) flow {
+	key := flow{guestPort: guestPort, remotePort: remotePort}
+	copy(key.guest[:], guest.To4())
+	copy(key.remote[:], remote.To4())
+	return key
+}
+
+//
+// Stack --
+//
+// A user-mode network stack. Frames from the guest are
+// read from a connection (one frame per read), guest TCP
+// and UDP flows are terminated here and NATed onto host
+// sockets, and replies are written back as frames.
+//
+type Stack struct {
+	config Config
+
+	// Our (gateway) mac.
+	mac net.HardwareAddr
+
+	// Outgoing frames.
+	out  chan []byte
+	done chan struct{}
+
+	// Known guest addresses.
+	neighbors map[[4]byte]net.HardwareAddr
+
+	// DHCP leases (by mac).
+	leases map[string]net.IP
+
+	// Active flows.
+	tcp map[flow]*tcpConn
+	udp map[flow]*udpConn
+
+	// Forward listeners.
+	listeners []io.Closer
+	addresses []net.Addr
+
+	// UDP forwards (by gateway port).
+	udpForwards map[uint16]*udpPeer
+
+	// Next ephemeral port & ip id.
+	port uint16
+	id   uint16
+
+	lock sync.Mutex
+}
+
+func New(config Config) (*Stack, error) {
+
+	if config.Network == nil {
+		_, config.Network, _ = net.ParseCIDR("10.0.2.0/24")
+	}
+	base := config.Network.IP.To4()
+	if base == nil {
+		return nil, InvalidNetwork
+	}
+	if len(config.Network.Mask) == net.IPv6len {
+		config.Network = &net.IPNet{IP: base, Mask: config.Network.Mask[12:]}
+	}
+	host := func(n byte) net.IP {
+		return net.IPv4(base[0], base[1], base[2], base[3]|n).To4()
+	}
+	if config.Gateway == nil {
+		config.Gateway = host(2)
+	}
+	if config.Dns == nil {
+		config.Dns = host(3)
+	}
+	if config.Guest == nil {
+		config.Guest = host(15)
+	}
+	if config.Resolver == "" {
+		config.Resolver = hostResolver()
+	}
+
+	gateway := config.Gateway.To4()
+	stack := &Stack{
+		config:      config,
+		mac:         net.HardwareAddr{0x52, 0x55, gateway[0], gateway[1], gateway[2], gateway[3]},
+		out:         make(chan []byte, 256),
+		done:        make(chan struct{}),
+		neighbors:   make(map[[4]byte]net.HardwareAddr),
+		leases:      make(map[string]net.IP),
+		tcp:         make(map[flow]*tcpConn),
+		udp:         make(map[flow]*udpConn),
+		udpForwards: make(map[uint16]*udpPeer),
+		port:        40000,
+	}
+
+	for _, forward := range config.Forwards {
+		err := stack.listen(forward)
+		if err != nil {
+			stack.Close()
+			return nil, err
+		}
+	}
+
+	return stack, nil
+}
+
+//
+// Find the host's nameserver.
+//
+func hostResolver() string {
+	data, err := ioutil.ReadFile("/etc/resolv.conf")
+	if err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) >= 2 && fields[0] == "nameserver" {
+				return net.JoinHostPort(fields[1], "53")
+			}
+		}
+	}
+	return "127.0.0.1:53"
+}
+
+func (stack *Stack) debug(format string, args ...interface{}) {
+	if stack.config.Debug {
+		log.Printf("slirp: "+format, args...)
+	}
+}
+
+//
+// The addresses our forwards are listening on.
+// (Useful when asking for port zero).
+//
+func (stack *Stack) Addresses() []net.Addr {
+	stack.lock.Lock()
+	defer stack.lock.Unlock()
+	return append([]net.Addr(nil), stack.addresses...)
+}
+
+//
+// Run the stack over the given connection.
+// Each read must return exactly one frame, and
+// each write sends one (e.g. a datagram socket).
+// This returns when the connection fails.
+//
+func (stack *Stack) Serve(conn io.ReadWriter) error {
+
+	go func() {
+		for {
+			select {
+			case frame := <-stack.out:
+				_, err := conn.Write(frame)
+				if err != nil {
+					stack.debug("write: %s", err.Error())
+				}
+			case <-stack.done:
+				return
+			}
+		}
+	}()
+
+	buffer := make([]byte, 65536)
+	for {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			return err
+		}
+		frame := make([]byte, n)
+		copy(frame, buffer[:n])
+
+		stack.lock.Lock()
+		stack.input(frame)
+		stack.lock.Unlock()
+	}
+}
+
+func (stack *Stack) Close() error {
+	stack.lock.Lock()
+	defer stack.lock.Unlock()
+
+	select {
+	case <-stack.done:
+		return nil
+	default:
+	}
+	close(stack.done)
+
+	for _, listener := range stack.listeners {
+		listener.Close()
+	}
+	for _, conn := range stack.tcp {
+		conn.abort()
+	}
+	for _, conn := range stack.udp {
+		conn.host.Close()
+	}
+	return nil
+}
+
+//
+// Process a frame from the guest.
+// The stack lock must be held.
+//
+func (stack *Stack) input(frame []byte) {
+	if len(frame) < EtherHeader {
+		return
+	}
+	dest := net.HardwareAddr(frame[0:6])
+	source := net.HardwareAddr(frame[6:12])
+	if !bytes.Equal(dest, stack.mac) && !bytes.Equal(dest, Broadcast) {
+		return
+	}
+
+	switch binary.BigEndian.Uint16(frame[12:14]) {
+	case EtherTypeArp:
+		stack.arp(source, frame[EtherHeader:])
+	case EtherTypeIPv4:
+		stack.ip(source, frame[EtherHeader:])
+	}
+}
+
+//
+// Is this one of our addresses?
+//
+func (stack *Stack) isLocal(ip net.IP) bool {
+	return ip.Equal(stack.config.Gateway) || ip.Equal(stack.config.Dns)
+}
+
+func (stack *Stack) learn(ip net.IP, mac net.HardwareAddr) {
+	if !stack.config.Network.Contains(ip) || stack.isLocal(ip) {
+		return
+	}
+	var key [4]byte
+	copy(key[:], ip.To4())
+	stack.neighbors[key] = append(net.HardwareAddr(nil), mac...)
+}
+
+func (stack *Stack) arp(source net.HardwareAddr, data []byte) {
+	if len(data) < ArpLength ||
+		binary.BigEndian.Uint16(data[0:2]) != 1 ||
+		binary.BigEndian.Uint16(data[2:4]) != EtherTypeIPv4 ||
+		data[4] != 6 || data[5] != 4 {
+		return
+	}
+
+	op := binary.BigEndian.Uint16(data[6:8])
+	sender_mac := net.HardwareAddr(data[8:14])
+	sender_ip := net.IP(data[14:18])
+	target_ip := net.IP(data[24:28])
+
+	stack.learn(sender_ip, sender_mac)
+
+	if op != ArpRequest || !stack.isLocal(target_ip) {
+		return
+	}
+
+	reply := make([]byte, ArpLength)
+	copy(reply, data[:6])
+	binary.BigEndian.PutUint16(reply[6:8], ArpReply)
+	copy(reply[8:14], stack.mac)
+	copy(reply[14:18], target_ip)
+	copy(reply[18:24], sender_mac)
+	copy(reply[24:28], sender_ip)
+	stack.send(sender_mac, EtherTypeArp, reply)
+}
+
+//
+// Ask the guest who has an address.
+//
+func (stack *Stack) arpRequest(ip net.IP) {
+	request := make([]byte, ArpLength)
+	binary.BigEndian.PutUint16(request[0:2], 1)
+	binary.BigEndian.PutUint16(request[2:4], EtherTypeIPv4)
+	request[4] = 6
+	request[5] = 4
+	binary.BigEndian.PutUint16(request[6:8], ArpRequest)
+	copy(request[8:14], stack.mac)
+	copy(request[14:18], stack.config.Gateway.To4())
+	copy(request[24:28], ip.To4())
+	stack.send(Broadcast, EtherTypeArp, request)
+}
+
+func (stack *Stack) ip(source net.HardwareAddr, data []byte) {
+	packet, ok := parseIPv4(data)
+	if !ok {
+		return
+	}
+	stack.learn(packet.src, source)
+
+	switch packet.proto {
+	case ProtoIcmp:
+		stack.icmp(packet)
+	case ProtoUdp:
+		segment, ok := parseUdp(packet)
+		if !ok {
+			return
+		}
+		if segment.dstPort == DhcpServerPort {
+			stack.dhcp(source, segment)
+			return
+		}
+		stack.udpInput(packet, segment)
+	case ProtoTcp:
+		segment, ok := parseTcp(packet)
+		if !ok {
+			return
+		}
+		stack.tcpInput(packet, segment)
+	}
+}
+
+//
+// We answer pings to our own addresses.
+//
+func (stack *Stack) icmp(packet *ipv4) {
+	data := packet.payload
+	if len(data) < IcmpHeader ||
+		data[0] != IcmpEchoRequest ||
+		!stack.isLocal(packet.dst) ||
+		checksum(data, 0) != 0 {
+		return
+	}
+
+	reply := make([]byte, len(data))
+	copy(reply, data)
+	reply[0] = IcmpEchoReply
+	reply[2] = 0
+	reply[3] = 0
+	binary.BigEndian.PutUint16(reply[2:4], checksum(reply, 0))
+	stack.sendIP(ProtoIcmp, packet.dst, packet.src, reply)
+}
+
+//
+// Where should a guest connection really go?
+// Returns "" if it is not reachable.
+//
+func (stack *Stack) hostAddress(ip net.IP, port uint16) string {
+	switch {
+	case ip.Equal(stack.config.Dns):
+		if port != 53 {
+			return ""
+		}
+		return stack.config.Resolver
+	case ip.Equal(stack.config.Gateway):
+		return net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port)))
+	case stack.config.Network.Contains(ip):
+		return ""
+	case ip.IsMulticast() || ip.Equal(net.IPv4bcast):
+		return ""
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+}
+
+//
+// Allocate a gateway port (for forwards).
+// The stack lock must be held.
+//
+func (stack *Stack) ephemeral() uint16 {
+	stack.port += 1
+	if stack.port < 40000 {
+		stack.port = 40000
+	}
+	return stack.port
+}
+
+//
+// Queue a frame for the guest.
+// As with a real NIC, we drop if the guest isn't keeping up.
+//
+func (stack *Stack) send(dest net.HardwareAddr, ethertype uint16, payload []byte) {
+	frame := make([]byte, EtherHeader+len(payload))
+	copy(frame[0:6], dest)
+	copy(frame[6:12], stack.mac)
+	binary.BigEndian.PutUint16(frame[12:14], ethertype)
+	copy(frame[EtherHeader:], payload)
+
+	select {
+	case stack.out <- frame:
+	default:
+		stack.debug("dropped frame")
+	}
+}
+
+//
+// Send an IP packet to the guest.
+// The stack lock must be held.
+//
+func (stack *Stack) sendIP(proto byte, src net.IP, dst net.IP, payload []byte) {
+	var dest net.HardwareAddr
+	if dst.Equal(net.IPv4bcast) {
+		dest = Broadcast
+	} else {
+		var key [4]byte
+		copy(key[:], dst.To4())
+		mac, ok := stack.neighbors[key]
+		if !ok {
+			// We'll get it next time.
+			stack.arpRequest(dst)
+			return
+		}
+		dest = mac
+	}
+
+	stack.id += 1
+	stack.send(dest, EtherTypeIPv4, buildIPv4(stack.id, proto, src, dst, payload))
+}
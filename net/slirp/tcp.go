@@ -0,0 +1,639 @@
+package slirp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+//
+// TCP termination.
+//
+// Each guest connection is terminated here, and its
+// data relayed over a host socket. This is a deliberately
+// simple TCP: we acknowledge every segment, only accept
+// segments in order (the guest retransmits anything else),
+// and retransmit with go-back-N on timeout. There is no
+// window scaling, so our receive window is at most 64K.
+//
+
+const (
+	tcpSynSent = iota
+	tcpDialing
+	tcpSynReceived
+	tcpEstablished
+	tcpClosed
+)
+
+const (
+	TcpWindow      = 65535
+	TcpSendBuffer  = 256 * 1024
+	TcpDialTimeout = 10 * time.Second
+	TcpRtoMin      = 200 * time.Millisecond
+	TcpRtoMax      = 10 * time.Second
+	TcpRetries     = 12
+	TcpDefaultMss  = 536
+)
+
+type tcpConn struct {
+	stack *Stack
+	key   flow
+	state int
+
+	guest      net.IP
+	guestPort  uint16
+	remote     net.IP
+	remotePort uint16
+
+	host net.Conn
+
+	// Towards the guest.
+	// The send buffer starts at sndUna.
+	iss      uint32
+	sndUna   uint32
+	sndNxt   uint32
+	sndWnd   uint32
+	mss      int
+	sendBuf  []byte
+	hostEOF  bool
+	finSent  bool
+	finAcked bool
+
+	// From the guest.
+	rcvNxt     uint32
+	recvBuf    []byte
+	writing    int
+	advertised int
+	guestFin   bool
+	writerDone bool
+
+	// Retransmission.
+	rto        time.Duration
+	retries    int
+	timer      *time.Timer
+	generation int
+
+	// Wakes our reader & writer.
+	cond *sync.Cond
+}
+
+func (stack *Stack) newTcpConn(
+	guest net.IP,
+	guestPort uint16,
+	remote net.IP,
+	remotePort uint16) *tcpConn {
+
+	var iss [4]byte
+	rand.Read(iss[:])
+
+	conn := &tcpConn{
+		stack:      stack,
+		key:        newFlow(guest, guestPort, remote, remotePort),
+		guest:      append(net.IP(nil), guest.To4()...),
+		guestPort:  guestPort,
+		remote:     append(net.IP(nil), remote.To4()...),
+		remotePort: remotePort,
+		iss:        binary.BigEndian.Uint32(iss[:]),
+		mss:        TcpDefaultMss,
+		rto:        TcpRtoMin,
+		cond:       sync.NewCond(&stack.lock),
+	}
+	conn.sndUna = conn.iss
+	conn.sndNxt = conn.iss + 1
+	stack.tcp[conn.key] = conn
+	return conn
+}
+
+//
+// Handle a segment from the guest.
+// The stack lock must be held.
+//
+func (stack *Stack) tcpInput(packet *ipv4, segment *tcp) {
+	key := newFlow(packet.src, segment.srcPort, packet.dst, segment.dstPort)
+	conn, ok := stack.tcp[key]
+	if ok {
+		conn.input(segment)
+		return
+	}
+
+	if segment.flags&TcpRst != 0 {
+		return
+	}
+	if segment.flags&(TcpSyn|TcpAck) != TcpSyn {
+		stack.tcpReset(packet, segment)
+		return
+	}
+
+	// A new connection.
+	address := stack.hostAddress(packet.dst, segment.dstPort)
+	if address == "" {
+		stack.tcpReset(packet, segment)
+		return
+	}
+
+	conn = stack.newTcpConn(packet.src, segment.srcPort, packet.dst, segment.dstPort)
+	conn.state = tcpDialing
+	conn.rcvNxt = segment.seq + 1
+	conn.sndWnd = uint32(segment.window)
+	conn.setMss(segment.mss)
+	go conn.dial(address)
+}
+
+//
+// Reset a segment for which we have no connection.
+//
+func (stack *Stack) tcpReset(packet *ipv4, segment *tcp) {
+	reply := &tcp{
+		srcPort: segment.dstPort,
+		dstPort: segment.srcPort,
+	}
+	if segment.flags&TcpAck != 0 {
+		reply.seq = segment.ack
+		reply.flags = TcpRst
+	} else {
+		length := uint32(len(segment.payload))
+		if segment.flags&TcpSyn != 0 {
+			length += 1
+		}
+		if segment.flags&TcpFin != 0 {
+			length += 1
+		}
+		reply.ack = segment.seq + length
+		reply.flags = TcpRst | TcpAck
+	}
+	stack.sendIP(ProtoTcp, packet.dst, packet.src, buildTcp(packet.dst, packet.src, reply))
+}
+
+func (conn *tcpConn) setMss(mss int) {
+	if mss == 0 {
+		mss = TcpDefaultMss
+	}
+	if mss > Mss {
+		mss = Mss
+	}
+	conn.mss = mss
+}
+
+func (conn *tcpConn) dial(address string) {
+	host, err := net.DialTimeout("tcp", address, TcpDialTimeout)
+
+	conn.stack.lock.Lock()
+	defer conn.stack.lock.Unlock()
+
+	if conn.state == tcpClosed {
+		if err == nil {
+			host.Close()
+		}
+		return
+	}
+	if err != nil {
+		conn.stack.debug("tcp %s: %s", address, err.Error())
+		conn.reset()
+		return
+	}
+
+	conn.host = host
+	conn.state = tcpSynReceived
+	conn.sendSyn()
+	conn.start()
+}
+
+//
+// Connect into the guest (for a forward).
+// The stack lock must be held.
+//
+func (stack *Stack) tcpForward(host net.Conn, port uint16) {
+	conn := stack.newTcpConn(stack.config.Guest, port, stack.config.Gateway, stack.ephemeral())
+	conn.host = host
+	conn.state = tcpSynSent
+	conn.sendSyn()
+	conn.start()
+}
+
+func (stack *Stack) listenTcp(forward Forward) error {
+	listener, err := net.Listen("tcp", forward.Host)
+	if err != nil {
+		return err
+	}
+	stack.listeners = append(stack.listeners, listener)
+	stack.addresses = append(stack.addresses, listener.Addr())
+
+	go func() {
+		for {
+			host, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			stack.lock.Lock()
+			stack.tcpForward(host, forward.Port)
+			stack.lock.Unlock()
+		}
+	}()
+
+	return nil
+}
+
+func (stack *Stack) listen(forward Forward) error {
+	switch forward.Proto {
+	case "tcp", "":
+		return stack.listenTcp(forward)
+	case "udp":
+		return stack.listenUdp(forward)
+	}
+	return InvalidForward
+}
+
+//
+// Start relaying to & from the host.
+//
+func (conn *tcpConn) start() {
+	go conn.reader()
+	go conn.writer()
+}
+
+func (conn *tcpConn) window() int {
+	window := TcpWindow - len(conn.recvBuf) - conn.writing
+	if window < 0 {
+		window = 0
+	}
+	return window
+}
+
+func (conn *tcpConn) send(flags byte, seq uint32, payload []byte, mss int) {
+	segment := &tcp{
+		srcPort: conn.remotePort,
+		dstPort: conn.guestPort,
+		seq:     seq,
+		flags:   flags,
+		mss:     mss,
+		payload: payload,
+	}
+	if conn.state != tcpSynSent {
+		segment.flags |= TcpAck
+		segment.ack = conn.rcvNxt
+	}
+	conn.advertised = conn.window()
+	segment.window = uint16(conn.advertised)
+	conn.stack.sendIP(
+		ProtoTcp,
+		conn.remote,
+		conn.guest,
+		buildTcp(conn.remote, conn.guest, segment))
+}
+
+func (conn *tcpConn) sendSyn() {
+	conn.send(TcpSyn, conn.iss, nil, Mss)
+	conn.arm()
+}
+
+func (conn *tcpConn) sendAck() {
+	conn.send(0, conn.sndNxt, nil, 0)
+}
+
+//
+// Send whatever the guest's window allows.
+//
+func (conn *tcpConn) output() {
+	if conn.state != tcpEstablished {
+		return
+	}
+
+	for {
+		offset := int(conn.sndNxt - conn.sndUna)
+		if offset >= len(conn.sendBuf) {
+			break
+		}
+		length := len(conn.sendBuf) - offset
+		window := int(conn.sndWnd) - offset
+		if window <= 0 {
+			break
+		}
+		if length > window {
+			length = window
+		}
+		if length > conn.mss {
+			length = conn.mss
+		}
+		conn.send(TcpPsh, conn.sndNxt, conn.sendBuf[offset:offset+length], 0)
+		conn.sndNxt += uint32(length)
+	}
+
+	if conn.hostEOF && !conn.finSent &&
+		conn.sndNxt == conn.sndUna+uint32(len(conn.sendBuf)) {
+		conn.send(TcpFin, conn.sndNxt, nil, 0)
+		conn.sndNxt += 1
+		conn.finSent = true
+	}
+
+	if conn.sndNxt != conn.sndUna || len(conn.sendBuf) > 0 {
+		conn.arm()
+	}
+}
+
+//
+// Ensure the retransmit timer is running.
+//
+func (conn *tcpConn) arm() {
+	if conn.timer != nil {
+		return
+	}
+	generation := conn.generation
+	conn.timer = time.AfterFunc(conn.rto, func() {
+		conn.timeout(generation)
+	})
+}
+
+func (conn *tcpConn) disarm() {
+	if conn.timer != nil {
+		conn.timer.Stop()
+		conn.timer = nil
+	}
+	conn.generation += 1
+}
+
+func (conn *tcpConn) timeout(generation int) {
+	conn.stack.lock.Lock()
+	defer conn.stack.lock.Unlock()
+
+	if generation != conn.generation || conn.state == tcpClosed {
+		return
+	}
+	conn.timer = nil
+	conn.generation += 1
+
+	conn.retries += 1
+	if conn.retries > TcpRetries {
+		conn.reset()
+		return
+	}
+	conn.rto *= 2
+	if conn.rto > TcpRtoMax {
+		conn.rto = TcpRtoMax
+	}
+
+	switch conn.state {
+	case tcpSynSent, tcpSynReceived:
+		conn.sendSyn()
+		return
+	}
+
+	if conn.sndNxt == conn.sndUna && conn.sndWnd == 0 && len(conn.sendBuf) > 0 {
+		// Probe a zero window.
+		conn.send(TcpPsh, conn.sndNxt, conn.sendBuf[:1], 0)
+		conn.sndNxt += 1
+		conn.arm()
+		return
+	}
+
+	// Go back and send it all again.
+	conn.sndNxt = conn.sndUna
+	conn.finSent = false
+	conn.output()
+}
+
+func (conn *tcpConn) input(segment *tcp) {
+
+	if segment.flags&TcpRst != 0 {
+		conn.abort()
+		return
+	}
+
+	switch conn.state {
+	case tcpDialing:
+		// Still waiting on the host.
+		return
+
+	case tcpSynSent:
+		if segment.flags&(TcpSyn|TcpAck) != TcpSyn|TcpAck ||
+			segment.ack != conn.iss+1 {
+			return
+		}
+		conn.rcvNxt = segment.seq + 1
+		conn.sndUna = conn.iss + 1
+		conn.sndWnd = uint32(segment.window)
+		conn.setMss(segment.mss)
+		conn.established()
+		conn.sendAck()
+		conn.output()
+		return
+
+	case tcpSynReceived:
+		if segment.flags&TcpSyn != 0 {
+			// Our SYN-ACK was lost.
+			conn.send(TcpSyn, conn.iss, nil, Mss)
+			return
+		}
+		if segment.flags&TcpAck == 0 || segment.ack != conn.iss+1 {
+			return
+		}
+		conn.sndUna = conn.iss + 1
+		conn.established()
+	}
+
+	if segment.flags&TcpSyn != 0 {
+		// A retransmitted SYN-ACK.
+		conn.sendAck()
+		return
+	}
+
+	if segment.flags&TcpAck != 0 {
+		conn.acknowledge(segment)
+	}
+	conn.receive(segment)
+	conn.output()
+	conn.finish()
+}
+
+func (conn *tcpConn) established() {
+	conn.state = tcpEstablished
+	conn.retries = 0
+	conn.rto = TcpRtoMin
+	conn.disarm()
+}
+
+func (conn *tcpConn) acknowledge(segment *tcp) {
+	acked := segment.ack - conn.sndUna
+	inflight := conn.sndNxt - conn.sndUna
+	if acked > 0 && acked <= inflight {
+		data := int(acked)
+		if data > len(conn.sendBuf) {
+			data = len(conn.sendBuf)
+		}
+		conn.sendBuf = conn.sendBuf[data:]
+		if conn.finSent && segment.ack == conn.sndNxt {
+			conn.finAcked = true
+		}
+		conn.sndUna = segment.ack
+
+		// Progress.
+		conn.retries = 0
+		conn.rto = TcpRtoMin
+		conn.disarm()
+		conn.cond.Broadcast()
+	}
+	conn.sndWnd = uint32(segment.window)
+}
+
+func (conn *tcpConn) receive(segment *tcp) {
+	payload := segment.payload
+	fin := segment.flags&TcpFin != 0
+	if len(payload) == 0 && !fin {
+		return
+	}
+	if conn.guestFin {
+		// Already closed; just ack again.
+		conn.sendAck()
+		return
+	}
+
+	// Trim anything we've already seen.
+	behind := int32(conn.rcvNxt - segment.seq)
+	if behind > 0 {
+		if int(behind) > len(payload) {
+			conn.sendAck()
+			return
+		}
+		payload = payload[behind:]
+	} else if behind < 0 {
+		// Out of order; they'll resend.
+		conn.sendAck()
+		return
+	}
+
+	// Only take what fits.
+	if len(payload) > conn.window() {
+		payload = payload[:conn.window()]
+		fin = false
+	}
+
+	conn.recvBuf = append(conn.recvBuf, payload...)
+	conn.rcvNxt += uint32(len(payload))
+	if fin {
+		conn.rcvNxt += 1
+		conn.guestFin = true
+	}
+	conn.cond.Broadcast()
+	conn.sendAck()
+}
+
+//
+// Tear down once both sides are done.
+//
+func (conn *tcpConn) finish() {
+	if conn.guestFin && conn.writerDone && conn.finAcked {
+		conn.abort()
+	}
+}
+
+//
+// Drop the connection (without telling the guest).
+//
+func (conn *tcpConn) abort() {
+	if conn.state == tcpClosed {
+		return
+	}
+	conn.state = tcpClosed
+	conn.disarm()
+	if conn.host != nil {
+		conn.host.Close()
+	}
+	if conn.stack.tcp[conn.key] == conn {
+		delete(conn.stack.tcp, conn.key)
+	}
+	conn.cond.Broadcast()
+}
+
+//
+// Drop the connection, and tell the guest.
+//
+func (conn *tcpConn) reset() {
+	if conn.state != tcpSynSent {
+		conn.send(TcpRst, conn.sndNxt, nil, 0)
+	}
+	conn.abort()
+}
+
+//
+// Host -> guest.
+//
+func (conn *tcpConn) reader() {
+	buffer := make([]byte, 65536)
+	for {
+		n, err := conn.host.Read(buffer)
+
+		conn.stack.lock.Lock()
+		for conn.state != tcpClosed && len(conn.sendBuf) >= TcpSendBuffer {
+			conn.cond.Wait()
+		}
+		if conn.state == tcpClosed {
+			conn.stack.lock.Unlock()
+			return
+		}
+		conn.sendBuf = append(conn.sendBuf, buffer[:n]...)
+		if err == io.EOF {
+			conn.hostEOF = true
+		} else if err != nil {
+			conn.reset()
+			conn.stack.lock.Unlock()
+			return
+		}
+		conn.output()
+		conn.finish()
+		conn.stack.lock.Unlock()
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+//
+// Guest -> host.
+//
+func (conn *tcpConn) writer() {
+	conn.stack.lock.Lock()
+	defer conn.stack.lock.Unlock()
+
+	for {
+		for conn.state != tcpClosed && len(conn.recvBuf) == 0 && !conn.guestFin {
+			conn.cond.Wait()
+		}
+		if conn.state == tcpClosed {
+			return
+		}
+
+		if len(conn.recvBuf) == 0 {
+			// The guest is done sending.
+			if tcp, ok := conn.host.(*net.TCPConn); ok {
+				tcp.CloseWrite()
+			}
+			conn.writerDone = true
+			conn.finish()
+			return
+		}
+
+		data := conn.recvBuf
+		conn.recvBuf = nil
+		conn.writing = len(data)
+		conn.stack.lock.Unlock()
+		_, err := conn.host.Write(data)
+		conn.stack.lock.Lock()
+		conn.writing = 0
+
+		if conn.state == tcpClosed {
+			return
+		}
+		if err != nil {
+			conn.reset()
+			return
+		}
+
+		// Let the guest know if the window opened up.
+		if conn.advertised < TcpWindow/2 {
+			conn.sendAck()
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package slirp
+
+import (
+	"net"
+	"time"
+)
+
+//
+// How long we keep idle UDP flows
+// (and the clients of UDP forwards).
+//
+const UdpTimeout = 2 * time.Minute
+
+//
+// A guest UDP flow, NATed onto a host socket.
+//
+type udpConn struct {
+	key        flow
+	guest      net.IP
+	guestPort  uint16
+	remote     net.IP
+	remotePort uint16
+	host       net.Conn
+}
+
+//
+// A host client of a UDP forward.
+//
+type udpPeer struct {
+	listener *net.UDPConn
+	address  *net.UDPAddr
+	last     time.Time
+}
+
+func (stack *Stack) udpInput(packet *ipv4, segment *udp) {
+
+	// A reply to a forwarded client?
+	if packet.dst.Equal(stack.config.Gateway) {
+		if peer, ok := stack.udpForwards[segment.dstPort]; ok {
+			peer.last = time.Now()
+			peer.listener.WriteToUDP(segment.payload, peer.address)
+			return
+		}
+	}
+
+	key := newFlow(packet.src, segment.srcPort, packet.dst, segment.dstPort)
+	conn, ok := stack.udp[key]
+	if !ok {
+		address := stack.hostAddress(packet.dst, segment.dstPort)
+		if address == "" {
+			return
+		}
+		host, err := net.Dial("udp", address)
+		if err != nil {
+			stack.debug("udp %s: %s", address, err.Error())
+			return
+		}
+		conn = &udpConn{
+			key:        key,
+			guest:      append(net.IP(nil), packet.src...),
+			guestPort:  segment.srcPort,
+			remote:     append(net.IP(nil), packet.dst...),
+			remotePort: segment.dstPort,
+			host:       host,
+		}
+		stack.udp[key] = conn
+		go conn.run(stack)
+	}
+
+	conn.host.Write(segment.payload)
+}
+
+func (conn *udpConn) run(stack *Stack) {
+	buffer := make([]byte, 65536)
+	for {
+		conn.host.SetReadDeadline(time.Now().Add(UdpTimeout))
+		n, err := conn.host.Read(buffer)
+
+		stack.lock.Lock()
+		if err != nil {
+			if stack.udp[conn.key] == conn {
+				delete(stack.udp, conn.key)
+			}
+			stack.lock.Unlock()
+			conn.host.Close()
+			return
+		}
+		stack.sendIP(
+			ProtoUdp,
+			conn.remote,
+			conn.guest,
+			buildUdp(conn.remote, conn.remotePort, conn.guest, conn.guestPort, buffer[:n]))
+		stack.lock.Unlock()
+	}
+}
+
+func (stack *Stack) listenUdp(forward Forward) error {
+	address, err := net.ResolveUDPAddr("udp", forward.Host)
+	if err != nil {
+		return err
+	}
+	listener, err := net.ListenUDP("udp", address)
+	if err != nil {
+		return err
+	}
+	stack.listeners = append(stack.listeners, listener)
+	stack.addresses = append(stack.addresses, listener.LocalAddr())
+
+	go stack.forwardUdp(listener, forward)
+	return nil
+}
+
+//
+// Each host client gets its own gateway port, which is
+// given up once the client has been idle for a while
+// (with nothing either way), or the listener is closed.
+//
+func (stack *Stack) forwardUdp(listener *net.UDPConn, forward Forward) {
+	clients := make(map[string]uint16)
+	defer func() {
+		stack.lock.Lock()
+		for _, port := range clients {
+			delete(stack.udpForwards, port)
+		}
+		stack.lock.Unlock()
+	}()
+
+	expire := func(now time.Time) {
+		for name, port := range clients {
+			if now.Sub(stack.udpForwards[port].last) >= UdpTimeout {
+				delete(stack.udpForwards, port)
+				delete(clients, name)
+			}
+		}
+	}
+
+	buffer := make([]byte, 65536)
+	swept := time.Now()
+	for {
+		listener.SetReadDeadline(time.Now().Add(UdpTimeout))
+		n, client, err := listener.ReadFromUDP(buffer)
+		if err != nil {
+			if net_err, ok := err.(net.Error); ok && net_err.Timeout() {
+				// Nothing from anyone.
+				stack.lock.Lock()
+				expire(time.Now())
+				stack.lock.Unlock()
+				continue
+			}
+			return
+		}
+
+		stack.lock.Lock()
+		now := time.Now()
+		if now.Sub(swept) >= UdpTimeout {
+			expire(now)
+			swept = now
+		}
+		port, ok := clients[client.String()]
+		if !ok {
+			port = stack.ephemeral()
+			clients[client.String()] = port
+			stack.udpForwards[port] = &udpPeer{listener: listener, address: client}
+		}
+		stack.udpForwards[port].last = now
+		stack.sendIP(
+			ProtoUdp,
+			stack.config.Gateway,
+			stack.config.Guest,
+			buildUdp(stack.config.Gateway, port, stack.config.Guest, forward.Port, buffer[:n]))
+		stack.lock.Unlock()
+	}
+}
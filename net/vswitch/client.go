@@ -0,0 +1,40 @@
+package vswitch
+
+import (
+	"encoding/json"
+
+	unix "golang.org/x/sys/unix"
+)
+
+//
+// Connect a port to the switch at the given path.
+//
+// This returns a raw fd, to be used like a tap (one frame
+// per read or write, without a vnet header).
+//
+// NOTE: The fd is deliberately not CLOEXEC, so that
+// it is preserved across a re-exec.
+//
+func Connect(path string, config PortConfig) (int, error) {
+	hello, err := json.Marshal(&config)
+	if err != nil {
+		return -1, err
+	}
+
+	fd, err := unix.Socket(unix.AF_UNIX, unix.SOCK_SEQPACKET, 0)
+	if err != nil {
+		return -1, err
+	}
+	err = unix.Connect(fd, &unix.SockaddrUnix{Name: path})
+	if err != nil {
+		unix.Close(fd)
+		return -1, err
+	}
+	_, err = unix.Write(fd, hello)
+	if err != nil {
+		unix.Close(fd)
+		return -1, err
+	}
+
+	return fd, nil
+}
@@ -0,0 +1,288 @@
+package vswitch
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+//
+// How long we remember where a mac lives.
+//
+const AgeTime = 5 * time.Minute
+
+//
+// Frames queued per port before we drop.
+//
+const PortQueue = 256
+
+//
+// PortConfig --
+//
+// Sent by each client when it connects (as the first
+// message on the socket, in JSON).
+//
+// A port with a VLAN is an access port: frames from it are
+// untagged and belong to that VLAN, and it only sees frames
+// on that VLAN (untagged). A port without a VLAN is a trunk:
+// frames carry their own 802.1Q tags.
+//
+// Isolated ports can't talk to each other, only to
+// ports that are not isolated (e.g. a router).
+//
+type PortConfig struct {
+	Vlan     uint16 `json:"vlan,omitempty"`
+	Isolated bool   `json:"isolated,omitempty"`
+}
+
+type port struct {
+	id     int
+	config PortConfig
+	conn   *net.UnixConn
+	out    chan []byte
+	done   chan struct{}
+}
+
+type entry struct {
+	vlan uint16
+	mac  [6]byte
+}
+
+type station struct {
+	port *port
+	seen time.Time
+}
+
+//
+// Switch --
+//
+// A learning L2 switch. Each client connects over a
+// unix seqpacket socket and exchanges one frame per
+// message (no vnet header). Unknown unicast, broadcast
+// and multicast frames are flooded.
+//
+type Switch struct {
+	// Log what we're doing?
+	Debug bool
+
+	ports map[int]*port
+	table map[entry]station
+	next  int
+
+	lock sync.Mutex
+}
+
+func New() *Switch {
+	return &Switch{
+		ports: make(map[int]*port),
+		table: make(map[entry]station),
+	}
+}
+
+func (sw *Switch) debug(format string, args ...interface{}) {
+	if sw.Debug {
+		log.Printf("switch: "+format, args...)
+	}
+}
+
+//
+// Listen on the given path.
+// Any stale socket is removed first.
+//
+func Listen(path string) (*net.UnixListener, error) {
+	os.Remove(path)
+	return net.ListenUnix("unixpacket", &net.UnixAddr{Name: path, Net: "unixpacket"})
+}
+
+//
+// Accept ports until the listener is closed.
+//
+func (sw *Switch) Serve(listener *net.UnixListener) error {
+	for {
+		conn, err := listener.AcceptUnix()
+		if err != nil {
+			return err
+		}
+		go sw.serve(conn)
+	}
+}
+
+func (sw *Switch) serve(conn *net.UnixConn) {
+	defer conn.Close()
+
+	buffer := make([]byte, 65536)
+	n, err := conn.Read(buffer)
+	if err != nil {
+		return
+	}
+	var config PortConfig
+	err = json.Unmarshal(buffer[:n], &config)
+	if err != nil || config.Vlan > 4094 {
+		sw.debug("bad port config: %s", string(buffer[:n]))
+		return
+	}
+
+	port := sw.add(conn, config)
+	defer sw.remove(port)
+	go port.write()
+
+	for {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			return
+		}
+		frame := make([]byte, n)
+		copy(frame, buffer[:n])
+		sw.forward(port, frame)
+	}
+}
+
+func (port *port) write() {
+	for {
+		select {
+		case frame := <-port.out:
+			_, err := port.conn.Write(frame)
+			if err != nil {
+				return
+			}
+		case <-port.done:
+			return
+		}
+	}
+}
+
+func (sw *Switch) add(conn *net.UnixConn, config PortConfig) *port {
+	sw.lock.Lock()
+	defer sw.lock.Unlock()
+
+	sw.next += 1
+	port := &port{
+		id:     sw.next,
+		config: config,
+		conn:   conn,
+		out:    make(chan []byte, PortQueue),
+		done:   make(chan struct{}),
+	}
+	sw.ports[port.id] = port
+	sw.debug("port %d up (vlan %d, isolated %v)", port.id, config.Vlan, config.Isolated)
+	return port
+}
+
+func (sw *Switch) remove(port *port) {
+	sw.lock.Lock()
+	defer sw.lock.Unlock()
+
+	delete(sw.ports, port.id)
+	for key, station := range sw.table {
+		if station.port == port {
+			delete(sw.table, key)
+		}
+	}
+	close(port.done)
+	sw.debug("port %d down", port.id)
+}
+
+//
+// The number of connected ports.
+//
+func (sw *Switch) Ports() int {
+	sw.lock.Lock()
+	defer sw.lock.Unlock()
+	return len(sw.ports)
+}
+
+//
+// Can frames on this VLAN go from one port to another?
+//
+func eligible(src *port, dst *port, vlan uint16) bool {
+	if dst == src {
+		return false
+	}
+	if dst.config.Vlan != 0 && dst.config.Vlan != vlan {
+		return false
+	}
+	return !(src.config.Isolated && dst.config.Isolated)
+}
+
+//
+// Queue a frame (we drop if the port is behind).
+//
+func (sw *Switch) deliver(dst *port, vlan uint16, frame []byte) {
+	if dst.config.Vlan == 0 && vlan != 0 {
+		// Tag it for the trunk.
+		tagged := make([]byte, len(frame)+4)
+		copy(tagged[0:12], frame[0:12])
+		binary.BigEndian.PutUint16(tagged[12:14], 0x8100)
+		binary.BigEndian.PutUint16(tagged[14:16], vlan)
+		copy(tagged[16:], frame[12:])
+		frame = tagged
+	}
+
+	select {
+	case dst.out <- frame:
+	default:
+		sw.debug("port %d: dropped frame", dst.id)
+	}
+}
+
+func (sw *Switch) forward(src *port, frame []byte) {
+	if len(frame) < 14 {
+		return
+	}
+
+	// Figure out the VLAN, and strip any tag.
+	vlan := src.config.Vlan
+	if binary.BigEndian.Uint16(frame[12:14]) == 0x8100 {
+		if vlan != 0 || len(frame) < 18 {
+			// Not allowed on an access port.
+			return
+		}
+		vlan = binary.BigEndian.Uint16(frame[14:16]) & 0xfff
+		untagged := make([]byte, len(frame)-4)
+		copy(untagged[0:12], frame[0:12])
+		copy(untagged[12:], frame[16:])
+		frame = untagged
+	}
+
+	sw.lock.Lock()
+	defer sw.lock.Unlock()
+
+	now := time.Now()
+	var source, dest entry
+	source.vlan = vlan
+	copy(source.mac[:], frame[6:12])
+	dest.vlan = vlan
+	copy(dest.mac[:], frame[0:6])
+
+	// Learn.
+	if source.mac[0]&1 == 0 {
+		if existing, ok := sw.table[source]; !ok || existing.port != src {
+			sw.debug("%s on port %d (vlan %d)", net.HardwareAddr(source.mac[:]), src.id, vlan)
+		}
+		sw.table[source] = station{port: src, seen: now}
+	}
+
+	// Known unicast?
+	if dest.mac[0]&1 == 0 {
+		if station, ok := sw.table[dest]; ok {
+			if now.Sub(station.seen) < AgeTime {
+				if eligible(src, station.port, vlan) {
+					sw.deliver(station.port, vlan, frame)
+				}
+				return
+			}
+			delete(sw.table, dest)
+		}
+	}
+
+	// Flood.
+	for _, dst := range sw.ports {
+		if eligible(src, dst, vlan) {
+			sw.deliver(dst, vlan, frame)
+		}
+	}
+}
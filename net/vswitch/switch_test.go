@@ -0,0 +1,188 @@
+package vswitch
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	unix "golang.org/x/sys/unix"
+)
+
+func start(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "switch")
+	listener, err := Listen(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sw := New()
+	go sw.Serve(listener)
+	t.Cleanup(func() { listener.Close() })
+	return path
+}
+
+type testPort struct {
+	t    *testing.T
+	file *os.File
+}
+
+func connect(t *testing.T, path string, config PortConfig) *testPort {
+	fd, err := Connect(path, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unix.SetNonblock(fd, true)
+	port := &testPort{t: t, file: os.NewFile(uintptr(fd), "port")}
+	t.Cleanup(func() { port.file.Close() })
+	return port
+}
+
+func mac(n byte) []byte {
+	return []byte{0x52, 0x54, 0, 0, 0, n}
+}
+
+func frame(dst []byte, src []byte, payload string) []byte {
+	data := make([]byte, 14+len(payload))
+	copy(data[0:6], dst)
+	copy(data[6:12], src)
+	binary.BigEndian.PutUint16(data[12:14], 0x0800)
+	copy(data[14:], payload)
+	return data
+}
+
+func tagged(data []byte, vlan uint16) []byte {
+	result := make([]byte, len(data)+4)
+	copy(result[0:12], data[0:12])
+	binary.BigEndian.PutUint16(result[12:14], 0x8100)
+	binary.BigEndian.PutUint16(result[14:16], vlan)
+	copy(result[16:], data[12:])
+	return result
+}
+
+func (port *testPort) send(data []byte) {
+	_, err := port.file.Write(data)
+	if err != nil {
+		port.t.Fatal(err)
+	}
+}
+
+//
+// The next frame, or nil if nothing arrives.
+//
+func (port *testPort) recv() []byte {
+	port.file.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	buffer := make([]byte, 65536)
+	n, err := port.file.Read(buffer)
+	if err != nil {
+		return nil
+	}
+	return buffer[:n]
+}
+
+func (port *testPort) expect(data []byte) {
+	port.t.Helper()
+	received := port.recv()
+	if !bytes.Equal(received, data) {
+		port.t.Fatalf("expected %x, got %x", data, received)
+	}
+}
+
+func (port *testPort) expectNothing() {
+	port.t.Helper()
+	received := port.recv()
+	if received != nil {
+		port.t.Fatalf("unexpected frame %x", received)
+	}
+}
+
+func wait(ports ...*testPort) {
+	// Ensure everyone is connected (the hello is async).
+	for _, port := range ports {
+		probe := frame(mac(0xff), mac(0xfe), "probe")
+		port.send(probe)
+	}
+	for _, port := range ports {
+		for port.recv() != nil {
+		}
+	}
+}
+
+func TestLearning(t *testing.T) {
+	path := start(t)
+	a := connect(t, path, PortConfig{})
+	b := connect(t, path, PortConfig{})
+	c := connect(t, path, PortConfig{})
+	wait(a, b, c)
+
+	// Unknown, so flooded.
+	hello := frame(mac(2), mac(1), "hello")
+	a.send(hello)
+	b.expect(hello)
+	c.expect(hello)
+
+	// Now b is known, so only a sees this.
+	reply := frame(mac(1), mac(2), "reply")
+	b.send(reply)
+	a.expect(reply)
+	c.expectNothing()
+
+	// And back again.
+	a.send(hello)
+	b.expect(hello)
+	c.expectNothing()
+
+	// Broadcast goes everywhere.
+	broadcast := frame([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, mac(3), "all")
+	c.send(broadcast)
+	a.expect(broadcast)
+	b.expect(broadcast)
+	c.expectNothing()
+}
+
+func TestVlan(t *testing.T) {
+	path := start(t)
+	a := connect(t, path, PortConfig{Vlan: 10})
+	b := connect(t, path, PortConfig{Vlan: 20})
+	c := connect(t, path, PortConfig{Vlan: 10})
+	trunk := connect(t, path, PortConfig{})
+	wait(a, b, c, trunk)
+
+	// Only vlan 10 (and the trunk, tagged).
+	hello := frame(mac(2), mac(1), "hello")
+	a.send(hello)
+	c.expect(hello)
+	trunk.expect(tagged(hello, 10))
+	b.expectNothing()
+
+	// Tagged from the trunk reaches the access port untagged.
+	other := frame(mac(4), mac(5), "other")
+	trunk.send(tagged(other, 20))
+	b.expect(other)
+	a.expectNothing()
+	c.expectNothing()
+
+	// Tagged frames aren't allowed from access ports.
+	a.send(tagged(other, 20))
+	b.expectNothing()
+	trunk.expectNothing()
+}
+
+func TestIsolation(t *testing.T) {
+	path := start(t)
+	a := connect(t, path, PortConfig{Isolated: true})
+	b := connect(t, path, PortConfig{Isolated: true})
+	router := connect(t, path, PortConfig{})
+	wait(a, b, router)
+
+	hello := frame(mac(2), mac(1), "hello")
+	a.send(hello)
+	router.expect(hello)
+	b.expectNothing()
+
+	reply := frame(mac(1), mac(3), "reply")
+	router.send(reply)
+	a.expect(reply)
+	b.expectNothing()
+}
@@ -6,3 +6,9 @@ import (
 
 var InvalidControlSocket = errors.New("Invalid control socket?")
 var InternalGuestError = errors.New("Internal guest error?")
+var DeviceNotFound = errors.New("Device not found?")
+var NotABlockDevice = errors.New("Not a block device?")
+var NotANetDevice = errors.New("Not a network device?")
+var NotAConsoleDevice = errors.New("Not a console device?")
+var NotAScsiDevice = errors.New("Not a scsi device?")
+var NotAFsDevice = errors.New("Not a filesystem device?")
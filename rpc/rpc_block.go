@@ -0,0 +1,163 @@
+package control
+
+import (
+	machine "github.com/multiverse-os/portalgun/vm"
+)
+
+//
+// Block device controls.
+type BlockCommitSettings struct {
+	// The device name.
+	Name string `json:"name"`
+	// Where to write the new base image.
+	Path string `json:"path"`
+}
+
+type BlockDiscardSettings struct {
+	// The device name.
+	Name string `json:"name"`
+}
+
+type BlockExportSettings struct {
+	// The device name.
+	Name string `json:"name"`
+	// Either "unix" or "tcp".
+	Network string `json:"network"`
+	// Where to listen.
+	Address string `json:"address"`
+	// Refuse writes?
+	ReadOnly bool `json:"readonly"`
+}
+
+type BlockUnexportSettings struct {
+	// The device name.
+	Name string `json:"name"`
+}
+
+type BlockStatsSettings struct {
+	// The device name.
+	Name string `json:"name"`
+}
+
+type BlockBackupSettings struct {
+	// The device name.
+	Name string `json:"name"`
+	// Where to write the backup.
+	Target string `json:"target"`
+	// Only regions changed since the last backup?
+	Incremental bool `json:"incremental"`
+}
+
+type BlockBackupStatusSettings struct {
+	// The device name.
+	Name string `json:"name"`
+}
+
+type BlockBackupCancelSettings struct {
+	// The device name.
+	Name string `json:"name"`
+}
+
+type BlockUnlockSettings struct {
+	// The device name.
+	Name string `json:"name"`
+	// The image passphrase.
+	Passphrase string `json:"passphrase"`
+}
+
+func (rpc *RPC) blockDevice(name string) (*machine.VirtioBlockDevice, error) {
+	for _, device := range rpc.model.Devices() {
+		if device.Name() == name {
+			block, ok := device.(*machine.VirtioBlockDevice)
+			if !ok {
+				return nil, NotABlockDevice
+			}
+			return block, nil
+		}
+	}
+	return nil, DeviceNotFound
+}
+
+func (rpc *RPC) BlockCommit(settings *BlockCommitSettings, nop *Nop) error {
+	block, err := rpc.blockDevice(settings.Name)
+	if err != nil {
+		return err
+	}
+	return block.Commit(settings.Path)
+}
+
+// NOTE: The guest sees the disk revert underneath it,
+// so this is really only safe while the guest is paused
+// or not using the device (e.g. prior to a reboot).
+func (rpc *RPC) BlockDiscard(settings *BlockDiscardSettings, nop *Nop) error {
+	block, err := rpc.blockDevice(settings.Name)
+	if err != nil {
+		return err
+	}
+	return block.Discard()
+}
+
+func (rpc *RPC) BlockStats(settings *BlockStatsSettings, stats *machine.BlockThrottleStats) error {
+	block, err := rpc.blockDevice(settings.Name)
+	if err != nil {
+		return err
+	}
+	*stats = block.ThrottleStats()
+	return nil
+}
+
+func (rpc *RPC) BlockExport(settings *BlockExportSettings, nop *Nop) error {
+	block, err := rpc.blockDevice(settings.Name)
+	if err != nil {
+		return err
+	}
+	network := settings.Network
+	if network == "" {
+		network = "unix"
+	}
+	return block.Export(network, settings.Address, settings.ReadOnly)
+}
+
+func (rpc *RPC) BlockUnexport(settings *BlockUnexportSettings, nop *Nop) error {
+	block, err := rpc.blockDevice(settings.Name)
+	if err != nil {
+		return err
+	}
+	return block.Unexport()
+}
+
+func (rpc *RPC) BlockUnlock(settings *BlockUnlockSettings, nop *Nop) error {
+	block, err := rpc.blockDevice(settings.Name)
+	if err != nil {
+		return err
+	}
+	return block.Unlock([]byte(settings.Passphrase))
+}
+
+func (rpc *RPC) BlockBackup(settings *BlockBackupSettings, nop *Nop) error {
+	block, err := rpc.blockDevice(settings.Name)
+	if err != nil {
+		return err
+	}
+	return block.Backup(settings.Target, settings.Incremental)
+}
+
+func (rpc *RPC) BlockBackupStatus(
+	settings *BlockBackupStatusSettings,
+	status *machine.BlockBackupStatus) error {
+
+	block, err := rpc.blockDevice(settings.Name)
+	if err != nil {
+		return err
+	}
+	*status, err = block.BackupStatus()
+	return err
+}
+
+func (rpc *RPC) BlockBackupCancel(settings *BlockBackupCancelSettings, nop *Nop) error {
+	block, err := rpc.blockDevice(settings.Name)
+	if err != nil {
+		return err
+	}
+	return block.BackupCancel()
+}
@@ -0,0 +1,89 @@
+package control
+
+import (
+	machine "github.com/multiverse-os/portalgun/vm"
+)
+
+//
+// Console port controls.
+type PortAddSettings struct {
+	// The device name.
+	Name string `json:"name"`
+	// The port to add.
+	Port machine.VirtioConsolePortInfo `json:"port"`
+}
+
+type PortRemoveSettings struct {
+	// The device name.
+	Name string `json:"name"`
+	// The port name.
+	Port string `json:"port"`
+}
+
+type PortListSettings struct {
+	// The device name.
+	Name string `json:"name"`
+}
+
+type ResizeSettings struct {
+	// The device name.
+	Name string `json:"name"`
+	// The port name.
+	Port string `json:"port"`
+	// The new size.
+	Cols uint16 `json:"cols"`
+	Rows uint16 `json:"rows"`
+}
+
+func (rpc *RPC) consoleDevice(name string) (*machine.VirtioConsoleDevice, error) {
+	for _, device := range rpc.model.Devices() {
+		if device.Name() == name {
+			console, ok := device.(*machine.VirtioConsoleDevice)
+			if !ok {
+				return nil, NotAConsoleDevice
+			}
+			return console, nil
+		}
+	}
+	return nil, DeviceNotFound
+}
+
+func (rpc *RPC) PortAdd(
+	settings *PortAddSettings,
+	port *machine.VirtioConsolePortInfo) error {
+
+	console, err := rpc.consoleDevice(settings.Name)
+	if err != nil {
+		return err
+	}
+	*port, err = console.AddPort(settings.Port)
+	return err
+}
+
+func (rpc *RPC) PortRemove(settings *PortRemoveSettings, nop *Nop) error {
+	console, err := rpc.consoleDevice(settings.Name)
+	if err != nil {
+		return err
+	}
+	return console.RemovePort(settings.Port)
+}
+
+func (rpc *RPC) PortList(
+	settings *PortListSettings,
+	ports *[]machine.VirtioConsolePortInfo) error {
+
+	console, err := rpc.consoleDevice(settings.Name)
+	if err != nil {
+		return err
+	}
+	*ports = console.PortList()
+	return nil
+}
+
+func (rpc *RPC) Resize(settings *ResizeSettings, nop *Nop) error {
+	console, err := rpc.consoleDevice(settings.Name)
+	if err != nil {
+		return err
+	}
+	return console.ResizePort(settings.Port, settings.Cols, settings.Rows)
+}
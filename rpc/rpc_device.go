@@ -2,6 +2,8 @@ package control
 
 import (
 	"regexp"
+
+	machine "github.com/multiverse-os/portalgun/vm"
 )
 
 //
@@ -11,6 +13,9 @@ type DeviceSettings struct {
 	Driver string `json:"driver"`
 	Debug  bool   `json:"debug"`
 	Paused bool   `json:"paused"`
+
+	// Block I/O limits (optional).
+	Throttle *machine.BlockLimits `json:"throttle,omitempty"`
 }
 
 func (rpc *RPC) Device(settings *DeviceSettings, nop *Nop) error {
@@ -29,6 +34,11 @@ func (rpc *RPC) Device(settings *DeviceSettings, nop *Nop) error {
 			rd.MatchString(device.Driver()) {
 
 			device.SetDebugging(settings.Debug)
+			if settings.Throttle != nil {
+				if block, ok := device.(*machine.VirtioBlockDevice); ok {
+					block.SetLimits(*settings.Throttle)
+				}
+			}
 			if settings.Paused {
 				err = device.Pause(true)
 			} else {
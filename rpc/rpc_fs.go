@@ -0,0 +1,94 @@
+package control
+
+import (
+	machine "github.com/multiverse-os/portalgun/vm"
+	plan9 "github.com/multiverse-os/portalgun/vm/fs/plan9"
+)
+
+//
+// Filesystem (write layer) controls.
+type FsDiffSettings struct {
+	// The device name.
+	Name string `json:"name"`
+}
+
+type FsExportSettings struct {
+	// The device name.
+	Name string `json:"name"`
+	// Where to write the archive.
+	Path string `json:"path"`
+}
+
+type FsResetSettings struct {
+	// The device name.
+	Name string `json:"name"`
+}
+
+type FsCommitSettings struct {
+	// The device name.
+	Name string `json:"name"`
+	// Where to put the new read layer.
+	Path string `json:"path"`
+}
+
+func (rpc *RPC) fsDevice(name string) (*machine.VirtioFsDevice, error) {
+	for _, device := range rpc.model.Devices() {
+		if device.Name() == name {
+			fs, ok := device.(*machine.VirtioFsDevice)
+			if !ok {
+				return nil, NotAFsDevice
+			}
+			return fs, nil
+		}
+	}
+	return nil, DeviceNotFound
+}
+
+func (rpc *RPC) FsDiff(settings *FsDiffSettings, changes *[]plan9.Change) error {
+	fs, err := rpc.fsDevice(settings.Name)
+	if err != nil {
+		return err
+	}
+	*changes, err = fs.Diff()
+	return err
+}
+
+func (rpc *RPC) FsExport(settings *FsExportSettings, nop *Nop) error {
+	fs, err := rpc.fsDevice(settings.Name)
+	if err != nil {
+		return err
+	}
+	return fs.ExportChanges(settings.Path)
+}
+
+//
+// The guest is paused for these, as the files
+// are changing underneath it. (Though it may
+// still have stale data cached after a reset).
+// Requests already queued are held off by the
+// filesystem itself until the layers are done.
+func (rpc *RPC) FsReset(settings *FsResetSettings, nop *Nop) error {
+	fs, err := rpc.fsDevice(settings.Name)
+	if err != nil {
+		return err
+	}
+	err = rpc.VM.Pause(false)
+	if err != nil {
+		return err
+	}
+	defer rpc.VM.Unpause(false)
+	return fs.Reset()
+}
+
+func (rpc *RPC) FsCommit(settings *FsCommitSettings, nop *Nop) error {
+	fs, err := rpc.fsDevice(settings.Name)
+	if err != nil {
+		return err
+	}
+	err = rpc.VM.Pause(false)
+	if err != nil {
+		return err
+	}
+	defer rpc.VM.Unpause(false)
+	return fs.Commit(settings.Path)
+}
@@ -0,0 +1,168 @@
+package control
+
+import (
+	machine "github.com/multiverse-os/portalgun/vm"
+)
+
+//
+// Network device controls.
+type LinkSettings struct {
+	// The device name.
+	Name string `json:"name"`
+	// Bring the link up (or down)?
+	Up bool `json:"up"`
+}
+
+type AnnounceSettings struct {
+	// The device name.
+	Name string `json:"name"`
+}
+
+func (rpc *RPC) netDevice(name string) (*machine.VirtioNetDevice, error) {
+	for _, device := range rpc.model.Devices() {
+		if device.Name() == name {
+			nic, ok := device.(*machine.VirtioNetDevice)
+			if !ok {
+				return nil, NotANetDevice
+			}
+			return nic, nil
+		}
+	}
+	return nil, DeviceNotFound
+}
+
+func (rpc *RPC) Link(settings *LinkSettings, nop *Nop) error {
+	nic, err := rpc.netDevice(settings.Name)
+	if err != nil {
+		return err
+	}
+	return nic.SetLink(settings.Up)
+}
+
+func (rpc *RPC) Announce(settings *AnnounceSettings, nop *Nop) error {
+	nic, err := rpc.netDevice(settings.Name)
+	if err != nil {
+		return err
+	}
+	return nic.Announce()
+}
+
+type CaptureSettings struct {
+	// The device name.
+	Name string `json:"name"`
+	// The pcapng file to write.
+	Path string `json:"path"`
+	// Or, stream to this address.
+	Network string `json:"network"`
+	Address string `json:"address"`
+	// Bytes to keep from each frame (0 for all).
+	Snaplen int `json:"snaplen"`
+	// Which frames to keep (e.g. "tcp port 80").
+	Filter string `json:"filter"`
+}
+
+type CaptureStopSettings struct {
+	// The device name.
+	Name string `json:"name"`
+}
+
+type CaptureStatsSettings struct {
+	// The device name.
+	Name string `json:"name"`
+}
+
+func (rpc *RPC) Capture(settings *CaptureSettings, nop *Nop) error {
+	nic, err := rpc.netDevice(settings.Name)
+	if err != nil {
+		return err
+	}
+	return nic.StartCapture(
+		settings.Path,
+		settings.Network,
+		settings.Address,
+		settings.Snaplen,
+		settings.Filter)
+}
+
+func (rpc *RPC) CaptureStop(
+	settings *CaptureStopSettings,
+	stats *machine.VirtioNetCaptureStats) error {
+
+	nic, err := rpc.netDevice(settings.Name)
+	if err != nil {
+		return err
+	}
+	*stats, err = nic.StopCapture()
+	return err
+}
+
+func (rpc *RPC) CaptureStats(
+	settings *CaptureStatsSettings,
+	stats *machine.VirtioNetCaptureStats) error {
+
+	nic, err := rpc.netDevice(settings.Name)
+	if err != nil {
+		return err
+	}
+	*stats, err = nic.CaptureStats()
+	return err
+}
+
+type FirewallSettings struct {
+	// The device name.
+	Name string `json:"name"`
+	// The new rules & limits.
+	Config machine.VirtioNetFirewallConfig `json:"config"`
+}
+
+type FirewallClearSettings struct {
+	// The device name.
+	Name string `json:"name"`
+}
+
+type FirewallStatusSettings struct {
+	// The device name.
+	Name string `json:"name"`
+}
+
+func (rpc *RPC) Firewall(settings *FirewallSettings, nop *Nop) error {
+	nic, err := rpc.netDevice(settings.Name)
+	if err != nil {
+		return err
+	}
+	return nic.SetFirewall(settings.Config)
+}
+
+func (rpc *RPC) FirewallClear(settings *FirewallClearSettings, nop *Nop) error {
+	nic, err := rpc.netDevice(settings.Name)
+	if err != nil {
+		return err
+	}
+	nic.ClearFirewall()
+	return nil
+}
+
+// NOTE: The rules include their hit counters.
+func (rpc *RPC) FirewallRules(
+	settings *FirewallStatusSettings,
+	config *machine.VirtioNetFirewallConfig) error {
+
+	nic, err := rpc.netDevice(settings.Name)
+	if err != nil {
+		return err
+	}
+	*config, err = nic.FirewallConfig()
+	return err
+}
+
+func (rpc *RPC) FirewallStats(
+	settings *FirewallStatusSettings,
+	stats *machine.VirtioNetFirewallStats) error {
+
+	nic, err := rpc.netDevice(settings.Name)
+	if err != nil {
+		return err
+	}
+	*stats, err = nic.FirewallStats()
+	return err
+}
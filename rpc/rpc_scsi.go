@@ -0,0 +1,72 @@
+package control
+
+import (
+	machine "github.com/multiverse-os/portalgun/vm"
+)
+
+//
+// Scsi LUN controls.
+type ScsiAddSettings struct {
+	// The device name.
+	Name string `json:"name"`
+	// The LUN to add.
+	Lun machine.VirtioScsiLunInfo `json:"lun"`
+}
+
+type ScsiRemoveSettings struct {
+	// The device name.
+	Name string `json:"name"`
+	// The LUN address.
+	Target int `json:"target"`
+	Lun    int `json:"lun"`
+}
+
+type ScsiListSettings struct {
+	// The device name.
+	Name string `json:"name"`
+}
+
+func (rpc *RPC) scsiDevice(name string) (*machine.VirtioScsiDevice, error) {
+	for _, device := range rpc.model.Devices() {
+		if device.Name() == name {
+			scsi, ok := device.(*machine.VirtioScsiDevice)
+			if !ok {
+				return nil, NotAScsiDevice
+			}
+			return scsi, nil
+		}
+	}
+	return nil, DeviceNotFound
+}
+
+func (rpc *RPC) ScsiAdd(
+	settings *ScsiAddSettings,
+	lun *machine.VirtioScsiLunInfo) error {
+
+	scsi, err := rpc.scsiDevice(settings.Name)
+	if err != nil {
+		return err
+	}
+	*lun, err = scsi.AddLun(settings.Lun)
+	return err
+}
+
+func (rpc *RPC) ScsiRemove(settings *ScsiRemoveSettings, nop *Nop) error {
+	scsi, err := rpc.scsiDevice(settings.Name)
+	if err != nil {
+		return err
+	}
+	return scsi.RemoveLun(settings.Target, settings.Lun)
+}
+
+func (rpc *RPC) ScsiList(
+	settings *ScsiListSettings,
+	luns *[]machine.VirtioScsiLunInfo) error {
+
+	scsi, err := rpc.scsiDevice(settings.Name)
+	if err != nil {
+		return err
+	}
+	*luns = scsi.LunList()
+	return nil
+}
@@ -0,0 +1,13 @@
+package ring
+
+import (
+	"errors"
+)
+
+// Global errors.
+var (
+	InvalidSize       = errors.New("invalid ring size")
+	InvalidDescriptor = errors.New("invalid descriptor")
+	InvalidIndirect   = errors.New("invalid indirect table")
+	DescriptorLoop    = errors.New("descriptor chain too long")
+)
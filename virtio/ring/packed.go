@@ -0,0 +1,394 @@
+package ring
+
+import (
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+//
+// Packed descriptor flags.
+// (Along with DescFNext, DescFWrite & DescFIndirect.)
+//
+const (
+	PackedDescFAvail = 1 << 7
+	PackedDescFUsed  = 1 << 15
+)
+
+//
+// Event suppression flags.
+//
+const (
+	EventFlagEnable  = 0
+	EventFlagDisable = 1
+	EventFlagDesc    = 2
+)
+
+const (
+	EventSize = 4
+	eventWrap = 1 << 15
+)
+
+//
+// PackedBuffer --
+//
+// A buffer we've taken but not yet returned. We keep the
+// segments around, as the driver may reuse descriptors as
+// soon as anything ahead of them in the ring is used.
+//
+type PackedBuffer struct {
+	Segments []Segment `json:"segments"`
+
+	// The number of descriptors it used.
+	Count uint16 `json:"count"`
+}
+
+//
+// PackedState --
+//
+// Where we're up to in a packed ring. Unlike split rings,
+// none of this lives in guest memory, so it must be saved
+// by whoever owns the ring.
+//
+type PackedState struct {
+	// The next descriptor we'll take.
+	Avail     uint16 `json:"avail"`
+	AvailWrap bool   `json:"avail-wrap"`
+
+	// The next descriptor we'll write back.
+	Used     uint16 `json:"used"`
+	UsedWrap bool   `json:"used-wrap"`
+
+	// Buffers taken, by id.
+	Inflight map[uint16]PackedBuffer `json:"inflight"`
+}
+
+func NewPackedState() *PackedState {
+	return &PackedState{
+		AvailWrap: true,
+		UsedWrap:  true,
+		Inflight:  make(map[uint16]PackedBuffer),
+	}
+}
+
+//
+// Packed --
+//
+// A packed virtqueue: a single descriptor ring shared by
+// the driver and the device, with the driver and device
+// event suppression structures alongside.
+//
+type Packed struct {
+	// Number of entries.
+	Size uint16
+
+	memory Memory
+
+	desc   []byte
+	driver []byte
+	device []byte
+
+	// Our position (and what's inflight).
+	state *PackedState
+
+	// Protects the inflight map.
+	lock sync.Mutex
+
+	// For ordering stores against loads.
+	fence uint32
+}
+
+//
+// A packed ring with each part at the given address.
+//
+func NewPacked(
+	memory Memory,
+	size uint16,
+	desc uint64,
+	driver uint64,
+	device uint64,
+	state *PackedState) (*Packed, error) {
+
+	if size == 0 || size > MaxSize {
+		return nil, InvalidSize
+	}
+	if state.Inflight == nil {
+		state.Inflight = make(map[uint16]PackedBuffer)
+	}
+
+	ring := &Packed{Size: size, memory: memory, state: state}
+	var err error
+	ring.desc, err = memory.Map(desc, DescTableSize(size))
+	if err != nil {
+		return nil, err
+	}
+	ring.driver, err = memory.Map(driver, EventSize)
+	if err != nil {
+		return nil, err
+	}
+	ring.device, err = memory.Map(device, EventSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return ring, nil
+}
+
+//
+// The host addresses of each part.
+//
+func (ring *Packed) Addresses() (uintptr, uintptr, uintptr) {
+	return uintptr(unsafe.Pointer(&ring.desc[0])),
+		uintptr(unsafe.Pointer(&ring.driver[0])),
+		uintptr(unsafe.Pointer(&ring.device[0]))
+}
+
+//
+// The id & flags of a descriptor are read and written
+// together, so the flags are always the last thing the
+// other side sees change.
+//
+func (ring *Packed) flags(index uint16) (uint16, uint16) {
+	value := atomic.LoadUint32(header(ring.desc[DescSize*uint64(index)+12:]))
+	return uint16(value), uint16(value >> 16)
+}
+
+func isAvailable(flags uint16, wrap bool) bool {
+	avail := flags&PackedDescFAvail != 0
+	used := flags&PackedDescFUsed != 0
+	return avail == wrap && used != wrap
+}
+
+func (ring *Packed) descriptor(table []byte, index uint16) (Segment, uint16, uint16) {
+	entry := table[DescSize*uint64(index):]
+	flags := binary.LittleEndian.Uint16(entry[14:])
+	return Segment{
+		Addr:   binary.LittleEndian.Uint64(entry[0:]),
+		Length: binary.LittleEndian.Uint32(entry[8:]),
+		Write:  flags&DescFWrite != 0,
+	}, flags, binary.LittleEndian.Uint16(entry[12:])
+}
+
+func appendSegment(segments []Segment, segment Segment) ([]Segment, error) {
+	// Readable segments must come first.
+	if !segment.Write && len(segments) > 0 &&
+		segments[len(segments)-1].Write {
+		return nil, InvalidDescriptor
+	}
+	return append(segments, segment), nil
+}
+
+//
+// Walk an indirect table. In a packed ring, these
+// are simply read in order (there is no chaining).
+//
+func (ring *Packed) indirect(segment Segment) ([]Segment, error) {
+	if segment.Length == 0 ||
+		segment.Length%DescSize != 0 ||
+		uint64(segment.Length)/DescSize > MaxIndirect {
+		return nil, InvalidIndirect
+	}
+	table, err := ring.memory.Map(segment.Addr, uint64(segment.Length))
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []Segment
+	for index := uint16(0); uint64(index) < uint64(segment.Length)/DescSize; index += 1 {
+		entry, flags, _ := ring.descriptor(table, index)
+		if flags&DescFIndirect != 0 {
+			return nil, InvalidIndirect
+		}
+		segments, err = appendSegment(segments, entry)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return segments, nil
+}
+
+//
+// Take the next available buffer, if there is one.
+//
+// The buffer id comes from the last descriptor in the
+// chain. We give up on chains longer than the ring.
+//
+func (ring *Packed) Next() (uint16, []Segment, bool, error) {
+	state := ring.state
+	_, flags := ring.flags(state.Avail)
+	if !isAvailable(flags, state.AvailWrap) {
+		return 0, nil, false, nil
+	}
+
+	var segments []Segment
+	var id uint16
+	var err error
+	index := state.Avail
+	count := uint16(0)
+
+	for {
+		count += 1
+		if count > ring.Size {
+			return 0, nil, false, DescriptorLoop
+		}
+
+		var segment Segment
+		segment, flags, id = ring.descriptor(ring.desc, index)
+		index += 1
+		if index == ring.Size {
+			index = 0
+		}
+
+		if flags&DescFIndirect != 0 {
+			// Only on its own.
+			if len(segments) > 0 || flags&DescFNext != 0 {
+				return 0, nil, false, InvalidIndirect
+			}
+			segments, err = ring.indirect(segment)
+			if err != nil {
+				return 0, nil, false, err
+			}
+			break
+		}
+
+		segments, err = appendSegment(segments, segment)
+		if err != nil {
+			return 0, nil, false, err
+		}
+		if flags&DescFNext == 0 {
+			break
+		}
+	}
+
+	ring.lock.Lock()
+	defer ring.lock.Unlock()
+	if _, ok := state.Inflight[id]; ok {
+		// The driver is reusing an id?
+		return 0, nil, false, InvalidDescriptor
+	}
+	state.Inflight[id] = PackedBuffer{Segments: segments, Count: count}
+
+	// Move along.
+	state.Avail += count
+	if state.Avail >= ring.Size {
+		state.Avail -= ring.Size
+		state.AvailWrap = !state.AvailWrap
+	}
+
+	return id, segments, true, nil
+}
+
+//
+// A buffer we've already taken.
+//
+func (ring *Packed) Buffer(id uint16) ([]Segment, bool) {
+	ring.lock.Lock()
+	defer ring.lock.Unlock()
+	buffer, ok := ring.state.Inflight[id]
+	return buffer.Segments, ok
+}
+
+//
+// Where the used side is up to.
+//
+func (ring *Packed) Used() uint16 {
+	return ring.state.Used
+}
+
+//
+// Return a buffer to the driver.
+//
+// This takes up as many descriptors as the buffer did
+// when it was made available.
+//
+func (ring *Packed) Put(id uint16, length uint32) {
+	ring.lock.Lock()
+	buffer, ok := ring.state.Inflight[id]
+	delete(ring.state.Inflight, id)
+	ring.lock.Unlock()
+	if !ok {
+		buffer.Count = 1
+	}
+
+	state := ring.state
+	entry := ring.desc[DescSize*uint64(state.Used):]
+	binary.LittleEndian.PutUint32(entry[8:], length)
+	flags := uint16(0)
+	if state.UsedWrap {
+		flags = PackedDescFAvail | PackedDescFUsed
+	}
+	atomic.StoreUint32(header(entry[12:]), uint32(id)|uint32(flags)<<16)
+
+	state.Used += buffer.Count
+	if state.Used >= ring.Size {
+		state.Used -= ring.Size
+		state.UsedWrap = !state.UsedWrap
+	}
+}
+
+func event(data []byte) (uint16, uint16) {
+	value := atomic.LoadUint32(header(data))
+	return uint16(value), uint16(value >> 16)
+}
+
+//
+// Does the driver want an interrupt for the buffers
+// we've returned since old?
+//
+func (ring *Packed) NeedsInterrupt(old uint16, event_idx bool) bool {
+	off_wrap, flags := event(ring.driver)
+	switch {
+	case flags == EventFlagDisable:
+		return false
+	case flags == EventFlagDesc && event_idx:
+		// Work in terms of the lap old was in. If we've
+		// wrapped since, new is a lap ahead. The event is
+		// in whichever lap its wrap counter says.
+		base := 0
+		if ring.state.Used < old {
+			base = int(ring.Size)
+		}
+		new := int(ring.state.Used) + base
+		off := int(off_wrap&^eventWrap) + base
+		if (off_wrap&eventWrap != 0) != ring.state.UsedWrap {
+			off -= int(ring.Size)
+		}
+		return NeedEvent(uint16(off), uint16(new), old)
+	}
+	return true
+}
+
+//
+// We don't need kicks while we're busy consuming.
+//
+func (ring *Packed) DisableNotify(event_idx bool) {
+	atomic.StoreUint32(header(ring.device), uint32(EventFlagDisable)<<16)
+}
+
+//
+// Ask for a kick for the next available buffer.
+//
+// As with split rings, we return true if a buffer was
+// made available while we weren't looking.
+//
+func (ring *Packed) EnableNotify(event_idx bool) bool {
+	state := ring.state
+	if event_idx {
+		off_wrap := uint32(state.Avail)
+		if state.AvailWrap {
+			off_wrap |= eventWrap
+		}
+		atomic.StoreUint32(header(ring.device), off_wrap|uint32(EventFlagDesc)<<16)
+	} else {
+		atomic.StoreUint32(header(ring.device), uint32(EventFlagEnable)<<16)
+	}
+
+	// The store above must be visible before we
+	// look at the next descriptor again.
+	atomic.AddUint32(&ring.fence, 1)
+
+	_, flags := ring.flags(state.Avail)
+	return isAvailable(flags, state.AvailWrap)
+}
@@ -0,0 +1,317 @@
+package ring
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+)
+
+//
+// A simulated packed ring driver.
+//
+type testPackedGuest struct {
+	memory testMemory
+	size   uint16
+	desc   uint64
+	driver uint64
+	device uint64
+
+	// Where the driver is up to.
+	next     uint16
+	wrap     bool
+	used     uint16
+	usedWrap bool
+
+	state *PackedState
+	ring  *Packed
+}
+
+func newPackedGuest(t *testing.T, size uint16) *testPackedGuest {
+	guest := &testPackedGuest{
+		memory:   make(testMemory, 1<<20),
+		size:     size,
+		desc:     0x1000,
+		driver:   0x1000 + DescTableSize(size),
+		device:   0x1000 + DescTableSize(size) + EventSize,
+		wrap:     true,
+		usedWrap: true,
+		state:    NewPackedState(),
+	}
+	var err error
+	guest.ring, err = NewPacked(
+		guest.memory,
+		size,
+		guest.desc,
+		guest.driver,
+		guest.device,
+		guest.state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return guest
+}
+
+func (guest *testPackedGuest) flags(wrap bool) uint16 {
+	if wrap {
+		return PackedDescFAvail
+	}
+	return PackedDescFUsed
+}
+
+func writePacked(table []byte, index uint16, addr uint64, length uint32, id uint16, flags uint16) {
+	entry := table[DescSize*uint64(index):]
+	binary.LittleEndian.PutUint64(entry[0:], addr)
+	binary.LittleEndian.PutUint32(entry[8:], length)
+	binary.LittleEndian.PutUint16(entry[12:], id)
+	binary.LittleEndian.PutUint16(entry[14:], flags)
+}
+
+//
+// Make a buffer available. The first descriptor's
+// flags are written last, as a real driver would.
+//
+func (guest *testPackedGuest) publish(id uint16, segments []Segment, extra uint16) {
+	head := guest.next
+	headWrap := guest.wrap
+	var headFlags uint16
+
+	for i, segment := range segments {
+		flags := extra
+		if segment.Write {
+			flags |= DescFWrite
+		}
+		if i < len(segments)-1 {
+			flags |= DescFNext
+		}
+		flags |= guest.flags(guest.wrap)
+		if i == 0 {
+			headFlags = flags
+			flags = guest.flags(!headWrap)
+		}
+		writePacked(guest.memory[guest.desc:], guest.next, segment.Addr, segment.Length, id, flags)
+
+		guest.next += 1
+		if guest.next == guest.size {
+			guest.next = 0
+			guest.wrap = !guest.wrap
+		}
+	}
+
+	binary.LittleEndian.PutUint16(guest.memory[guest.desc+DescSize*uint64(head)+14:], headFlags)
+}
+
+//
+// Collect a used buffer, if there is one.
+//
+func (guest *testPackedGuest) collect(count uint16) (uint16, uint32, bool) {
+	entry := guest.memory[guest.desc+DescSize*uint64(guest.used):]
+	flags := binary.LittleEndian.Uint16(entry[14:])
+	avail := flags&PackedDescFAvail != 0
+	used := flags&PackedDescFUsed != 0
+	if avail != guest.usedWrap || used != guest.usedWrap {
+		return 0, 0, false
+	}
+	guest.used += count
+	if guest.used >= guest.size {
+		guest.used -= guest.size
+		guest.usedWrap = !guest.usedWrap
+	}
+	return binary.LittleEndian.Uint16(entry[12:]), binary.LittleEndian.Uint32(entry[8:]), true
+}
+
+func (guest *testPackedGuest) setEvent(off_wrap uint16, flags uint16) {
+	binary.LittleEndian.PutUint16(guest.memory[guest.driver:], off_wrap)
+	binary.LittleEndian.PutUint16(guest.memory[guest.driver+2:], flags)
+}
+
+func TestPackedChains(t *testing.T) {
+	guest := newPackedGuest(t, 4)
+	if _, _, ok, _ := guest.ring.Next(); ok {
+		t.Fatal("unexpected buffer")
+	}
+
+	// Go around the ring a few times, with chains
+	// that straddle the end of the ring.
+	chain := []Segment{
+		{0x10000, 16, false},
+		{0x20000, 512, true},
+		{0x30000, 1, true},
+	}
+	for i := uint16(0); i < 8; i += 1 {
+		guest.publish(i, chain, 0)
+
+		id, segments, ok, err := guest.ring.Next()
+		if err != nil || !ok || id != i {
+			t.Fatalf("round %d: got %d, %v, %v", i, id, ok, err)
+		}
+		expectSegments(t, segments, chain)
+		if _, _, ok, _ := guest.ring.Next(); ok {
+			t.Fatalf("round %d: unexpected buffer", i)
+		}
+
+		guest.ring.Put(id, 100+uint32(i))
+		used, length, ok := guest.collect(uint16(len(chain)))
+		if !ok || used != i || length != 100+uint32(i) {
+			t.Fatalf("round %d: used %d, %d, %v", i, used, length, ok)
+		}
+		if guest.state.Avail != guest.next || guest.state.AvailWrap != guest.wrap {
+			t.Fatalf("round %d: device at %d, driver at %d", i, guest.state.Avail, guest.next)
+		}
+	}
+}
+
+func TestPackedIndirect(t *testing.T) {
+	guest := newPackedGuest(t, 4)
+	table := guest.memory[0x40000:]
+	writePacked(table, 0, 0x10000, 16, 0, 0)
+	writePacked(table, 1, 0x20000, 4096, 0, DescFWrite)
+	guest.publish(7, []Segment{{0x40000, 2 * DescSize, false}}, DescFIndirect)
+
+	id, segments, ok, err := guest.ring.Next()
+	if err != nil || !ok || id != 7 {
+		t.Fatalf("got %d, %v, %v", id, ok, err)
+	}
+	expectSegments(t, segments, []Segment{
+		{0x10000, 16, false},
+		{0x20000, 4096, true},
+	})
+
+	// An indirect descriptor uses one slot.
+	guest.ring.Put(7, 0)
+	if used, _, ok := guest.collect(1); !ok || used != 7 {
+		t.Fatalf("used %d, %v", used, ok)
+	}
+
+	// No nesting.
+	writePacked(table, 0, 0x40000, DescSize, 0, DescFIndirect)
+	guest.publish(8, []Segment{{0x40000, DescSize, false}}, DescFIndirect)
+	if _, _, _, err := guest.ring.Next(); err != InvalidIndirect {
+		t.Fatalf("expected %v, got %v", InvalidIndirect, err)
+	}
+}
+
+func TestPackedOutOfOrder(t *testing.T) {
+	guest := newPackedGuest(t, 8)
+	guest.publish(1, []Segment{{0x10000, 16, false}, {0x11000, 16, true}}, 0)
+	guest.publish(2, []Segment{{0x20000, 16, true}}, 0)
+	for i := 0; i < 2; i += 1 {
+		if _, _, ok, err := guest.ring.Next(); !ok || err != nil {
+			t.Fatalf("buffer %d: %v, %v", i, ok, err)
+		}
+	}
+
+	// The state survives a round trip (as it
+	// would across a restore) with the buffers.
+	data, err := json.Marshal(guest.state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := new(PackedState)
+	if err := json.Unmarshal(data, restored); err != nil {
+		t.Fatal(err)
+	}
+	guest.ring, err = NewPacked(guest.memory, 8, guest.desc, guest.driver, guest.device, restored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if segments, ok := guest.ring.Buffer(1); !ok || len(segments) != 2 {
+		t.Fatalf("lost buffer: %v", segments)
+	}
+
+	// The second buffer comes back first.
+	guest.ring.Put(2, 16)
+	guest.ring.Put(1, 16)
+	if id, _, ok := guest.collect(1); !ok || id != 2 {
+		t.Fatalf("expected 2, got %d", id)
+	}
+	if id, _, ok := guest.collect(2); !ok || id != 1 {
+		t.Fatalf("expected 1, got %d", id)
+	}
+	if restored.Used != 3 || len(restored.Inflight) != 0 {
+		t.Fatalf("bad state %+v", restored)
+	}
+}
+
+func TestPackedBadChains(t *testing.T) {
+	guest := newPackedGuest(t, 4)
+
+	// A chain that goes all the way around.
+	for i := uint16(0); i < 4; i += 1 {
+		writePacked(guest.memory[guest.desc:], i, 0x10000, 16, 0, DescFNext|PackedDescFAvail)
+	}
+	if _, _, _, err := guest.ring.Next(); err != DescriptorLoop {
+		t.Fatalf("expected %v, got %v", DescriptorLoop, err)
+	}
+
+	// Writable before readable.
+	guest = newPackedGuest(t, 4)
+	guest.publish(0, []Segment{{0x10000, 16, true}, {0x10000, 16, false}}, 0)
+	if _, _, _, err := guest.ring.Next(); err != InvalidDescriptor {
+		t.Fatalf("expected %v, got %v", InvalidDescriptor, err)
+	}
+
+	// Reusing an id that's inflight.
+	guest = newPackedGuest(t, 4)
+	guest.publish(3, []Segment{{0x10000, 16, false}}, 0)
+	guest.publish(3, []Segment{{0x10000, 16, false}}, 0)
+	guest.ring.Next()
+	if _, _, _, err := guest.ring.Next(); err != InvalidDescriptor {
+		t.Fatalf("expected %v, got %v", InvalidDescriptor, err)
+	}
+}
+
+func TestPackedEvents(t *testing.T) {
+	guest := newPackedGuest(t, 4)
+	segment := []Segment{{0x10000, 16, false}}
+
+	// Enabled, disabled, and at a given descriptor.
+	for _, event_idx := range []bool{false, true} {
+		guest.setEvent(0, EventFlagEnable)
+		if !guest.ring.NeedsInterrupt(guest.ring.Used(), event_idx) {
+			t.Fatal("expected an interrupt")
+		}
+		guest.setEvent(0, EventFlagDisable)
+		if guest.ring.NeedsInterrupt(guest.ring.Used(), event_idx) {
+			t.Fatal("unexpected interrupt")
+		}
+	}
+
+	// Ask for an interrupt once the third buffer is used.
+	guest.setEvent(2|eventWrap, EventFlagDesc)
+	interrupts := 0
+	for i := uint16(0); i < 4; i += 1 {
+		guest.publish(i, segment, 0)
+		guest.ring.Next()
+		old := guest.ring.Used()
+		guest.ring.Put(i, 0)
+		if guest.ring.NeedsInterrupt(old, true) {
+			interrupts += 1
+			if i != 2 {
+				t.Fatalf("interrupt at %d", i)
+			}
+		}
+	}
+	if interrupts != 1 {
+		t.Fatalf("expected one interrupt, got %d", interrupts)
+	}
+
+	// And the device side: kicks are off while busy,
+	// and on (at the next descriptor) when idle.
+	guest.ring.DisableNotify(true)
+	if flags := binary.LittleEndian.Uint16(guest.memory[guest.device+2:]); flags != EventFlagDisable {
+		t.Fatalf("bad device flags %d", flags)
+	}
+	if guest.ring.EnableNotify(true) {
+		t.Fatal("nothing should be available")
+	}
+	off_wrap := binary.LittleEndian.Uint16(guest.memory[guest.device:])
+	flags := binary.LittleEndian.Uint16(guest.memory[guest.device+2:])
+	if flags != EventFlagDesc || off_wrap != 0 {
+		// We've wrapped once, so the counter is clear.
+		t.Fatalf("bad device event %x/%d", off_wrap, flags)
+	}
+	guest.publish(4, segment, 0)
+	if !guest.ring.EnableNotify(false) {
+		t.Fatal("missed a buffer")
+	}
+}
@@ -0,0 +1,327 @@
+package ring
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+var outOfRange = errors.New("out of range")
+
+//
+// Guest memory, as a flat slab.
+//
+type testMemory []byte
+
+func (memory testMemory) Map(addr uint64, size uint64) ([]byte, error) {
+	if addr+size > uint64(len(memory)) || addr+size < addr {
+		return nil, outOfRange
+	}
+	return memory[addr : addr+size], nil
+}
+
+//
+// A simulated guest driver.
+//
+type testGuest struct {
+	memory testMemory
+	size   uint16
+	desc   uint64
+	avail  uint64
+	used   uint64
+	next   uint16
+	ring   *Split
+}
+
+const testRingAddr = 0x1000
+
+func newGuest(t *testing.T, size uint16) *testGuest {
+	memory := make(testMemory, 1<<20)
+	ring, err := NewLegacySplit(memory, size, testRingAddr, LegacyAlign)
+	if err != nil {
+		t.Fatal(err)
+	}
+	avail := testRingAddr + DescTableSize(size)
+	return &testGuest{
+		memory: memory,
+		size:   size,
+		desc:   testRingAddr,
+		avail:  avail,
+		used:   align(avail+AvailSize(size), LegacyAlign),
+		ring:   ring,
+	}
+}
+
+func (guest *testGuest) writeDesc(table uint64, index uint16, addr uint64, length uint32, flags uint16, next uint16) {
+	entry := guest.memory[table+DescSize*uint64(index):]
+	binary.LittleEndian.PutUint64(entry[0:], addr)
+	binary.LittleEndian.PutUint32(entry[8:], length)
+	binary.LittleEndian.PutUint16(entry[12:], flags)
+	binary.LittleEndian.PutUint16(entry[14:], next)
+}
+
+func (guest *testGuest) publish(head uint16) {
+	binary.LittleEndian.PutUint16(guest.memory[guest.avail+4+2*uint64(guest.next%guest.size):], head)
+	guest.next += 1
+	binary.LittleEndian.PutUint16(guest.memory[guest.avail+2:], guest.next)
+}
+
+func (guest *testGuest) chain(t *testing.T, index uint16) ([]Segment, error) {
+	t.Helper()
+	head, ok := guest.ring.Available(index)
+	if !ok {
+		t.Fatal("nothing available")
+	}
+	return guest.ring.Chain(head)
+}
+
+func expectSegments(t *testing.T, segments []Segment, expected []Segment) {
+	t.Helper()
+	if len(segments) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, segments)
+	}
+	for i := range segments {
+		if segments[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, segments)
+		}
+	}
+}
+
+func TestLayout(t *testing.T) {
+	if LegacySize(256, LegacyAlign) != 0x2000+UsedSize(256) {
+		t.Fatalf("bad legacy size %x", LegacySize(256, LegacyAlign))
+	}
+	_, err := NewSplit(make(testMemory, 1<<16), 3, 0, 0, 0)
+	if err != InvalidSize {
+		t.Fatalf("expected invalid size, got %v", err)
+	}
+}
+
+func TestDirect(t *testing.T) {
+	guest := newGuest(t, 8)
+	if _, ok := guest.ring.Available(0); ok {
+		t.Fatal("unexpected buffer")
+	}
+
+	guest.writeDesc(guest.desc, 5, 0x10000, 16, DescFNext, 2)
+	guest.writeDesc(guest.desc, 2, 0x20000, 512, DescFNext|DescFWrite, 7)
+	guest.writeDesc(guest.desc, 7, 0x30000, 1, DescFWrite, 0)
+	guest.publish(5)
+
+	segments, err := guest.chain(t, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectSegments(t, segments, []Segment{
+		{0x10000, 16, false},
+		{0x20000, 512, true},
+		{0x30000, 1, true},
+	})
+}
+
+func TestIndirect(t *testing.T) {
+	guest := newGuest(t, 8)
+	table := uint64(0x40000)
+	guest.writeDesc(table, 0, 0x10000, 16, DescFNext, 1)
+	guest.writeDesc(table, 1, 0x20000, 4096, DescFNext|DescFWrite, 2)
+	guest.writeDesc(table, 2, 0x30000, 1, DescFWrite, 0)
+	guest.writeDesc(guest.desc, 3, table, 3*DescSize, DescFIndirect, 0)
+	guest.publish(3)
+
+	segments, err := guest.chain(t, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectSegments(t, segments, []Segment{
+		{0x10000, 16, false},
+		{0x20000, 4096, true},
+		{0x30000, 1, true},
+	})
+}
+
+func TestBadChains(t *testing.T) {
+	table := uint64(0x40000)
+	cases := []struct {
+		name     string
+		setup    func(guest *testGuest)
+		expected error
+	}{
+		{"direct loop", func(guest *testGuest) {
+			guest.writeDesc(guest.desc, 0, 0x10000, 16, DescFNext, 1)
+			guest.writeDesc(guest.desc, 1, 0x10000, 16, DescFNext, 0)
+		}, DescriptorLoop},
+		{"direct bounds", func(guest *testGuest) {
+			guest.writeDesc(guest.desc, 0, 0x10000, 16, DescFNext, 8)
+		}, InvalidDescriptor},
+		{"indirect loop", func(guest *testGuest) {
+			guest.writeDesc(table, 0, 0x10000, 16, DescFNext, 1)
+			guest.writeDesc(table, 1, 0x10000, 16, DescFNext, 0)
+			guest.writeDesc(guest.desc, 0, table, 2*DescSize, DescFIndirect, 0)
+		}, DescriptorLoop},
+		{"indirect bounds", func(guest *testGuest) {
+			guest.writeDesc(table, 0, 0x10000, 16, DescFNext, 2)
+			guest.writeDesc(guest.desc, 0, table, 2*DescSize, DescFIndirect, 0)
+		}, InvalidDescriptor},
+		{"nested indirect", func(guest *testGuest) {
+			guest.writeDesc(table, 0, table, DescSize, DescFIndirect, 0)
+			guest.writeDesc(guest.desc, 0, table, DescSize, DescFIndirect, 0)
+		}, InvalidIndirect},
+		{"chained indirect", func(guest *testGuest) {
+			guest.writeDesc(table, 0, 0x10000, 16, 0, 0)
+			guest.writeDesc(guest.desc, 0, table, DescSize, DescFIndirect|DescFNext, 1)
+		}, InvalidIndirect},
+		{"empty indirect", func(guest *testGuest) {
+			guest.writeDesc(guest.desc, 0, table, 0, DescFIndirect, 0)
+		}, InvalidIndirect},
+		{"partial indirect", func(guest *testGuest) {
+			guest.writeDesc(guest.desc, 0, table, DescSize+1, DescFIndirect, 0)
+		}, InvalidIndirect},
+		{"unmapped indirect", func(guest *testGuest) {
+			guest.writeDesc(guest.desc, 0, 1<<20, DescSize, DescFIndirect, 0)
+		}, outOfRange},
+		{"write before read", func(guest *testGuest) {
+			guest.writeDesc(guest.desc, 0, 0x10000, 16, DescFNext|DescFWrite, 1)
+			guest.writeDesc(guest.desc, 1, 0x10000, 16, 0, 0)
+		}, InvalidDescriptor},
+	}
+
+	for _, c := range cases {
+		guest := newGuest(t, 8)
+		c.setup(guest)
+		guest.publish(0)
+		_, err := guest.chain(t, 0)
+		if err != c.expected {
+			t.Errorf("%s: expected %v, got %v", c.name, c.expected, err)
+		}
+	}
+
+	// And a bad head.
+	guest := newGuest(t, 8)
+	guest.publish(9)
+	_, err := guest.chain(t, 0)
+	if err != InvalidDescriptor {
+		t.Errorf("bad head: expected %v, got %v", InvalidDescriptor, err)
+	}
+}
+
+func TestUsed(t *testing.T) {
+	guest := newGuest(t, 4)
+
+	for i := uint16(0); i < 6; i += 1 {
+		old := guest.ring.Used()
+		guest.ring.Put(i%4, uint32(100+i))
+		if guest.ring.Used() != old+1 {
+			t.Fatalf("used index %d after %d", guest.ring.Used(), old)
+		}
+		elem := guest.memory[guest.used+4+UsedElemSize*uint64(i%4):]
+		if binary.LittleEndian.Uint32(elem[0:]) != uint32(i%4) ||
+			binary.LittleEndian.Uint32(elem[4:]) != uint32(100+i) {
+			t.Fatalf("bad used element %x", elem[:8])
+		}
+	}
+
+	// Without event index, the flag decides.
+	if !guest.ring.NeedsInterrupt(5, false) {
+		t.Fatal("expected an interrupt")
+	}
+	binary.LittleEndian.PutUint16(guest.memory[guest.avail:], AvailFNoInterrupt)
+	if guest.ring.NeedsInterrupt(5, false) {
+		t.Fatal("unexpected interrupt")
+	}
+
+	// With it, only crossing used_event counts.
+	event := guest.avail + 4 + 2*4
+	binary.LittleEndian.PutUint16(guest.memory[event:], 5)
+	if !guest.ring.NeedsInterrupt(5, true) {
+		t.Fatal("expected an interrupt at the event")
+	}
+	binary.LittleEndian.PutUint16(guest.memory[event:], 9)
+	if guest.ring.NeedsInterrupt(5, true) {
+		t.Fatal("unexpected interrupt before the event")
+	}
+}
+
+//
+// The driver side of notification suppression.
+//
+func (guest *testGuest) shouldKick(old uint16, event_idx bool) bool {
+	if event_idx {
+		event := binary.LittleEndian.Uint16(guest.memory[guest.used+4+UsedElemSize*uint64(guest.size):])
+		return NeedEvent(event, guest.next, old)
+	}
+	return binary.LittleEndian.Uint16(guest.memory[guest.used:])&UsedFNoNotify == 0
+}
+
+func TestNotify(t *testing.T) {
+	for _, event_idx := range []bool{false, true} {
+		guest := newGuest(t, 8)
+		guest.writeDesc(guest.desc, 0, 0x10000, 16, 0, 0)
+		consumed := uint16(0)
+		kicks := 0
+
+		// Device is idle, and wants to hear about the first buffer.
+		if guest.ring.EnableNotify(consumed, event_idx) {
+			t.Fatal("nothing should be available")
+		}
+
+		for i := 0; i < 4; i += 1 {
+			old := guest.next
+			guest.publish(0)
+			if guest.shouldKick(old, event_idx) {
+				kicks += 1
+			}
+		}
+		// Without event indices, the driver keeps kicking
+		// until the device gets around to setting the flag.
+		expected := 4
+		if event_idx {
+			expected = 1
+		}
+		if kicks != expected {
+			t.Fatalf("event_idx=%v: expected %d kicks, got %d", event_idx, expected, kicks)
+		}
+
+		// The device wakes up and consumes everything, but
+		// a buffer sneaks in before it re-enables.
+		guest.ring.DisableNotify(event_idx)
+		for {
+			if _, ok := guest.ring.Available(consumed); !ok {
+				break
+			}
+			consumed += 1
+		}
+		old := guest.next
+		guest.publish(0)
+		if guest.shouldKick(old, event_idx) {
+			t.Fatalf("event_idx=%v: unexpected kick while busy", event_idx)
+		}
+		if !guest.ring.EnableNotify(consumed, event_idx) {
+			t.Fatalf("event_idx=%v: missed a buffer", event_idx)
+		}
+		consumed += 1
+		if guest.ring.EnableNotify(consumed, event_idx) {
+			t.Fatalf("event_idx=%v: nothing more should be available", event_idx)
+		}
+		if event_idx && guest.ring.AvailEvent() != consumed {
+			t.Fatalf("bad avail_event %d", guest.ring.AvailEvent())
+		}
+
+		// And the next buffer is kicked again.
+		old = guest.next
+		guest.publish(0)
+		if !guest.shouldKick(old, event_idx) {
+			t.Fatalf("event_idx=%v: expected a kick", event_idx)
+		}
+	}
+}
+
+func TestUsedFlags(t *testing.T) {
+	guest := newGuest(t, 4)
+	guest.ring.DisableNotify(false)
+	guest.ring.Put(1, 10)
+	guest.ring.Put(2, 20)
+	flags := binary.LittleEndian.Uint16(guest.memory[guest.used:])
+	if flags != UsedFNoNotify || guest.ring.Used() != 2 {
+		t.Fatalf("bad used header %x/%d", flags, guest.ring.Used())
+	}
+}
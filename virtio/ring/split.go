@@ -0,0 +1,384 @@
+package ring
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+	"unsafe"
+)
+
+//
+// Descriptor flags.
+//
+const (
+	DescFNext     = 1
+	DescFWrite    = 2
+	DescFIndirect = 4
+)
+
+//
+// Ring flags.
+//
+const (
+	AvailFNoInterrupt = 1
+	UsedFNoNotify     = 1
+)
+
+//
+// Layout.
+//
+const (
+	DescSize      = 16
+	UsedElemSize  = 8
+	LegacyAlign   = 4096
+	MaxSize       = 32768
+	MaxIndirect   = MaxSize
+	ringHeader    = 4
+	ringEventSize = 2
+)
+
+//
+// Memory --
+//
+// How we get at guest memory. The slice returned
+// must cover the whole range (or it's an error).
+//
+type Memory interface {
+	Map(addr uint64, size uint64) ([]byte, error)
+}
+
+//
+// Segment --
+//
+// One piece of a buffer, in guest physical memory.
+//
+type Segment struct {
+	Addr   uint64 `json:"addr"`
+	Length uint32 `json:"length"`
+	Write  bool   `json:"write"`
+}
+
+//
+// Split --
+//
+// A split virtqueue: a descriptor table, the available
+// ring (written by the driver) and the used ring (written
+// by us). This is the layout for legacy devices, and for
+// modern devices that don't use packed rings.
+//
+type Split struct {
+	// Number of entries.
+	Size uint16
+
+	memory Memory
+
+	desc  []byte
+	avail []byte
+	used  []byte
+
+	// For ordering stores against loads.
+	fence uint32
+}
+
+//
+// The sizes of each part.
+//
+func DescTableSize(size uint16) uint64 {
+	return DescSize * uint64(size)
+}
+
+func AvailSize(size uint16) uint64 {
+	return ringHeader + 2*uint64(size) + ringEventSize
+}
+
+func UsedSize(size uint16) uint64 {
+	return ringHeader + UsedElemSize*uint64(size) + ringEventSize
+}
+
+func align(value uint64, alignment uint64) uint64 {
+	return (value + alignment - 1) &^ (alignment - 1)
+}
+
+//
+// The size of a legacy ring (all parts, contiguous).
+//
+func LegacySize(size uint16, alignment uint64) uint64 {
+	used := align(DescTableSize(size)+AvailSize(size), alignment)
+	return used + UsedSize(size)
+}
+
+//
+// A ring with each part at the given address.
+//
+func NewSplit(
+	memory Memory,
+	size uint16,
+	desc uint64,
+	avail uint64,
+	used uint64) (*Split, error) {
+
+	if size == 0 || size > MaxSize || size&(size-1) != 0 {
+		return nil, InvalidSize
+	}
+
+	ring := &Split{Size: size, memory: memory}
+	var err error
+	ring.desc, err = memory.Map(desc, DescTableSize(size))
+	if err != nil {
+		return nil, err
+	}
+	ring.avail, err = memory.Map(avail, AvailSize(size))
+	if err != nil {
+		return nil, err
+	}
+	ring.used, err = memory.Map(used, UsedSize(size))
+	if err != nil {
+		return nil, err
+	}
+
+	return ring, nil
+}
+
+//
+// A ring in the legacy layout, starting at addr.
+//
+func NewLegacySplit(
+	memory Memory,
+	size uint16,
+	addr uint64,
+	alignment uint64) (*Split, error) {
+
+	avail := addr + DescTableSize(size)
+	used := align(avail+AvailSize(size), alignment)
+	return NewSplit(memory, size, addr, avail, used)
+}
+
+//
+// The host addresses of each part.
+//
+func (ring *Split) Addresses() (uintptr, uintptr, uintptr) {
+	return uintptr(unsafe.Pointer(&ring.desc[0])),
+		uintptr(unsafe.Pointer(&ring.avail[0])),
+		uintptr(unsafe.Pointer(&ring.used[0]))
+}
+
+//
+// The header words (flags & index) are read and
+// written atomically, so the guest sees them in order.
+//
+func header(data []byte) *uint32 {
+	return (*uint32)(unsafe.Pointer(&data[0]))
+}
+
+func (ring *Split) availHeader() (uint16, uint16) {
+	value := atomic.LoadUint32(header(ring.avail))
+	return uint16(value), uint16(value >> 16)
+}
+
+func (ring *Split) usedHeader() (uint16, uint16) {
+	value := atomic.LoadUint32(header(ring.used))
+	return uint16(value), uint16(value >> 16)
+}
+
+//
+// The next available head, if index hasn't
+// caught up with the driver yet.
+//
+func (ring *Split) Available(index uint16) (uint16, bool) {
+	_, idx := ring.availHeader()
+	if idx == index {
+		return 0, false
+	}
+	offset := ringHeader + 2*uint64(index%ring.Size)
+	return binary.LittleEndian.Uint16(ring.avail[offset:]), true
+}
+
+//
+// Where the used ring is up to.
+//
+func (ring *Split) Used() uint16 {
+	_, idx := ring.usedHeader()
+	return idx
+}
+
+//
+// Return a buffer to the driver.
+//
+// The flags may be changed while we're doing this
+// (from the other side of the queue), so the header
+// is only ever updated with a compare & swap.
+//
+func (ring *Split) Put(head uint16, length uint32) {
+	_, idx := ring.usedHeader()
+	offset := ringHeader + UsedElemSize*uint64(idx%ring.Size)
+	binary.LittleEndian.PutUint32(ring.used[offset:], uint32(head))
+	binary.LittleEndian.PutUint32(ring.used[offset+4:], length)
+	ring.updateUsed(func(flags uint16, idx uint16) (uint16, uint16) {
+		return flags, idx + 1
+	})
+}
+
+func (ring *Split) updateUsed(update func(uint16, uint16) (uint16, uint16)) {
+	for {
+		old := atomic.LoadUint32(header(ring.used))
+		flags, idx := update(uint16(old), uint16(old>>16))
+		if atomic.CompareAndSwapUint32(
+			header(ring.used),
+			old,
+			uint32(flags)|uint32(idx)<<16) {
+			return
+		}
+	}
+}
+
+//
+// Our avail_event (only with EVENT_IDX).
+//
+func (ring *Split) AvailEvent() uint16 {
+	offset := ringHeader + UsedElemSize*uint64(ring.Size)
+	return binary.LittleEndian.Uint16(ring.used[offset:])
+}
+
+//
+// We don't need kicks while we're busy consuming.
+//
+// With EVENT_IDX there's nothing to do: the driver
+// only kicks when it passes our avail_event, and
+// we've already gone past that.
+//
+func (ring *Split) DisableNotify(event_idx bool) {
+	if event_idx {
+		return
+	}
+	ring.updateUsed(func(flags uint16, idx uint16) (uint16, uint16) {
+		return flags | UsedFNoNotify, idx
+	})
+}
+
+//
+// Ask for a kick once the driver makes index available.
+//
+// There's a window where the driver may have added a
+// buffer before seeing this, and won't kick for it. So
+// we check again afterwards, and return true if there
+// is more to consume (in which case, keep going).
+//
+func (ring *Split) EnableNotify(index uint16, event_idx bool) bool {
+	if event_idx {
+		offset := ringHeader + UsedElemSize*uint64(ring.Size)
+		*(*uint16)(unsafe.Pointer(&ring.used[offset])) = index
+	} else {
+		ring.updateUsed(func(flags uint16, idx uint16) (uint16, uint16) {
+			return flags &^ UsedFNoNotify, idx
+		})
+	}
+
+	// The store above must be visible before we
+	// look at the driver's index again.
+	atomic.AddUint32(&ring.fence, 1)
+
+	_, idx := ring.availHeader()
+	return idx != index
+}
+
+//
+// The driver's used_event (only with EVENT_IDX).
+//
+func (ring *Split) UsedEvent() uint16 {
+	offset := ringHeader + 2*uint64(ring.Size)
+	return binary.LittleEndian.Uint16(ring.avail[offset:])
+}
+
+//
+// Does the driver want an interrupt for the buffers
+// we've returned since old?
+//
+func (ring *Split) NeedsInterrupt(old uint16, event_idx bool) bool {
+	flags, _ := ring.availHeader()
+	if !event_idx {
+		return flags&AvailFNoInterrupt == 0
+	}
+	return NeedEvent(ring.UsedEvent(), ring.Used(), old)
+}
+
+//
+// The standard event index check: has the index
+// moved from old to new past the given event?
+//
+func NeedEvent(event uint16, new uint16, old uint16) bool {
+	return new-event-1 < new-old
+}
+
+func (ring *Split) descriptor(table []byte, index uint16) (Segment, uint16, uint16) {
+	entry := table[DescSize*uint64(index):]
+	flags := binary.LittleEndian.Uint16(entry[12:])
+	return Segment{
+		Addr:   binary.LittleEndian.Uint64(entry[0:]),
+		Length: binary.LittleEndian.Uint32(entry[8:]),
+		Write:  flags&DescFWrite != 0,
+	}, flags, binary.LittleEndian.Uint16(entry[14:])
+}
+
+//
+// Walk the chain starting at head.
+//
+// Indirect tables are mapped and walked in place of
+// the descriptor that points at them. We check every
+// index against the table it's in, and give up if a
+// chain is longer than its table (i.e. it loops).
+//
+func (ring *Split) Chain(head uint16) ([]Segment, error) {
+	if head >= ring.Size {
+		return nil, InvalidDescriptor
+	}
+
+	var segments []Segment
+	table := ring.desc
+	entries := uint64(ring.Size)
+	indirect := false
+	seen := uint64(0)
+	index := head
+
+	for {
+		seen += 1
+		if seen > entries {
+			return nil, DescriptorLoop
+		}
+
+		segment, flags, next := ring.descriptor(table, index)
+
+		if flags&DescFIndirect != 0 {
+			// Only one level, and never chained.
+			if indirect || flags&DescFNext != 0 ||
+				segment.Length == 0 ||
+				segment.Length%DescSize != 0 ||
+				uint64(segment.Length)/DescSize > MaxIndirect {
+				return nil, InvalidIndirect
+			}
+			mapped, err := ring.memory.Map(segment.Addr, uint64(segment.Length))
+			if err != nil {
+				return nil, err
+			}
+			table = mapped
+			entries = uint64(segment.Length) / DescSize
+			indirect = true
+			seen = 0
+			index = 0
+			continue
+		}
+
+		// Readable segments must come first.
+		if !segment.Write && len(segments) > 0 &&
+			segments[len(segments)-1].Write {
+			return nil, InvalidDescriptor
+		}
+		segments = append(segments, segment)
+
+		if flags&DescFNext == 0 {
+			return segments, nil
+		}
+		if uint64(next) >= entries {
+			return nil, InvalidDescriptor
+		}
+		index = next
+	}
+}